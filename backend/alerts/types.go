@@ -0,0 +1,567 @@
+package alerts
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mbta-performance-dashboard/consts"
+	"github.com/mbta-performance-dashboard/locks"
+	"github.com/mbta-performance-dashboard/performanceapi"
+	"github.com/mbta-performance-dashboard/types"
+	"github.com/mbta-performance-dashboard/utils"
+)
+
+// An APIResponse represents a response from the MBTA Performance API's past alerts endpoint.
+type APIResponse struct {
+	PastAlerts []*APIAlert `json:"past_alerts"`
+}
+
+func (a *APIResponse) Entities() ([]*APIAlert, []*types.RejectedRecord) {
+  if a == nil {
+    return nil, nil
+  }
+  return utils.Validate(a.PastAlerts, func(apiAlert *APIAlert) (*APIAlert, error) {
+    return apiAlert, apiAlert.Validate()
+  })
+}
+
+// An APIAlert represents an alert as returned by the MBTA Performance API, with every version of
+// it that was published.
+type APIAlert struct {
+	Route         string             `json:"-"`
+	AlertID       string             `json:"alert_id"`
+	AlertVersions []*APIAlertVersion `json:"alert_versions"`
+}
+
+// StopID is always empty, since alerts are cached per route.
+func (a *APIAlert) StopID() string {
+  return ""
+}
+
+func (a *APIAlert) SetStopID(stopID string) {}
+
+func (a *APIAlert) RouteID() string {
+  return a.Route
+}
+
+// An APIAlertVersion represents a single published version of an alert.
+type APIAlertVersion struct {
+	VersionID       string               `json:"version_id"`
+	ValidFrom       string               `json:"valid_from"`
+	Cause           string               `json:"cause"`
+	Effect          string               `json:"effect"`
+	HeaderText      string               `json:"header_text"`
+	DescriptionText string               `json:"description_text"`
+	Severity        string               `json:"severity"`
+	InformedEntity  []*APIInformedEntity `json:"informed_entity"`
+	ActivePeriod    []*APIActivePeriod   `json:"active_period"`
+}
+
+// An APIInformedEntity represents a route or stop affected by an alert.
+type APIInformedEntity struct {
+	RouteID string `json:"route_id"`
+	StopID  string `json:"stop_id"`
+}
+
+// An APIActivePeriod represents a period during which an alert was in effect, in Unix seconds.
+//
+// End is empty if the alert had no planned end.
+type APIActivePeriod struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Validate checks that an alert has a version and that the active periods of its latest version
+// can be converted before it's inserted.
+func (a *APIAlert) Validate() error {
+  version := a.latestVersion()
+  if version == nil {
+    return errors.New("Alert has no versions")
+  }
+
+  for _, period := range version.ActivePeriod {
+    if _, err := strconv.ParseInt(period.Start, 10, 64); err != nil {
+      return fmt.Errorf("Error converting active period start to integer: %w", err)
+    }
+    if period.End == "" {
+      continue
+    }
+    if _, err := strconv.ParseInt(period.End, 10, 64); err != nil {
+      return fmt.Errorf("Error converting active period end to integer: %w", err)
+    }
+  }
+  return nil
+}
+
+// latestVersion returns the most recently published version of an alert, or nil if it has none.
+func (a *APIAlert) latestVersion() *APIAlertVersion {
+  var latest *APIAlertVersion
+  var latestValidFrom int64
+  for _, version := range a.AlertVersions {
+    validFrom, _ := strconv.ParseInt(version.ValidFrom, 10, 64)
+    if latest == nil || validFrom >= latestValidFrom {
+      latest = version
+      latestValidFrom = validFrom
+    }
+  }
+  return latest
+}
+
+
+// An Alert represents a service alert, along with when it was active and what it affected.
+type Alert struct {
+	ID               string            `json:"id"`
+	Cause            string            `json:"cause"`
+	Effect           string            `json:"effect"`
+	HeaderText       string            `json:"header_text"`
+	DescriptionText  string            `json:"description_text"`
+	Severity         string            `json:"severity"`
+	ActivePeriods    []*ActivePeriod   `json:"active_periods"`
+	InformedEntities []*InformedEntity `json:"informed_entities"`
+}
+
+// An ActivePeriod represents a period during which an alert was in effect.
+//
+// End is nil if the alert had no planned end.
+type ActivePeriod struct {
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end"`
+}
+
+// An InformedEntity represents a route or stop affected by an alert.
+//
+// StopID is empty if the alert affected the whole route, and RouteID is empty if it affected a
+// stop on every route that serves it.
+type InformedEntity struct {
+	RouteID string `json:"route_id"`
+	StopID  string `json:"stop_id"`
+}
+
+
+// ActiveAlertIDs returns an SQL expression for the IDs of the alerts that were active on a route
+// at a stop and datetime, given the columns that hold them.
+//
+// Alerts that affected the whole route count as active at every one of its stops. Alerts that
+// affected a stop, either on the route or on every route, count as active at the stop and at
+// every platform of it if it's a station.
+func ActiveAlertIDs(routeColumn string, stopColumn string, dateColumn string) string {
+  return fmt.Sprintf(
+    "ARRAY(SELECT DISTINCT alert_active_period.alert_id FROM alert_active_period JOIN " +
+      "alert_informed_entity ON alert_informed_entity.alert_id = alert_active_period.alert_id " +
+      "WHERE ((alert_informed_entity.route_id = %s AND alert_informed_entity.stop_id = '') OR " +
+      "(alert_informed_entity.route_id IN (%s, '') AND (alert_informed_entity.stop_id = %s OR " +
+      "alert_informed_entity.stop_id IN (SELECT stop.parent_station FROM stop WHERE stop.id = " +
+      "%s AND stop.parent_station <> '')))) AND alert_active_period.start_dt <= %s AND " +
+      "(alert_active_period.end_dt IS NULL OR alert_active_period.end_dt >= %s) ORDER BY " +
+      "alert_active_period.alert_id)",
+    routeColumn,
+    routeColumn,
+    stopColumn,
+    stopColumn,
+    dateColumn,
+    dateColumn,
+  )
+}
+
+
+// An AlertService represents a service that will fetch and store alerts.
+//
+// Alerts are cached per route rather than per stop, so everything is keyed by route ID alone.
+type AlertService struct {
+  types.BaseService
+}
+
+func NewService(
+  db *sql.DB,
+  api performanceapi.Client,
+  lockManager *locks.Manager,
+  retentionDays int,
+) *AlertService {
+  return &AlertService{
+    BaseService: types.BaseService{
+      DB: db,
+      API: api,
+      Locks: lockManager,
+      Entity: "alert",
+      RetentionDays: retentionDays,
+    },
+  }
+}
+
+func (s *AlertService) BeginTx() (*sql.Tx, error) {
+  return s.BaseService.BeginTx()
+}
+
+// Lock locks a route's alerts and returns a function that unlocks them.
+func (s *AlertService) Lock(routeID string) func() {
+  return s.Locks.Lock(fmt.Sprintf("%s:%s", s.Entity, routeID))
+}
+
+// Coalesce calls fn, unless a call for the same route is already in progress, in which case it
+// shares that call's result instead.
+//
+// fn is given a context that isn't cancelled along with ctx, and cancelling ctx only stops this
+// caller from waiting.
+func (s *AlertService) Coalesce(
+  ctx context.Context,
+  routeID string,
+  fn func(ctx context.Context) (any, error),
+) (any, error) {
+  return s.Locks.Do(ctx, fmt.Sprintf("%s:%s", s.Entity, routeID), fn)
+}
+
+// FetchFromAPI fetches a route's past alerts from the MBTA Performance API, in week-long chunks
+// from its last cache datetime (or 30 days ago) up to the end of yesterday.
+func (s *AlertService) FetchFromAPI(
+  ctx context.Context,
+  tx *sql.Tx,
+  routeID string,
+) ([]types.ChunkResult[*APIAlert], error) {
+  var datetime time.Time
+  cached := true
+  err := tx.QueryRow(
+    "SELECT value AT TIME ZONE 'America/New_York' FROM last_alert_cache_datetime WHERE " +
+      "route_id = $1",
+    routeID,
+  ).Scan(&datetime)
+  if err == sql.ErrNoRows {
+    cached = false
+  } else if err != nil {
+    return nil, fmt.Errorf("Error querying datetimes: %w", err)
+  }
+
+  startOfToday, err := utils.StartOfToday()
+  if err != nil {
+    return nil, err
+  }
+
+  var chunks []types.Chunk = []types.Chunk{}
+  for _, window := range utils.CacheWindows(datetime, cached, startOfToday) {
+    chunks = append(chunks, types.Chunk{
+      Key: routeID,
+      Window: window,
+      Params: map[string]string{
+        "route": routeID,
+        "from_datetime": strconv.FormatInt(window.Start.Unix(), 10),
+        "to_datetime": strconv.FormatInt(window.End.Unix(), 10),
+      },
+    })
+  }
+
+  results := utils.FetchChunks[*APIAlert, *APIResponse](ctx, s.API, "pastalerts", chunks)
+  for _, result := range results {
+    for j := 0; j < len(result.Entities); j++ {
+      result.Entities[j].Route = routeID
+    }
+  }
+
+  return results, nil
+}
+
+// Insert stores the latest version of every provided alert, replacing the active periods and
+// informed entities of alerts that were already stored.
+func (s *AlertService) Insert(tx *sql.Tx, apiAlerts []*APIAlert) error {
+  var paramIDs []string = []string{}
+  var paramCauses []string = []string{}
+  var paramEffects []string = []string{}
+  var paramHeaderTexts []string = []string{}
+  var paramDescriptionTexts []string = []string{}
+  var paramSeverities []string = []string{}
+
+  var paramPeriodAlertIDs []string = []string{}
+  var paramPeriodStarts []int64 = []int64{}
+  var paramPeriodEnds []int64 = []int64{}
+
+  var paramEntityAlertIDs []string = []string{}
+  var paramEntityRouteIDs []string = []string{}
+  var paramEntityStopIDs []string = []string{}
+
+  seen := make(map[string]bool)
+  for i := 0; i < len(apiAlerts); i++ {
+    version := apiAlerts[i].latestVersion()
+    if version == nil || seen[apiAlerts[i].AlertID] {
+      continue
+    }
+    seen[apiAlerts[i].AlertID] = true
+
+    paramIDs = append(paramIDs, apiAlerts[i].AlertID)
+    paramCauses = append(paramCauses, version.Cause)
+    paramEffects = append(paramEffects, version.Effect)
+    paramHeaderTexts = append(paramHeaderTexts, version.HeaderText)
+    paramDescriptionTexts = append(paramDescriptionTexts, version.DescriptionText)
+    paramSeverities = append(paramSeverities, version.Severity)
+
+    for _, period := range version.ActivePeriod {
+      convertedStart, err := strconv.ParseInt(period.Start, 10, 64)
+      if err != nil {
+        return fmt.Errorf("Error converting active period start to integer: %w", err)
+      }
+
+      // Periods without an end are stored with a NULL end
+      var convertedEnd int64
+      if period.End != "" {
+        convertedEnd, err = strconv.ParseInt(period.End, 10, 64)
+        if err != nil {
+          return fmt.Errorf("Error converting active period end to integer: %w", err)
+        }
+      }
+
+      paramPeriodAlertIDs = append(paramPeriodAlertIDs, apiAlerts[i].AlertID)
+      paramPeriodStarts = append(paramPeriodStarts, convertedStart)
+      paramPeriodEnds = append(paramPeriodEnds, convertedEnd)
+    }
+
+    // Entities that only name a stop are stored with an empty route, since they affect the stop
+    // on every route that serves it
+    for _, entity := range version.InformedEntity {
+      if entity.RouteID == "" && entity.StopID == "" {
+        continue
+      }
+      paramEntityAlertIDs = append(paramEntityAlertIDs, apiAlerts[i].AlertID)
+      paramEntityRouteIDs = append(paramEntityRouteIDs, entity.RouteID)
+      paramEntityStopIDs = append(paramEntityStopIDs, entity.StopID)
+    }
+  }
+
+  if len(paramIDs) == 0 {
+    return nil
+  }
+
+  _, err := tx.Exec(
+    "INSERT INTO alert (id, cause, effect, header_text, description_text, severity) SELECT " +
+      "unnest($1::text[]), unnest($2::text[]), unnest($3::text[]), unnest($4::text[]), " +
+      "unnest($5::text[]), unnest($6::text[]) ON CONFLICT (id) DO UPDATE SET " +
+      "cause = EXCLUDED.cause, " +
+      "effect = EXCLUDED.effect, " +
+      "header_text = EXCLUDED.header_text, " +
+      "description_text = EXCLUDED.description_text, " +
+      "severity = EXCLUDED.severity",
+    pq.Array(paramIDs),
+    pq.Array(paramCauses),
+    pq.Array(paramEffects),
+    pq.Array(paramHeaderTexts),
+    pq.Array(paramDescriptionTexts),
+    pq.Array(paramSeverities),
+  )
+  if err != nil {
+    return fmt.Errorf("Error inserting alerts: %w", err)
+  }
+
+  // Later versions of an alert can drop periods and entities, so they're replaced rather than
+  // upserted
+  for _, table := range []string{ "alert_active_period", "alert_informed_entity" } {
+    _, err = tx.Exec(
+      fmt.Sprintf("DELETE FROM %s WHERE alert_id = ANY($1::text[])", table),
+      pq.Array(paramIDs),
+    )
+    if err != nil {
+      return fmt.Errorf("Error replacing alerts: %w", err)
+    }
+  }
+
+  _, err = tx.Exec(
+    "INSERT INTO alert_active_period (alert_id, start_dt, end_dt) SELECT DISTINCT ON " +
+      "(alert_id, start_dt) * FROM (SELECT " +
+      "unnest($1::text[]) AS alert_id, " +
+      "TO_TIMESTAMP(unnest($2::bigint[])) AS start_dt, " +
+      "TO_TIMESTAMP(NULLIF(unnest($3::bigint[]), 0)) AS end_dt) AS upserted",
+    pq.Array(paramPeriodAlertIDs),
+    pq.Array(paramPeriodStarts),
+    pq.Array(paramPeriodEnds),
+  )
+  if err != nil {
+    return fmt.Errorf("Error inserting alert active periods: %w", err)
+  }
+
+  _, err = tx.Exec(
+    "INSERT INTO alert_informed_entity (alert_id, route_id, stop_id) SELECT DISTINCT " +
+      "unnest($1::text[]), unnest($2::text[]), unnest($3::text[])",
+    pq.Array(paramEntityAlertIDs),
+    pq.Array(paramEntityRouteIDs),
+    pq.Array(paramEntityStopIDs),
+  )
+  if err != nil {
+    return fmt.Errorf("Error inserting alert informed entities: %w", err)
+  }
+
+  return nil
+}
+
+// Select selects the alerts that affected a route and were active at some point during a
+// filter's time range.
+//
+// Alerts that affected a stop on every route are selected if the route serves the stop. If stop
+// IDs are provided, only alerts that affected one of them, their stations or the whole route are
+// selected.
+func (s *AlertService) Select(
+  tx *sql.Tx,
+  stopIDs []string,
+  routeID string,
+  filter types.Filter,
+) ([]*Alert, error) {
+  conditions := "(alert_informed_entity.route_id = $1 OR (alert_informed_entity.route_id = '' " +
+    "AND alert_informed_entity.stop_id IN (SELECT id FROM stop WHERE route_id = $1 UNION SELECT " +
+    "parent_station FROM stop WHERE route_id = $1)))"
+  params := []any{ routeID }
+  if len(stopIDs) > 0 {
+    params = append(params, pq.Array(stopIDs))
+    conditions = "((alert_informed_entity.route_id = $1 AND alert_informed_entity.stop_id = '') " +
+      "OR (alert_informed_entity.route_id IN ($1, '') AND (alert_informed_entity.stop_id = " +
+      "ANY($2::text[]) OR alert_informed_entity.stop_id IN (SELECT parent_station FROM stop " +
+      "WHERE id = ANY($2::text[]) AND parent_station <> ''))))"
+  }
+
+  // A period overlaps the time range if it starts before the range ends and ends after the range
+  // starts
+  if !filter.EndDatetime.IsZero() {
+    params = append(params, filter.EndDatetime.Unix())
+    conditions += fmt.Sprintf(
+      " AND alert_active_period.start_dt <= TO_TIMESTAMP($%d)",
+      len(params),
+    )
+  }
+  if !filter.StartDatetime.IsZero() {
+    params = append(params, filter.StartDatetime.Unix())
+    conditions += fmt.Sprintf(
+      " AND (alert_active_period.end_dt IS NULL OR alert_active_period.end_dt >= " +
+        "TO_TIMESTAMP($%d))",
+      len(params),
+    )
+  }
+
+	rows, err := tx.Query(
+    fmt.Sprintf(
+      "SELECT id, cause, effect, header_text, description_text, severity FROM alert WHERE id IN " +
+        "(SELECT alert_active_period.alert_id FROM alert_active_period JOIN " +
+        "alert_informed_entity ON alert_informed_entity.alert_id = alert_active_period.alert_id " +
+        "WHERE %s) ORDER BY id",
+      conditions,
+    ),
+    params...,
+  )
+	if err != nil {
+    return nil, fmt.Errorf("Error fetching alerts: %w", err)
+	}
+
+	var alerts []*Alert = []*Alert{}
+	alertsByID := make(map[string]*Alert)
+	for rows.Next() {
+		alert := Alert{
+			ActivePeriods: []*ActivePeriod{},
+			InformedEntities: []*InformedEntity{},
+		}
+		err := rows.Scan(
+			&alert.ID,
+			&alert.Cause,
+			&alert.Effect,
+			&alert.HeaderText,
+			&alert.DescriptionText,
+			&alert.Severity,
+		)
+		if err != nil {
+			rows.Close()
+      return nil, fmt.Errorf("Error scanning alerts: %w", err)
+		}
+		alerts = append(alerts, &alert)
+		alertsByID[alert.ID] = &alert
+	}
+	rows.Close()
+
+	if len(alerts) == 0 {
+		return alerts, nil
+	}
+
+	ids := make([]string, 0, len(alertsByID))
+	for id := range alertsByID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	rows, err = tx.Query(
+    "SELECT alert_id, start_dt AT TIME ZONE 'America/New_York', end_dt AT TIME ZONE " +
+      "'America/New_York' FROM alert_active_period WHERE alert_id = ANY($1::text[]) ORDER BY " +
+      "alert_id, start_dt",
+    pq.Array(ids),
+  )
+	if err != nil {
+    return nil, fmt.Errorf("Error fetching alert active periods: %w", err)
+	}
+
+	for rows.Next() {
+		var alertID string
+		var period ActivePeriod
+		if err := rows.Scan(&alertID, &period.Start, &period.End); err != nil {
+			rows.Close()
+      return nil, fmt.Errorf("Error scanning alert active periods: %w", err)
+		}
+		alertsByID[alertID].ActivePeriods = append(alertsByID[alertID].ActivePeriods, &period)
+	}
+	rows.Close()
+
+	rows, err = tx.Query(
+    "SELECT alert_id, route_id, stop_id FROM alert_informed_entity WHERE alert_id = " +
+      "ANY($1::text[]) ORDER BY alert_id, route_id, stop_id",
+    pq.Array(ids),
+  )
+	if err != nil {
+    return nil, fmt.Errorf("Error fetching alert informed entities: %w", err)
+	}
+
+	for rows.Next() {
+		var alertID string
+		var entity InformedEntity
+		if err := rows.Scan(&alertID, &entity.RouteID, &entity.StopID); err != nil {
+			rows.Close()
+      return nil, fmt.Errorf("Error scanning alert informed entities: %w", err)
+		}
+		alertsByID[alertID].InformedEntities = append(alertsByID[alertID].InformedEntities, &entity)
+	}
+	rows.Close()
+
+	return alerts, nil
+}
+
+// UpdateCacheDatetime advances the last cache datetime of a route's alerts to the provided value.
+func (s *AlertService) UpdateCacheDatetime(tx *sql.Tx, routeID string, value time.Time) error {
+  _, err := tx.Exec(
+    "INSERT INTO last_alert_cache_datetime (route_id, value) VALUES ($1, $2) ON CONFLICT " +
+      "(route_id) DO UPDATE SET value = EXCLUDED.value WHERE last_alert_cache_datetime.value < " +
+      "EXCLUDED.value",
+    routeID,
+    value,
+  )
+  if err != nil {
+    return fmt.Errorf("Error updating last cache datetime: %w", err)
+  }
+
+  return nil
+}
+
+// DeleteOutdated deletes alerts whose every active period ended before the retention period,
+// including alerts without any active periods.
+//
+// Their active periods and informed entities are deleted along with them.
+func (s *AlertService) DeleteOutdated(tx *sql.Tx) error {
+  if s.RetentionDays == consts.KeepForever {
+    return nil
+  }
+
+  _, err := tx.Exec(fmt.Sprintf(
+    "DELETE FROM alert WHERE NOT EXISTS (SELECT 1 FROM alert_active_period WHERE " +
+      "alert_active_period.alert_id = alert.id AND (alert_active_period.end_dt IS NULL OR " +
+      "alert_active_period.end_dt >= DATE_TRUNC('day', NOW() AT TIME ZONE 'America/New_York' - " +
+      "INTERVAL '%d days')))",
+    s.RetentionDays,
+  ))
+  if err != nil {
+    return fmt.Errorf("Error deleting outdated alerts: %w", err)
+  }
+
+  return nil
+}
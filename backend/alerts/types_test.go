@@ -0,0 +1,106 @@
+package alerts
+
+import (
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/mbta-performance-dashboard/db/dbtest"
+  "github.com/mbta-performance-dashboard/types"
+)
+
+func TestInsertStoresStopOnlyInformedEntities(t *testing.T) {
+  tx, recorder := dbtest.Begin(t)
+  service := &AlertService{}
+  err := service.Insert(tx, []*APIAlert{
+    {
+      Route:   "Red",
+      AlertID: "1",
+      AlertVersions: []*APIAlertVersion{
+        {
+          ValidFrom: "1700000000",
+          InformedEntity: []*APIInformedEntity{
+            { RouteID: "Red" },
+            { StopID: "place-pktrm" },
+            { RouteID: "Red", StopID: "70075" },
+            {},
+          },
+        },
+      },
+    },
+  })
+  if err != nil {
+    t.Fatalf("Expected the alert to be inserted, got %v", err)
+  }
+
+  var inserted dbtest.Query
+  for _, query := range recorder.Queries() {
+    if strings.HasPrefix(query.SQL, "INSERT INTO alert_informed_entity") {
+      inserted = query
+    }
+  }
+
+  // Entities naming neither a route nor a stop are skipped
+  expected := []any{ `{"1","1","1"}`, `{"Red","","Red"}`, `{"","place-pktrm","70075"}` }
+  if len(inserted.Args) != len(expected) {
+    t.Fatalf("Expected informed entities to be inserted, got %v", recorder.Queries())
+  }
+  for i, arg := range inserted.Args {
+    if arg != expected[i] {
+      t.Errorf("Expected informed entity argument %d to be %v, got %v", i + 1, expected[i], arg)
+    }
+  }
+}
+
+func TestActiveAlertIDsMatchesStopsAndStations(t *testing.T) {
+  clause := ActiveAlertIDs("dwell.route_id", "dwell.stop_id", "dwell.arr_dt")
+
+  for _, fragment := range []string{
+    "(alert_informed_entity.route_id = dwell.route_id AND alert_informed_entity.stop_id = '')",
+    "alert_informed_entity.route_id IN (dwell.route_id, '')",
+    "alert_informed_entity.stop_id = dwell.stop_id",
+    "SELECT stop.parent_station FROM stop WHERE stop.id = dwell.stop_id",
+  } {
+    if !strings.Contains(clause, fragment) {
+      t.Errorf("Expected clause to contain %q, got %s", fragment, clause)
+    }
+  }
+}
+
+func TestSelectPlaceholders(t *testing.T) {
+  filter := types.Filter{
+    StartDatetime: time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC),
+    EndDatetime:   time.Date(2024, time.March, 8, 0, 0, 0, 0, time.UTC),
+  }
+  cases := []struct {
+    name     string
+    stopIDs  []string
+    expected string
+  }{
+    {
+      name:     "route",
+      expected: "alert_informed_entity.stop_id IN (SELECT id FROM stop WHERE route_id = $1",
+    },
+    {
+      name:     "stops",
+      stopIDs:  []string{ "70075", "70076" },
+      expected: "SELECT parent_station FROM stop WHERE id = ANY($2::text[])",
+    },
+  }
+
+  for _, tc := range cases {
+    t.Run(tc.name, func(t *testing.T) {
+      tx, recorder := dbtest.Begin(t)
+      service := &AlertService{}
+      if _, err := service.Select(tx, tc.stopIDs, "Red", filter); err != nil {
+        t.Fatalf("Expected the query to run, got %v", err)
+      }
+
+      query := recorder.Only(t)
+      dbtest.CheckPlaceholders(t, query)
+      if !strings.Contains(query.SQL, tc.expected) {
+        t.Errorf("Expected query to contain %q, got %s", tc.expected, query.SQL)
+      }
+    })
+  }
+}
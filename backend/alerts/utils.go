@@ -0,0 +1,150 @@
+package alerts
+
+import (
+  "context"
+  "database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+  "github.com/mbta-performance-dashboard/types"
+  "github.com/mbta-performance-dashboard/utils"
+)
+
+func CacheAlerts(c *gin.Context, service *AlertService) {
+	routeID := c.DefaultQuery("route_id", "")
+
+  report, err := CacheEntities(c.Request.Context(), service, routeID)
+  if err != nil {
+    utils.PropagateToResponse(c, err)
+    return
+  }
+
+  utils.RespondWithReport(c, report)
+}
+
+// CacheEntities caches a route's past alerts up to the end of yesterday, without being tied to a
+// request.
+//
+// The route is keyed by its ID in the returned report.
+func CacheEntities(
+  ctx context.Context,
+  service *AlertService,
+  routeID string,
+) (*types.CacheReport, error) {
+  report, err := service.Coalesce(ctx, routeID, func(ctx context.Context) (any, error) {
+    unlock := service.Lock(routeID)
+    defer unlock()
+
+    return cacheEntities(ctx, service, routeID)
+  })
+  if err != nil {
+    return nil, err
+  }
+  return report.(*types.CacheReport), nil
+}
+
+// cacheEntities caches alerts, assuming that the caller has already locked the route.
+func cacheEntities(
+  ctx context.Context,
+  service *AlertService,
+  routeID string,
+) (*types.CacheReport, error) {
+  results, err := func() ([]types.ChunkResult[*APIAlert], error) {
+    tx, err := service.BeginTx()
+    if err != nil {
+      return nil, err
+    }
+    defer tx.Rollback()
+
+    if err := utils.ValidateRouteID(tx, routeID); err != nil {
+      return nil, err
+    }
+
+    return service.FetchFromAPI(ctx, tx, routeID)
+  }()
+  if err != nil {
+    return nil, err
+  }
+
+  report := utils.CommitChunks[*APIAlert](
+    service.BeginTx,
+    []string{ routeID },
+    results,
+    func(tx *sql.Tx, result types.ChunkResult[*APIAlert]) error {
+      return service.Insert(tx, result.Entities)
+    },
+    func(tx *sql.Tx, result types.ChunkResult[*APIAlert]) error {
+      return service.UpdateCacheDatetime(tx, routeID, result.Chunk.Window.End.Add(time.Second))
+    },
+  )
+
+  if err := utils.DeleteOutdatedInTx(service.BeginTx, service.DeleteOutdated); err != nil {
+    return nil, err
+  }
+
+  return report, nil
+}
+
+// SelectAlerts selects the alerts overlapping a route, optional stops and an optional time range.
+func SelectAlerts(c *gin.Context, service *AlertService) {
+	stopIDs := parseStopIDs(c.DefaultQuery("stop_ids", ""))
+	routeID := c.DefaultQuery("route_id", "")
+
+  var alerts []*Alert
+  err := func() error {
+    filter, err := utils.ParseFilter(c)
+    if err != nil {
+      return err
+    }
+
+    tx, err := service.BeginTx()
+    if err != nil {
+      return err
+    }
+    defer func() {
+      if tx != nil {
+        tx.Rollback()
+      }
+    }()
+
+    if len(stopIDs) > 0 {
+      err = utils.ValidateIDs(tx, stopIDs, routeID)
+    } else {
+      err = utils.ValidateRouteID(tx, routeID)
+    }
+    if err != nil {
+      return err
+    }
+
+    alerts, err = service.Select(tx, stopIDs, routeID, filter)
+    if err != nil {
+      return err
+    }
+
+    if err = tx.Commit(); err != nil {
+      return fmt.Errorf("Error committing transaction: %w", err)
+    }
+    tx = nil
+
+    return nil
+  }()
+  if err != nil {
+    utils.PropagateToResponse(c, err)
+    return
+  }
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": alerts,
+	})
+}
+
+// parseStopIDs splits comma-separated stop IDs, treating an empty value as no stop IDs at all.
+func parseStopIDs(value string) []string {
+  if value == "" {
+    return []string{}
+  }
+  return strings.Split(value, ",")
+}
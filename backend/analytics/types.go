@@ -0,0 +1,477 @@
+package analytics
+
+import (
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "time"
+
+  "github.com/lib/pq"
+  "github.com/mbta-performance-dashboard/alerts"
+  "github.com/mbta-performance-dashboard/types"
+  "github.com/mbta-performance-dashboard/utils"
+)
+
+// The classifications of a headway against its benchmark.
+const (
+  HeadwayBunched string = "bunched"
+  HeadwayOnTime  string = "on_time"
+  HeadwayGapped  string = "gapped"
+)
+
+// The granularities that adherence can be summarized at.
+const (
+  GranularityDay  string = "day"
+  GranularityHour string = "hour"
+)
+
+// The methods that dwell outliers can be detected with.
+const (
+  OutlierMethodMAD string = "mad"
+  OutlierMethodIQR string = "iqr"
+)
+
+// HeadwayThresholds represent the ratios of a headway to its benchmark that it's classified by.
+//
+// A headway is bunched if it's at most BunchedRatio times its benchmark, gapped if it's more than
+// GappedRatio times its benchmark, and on time otherwise.
+type HeadwayThresholds struct {
+  BunchedRatio float64 `json:"bunched_ratio"`
+  GappedRatio  float64 `json:"gapped_ratio"`
+}
+
+// An AdherenceSummary represents how a stop's headways in one direction compared to their
+// benchmarks over a service day, or a single hour of one.
+//
+// Hour is the hour of the day in EST, or nil if the summary covers the whole service day.
+// Percentages are out of 100, and AdherencePct is the share of headways that were on time.
+type AdherenceSummary struct {
+  StopID        string          `json:"stop_id"`
+  Direction     types.Direction `json:"direction"`
+  DirectionName string          `json:"direction_name"`
+  ServiceDate   string          `json:"service_date"`
+  Hour          *int            `json:"hour"`
+  Count         int             `json:"count"`
+  Bunched       int             `json:"bunched"`
+  OnTime        int             `json:"on_time"`
+  Gapped        int             `json:"gapped"`
+  AdherencePct  float64         `json:"adherence_pct"`
+  BunchedPct    float64         `json:"bunched_pct"`
+  GappedPct     float64         `json:"gapped_pct"`
+}
+
+// An OffendingHeadway represents a departure whose headway was either bunched or gapped.
+//
+// Ratio is the headway divided by its benchmark.
+type OffendingHeadway struct {
+  StopID                  string          `json:"stop_id"`
+  RouteID                 string          `json:"route_id"`
+  Direction               types.Direction `json:"direction"`
+  DirectionName           string          `json:"direction_name"`
+  CurrentDepDt            time.Time       `json:"current_dep_dt"`
+  PreviousDepDt           time.Time       `json:"previous_dep_dt"`
+  HeadwayTimeSec          int             `json:"headway_time_sec"`
+  BenchmarkHeadwayTimeSec int             `json:"benchmark_headway_time_sec"`
+  Ratio                   float64         `json:"ratio"`
+  Classification          string          `json:"classification"`
+}
+
+// MarshalJSON marshals an offending headway with its datetimes in EST.
+func (h *OffendingHeadway) MarshalJSON() ([]byte, error) {
+  type offendingHeadway OffendingHeadway
+  marshaled := offendingHeadway(*h)
+
+  var err error
+  if marshaled.CurrentDepDt, err = utils.InNewYork(h.CurrentDepDt); err != nil {
+    return nil, err
+  }
+  if marshaled.PreviousDepDt, err = utils.InNewYork(h.PreviousDepDt); err != nil {
+    return nil, err
+  }
+  return json.Marshal(marshaled)
+}
+
+// A HeadwayAdherence represents the adherence summaries and offending departures of a selection of
+// headways, along with the thresholds they were classified by.
+type HeadwayAdherence struct {
+  Thresholds HeadwayThresholds   `json:"thresholds"`
+  Summaries  []*AdherenceSummary `json:"summaries"`
+  Offending  []*OffendingHeadway `json:"offending"`
+}
+
+// A DwellOutlier represents a dwell that was unusually long or short for its stop, direction and
+// hour of the day.
+//
+// The expected range is computed from every retained dwell at the stop in the same direction and
+// hour, of which there were SampleCount.
+type DwellOutlier struct {
+  StopID        string          `json:"stop_id"`
+  RouteID       string          `json:"route_id"`
+  Direction     types.Direction `json:"direction"`
+  DirectionName string          `json:"direction_name"`
+  ArrDt         time.Time       `json:"arr_dt"`
+  DepDt         time.Time       `json:"dep_dt"`
+  DwellTimeSec  int             `json:"dwell_time_sec"`
+  Hour          int             `json:"hour"`
+  SampleCount   int             `json:"sample_count"`
+  MedianSec     float64         `json:"median_sec"`
+  ExpectedMin   float64         `json:"expected_min_sec"`
+  ExpectedMax   float64         `json:"expected_max_sec"`
+
+  // AlertIDs are the IDs of the alerts that were active at the stop when the train arrived.
+  AlertIDs []string `json:"alert_ids"`
+}
+
+// MarshalJSON marshals a dwell outlier with its datetimes in EST.
+func (d *DwellOutlier) MarshalJSON() ([]byte, error) {
+  type dwellOutlier DwellOutlier
+  marshaled := dwellOutlier(*d)
+
+  var err error
+  if marshaled.ArrDt, err = utils.InNewYork(d.ArrDt); err != nil {
+    return nil, err
+  }
+  if marshaled.DepDt, err = utils.InNewYork(d.DepDt); err != nil {
+    return nil, err
+  }
+  return json.Marshal(marshaled)
+}
+
+
+// An AnalyticsService represents a service that interprets cached entities, without fetching
+// anything from the MBTA Performance API.
+type AnalyticsService struct {
+  types.BaseService
+}
+
+func NewService(db *sql.DB) *AnalyticsService {
+  return &AnalyticsService{
+    BaseService: types.BaseService{
+      DB: db,
+      Entity: "analytics",
+    },
+  }
+}
+
+func (s *AnalyticsService) BeginTx() (*sql.Tx, error) {
+  return s.BaseService.BeginTx()
+}
+
+// hourOfDay returns an SQL expression for the hour of the day of a table's datetime column, in EST.
+func hourOfDay(dateColumn string) string {
+  return fmt.Sprintf(
+    "EXTRACT(HOUR FROM %s::timestamptz AT TIME ZONE 'America/New_York')::integer",
+    dateColumn,
+  )
+}
+
+// HeadwayClassification returns an SQL expression that classifies a headway against its benchmark,
+// using the ratios at the provided placeholders.
+//
+// Every adherence figure is based on it, so that they all agree on which headways were on time.
+func HeadwayClassification(bunchedPlaceholder string, gappedPlaceholder string) string {
+  return fmt.Sprintf(
+    "CASE WHEN headway_time_sec <= benchmark_headway_time_sec * %s::float THEN '%s' WHEN " +
+      "headway_time_sec > benchmark_headway_time_sec * %s::float THEN '%s' ELSE '%s' END",
+    bunchedPlaceholder,
+    HeadwayBunched,
+    gappedPlaceholder,
+    HeadwayGapped,
+    HeadwayOnTime,
+  )
+}
+
+// SelectHeadwayAdherence summarizes how headways compared to their benchmarks, per stop, direction
+// and service day, or per hour of each service day.
+//
+// Headways without a benchmark can't be classified, so they're left out.
+func (s *AnalyticsService) SelectHeadwayAdherence(
+  tx *sql.Tx,
+  stopIDs []string,
+  routeID string,
+  filter types.Filter,
+  thresholds HeadwayThresholds,
+  granularity string,
+) ([]*AdherenceSummary, error) {
+  offset := len(stopIDs) + 1
+  filterClause, filterParams := utils.FilterClause(filter, "current_dep_dt", offset)
+  offset += len(filterParams)
+
+  hour := "NULL::integer"
+  if granularity == GranularityHour {
+    hour = hourOfDay("current_dep_dt")
+  }
+
+	rows, err := tx.Query(
+    fmt.Sprintf(
+      "SELECT stop_id, direction, %s, service_date, hour, COUNT(*), COUNT(*) FILTER (WHERE " +
+        "classification = '%s'), COUNT(*) FILTER (WHERE classification = '%s'), COUNT(*) FILTER " +
+        "(WHERE classification = '%s') FROM (SELECT stop_id, route_id, direction, %s AS " +
+        "service_date, %s AS hour, %s AS classification FROM headway WHERE stop_id IN (%s) AND " +
+        "route_id = %s AND benchmark_headway_time_sec > 0%s) AS headways GROUP BY stop_id, " +
+        "route_id, direction, service_date, hour ORDER BY service_date, hour, stop_id, direction",
+      utils.DirectionName("headways.route_id", "headways.direction"),
+      HeadwayBunched,
+      HeadwayOnTime,
+      HeadwayGapped,
+      utils.ServiceDate("current_dep_dt"),
+      hour,
+      HeadwayClassification(
+        utils.PgPlaceholders(offset, offset+1),
+        utils.PgPlaceholders(offset+1, offset+2),
+      ),
+      utils.PgPlaceholders(0, len(stopIDs)),
+      utils.PgPlaceholders(len(stopIDs), len(stopIDs)+1),
+      filterClause,
+    ),
+    append(
+      append(utils.SliceToAnySlice[string](append(stopIDs, routeID)), filterParams...),
+      thresholds.BunchedRatio,
+      thresholds.GappedRatio,
+    )...,
+  )
+	if err != nil {
+    return nil, fmt.Errorf("Error computing headway adherence: %w", err)
+	}
+	defer rows.Close()
+
+	var summaries []*AdherenceSummary = []*AdherenceSummary{}
+	for rows.Next() {
+		var summary AdherenceSummary
+		var direction bool
+		var serviceDate time.Time
+		var hour sql.NullInt64
+		err := rows.Scan(
+			&summary.StopID,
+			&direction,
+			&summary.DirectionName,
+			&serviceDate,
+			&hour,
+			&summary.Count,
+			&summary.Bunched,
+			&summary.OnTime,
+			&summary.Gapped,
+		)
+		if err != nil {
+      return nil, fmt.Errorf("Error scanning headway adherence: %w", err)
+		}
+
+		summary.Direction = types.DirectionFromBool(direction)
+		summary.ServiceDate = serviceDate.Format(time.DateOnly)
+		if hour.Valid {
+			value := int(hour.Int64)
+			summary.Hour = &value
+		}
+		summary.AdherencePct = percentage(summary.OnTime, summary.Count)
+		summary.BunchedPct = percentage(summary.Bunched, summary.Count)
+		summary.GappedPct = percentage(summary.Gapped, summary.Count)
+		summaries = append(summaries, &summary)
+	}
+
+	return summaries, nil
+}
+
+// SelectOffendingHeadways selects the departures whose headways were either bunched or gapped, in
+// order.
+func (s *AnalyticsService) SelectOffendingHeadways(
+  tx *sql.Tx,
+  stopIDs []string,
+  routeID string,
+  filter types.Filter,
+  thresholds HeadwayThresholds,
+) ([]*OffendingHeadway, error) {
+  offset := len(stopIDs) + 1
+  filterClause, filterParams := utils.FilterClause(filter, "current_dep_dt", offset)
+  offset += len(filterParams)
+
+	rows, err := tx.Query(
+    fmt.Sprintf(
+      "SELECT * FROM (SELECT stop_id, route_id, direction, %s, current_dep_dt AT TIME ZONE " +
+        "'America/New_York' AS current_dep_dt, previous_dep_dt AT TIME ZONE 'America/New_York', " +
+        "headway_time_sec, benchmark_headway_time_sec, headway_time_sec::float / " +
+        "benchmark_headway_time_sec, %s AS classification FROM headway WHERE stop_id IN (%s) AND " +
+        "route_id = %s AND benchmark_headway_time_sec > 0%s) AS headways WHERE classification " +
+        "<> '%s' ORDER BY current_dep_dt, stop_id",
+      utils.DirectionName("headway.route_id", "headway.direction"),
+      HeadwayClassification(
+        utils.PgPlaceholders(offset, offset+1),
+        utils.PgPlaceholders(offset+1, offset+2),
+      ),
+      utils.PgPlaceholders(0, len(stopIDs)),
+      utils.PgPlaceholders(len(stopIDs), len(stopIDs)+1),
+      filterClause,
+      HeadwayOnTime,
+    ),
+    append(
+      append(utils.SliceToAnySlice[string](append(stopIDs, routeID)), filterParams...),
+      thresholds.BunchedRatio,
+      thresholds.GappedRatio,
+    )...,
+  )
+	if err != nil {
+    return nil, fmt.Errorf("Error fetching offending headways: %w", err)
+	}
+	defer rows.Close()
+
+	var offending []*OffendingHeadway = []*OffendingHeadway{}
+	for rows.Next() {
+		var headway OffendingHeadway
+		var direction bool
+		err := rows.Scan(
+			&headway.StopID,
+			&headway.RouteID,
+			&direction,
+			&headway.DirectionName,
+			&headway.CurrentDepDt,
+			&headway.PreviousDepDt,
+			&headway.HeadwayTimeSec,
+			&headway.BenchmarkHeadwayTimeSec,
+			&headway.Ratio,
+			&headway.Classification,
+		)
+		if err != nil {
+      return nil, fmt.Errorf("Error scanning offending headways: %w", err)
+		}
+		headway.Direction = types.DirectionFromBool(direction)
+		offending = append(offending, &headway)
+	}
+
+	return offending, nil
+}
+
+// dwellBaselines returns the SQL common table expressions that compute the expected range of
+// dwells per stop, direction and hour from a history table, ending with one named baselines.
+//
+// The MAD method expects dwells within the threshold at the provided placeholder times the scaled
+// median absolute deviation of the median, which is at least a second so that stops where most
+// dwells are identical don't flag everything else. The IQR method expects dwells within the
+// threshold times the interquartile range outside the middle half of dwells.
+func dwellBaselines(method string, thresholdPlaceholder string) string {
+  if method == OutlierMethodIQR {
+    return fmt.Sprintf(
+      "quartiles AS (SELECT stop_id, direction, hour, COUNT(*) AS sample_count, " +
+        "PERCENTILE_CONT(0.25) WITHIN GROUP (ORDER BY dwell_time_sec) AS q1, " +
+        "PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY dwell_time_sec) AS median, " +
+        "PERCENTILE_CONT(0.75) WITHIN GROUP (ORDER BY dwell_time_sec) AS q3 FROM history GROUP " +
+        "BY stop_id, direction, hour), baselines AS (SELECT stop_id, direction, hour, " +
+        "sample_count, median, q1 - %s::float * (q3 - q1) AS expected_min, q3 + %s::float * " +
+        "(q3 - q1) AS expected_max FROM quartiles)",
+      thresholdPlaceholder,
+      thresholdPlaceholder,
+    )
+  }
+
+  // 1.4826 scales the median absolute deviation to a standard deviation for normal data
+  return fmt.Sprintf(
+    "medians AS (SELECT stop_id, direction, hour, COUNT(*) AS sample_count, " +
+      "PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY dwell_time_sec) AS median FROM history GROUP " +
+      "BY stop_id, direction, hour), spreads AS (SELECT medians.stop_id, medians.direction, " +
+      "medians.hour, medians.sample_count, medians.median, GREATEST(PERCENTILE_CONT(0.5) WITHIN " +
+      "GROUP (ORDER BY ABS(history.dwell_time_sec - medians.median)) * 1.4826, 1) AS spread FROM " +
+      "medians JOIN history ON history.stop_id = medians.stop_id AND history.direction = " +
+      "medians.direction AND history.hour = medians.hour GROUP BY medians.stop_id, " +
+      "medians.direction, medians.hour, medians.sample_count, medians.median), baselines AS " +
+      "(SELECT stop_id, direction, hour, sample_count, median, median - %s::float * spread AS " +
+      "expected_min, median + %s::float * spread AS expected_max FROM spreads)",
+    thresholdPlaceholder,
+    thresholdPlaceholder,
+  )
+}
+
+// SelectDwellOutliers selects the dwells that fell outside the expected range for their stop,
+// direction and hour of the day, in order.
+//
+// Only the selected dwells are filtered, while baselines always cover every retained dwell.
+// Baselines with fewer than the provided number of dwells are too noisy to flag anything.
+func (s *AnalyticsService) SelectDwellOutliers(
+  tx *sql.Tx,
+  stopIDs []string,
+  routeID string,
+  filter types.Filter,
+  method string,
+  threshold float64,
+  minSamples int,
+) ([]*DwellOutlier, error) {
+  offset := len(stopIDs) + 1
+  filterClause, filterParams := utils.FilterClause(filter, "arr_dt", offset)
+  offset += len(filterParams)
+
+  stopPlaceholders := utils.PgPlaceholders(0, len(stopIDs))
+  routePlaceholder := utils.PgPlaceholders(len(stopIDs), len(stopIDs)+1)
+	rows, err := tx.Query(
+    fmt.Sprintf(
+      "WITH history AS (SELECT stop_id, direction, %s AS hour, dwell_time_sec FROM dwell WHERE " +
+        "stop_id IN (%s) AND route_id = %s), %s, selected AS (SELECT stop_id, route_id, " +
+        "direction, %s AS direction_name, arr_dt AT TIME ZONE 'America/New_York' AS arr_dt, " +
+        "dep_dt AT TIME ZONE 'America/New_York' AS dep_dt, dwell_time_sec, %s AS hour, %s AS " +
+        "alert_ids FROM dwell WHERE stop_id IN (%s) AND route_id = %s%s) SELECT " +
+        "selected.stop_id, selected.route_id, selected.direction, selected.direction_name, " +
+        "selected.arr_dt, selected.dep_dt, selected.dwell_time_sec, selected.hour, " +
+        "baselines.sample_count, baselines.median, GREATEST(baselines.expected_min, 0), " +
+        "baselines.expected_max, selected.alert_ids FROM selected JOIN baselines ON " +
+        "baselines.stop_id = selected.stop_id AND baselines.direction = selected.direction AND " +
+        "baselines.hour = selected.hour WHERE baselines.sample_count >= %s AND " +
+        "(selected.dwell_time_sec < baselines.expected_min OR selected.dwell_time_sec > " +
+        "baselines.expected_max) ORDER BY selected.arr_dt, selected.stop_id",
+      hourOfDay("arr_dt"),
+      stopPlaceholders,
+      routePlaceholder,
+      dwellBaselines(method, utils.PgPlaceholders(offset, offset+1)),
+      utils.DirectionName("dwell.route_id", "dwell.direction"),
+      hourOfDay("arr_dt"),
+      alerts.ActiveAlertIDs("dwell.route_id", "dwell.stop_id", "dwell.arr_dt"),
+      stopPlaceholders,
+      routePlaceholder,
+      filterClause,
+      utils.PgPlaceholders(offset+1, offset+2),
+    ),
+    append(
+      append(utils.SliceToAnySlice[string](append(stopIDs, routeID)), filterParams...),
+      threshold,
+      minSamples,
+    )...,
+  )
+	if err != nil {
+    return nil, fmt.Errorf("Error detecting dwell outliers: %w", err)
+	}
+	defer rows.Close()
+
+	var outliers []*DwellOutlier = []*DwellOutlier{}
+	for rows.Next() {
+		var outlier DwellOutlier
+		var direction bool
+		err := rows.Scan(
+			&outlier.StopID,
+			&outlier.RouteID,
+			&direction,
+			&outlier.DirectionName,
+			&outlier.ArrDt,
+			&outlier.DepDt,
+			&outlier.DwellTimeSec,
+			&outlier.Hour,
+			&outlier.SampleCount,
+			&outlier.MedianSec,
+			&outlier.ExpectedMin,
+			&outlier.ExpectedMax,
+			pq.Array(&outlier.AlertIDs),
+		)
+		if err != nil {
+      return nil, fmt.Errorf("Error scanning dwell outliers: %w", err)
+		}
+		outlier.Direction = types.DirectionFromBool(direction)
+		if outlier.AlertIDs == nil {
+			outlier.AlertIDs = []string{}
+		}
+		outliers = append(outliers, &outlier)
+	}
+
+	return outliers, nil
+}
+
+// percentage returns part as a percentage of total, or 0 if total is 0.
+func percentage(part int, total int) float64 {
+  if total == 0 {
+    return 0
+  }
+  return float64(part) / float64(total) * 100
+}
@@ -0,0 +1,222 @@
+package analytics
+
+import (
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/mbta-performance-dashboard/db/dbtest"
+  "github.com/mbta-performance-dashboard/types"
+)
+
+// testFilter returns a filter that bounds both ends of the time range and picks a direction, so
+// that it takes up as many placeholders as a filter can.
+func testFilter() types.Filter {
+  direction := types.DirectionOne
+  return types.Filter{
+    StartDatetime: time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC),
+    EndDatetime:   time.Date(2024, time.March, 8, 0, 0, 0, 0, time.UTC),
+    Direction:     &direction,
+  }
+}
+
+// expectSQL fails the test unless a query contains every one of the provided fragments.
+func expectSQL(t *testing.T, query dbtest.Query, fragments ...string) {
+  t.Helper()
+
+  for _, fragment := range fragments {
+    if !strings.Contains(query.SQL, fragment) {
+      t.Errorf("Expected query to contain %q, got %s", fragment, query.SQL)
+    }
+  }
+}
+
+func TestHeadwayClassification(t *testing.T) {
+  clause := HeadwayClassification("$4", "$5")
+
+  // Bunching is checked first, so that a headway is never both bunched and gapped
+  bunched := strings.Index(clause, "headway_time_sec <= benchmark_headway_time_sec * $4::float")
+  gapped := strings.Index(clause, "headway_time_sec > benchmark_headway_time_sec * $5::float")
+  if bunched < 0 || gapped < 0 || bunched > gapped {
+    t.Errorf("Expected bunching at $4 to be checked before gapping at $5, got %s", clause)
+  }
+  if !strings.HasSuffix(clause, "ELSE '" + HeadwayOnTime + "' END") {
+    t.Errorf("Expected every other headway to be on time, got %s", clause)
+  }
+}
+
+func TestSelectHeadwayAdherencePlaceholders(t *testing.T) {
+  thresholds := HeadwayThresholds{ BunchedRatio: 0.4, GappedRatio: 1.6 }
+  cases := []struct {
+    name        string
+    stopIDs     []string
+    filter      types.Filter
+    granularity string
+    bunched     string
+    gapped      string
+  }{
+    {
+      name:        "unfiltered",
+      stopIDs:     []string{ "70061" },
+      granularity: GranularityDay,
+      bunched:     "$3",
+      gapped:      "$4",
+    },
+    {
+      name:        "filtered by hour",
+      stopIDs:     []string{ "70061", "70063" },
+      filter:      testFilter(),
+      granularity: GranularityHour,
+      bunched:     "$7",
+      gapped:      "$8",
+    },
+  }
+
+  for _, tc := range cases {
+    t.Run(tc.name, func(t *testing.T) {
+      tx, recorder := dbtest.Begin(t)
+      service := &AnalyticsService{}
+      _, err := service.SelectHeadwayAdherence(
+        tx,
+        tc.stopIDs,
+        "Red",
+        tc.filter,
+        thresholds,
+        tc.granularity,
+      )
+      if err != nil {
+        t.Fatalf("Expected the query to run, got %v", err)
+      }
+
+      query := recorder.Only(t)
+      dbtest.CheckPlaceholders(t, query)
+      expectSQL(
+        t,
+        query,
+        HeadwayClassification(tc.bunched, tc.gapped),
+        "benchmark_headway_time_sec > 0",
+      )
+      if query.Arg(t, tc.bunched) != thresholds.BunchedRatio {
+        t.Errorf("Expected the bunched ratio at %s, got %v", tc.bunched, query)
+      }
+      if query.Arg(t, tc.gapped) != thresholds.GappedRatio {
+        t.Errorf("Expected the gapped ratio at %s, got %v", tc.gapped, query)
+      }
+
+      if tc.granularity == GranularityHour {
+        expectSQL(t, query, hourOfDay("current_dep_dt") + " AS hour")
+      } else {
+        expectSQL(t, query, "NULL::integer AS hour")
+      }
+    })
+  }
+}
+
+func TestSelectOffendingHeadwaysPlaceholders(t *testing.T) {
+  tx, recorder := dbtest.Begin(t)
+  service := &AnalyticsService{}
+  thresholds := HeadwayThresholds{ BunchedRatio: 0.4, GappedRatio: 1.6 }
+  _, err := service.SelectOffendingHeadways(
+    tx,
+    []string{ "70061", "70063" },
+    "Red",
+    testFilter(),
+    thresholds,
+  )
+  if err != nil {
+    t.Fatalf("Expected the query to run, got %v", err)
+  }
+
+  query := recorder.Only(t)
+  dbtest.CheckPlaceholders(t, query)
+  expectSQL(
+    t,
+    query,
+    HeadwayClassification("$7", "$8"),
+    "classification <> '" + HeadwayOnTime + "'",
+  )
+  if query.Arg(t, "$7") != thresholds.BunchedRatio || query.Arg(t, "$8") != thresholds.GappedRatio {
+    t.Errorf("Expected the ratios at $7 and $8, got %v", query)
+  }
+}
+
+func TestDwellBaselines(t *testing.T) {
+  cases := []struct {
+    method   string
+    expected []string
+  }{
+    {
+      method: OutlierMethodMAD,
+      expected: []string{
+        "median - $7::float * spread AS expected_min",
+        "median + $7::float * spread AS expected_max",
+        "* 1.4826, 1) AS spread",
+      },
+    },
+    {
+      method: OutlierMethodIQR,
+      expected: []string{
+        "q1 - $7::float * (q3 - q1) AS expected_min",
+        "q3 + $7::float * (q3 - q1) AS expected_max",
+      },
+    },
+  }
+
+  for _, tc := range cases {
+    t.Run(tc.method, func(t *testing.T) {
+      baselines := dwellBaselines(tc.method, "$7")
+      for _, fragment := range tc.expected {
+        if !strings.Contains(baselines, fragment) {
+          t.Errorf("Expected baselines to contain %q, got %s", fragment, baselines)
+        }
+      }
+      expected := "baselines AS (SELECT stop_id, direction, hour, sample_count, median,"
+      if !strings.Contains(baselines, expected) {
+        t.Errorf("Expected baselines to end with a baselines expression, got %s", baselines)
+      }
+    })
+  }
+}
+
+func TestSelectDwellOutliersPlaceholders(t *testing.T) {
+  for _, method := range []string{ OutlierMethodMAD, OutlierMethodIQR } {
+    t.Run(method, func(t *testing.T) {
+      tx, recorder := dbtest.Begin(t)
+      service := &AnalyticsService{}
+      _, err := service.SelectDwellOutliers(
+        tx,
+        []string{ "70061", "70063" },
+        "Red",
+        testFilter(),
+        method,
+        2.5,
+        10,
+      )
+      if err != nil {
+        t.Fatalf("Expected the query to run, got %v", err)
+      }
+
+      query := recorder.Only(t)
+      dbtest.CheckPlaceholders(t, query)
+      expectSQL(
+        t,
+        query,
+        dwellBaselines(method, "$7"),
+        "baselines.sample_count >= $8",
+        "stop_id IN ($1, $2) AND route_id = $3 AND arr_dt >= TO_TIMESTAMP($4) AND arr_dt <= " +
+          "TO_TIMESTAMP($5) AND direction = $6",
+      )
+      if query.Arg(t, "$7") != 2.5 || query.Arg(t, "$8") != int64(10) {
+        t.Errorf("Expected the threshold at $7 and the minimum samples at $8, got %v", query)
+      }
+
+      // Baselines cover every retained dwell, no matter which dwells are selected
+      history := query.SQL[:strings.Index(query.SQL, "), ")]
+      expected := "WITH history AS (SELECT stop_id, direction, " + hourOfDay("arr_dt") +
+        " AS hour, dwell_time_sec FROM dwell WHERE stop_id IN ($1, $2) AND route_id = $3"
+      if history != expected {
+        t.Errorf("Expected the history to only be limited to the stops and route, got %s", history)
+      }
+    })
+  }
+}
@@ -0,0 +1,264 @@
+package analytics
+
+import (
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+
+  "github.com/gin-gonic/gin"
+  "github.com/mbta-performance-dashboard/consts"
+  "github.com/mbta-performance-dashboard/types"
+  "github.com/mbta-performance-dashboard/utils"
+)
+
+// parsePositiveFloat parses a positive number from a request's query parameter, or returns the
+// provided default if the request doesn't have one.
+func parsePositiveFloat(c *gin.Context, param string, defaultValue float64) (float64, error) {
+  value := c.DefaultQuery(param, "")
+  if value == "" {
+    return defaultValue, nil
+  }
+
+  number, err := strconv.ParseFloat(value, 64)
+  if err != nil || number <= 0 {
+    return 0, fmt.Errorf("Invalid %s %s, expected a positive number", param, value)
+  }
+  return number, nil
+}
+
+// parseHeadwayThresholds parses headway thresholds from a request's bunched_ratio and gapped_ratio
+// query parameters.
+//
+// Defaults to bunching at half the benchmark and gapping past 1.5 times the benchmark.
+func parseHeadwayThresholds(c *gin.Context) (HeadwayThresholds, error) {
+  bunchedRatio, err := parsePositiveFloat(c, "bunched_ratio", consts.HeadwayBunchingFactor)
+  if err != nil {
+    return HeadwayThresholds{}, err
+  }
+  gappedRatio, err := parsePositiveFloat(c, "gapped_ratio", consts.HeadwayAdherenceFactor)
+  if err != nil {
+    return HeadwayThresholds{}, err
+  }
+
+  if bunchedRatio >= gappedRatio {
+    return HeadwayThresholds{}, errors.New("Bunched ratio must be less than gapped ratio")
+  }
+
+  return HeadwayThresholds{ BunchedRatio: bunchedRatio, GappedRatio: gappedRatio }, nil
+}
+
+// parseGranularity parses the granularity to summarize at from a request's granularity query
+// parameter.
+//
+// Defaults to a day.
+func parseGranularity(c *gin.Context) (string, error) {
+  value := c.DefaultQuery("granularity", GranularityDay)
+  if value != GranularityDay && value != GranularityHour {
+    return "", fmt.Errorf(
+      "Invalid granularity %s, expected %s or %s",
+      value,
+      GranularityDay,
+      GranularityHour,
+    )
+  }
+  return value, nil
+}
+
+// parseOutlierMethod parses the method to detect dwell outliers with from a request's method query
+// parameter, along with how far outside the baseline a dwell has to be from its threshold query
+// parameter.
+//
+// Defaults to 3 scaled median absolute deviations from the median, or 1.5 interquartile ranges
+// with the IQR method.
+func parseOutlierMethod(c *gin.Context) (string, float64, error) {
+  method := c.DefaultQuery("method", OutlierMethodMAD)
+
+  var defaultThreshold float64
+  switch method {
+  case OutlierMethodMAD:
+    defaultThreshold = consts.DwellOutlierMADThreshold
+  case OutlierMethodIQR:
+    defaultThreshold = consts.DwellOutlierIQRThreshold
+  default:
+    return "", 0, fmt.Errorf(
+      "Invalid method %s, expected %s or %s",
+      method,
+      OutlierMethodMAD,
+      OutlierMethodIQR,
+    )
+  }
+
+  threshold, err := parsePositiveFloat(c, "threshold", defaultThreshold)
+  if err != nil {
+    return "", 0, err
+  }
+  return method, threshold, nil
+}
+
+func SelectHeadwayAdherence(c *gin.Context, service *AnalyticsService) {
+	routeID := c.DefaultQuery("route_id", "")
+
+  var adherence HeadwayAdherence
+  var direction *types.ResolvedDirection
+  err := func() error {
+    stopIDs, err := utils.ResolveStopIDs(c, service.BeginTx, "stop_ids", "station_id", routeID)
+    if err != nil {
+      return err
+    }
+
+    filter, err := utils.ParseFilter(c)
+    if err != nil {
+      return err
+    }
+
+    adherence.Thresholds, err = parseHeadwayThresholds(c)
+    if err != nil {
+      return err
+    }
+
+    granularity, err := parseGranularity(c)
+    if err != nil {
+      return err
+    }
+
+    tx, err := service.BeginTx()
+    if err != nil {
+      return fmt.Errorf("Error beginning transaction: %w", err)
+    }
+    defer func() {
+      if tx != nil {
+        tx.Rollback()
+      }
+    }()
+
+    if err := utils.ValidateIDs(tx, stopIDs, routeID); err != nil {
+      return err
+    }
+
+    direction, err = utils.ResolveDirection(c, tx, routeID)
+    if err != nil {
+      return err
+    }
+    if direction != nil {
+      filter.Direction = &direction.Direction
+    }
+
+    adherence.Summaries, err = service.SelectHeadwayAdherence(
+      tx,
+      stopIDs,
+      routeID,
+      filter,
+      adherence.Thresholds,
+      granularity,
+    )
+    if err != nil {
+      return err
+    }
+
+    adherence.Offending, err = service.SelectOffendingHeadways(
+      tx,
+      stopIDs,
+      routeID,
+      filter,
+      adherence.Thresholds,
+    )
+    if err != nil {
+      return err
+    }
+
+    if err = tx.Commit(); err != nil {
+      return fmt.Errorf("Error committing transaction: %w", err)
+    }
+    tx = nil
+
+    return nil
+  }()
+  if err != nil {
+    utils.PropagateToResponse(c, err)
+    return
+  }
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": adherence,
+		"direction": direction,
+	})
+}
+
+func SelectDwellOutliers(c *gin.Context, service *AnalyticsService) {
+	routeID := c.DefaultQuery("route_id", "")
+
+  var outliers []*DwellOutlier
+  var direction *types.ResolvedDirection
+  var method string
+  var threshold float64
+  err := func() error {
+    stopIDs, err := utils.ResolveStopIDs(c, service.BeginTx, "stop_ids", "station_id", routeID)
+    if err != nil {
+      return err
+    }
+
+    filter, err := utils.ParseFilter(c)
+    if err != nil {
+      return err
+    }
+
+    method, threshold, err = parseOutlierMethod(c)
+    if err != nil {
+      return err
+    }
+
+    tx, err := service.BeginTx()
+    if err != nil {
+      return fmt.Errorf("Error beginning transaction: %w", err)
+    }
+    defer func() {
+      if tx != nil {
+        tx.Rollback()
+      }
+    }()
+
+    if err := utils.ValidateIDs(tx, stopIDs, routeID); err != nil {
+      return err
+    }
+
+    direction, err = utils.ResolveDirection(c, tx, routeID)
+    if err != nil {
+      return err
+    }
+    if direction != nil {
+      filter.Direction = &direction.Direction
+    }
+
+    outliers, err = service.SelectDwellOutliers(
+      tx,
+      stopIDs,
+      routeID,
+      filter,
+      method,
+      threshold,
+      consts.DwellOutlierMinSamples,
+    )
+    if err != nil {
+      return err
+    }
+
+    if err = tx.Commit(); err != nil {
+      return fmt.Errorf("Error committing transaction: %w", err)
+    }
+    tx = nil
+
+    return nil
+  }()
+  if err != nil {
+    utils.PropagateToResponse(c, err)
+    return
+  }
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": outliers,
+		"direction": direction,
+		"method": method,
+		"threshold": threshold,
+	})
+}
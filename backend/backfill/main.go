@@ -0,0 +1,359 @@
+package main
+
+import (
+  "context"
+  "flag"
+  "fmt"
+  "log"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+
+  "database/sql"
+
+  "github.com/joho/godotenv"
+  _ "github.com/lib/pq"
+
+  "github.com/mbta-performance-dashboard/consts"
+  "github.com/mbta-performance-dashboard/dwells"
+  "github.com/mbta-performance-dashboard/events"
+  "github.com/mbta-performance-dashboard/headways"
+  "github.com/mbta-performance-dashboard/locks"
+  "github.com/mbta-performance-dashboard/performanceapi"
+  "github.com/mbta-performance-dashboard/traveltimes"
+  "github.com/mbta-performance-dashboard/types"
+  "github.com/mbta-performance-dashboard/utils"
+)
+
+// A Target represents a single key to backfill, along with the params that fetch it from the MBTA
+// Performance API.
+type Target struct {
+  Key    string
+  Params map[string]string
+}
+
+// loadCursor gets how far back a target has been backfilled so far, if it has been at all.
+func loadCursor(db *sql.DB, entity string, routeID string, key string) (time.Time, bool, error) {
+  var cursor time.Time
+  err := db.QueryRow(
+    "SELECT value AT TIME ZONE 'America/New_York' FROM backfill_cursor WHERE entity = $1 AND " +
+      "route_id = $2 AND key = $3",
+    entity,
+    routeID,
+    key,
+  ).Scan(&cursor)
+  if err == sql.ErrNoRows {
+    return time.Time{}, false, nil
+  }
+  if err != nil {
+    return time.Time{}, false, fmt.Errorf("Error querying backfill cursor: %w", err)
+  }
+  return cursor, true, nil
+}
+
+// saveCursor records how far back a target has been backfilled so far.
+func saveCursor(tx *sql.Tx, entity string, routeID string, key string, value time.Time) error {
+  _, err := tx.Exec(
+    "INSERT INTO backfill_cursor (entity, route_id, key, value) VALUES ($1, $2, $3, " +
+      "$4::timestamptz AT TIME ZONE 'America/New_York') ON CONFLICT (entity, route_id, key) DO " +
+      "UPDATE SET value = EXCLUDED.value",
+    entity,
+    routeID,
+    key,
+    value,
+  )
+  if err != nil {
+    return fmt.Errorf("Error saving backfill cursor: %w", err)
+  }
+  return nil
+}
+
+// backfill walks backwards from each target's cursor to the provided number of days ago in
+// week-long windows, committing every window along with the target's cursor so that an
+// interrupted backfill resumes where it left off.
+//
+// Targets that have never been backfilled start from where regular caching starts, 30 days ago.
+func backfill[T types.Entity, U types.APIResponse[T]](
+  ctx context.Context,
+  db *sql.DB,
+  api performanceapi.Client,
+  entity string,
+  endpoint string,
+  routeID string,
+  targets []Target,
+  days int,
+  insert func(tx *sql.Tx, entities []T) error,
+  annotate func(entity T, target Target),
+) error {
+  startOfToday, err := utils.StartOfToday()
+  if err != nil {
+    return err
+  }
+  horizon := startOfToday.AddDate(0, 0, -days)
+
+  for _, target := range targets {
+    cursor, ok, err := loadCursor(db, entity, routeID, target.Key)
+    if err != nil {
+      return err
+    }
+    if !ok {
+      cursor = startOfToday.AddDate(0, 0, -consts.MaxDays)
+    }
+
+    for cursor.After(horizon) {
+      start := cursor.AddDate(0, 0, -7)
+      if start.Before(horizon) {
+        start = horizon
+      }
+      window := types.Window{ Start: start, End: cursor.Add(-1 * time.Second) }
+
+      params := map[string]string{
+        "from_datetime": strconv.FormatInt(window.Start.Unix(), 10),
+        "to_datetime": strconv.FormatInt(window.End.Unix(), 10),
+      }
+      for k, v := range target.Params {
+        params[k] = v
+      }
+
+      chunk := types.Chunk{ Key: target.Key, Window: window, Params: params }
+      result := utils.FetchChunks[T, U](ctx, api, endpoint, []types.Chunk{ chunk })[0]
+      if result.Err != nil {
+        return result.Err
+      }
+
+      for _, entity := range result.Entities {
+        annotate(entity, target)
+      }
+
+      err := func() error {
+        tx, err := db.Begin()
+        if err != nil {
+          return fmt.Errorf("Error beginning transaction: %w", err)
+        }
+        defer func() {
+          if tx != nil {
+            tx.Rollback()
+          }
+        }()
+
+        if err = insert(tx, result.Entities); err != nil {
+          return err
+        }
+
+        if err = utils.InsertRejectedRecords(tx, result.Rejected); err != nil {
+          return err
+        }
+
+        if err = saveCursor(tx, entity, routeID, target.Key, window.Start); err != nil {
+          return err
+        }
+
+        if err = tx.Commit(); err != nil {
+          return fmt.Errorf("Error committing transaction: %w", err)
+        }
+        tx = nil
+
+        return nil
+      }()
+      if err != nil {
+        return err
+      }
+
+      log.Println(fmt.Sprintf(
+        "Backfilled %d %s entities for %s from %s to %s, rejecting %d",
+        len(result.Entities),
+        entity,
+        target.Key,
+        window.Start.Format(time.RFC3339),
+        window.End.Format(time.RFC3339),
+        len(result.Rejected),
+      ))
+      cursor = window.Start
+    }
+  }
+
+  return nil
+}
+
+func splitIDs(value string) []string {
+  if value == "" {
+    return []string{}
+  }
+  return strings.Split(value, ",")
+}
+
+func main() {
+  entity := flag.String("entity", "", "Entity to backfill: headway, dwell, event or travel_time")
+  routeID := flag.String("route_id", "", "Route ID to backfill")
+  stopIDs := flag.String("stop_ids", "", "Comma-separated stop IDs, for headways, dwells and events")
+  fromStopIDs := flag.String("from_stop_ids", "", "Comma-separated origin stop IDs, for travel times")
+  toStopIDs := flag.String("to_stop_ids", "", "Comma-separated destination stop IDs, for travel times")
+  days := flag.Int("days", consts.MaxQueryDays, "How many days back to backfill")
+  flag.Parse()
+
+  if *routeID == "" {
+    panic("Route ID required")
+  }
+  if *days < 1 || *days > consts.MaxQueryDays {
+    panic(fmt.Sprintf(
+      "Days must be between 1 and %d, since the Performance API can't go back any further",
+      consts.MaxQueryDays,
+    ))
+  }
+
+  err := godotenv.Load()
+  if err != nil {
+    panic(fmt.Sprintf("Error loading .env file: %v", err))
+  }
+
+  source := fmt.Sprintf(
+    "host=%s port=%s dbname=%s password=%s user=%s sslmode=disable",
+    os.Getenv("POSTGRES_HOST"),
+    os.Getenv("POSTGRES_PORT"),
+    os.Getenv("POSTGRES_DB"),
+    os.Getenv("POSTGRES_PASSWORD"),
+    os.Getenv("POSTGRES_USER"),
+  )
+  db, err := sql.Open("postgres", source)
+  if err != nil {
+    panic(fmt.Sprintf("Error opening database: %v", err))
+  }
+  defer db.Close()
+
+  performanceAPIConfig, err := performanceapi.ConfigFromEnv()
+  if err != nil {
+    panic(fmt.Sprintf("Error configuring Performance API client: %v", err))
+  }
+  performanceAPILimitConfig, err := performanceapi.LimitConfigFromEnv()
+  if err != nil {
+    panic(fmt.Sprintf("Error configuring Performance API rate limit: %v", err))
+  }
+  performanceAPI := performanceapi.NewLimitedClient(
+    performanceapi.NewHTTPClient(performanceAPIConfig),
+    performanceAPILimitConfig,
+  )
+  lockManager := locks.NewManager()
+
+  retentionEnv := map[string]string{
+    "headway": "HEADWAY_RETENTION_DAYS",
+    "dwell": "DWELL_RETENTION_DAYS",
+    "event": "EVENT_RETENTION_DAYS",
+    "travel_time": "TRAVEL_TIME_RETENTION_DAYS",
+  }
+  if _, ok := retentionEnv[*entity]; !ok {
+    panic(fmt.Sprintf("Unknown entity %s", *entity))
+  }
+  retentionDays, err := utils.RetentionDaysFromEnv(retentionEnv[*entity])
+  if err != nil {
+    panic(fmt.Sprintf("Error configuring retention: %v", err))
+  }
+  if retentionDays != consts.KeepForever && retentionDays < *days {
+    panic(fmt.Sprintf(
+      "%s only keeps %d days, so backfilled entities would be deleted on the next cache",
+      retentionEnv[*entity],
+      retentionDays,
+    ))
+  }
+
+  var targets []Target = []Target{}
+  ctx := context.Background()
+  switch *entity {
+  case "headway", "dwell", "event":
+    for _, stopID := range splitIDs(*stopIDs) {
+      targets = append(targets, Target{
+        Key: stopID,
+        Params: map[string]string{ "stop": stopID, "route": *routeID },
+      })
+    }
+  case "travel_time":
+    for _, fromStopID := range splitIDs(*fromStopIDs) {
+      for _, toStopID := range splitIDs(*toStopIDs) {
+        targets = append(targets, Target{
+          Key: traveltimes.PairKey(fromStopID, toStopID),
+          Params: map[string]string{
+            "from_stop": fromStopID,
+            "to_stop": toStopID,
+            "route": *routeID,
+          },
+        })
+      }
+    }
+  }
+  if len(targets) == 0 {
+    panic("At least one stop ID required")
+  }
+
+  switch *entity {
+  case "headway":
+    service := headways.NewService(db, performanceAPI, lockManager, retentionDays)
+    err = backfill[*headways.Headway, *headways.APIResponse](
+      ctx,
+      db,
+      performanceAPI,
+      *entity,
+      "headways",
+      *routeID,
+      targets,
+      *days,
+      service.Insert,
+      func(headway *headways.Headway, target Target) {
+        headway.SetStopID(target.Key)
+      },
+    )
+  case "dwell":
+    service := dwells.NewService(db, performanceAPI, lockManager, retentionDays)
+    err = backfill[*dwells.Dwell, *dwells.APIResponse](
+      ctx,
+      db,
+      performanceAPI,
+      *entity,
+      "dwells",
+      *routeID,
+      targets,
+      *days,
+      service.Insert,
+      func(dwell *dwells.Dwell, target Target) {
+        dwell.SetStopID(target.Key)
+      },
+    )
+  case "event":
+    service := events.NewService(db, performanceAPI, lockManager, retentionDays)
+    err = backfill[*events.Event, *events.APIResponse](
+      ctx,
+      db,
+      performanceAPI,
+      *entity,
+      "events",
+      *routeID,
+      targets,
+      *days,
+      service.Insert,
+      func(event *events.Event, target Target) {
+        event.SetStopID(target.Key)
+      },
+    )
+  case "travel_time":
+    service := traveltimes.NewService(db, performanceAPI, lockManager, retentionDays)
+    err = backfill[*traveltimes.TravelTime, *traveltimes.APIResponse](
+      ctx,
+      db,
+      performanceAPI,
+      *entity,
+      "traveltimes",
+      *routeID,
+      targets,
+      *days,
+      service.Insert,
+      func(travelTime *traveltimes.TravelTime, target Target) {
+        travelTime.FromStopID = target.Params["from_stop"]
+        travelTime.ToStopID = target.Params["to_stop"]
+      },
+    )
+  }
+  if err != nil {
+    panic(fmt.Sprintf("Error backfilling, rerun to resume: %v", err))
+  }
+
+  log.Println("Done!")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "os"
+)
+
+// The GTFS route types that get special treatment.
+const (
+  BusRouteType int = 3
+)
+
+// A RouteConfig represents a route to load, in the order it should be listed.
+//
+// DisplayName is optional, and defaults to the route's short name for buses and its long name for
+// everything else.
+type RouteConfig struct {
+  ID          string `json:"id"`
+  DisplayName string `json:"display_name"`
+}
+
+// defaultRouteConfigs returns the rapid transit routes, which are loaded when no route config is
+// provided.
+func defaultRouteConfigs() []RouteConfig {
+  return []RouteConfig{
+    { ID: "Red" },
+    { ID: "Mattapan" },
+    { ID: "Orange" },
+    { ID: "Green-B" },
+    { ID: "Green-C" },
+    { ID: "Green-D" },
+    { ID: "Green-E" },
+    { ID: "Blue" },
+  }
+}
+
+// loadRouteConfigs loads the routes to load from the JSON file at ROUTE_CONFIG, or the default
+// routes if it isn't set.
+func loadRouteConfigs() ([]RouteConfig, error) {
+  path, ok := os.LookupEnv("ROUTE_CONFIG")
+  if !ok {
+    return defaultRouteConfigs(), nil
+  }
+
+  body, err := os.ReadFile(path)
+  if err != nil {
+    return nil, fmt.Errorf("Error reading route config: %w", err)
+  }
+
+  var configs []RouteConfig
+  if err := json.Unmarshal(body, &configs); err != nil {
+    return nil, fmt.Errorf("Error decoding route config: %w", err)
+  }
+
+  if len(configs) == 0 {
+    return nil, errors.New("Route config must list at least one route")
+  }
+  seen := make(map[string]bool)
+  for _, config := range configs {
+    if config.ID == "" {
+      return nil, errors.New("Every route in the route config needs an ID")
+    }
+    if seen[config.ID] {
+      return nil, fmt.Errorf("Route %s is listed more than once in the route config", config.ID)
+    }
+    seen[config.ID] = true
+  }
+
+  return configs, nil
+}
+
+// displayName returns the name a route should be shown with.
+func displayName(config RouteConfig, routeType int, shortName string, longName string) string {
+  if config.DisplayName != "" {
+    return config.DisplayName
+  }
+  if routeType == BusRouteType && shortName != "" {
+    return shortName
+  }
+  if longName != "" {
+    return longName
+  }
+  if shortName != "" {
+    return shortName
+  }
+  return config.ID
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+  "archive/zip"
+  "encoding/csv"
+  "errors"
+  "fmt"
+  "io"
+  "io/fs"
+  "log"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// A gtfsRow represents a single row of a file in a GTFS static feed.
+type gtfsRow struct {
+  columns map[string]int
+  record  []string
+}
+
+// get returns the value of a column, or an empty string if the file doesn't have the column.
+func (r gtfsRow) get(column string) string {
+  index, ok := r.columns[column]
+  if !ok || index >= len(r.record) {
+    return ""
+  }
+  return r.record[index]
+}
+
+// readGTFSFile calls a provided function with every row of a file in a GTFS static feed.
+func readGTFSFile(archive *zip.ReadCloser, name string, handle func(row gtfsRow) error) error {
+  file, err := archive.Open(name)
+  if err != nil {
+    return fmt.Errorf("Error opening %s: %w", name, err)
+  }
+  defer file.Close()
+
+  reader := csv.NewReader(file)
+  reader.FieldsPerRecord = -1
+  reader.ReuseRecord = true
+
+  header, err := reader.Read()
+  if err != nil {
+    return fmt.Errorf("Error reading %s header: %w", name, err)
+  }
+  columns := make(map[string]int)
+  for i, column := range header {
+    // Feeds exported from spreadsheets sometimes start with a byte order mark
+    columns[strings.TrimPrefix(strings.TrimSpace(column), "\ufeff")] = i
+  }
+
+  for {
+    record, err := reader.Read()
+    if errors.Is(err, io.EOF) {
+      return nil
+    }
+    if err != nil {
+      return fmt.Errorf("Error reading %s: %w", name, err)
+    }
+
+    if err := handle(gtfsRow{ columns: columns, record: record }); err != nil {
+      return fmt.Errorf("Error handling %s: %w", name, err)
+    }
+  }
+}
+
+// A gtfsRoute represents the parts of a route that are needed to describe it.
+type gtfsRoute struct {
+  routeType int
+  color     string
+  shortName string
+  longName  string
+}
+
+// A gtfsTrip represents the parts of a trip that are needed to place its stops and shape.
+type gtfsTrip struct {
+  routeID     string
+  directionID int
+  shapeID     string
+}
+
+// A tripStop represents a stop made by a trip, at the trip's own stop sequence.
+type tripStop struct {
+  stopID   string
+  sequence int
+}
+
+// A routeDirectionKey represents one direction of a route.
+type routeDirectionKey struct {
+  routeID     string
+  directionID int
+}
+
+// A shapePoint represents a single point along a shape.
+type shapePoint struct {
+  sequence  int
+  latitude  float64
+  longitude float64
+}
+
+// loadGTFS loads the provided routes, along with their shapes, stops, directions and the sequence
+// of stops in each direction, from a GTFS static feed zip.
+//
+// Every shape and stop used by any trip on a route is loaded. The loaded network replaces the
+// current one rather than sitting alongside it, so an older feed can't be used to keep past service
+// patterns next to the current ones.
+//
+// Stops are ordered in each direction by a representative trip, which is the first typical route
+// pattern's if the feed has the optional route_patterns.txt, and the longest trip otherwise. See
+// orderRouteStops.
+//
+// Directions are only loaded if the feed has the optional directions.txt.
+func loadGTFS(path string, configs []RouteConfig) (*Network, error) {
+  archive, err := zip.OpenReader(path)
+  if err != nil {
+    return nil, fmt.Errorf("Error opening GTFS static feed: %w", err)
+  }
+  defer archive.Close()
+
+  wantedRoutes := make(map[string]bool)
+  for _, config := range configs {
+    wantedRoutes[config.ID] = true
+  }
+
+  feedRoutes := make(map[string]gtfsRoute)
+  err = readGTFSFile(archive, "routes.txt", func(row gtfsRow) error {
+    routeID := row.get("route_id")
+    if !wantedRoutes[routeID] {
+      return nil
+    }
+
+    routeType, err := strconv.Atoi(row.get("route_type"))
+    if err != nil {
+      return fmt.Errorf("Error converting type of route %s to integer: %w", routeID, err)
+    }
+    feedRoutes[routeID] = gtfsRoute{
+      routeType: routeType,
+      color: row.get("route_color"),
+      shortName: row.get("route_short_name"),
+      longName: row.get("route_long_name"),
+    }
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  // Routes are listed in the order they're configured in, rather than the order of the feed
+  var routes []Route = []Route{}
+  for _, config := range configs {
+    feedRoute, ok := feedRoutes[config.ID]
+    if !ok {
+      log.Println(fmt.Sprintf("Route %s isn't in the feed", config.ID))
+      continue
+    }
+    routes = append(routes, Route{
+      ID: config.ID,
+      Type: feedRoute.routeType,
+      Color: feedRoute.color,
+      DisplayName: displayName(
+        config,
+        feedRoute.routeType,
+        feedRoute.shortName,
+        feedRoute.longName,
+      ),
+    })
+  }
+
+  log.Println("Reading trips")
+  trips := make(map[string]gtfsTrip)
+  err = readGTFSFile(archive, "trips.txt", func(row gtfsRow) error {
+    if !wantedRoutes[row.get("route_id")] {
+      return nil
+    }
+
+    directionID, err := strconv.Atoi(row.get("direction_id"))
+    if err != nil {
+      return fmt.Errorf(
+        "Error converting direction of trip %s to integer: %w",
+        row.get("trip_id"),
+        err,
+      )
+    }
+    trips[row.get("trip_id")] = gtfsTrip{
+      routeID: row.get("route_id"),
+      directionID: directionID,
+      shapeID: row.get("shape_id"),
+    }
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  log.Println("Reading stop times")
+  tripStops := make(map[string][]tripStop)
+  err = readGTFSFile(archive, "stop_times.txt", func(row gtfsRow) error {
+    tripID := row.get("trip_id")
+    if _, ok := trips[tripID]; !ok {
+      return nil
+    }
+
+    stopSequence, err := strconv.Atoi(row.get("stop_sequence"))
+    if err != nil {
+      return fmt.Errorf("Error converting stop sequence to integer: %w", err)
+    }
+    tripStops[tripID] = append(tripStops[tripID], tripStop{
+      stopID: row.get("stop_id"),
+      sequence: stopSequence,
+    })
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  // Representative trips of typical route patterns, in the order the feed sorts them in
+  typicalRanks := make(map[string]int)
+  err = readGTFSFile(archive, "route_patterns.txt", func(row gtfsRow) error {
+    if !wantedRoutes[row.get("route_id")] || row.get("route_pattern_typicality") != "1" {
+      return nil
+    }
+
+    var sortOrder int
+    if value := row.get("route_pattern_sort_order"); value != "" {
+      converted, err := strconv.Atoi(value)
+      if err != nil {
+        return fmt.Errorf(
+          "Error converting sort order of route pattern %s to integer: %w",
+          row.get("route_pattern_id"),
+          err,
+        )
+      }
+      sortOrder = converted
+    }
+    if tripID := row.get("representative_trip_id"); tripID != "" {
+      typicalRanks[tripID] = sortOrder
+    }
+    return nil
+  })
+  if errors.Is(err, fs.ErrNotExist) {
+    log.Println("Feed has no route_patterns.txt, so stops will be ordered by the longest trips")
+  } else if err != nil {
+    return nil, err
+  }
+
+  tripIDsByDirection := make(map[routeDirectionKey][]string)
+  for tripID, trip := range trips {
+    if len(tripStops[tripID]) == 0 {
+      continue
+    }
+    key := routeDirectionKey{ routeID: trip.routeID, directionID: trip.directionID }
+    tripIDsByDirection[key] = append(tripIDsByDirection[key], tripID)
+  }
+
+  var routeStops []RouteStop = []RouteStop{}
+  for key, tripIDs := range tripIDsByDirection {
+    // Typical trips come first in their sort order, followed by every other trip from longest to
+    // shortest
+    sort.Slice(tripIDs, func(i, j int) bool {
+      rankI, typicalI := typicalRanks[tripIDs[i]]
+      rankJ, typicalJ := typicalRanks[tripIDs[j]]
+      if typicalI != typicalJ {
+        return typicalI
+      }
+      if typicalI && rankI != rankJ {
+        return rankI < rankJ
+      }
+      if len(tripStops[tripIDs[i]]) != len(tripStops[tripIDs[j]]) {
+        return len(tripStops[tripIDs[i]]) > len(tripStops[tripIDs[j]])
+      }
+      return tripIDs[i] < tripIDs[j]
+    })
+
+    orderedTrips := make([][]string, len(tripIDs))
+    for i, tripID := range tripIDs {
+      stops := tripStops[tripID]
+      sort.Slice(stops, func(a, b int) bool {
+        return stops[a].sequence < stops[b].sequence
+      })
+      orderedTrips[i] = make([]string, len(stops))
+      for j, stop := range stops {
+        orderedTrips[i][j] = stop.stopID
+      }
+    }
+
+    routeStops = append(routeStops, orderRouteStops(key.routeID, key.directionID, orderedTrips)...)
+  }
+  sortRouteStops(routeStops)
+
+  stopRoutes := make(map[string]map[string]bool)
+  for _, routeStop := range routeStops {
+    if stopRoutes[routeStop.StopID] == nil {
+      stopRoutes[routeStop.StopID] = make(map[string]bool)
+    }
+    stopRoutes[routeStop.StopID][routeStop.RouteID] = true
+  }
+
+  log.Println("Reading stops")
+  var stops []Stop = []Stop{}
+  err = readGTFSFile(archive, "stops.txt", func(row gtfsRow) error {
+    stopID := row.get("stop_id")
+    if len(stopRoutes[stopID]) == 0 {
+      return nil
+    }
+
+    latitude, err := strconv.ParseFloat(row.get("stop_lat"), 64)
+    if err != nil {
+      return fmt.Errorf("Error converting latitude of stop %s to float: %w", stopID, err)
+    }
+    longitude, err := strconv.ParseFloat(row.get("stop_lon"), 64)
+    if err != nil {
+      return fmt.Errorf("Error converting longitude of stop %s to float: %w", stopID, err)
+    }
+
+    for routeID := range stopRoutes[stopID] {
+      stops = append(stops, Stop{
+        ID: stopID,
+        RouteID: routeID,
+        Name: row.get("stop_name"),
+        Latitude: latitude,
+        Longitude: longitude,
+        ParentStation: row.get("parent_station"),
+        PlatformCode: row.get("platform_code"),
+      })
+    }
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  sort.Slice(stops, func(i, j int) bool {
+    if stops[i].RouteID != stops[j].RouteID {
+      return stops[i].RouteID < stops[j].RouteID
+    }
+    return stops[i].ID < stops[j].ID
+  })
+
+  shapeRoutes := make(map[string]string)
+  for _, trip := range trips {
+    if trip.shapeID != "" {
+      shapeRoutes[trip.shapeID] = trip.routeID
+    }
+  }
+
+  log.Println("Reading shapes")
+  points := make(map[string][]shapePoint)
+  err = readGTFSFile(archive, "shapes.txt", func(row gtfsRow) error {
+    shapeID := row.get("shape_id")
+    if _, ok := shapeRoutes[shapeID]; !ok {
+      return nil
+    }
+
+    sequence, err := strconv.Atoi(row.get("shape_pt_sequence"))
+    if err != nil {
+      return fmt.Errorf("Error converting sequence of shape %s to integer: %w", shapeID, err)
+    }
+    latitude, err := strconv.ParseFloat(row.get("shape_pt_lat"), 64)
+    if err != nil {
+      return fmt.Errorf("Error converting latitude of shape %s to float: %w", shapeID, err)
+    }
+    longitude, err := strconv.ParseFloat(row.get("shape_pt_lon"), 64)
+    if err != nil {
+      return fmt.Errorf("Error converting longitude of shape %s to float: %w", shapeID, err)
+    }
+
+    points[shapeID] = append(points[shapeID], shapePoint{
+      sequence: sequence,
+      latitude: latitude,
+      longitude: longitude,
+    })
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  var shapes []Shape = []Shape{}
+  for shapeID, shapePoints := range points {
+    sort.Slice(shapePoints, func(i, j int) bool {
+      return shapePoints[i].sequence < shapePoints[j].sequence
+    })
+    shapes = append(shapes, Shape{
+      ID: shapeID,
+      RouteID: shapeRoutes[shapeID],
+      Polyline: encodePolyline(shapePoints),
+    })
+  }
+  sort.Slice(shapes, func(i, j int) bool {
+    return shapes[i].ID < shapes[j].ID
+  })
+
+  var routeDirections []RouteDirection = []RouteDirection{}
+  err = readGTFSFile(archive, "directions.txt", func(row gtfsRow) error {
+    if !wantedRoutes[row.get("route_id")] {
+      return nil
+    }
+
+    directionID, err := strconv.Atoi(row.get("direction_id"))
+    if err != nil {
+      return fmt.Errorf("Error converting direction to integer: %w", err)
+    }
+    routeDirections = append(routeDirections, RouteDirection{
+      RouteID: row.get("route_id"),
+      DirectionID: directionID,
+      Name: row.get("direction"),
+      Destination: row.get("direction_destination"),
+    })
+    return nil
+  })
+  if errors.Is(err, fs.ErrNotExist) {
+    log.Println("Feed has no directions.txt, so no directions will be loaded")
+  } else if err != nil {
+    return nil, err
+  }
+
+  return &Network{
+    Routes: routes,
+    Shapes: shapes,
+    Stops: stops,
+    RouteStops: routeStops,
+    RouteDirections: routeDirections,
+  }, nil
+}
+
+// orderRouteStops places every stop served in one direction of a route, given the stops of each of
+// its trips in order, starting with the trip that represents the direction.
+//
+// Stops are ordered by the representative trip, followed by any stops it doesn't serve in the order
+// of the next trip that serves them, so that branches are ordered after the trunk they split from.
+// Only the order of stops within each trip is used, since GTFS only requires stop sequences to
+// increase within a trip, and short turns can number their stops starting from anywhere.
+func orderRouteStops(routeID string, directionID int, trips [][]string) []RouteStop {
+  placed := make(map[string]bool)
+  var routeStops []RouteStop = []RouteStop{}
+  for _, stopIDs := range trips {
+    for _, stopID := range stopIDs {
+      if placed[stopID] {
+        continue
+      }
+      placed[stopID] = true
+      routeStops = append(routeStops, RouteStop{
+        RouteID: routeID,
+        DirectionID: directionID,
+        StopID: stopID,
+        StopSequence: len(routeStops) + 1,
+      })
+    }
+  }
+  return routeStops
+}
+
+// sortRouteStops sorts route stops by route, direction and sequence.
+func sortRouteStops(routeStops []RouteStop) {
+  sort.Slice(routeStops, func(i, j int) bool {
+    a, b := routeStops[i], routeStops[j]
+    if a.RouteID != b.RouteID {
+      return a.RouteID < b.RouteID
+    }
+    if a.DirectionID != b.DirectionID {
+      return a.DirectionID < b.DirectionID
+    }
+    if a.StopSequence != b.StopSequence {
+      return a.StopSequence < b.StopSequence
+    }
+    return a.StopID < b.StopID
+  })
+}
+
+// encodePolyline encodes points with Google's encoded polyline algorithm, which is how the V3 API
+// returns shapes.
+func encodePolyline(points []shapePoint) string {
+  var builder strings.Builder
+  var previousLatitude, previousLongitude int
+  for _, point := range points {
+    latitude := roundCoordinate(point.latitude)
+    longitude := roundCoordinate(point.longitude)
+    encodePolylineValue(&builder, latitude - previousLatitude)
+    encodePolylineValue(&builder, longitude - previousLongitude)
+    previousLatitude, previousLongitude = latitude, longitude
+  }
+  return builder.String()
+}
+
+// roundCoordinate rounds a coordinate to the five decimal places that encoded polylines keep.
+func roundCoordinate(coordinate float64) int {
+  if coordinate < 0 {
+    return int(coordinate * 1e5 - 0.5)
+  }
+  return int(coordinate * 1e5 + 0.5)
+}
+
+// encodePolylineValue encodes a single delta of an encoded polyline.
+func encodePolylineValue(builder *strings.Builder, value int) {
+  shifted := value << 1
+  if value < 0 {
+    shifted = ^shifted
+  }
+  for shifted >= 0x20 {
+    builder.WriteByte(byte((0x20 | (shifted & 0x1f)) + 63))
+    shifted >>= 5
+  }
+  builder.WriteByte(byte(shifted + 63))
+}
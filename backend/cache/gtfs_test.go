@@ -0,0 +1,121 @@
+package main
+
+import (
+  "archive/zip"
+  "fmt"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+// writeTestFeed writes a GTFS static feed zip with the provided files, and returns its path.
+func writeTestFeed(t *testing.T, files map[string]string) string {
+  t.Helper()
+
+  path := filepath.Join(t.TempDir(), "feed.zip")
+  file, err := os.Create(path)
+  if err != nil {
+    t.Fatalf("Error creating feed: %v", err)
+  }
+  defer file.Close()
+
+  archive := zip.NewWriter(file)
+  for name, contents := range files {
+    writer, err := archive.Create(name)
+    if err != nil {
+      t.Fatalf("Error creating %s: %v", name, err)
+    }
+    if _, err := writer.Write([]byte(contents)); err != nil {
+      t.Fatalf("Error writing %s: %v", name, err)
+    }
+  }
+  if err := archive.Close(); err != nil {
+    t.Fatalf("Error closing feed: %v", err)
+  }
+
+  return path
+}
+
+// testFeedFiles returns a feed of a single direction of a route, with a full trip, a short turn
+// that numbers its stops from 1 partway along the line, and a branch trip.
+func testFeedFiles() map[string]string {
+  return map[string]string{
+    "routes.txt": "route_id,route_type,route_color,route_short_name,route_long_name\n" +
+      "Red,1,DA291C,,Red Line\n",
+    "trips.txt": "route_id,trip_id,direction_id,shape_id\n" +
+      "Red,full,0,shape\n" +
+      "Red,short,0,shape\n" +
+      "Red,branch,0,shape\n",
+    "stop_times.txt": "trip_id,stop_id,stop_sequence\n" +
+      "full,A,10\nfull,B,20\nfull,C,30\nfull,D,40\n" +
+      "short,C,1\nshort,D,2\n" +
+      "branch,A,1\nbranch,B,2\nbranch,E,3\n",
+    "stops.txt": "stop_id,stop_name,stop_lat,stop_lon,parent_station,platform_code\n" +
+      "A,A,42.1,-71.1,,\nB,B,42.2,-71.1,,\nC,C,42.3,-71.1,,\nD,D,42.4,-71.1,,\n" +
+      "E,E,42.3,-71.2,,\n",
+    "shapes.txt": "shape_id,shape_pt_lat,shape_pt_lon,shape_pt_sequence\n" +
+      "shape,42.1,-71.1,1\nshape,42.4,-71.1,2\n",
+  }
+}
+
+// stopOrder returns the stop IDs of route stops in order.
+func stopOrder(routeStops []RouteStop) string {
+  var stopIDs []string
+  for i, routeStop := range routeStops {
+    if routeStop.StopSequence != i + 1 {
+      return fmt.Sprintf("stop %s out of sequence at %d", routeStop.StopID, routeStop.StopSequence)
+    }
+    stopIDs = append(stopIDs, routeStop.StopID)
+  }
+  return fmt.Sprint(stopIDs)
+}
+
+func TestLoadGTFSOrdersStopsByLongestTrip(t *testing.T) {
+  network, err := loadGTFS(writeTestFeed(t, testFeedFiles()), []RouteConfig{ { ID: "Red" } })
+  if err != nil {
+    t.Fatalf("Expected the feed to load, got %v", err)
+  }
+
+  // The short turn's low sequences don't move C and D ahead of the stops before them
+  expected := fmt.Sprint([]string{ "A", "B", "C", "D", "E" })
+  if actual := stopOrder(network.RouteStops); actual != expected {
+    t.Errorf("Expected stops to be ordered %s, got %s", expected, actual)
+  }
+}
+
+func TestLoadGTFSOrdersStopsByTypicalRoutePatterns(t *testing.T) {
+  files := testFeedFiles()
+  files["route_patterns.txt"] = "route_pattern_id,route_id,direction_id," +
+    "route_pattern_typicality,route_pattern_sort_order,representative_trip_id\n" +
+    "Red-full,Red,0,1,20,full\n" +
+    "Red-branch,Red,0,1,10,branch\n" +
+    "Red-short,Red,0,3,30,short\n"
+
+  network, err := loadGTFS(writeTestFeed(t, files), []RouteConfig{ { ID: "Red" } })
+  if err != nil {
+    t.Fatalf("Expected the feed to load, got %v", err)
+  }
+
+  expected := fmt.Sprint([]string{ "A", "B", "E", "C", "D" })
+  if actual := stopOrder(network.RouteStops); actual != expected {
+    t.Errorf("Expected stops to be ordered %s, got %s", expected, actual)
+  }
+}
+
+func TestOrderRouteStopsAppendsStopsMissingFromRepresentativeTrip(t *testing.T) {
+  routeStops := orderRouteStops("Red", 1, [][]string{
+    { "A", "B", "C" },
+    { "C", "D" },
+    { "A", "E", "F" },
+  })
+
+  expected := fmt.Sprint([]string{ "A", "B", "C", "D", "E", "F" })
+  if actual := stopOrder(routeStops); actual != expected {
+    t.Errorf("Expected stops to be ordered %s, got %s", expected, actual)
+  }
+  for _, routeStop := range routeStops {
+    if routeStop.RouteID != "Red" || routeStop.DirectionID != 1 {
+      t.Errorf("Expected every stop to be on Red in direction 1, got %v", routeStop)
+    }
+  }
+}
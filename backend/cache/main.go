@@ -1,10 +1,12 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
   "log"
 	"os"
+	"sort"
 	"strings"
 
   "database/sql"
@@ -12,15 +14,36 @@ import (
 	"net/http"
 
 	"github.com/joho/godotenv"
-  _ "github.com/lib/pq"
+  "github.com/lib/pq"
 )
 
 type RoutesResponse struct {
+  Data     []RouteData    `json:"data"`
   Included []RoutePattern `json:"included"`
 }
 
+type RouteData struct {
+  ID         string          `json:"id"`
+  Attributes RouteAttributes `json:"attributes"`
+}
+
+type RouteAttributes struct {
+  Type                  int      `json:"type"`
+  Color                 string   `json:"color"`
+  ShortName             string   `json:"short_name"`
+  LongName              string   `json:"long_name"`
+  DirectionNames        []string `json:"direction_names"`
+  DirectionDestinations []string `json:"direction_destinations"`
+}
+
 type RoutePattern struct {
-  Relationship Relationship `json:"relationships"`
+  Attributes   RoutePatternAttributes `json:"attributes"`
+  Relationship Relationship           `json:"relationships"`
+}
+
+type RoutePatternAttributes struct {
+  Typicality int `json:"typicality"`
+  SortOrder  int `json:"sort_order"`
 }
 
 type Relationship struct {
@@ -36,13 +59,37 @@ type RepresentativeTripData struct {
 }
 
 type TripsResponse struct {
-  Included []Entity `json:"included"`
+  Data     []TripData `json:"data"`
+  Included []Entity   `json:"included"`
+}
+
+type TripData struct {
+  ID            string            `json:"id"`
+  Attributes    TripAttributes    `json:"attributes"`
+  Relationships TripRelationships `json:"relationships"`
+}
+
+type TripAttributes struct {
+  DirectionID int `json:"direction_id"`
+}
+
+type TripRelationships struct {
+  Stops TripStops `json:"stops"`
+}
+
+type TripStops struct {
+  Data []TripStopData `json:"data"`
+}
+
+type TripStopData struct {
+  ID string `json:"id"`
 }
 
 type Entity struct {
-  ID         string          `json:"id"`
-  Type       string          `json:"type"`
-  Attributes json.RawMessage `json:"attributes"`
+  ID            string          `json:"id"`
+  Type          string          `json:"type"`
+  Attributes    json.RawMessage `json:"attributes"`
+  Relationships json.RawMessage `json:"relationships"`
 }
 
 type ShapeAttributes struct {
@@ -50,15 +97,31 @@ type ShapeAttributes struct {
 }
 
 type StopAttributes struct {
-  Latitude  float64 `json:"latitude"`
-  Longitude float64 `json:"longitude"`
-  Name      string  `json:"name"`
+  Latitude     float64 `json:"latitude"`
+  Longitude    float64 `json:"longitude"`
+  Name         string  `json:"name"`
+  PlatformCode string  `json:"platform_code"`
 }
 
-type Route struct {
+type StopRelationships struct {
+  ParentStation ParentStation `json:"parent_station"`
+}
+
+type ParentStation struct {
+  Data *ParentStationData `json:"data"`
+}
+
+type ParentStationData struct {
   ID string `json:"id"`
 }
 
+type Route struct {
+  ID          string `json:"id"`
+  Type        int    `json:"type"`
+  Color       string `json:"color"`
+  DisplayName string `json:"display_name"`
+}
+
 type Shape struct {
   ID          string      `json:"id"`
   RouteID     string      `json:"route_id"`
@@ -66,40 +129,55 @@ type Shape struct {
 }
 
 type Stop struct {
-  ID         string    `json:"id"`
-  RouteID    string    `json:"route_id"`
-  Name       string    `json:"name"`
-  Latitude   float64   `json:"latitude"`
-  Longitude  float64   `json:"longitude"`
+  ID            string    `json:"id"`
+  RouteID       string    `json:"route_id"`
+  Name          string    `json:"name"`
+  Latitude      float64   `json:"latitude"`
+  Longitude     float64   `json:"longitude"`
+  ParentStation string    `json:"parent_station"`
+  PlatformCode  string    `json:"platform_code"`
 }
 
-const V3Api string = "https://api-v3.mbta.com"
+// A RouteStop represents where a stop falls along a route in one direction.
+type RouteStop struct {
+  RouteID      string `json:"route_id"`
+  DirectionID  int    `json:"direction_id"`
+  StopID       string `json:"stop_id"`
+  StopSequence int    `json:"stop_sequence"`
+}
 
-func routeIDs() []string {
-  return []string {
-    "Red",
-    "Mattapan",
-    "Orange",
-    "Green-B",
-    "Green-C",
-    "Green-D",
-    "Green-E",
-    "Blue",
-  }
+// A RouteDirection represents one of the two directions of a route, like "South" towards
+// "Ashmont/Braintree".
+type RouteDirection struct {
+  RouteID     string `json:"route_id"`
+  DirectionID int    `json:"direction_id"`
+  Name        string `json:"name"`
+  Destination string `json:"destination"`
 }
 
-func main() {
-  err := godotenv.Load()
-  if err != nil {
-    panic(fmt.Sprintf("Error loading .env file: %v", err))
-  }
+// A Network represents everything the loader loads.
+type Network struct {
+  Routes          []Route
+  Shapes          []Shape
+  Stops           []Stop
+  RouteStops      []RouteStop
+  RouteDirections []RouteDirection
+}
+
+const V3Api string = "https://api-v3.mbta.com"
+
+// fetchFromV3 fetches every route, along with the shapes and stops of its representative trips,
+// from the V3 API.
+//
+// Where stops fall along a route is taken from the representative trips of its typical route
+// patterns, in their sort order. See orderRouteStops.
+func fetchFromV3(configs []RouteConfig) *Network {
   apiKey, apiKeyExists := os.LookupEnv("V3_API_KEY")
 
+  network := &Network{}
   client := http.Client{}
-  var routes []Route
-  var shapes []Shape
-  var stops []Stop
-  for _, routeID := range routeIDs() {
+  for _, config := range configs {
+    routeID := config.ID
     req, err := http.NewRequest("GET", fmt.Sprintf("%s/routes", V3Api), nil)
     if err != nil {
       panic(fmt.Sprintf("Error creating HTTP request to routes endpoint: %v", err))
@@ -109,7 +187,10 @@ func main() {
       req.Header.Add("x-api-key", apiKey)
     }
     query := req.URL.Query()
-    query.Add("fields[route]", "id")
+    query.Add(
+      "fields[route]",
+      "type,color,short_name,long_name,direction_names,direction_destinations",
+    )
     query.Add("include", "route_patterns")
     query.Add("filter[id]", routeID)
     req.URL.RawQuery = query.Encode()
@@ -129,8 +210,17 @@ func main() {
     var tripIDs []string
     var routesRes RoutesResponse
     json.Unmarshal(body, &routesRes)
+    if len(routesRes.Data) == 0 {
+      panic(fmt.Sprintf("Route %s doesn't exist", routeID))
+    }
+    routeAttr := routesRes.Data[0].Attributes
+    typicalRanks := make(map[string]int)
     for _, routePattern := range routesRes.Included {
-      tripIDs = append(tripIDs, routePattern.Relationship.RepresentativeTrip.Data.ID)
+      tripID := routePattern.Relationship.RepresentativeTrip.Data.ID
+      tripIDs = append(tripIDs, tripID)
+      if routePattern.Attributes.Typicality == 1 {
+        typicalRanks[tripID] = routePattern.Attributes.SortOrder
+      }
     }
 
     log.Println("Fetching accumulated trips")
@@ -157,18 +247,59 @@ func main() {
     }
     res.Body.Close()
 
-    routes = append(routes, Route {
+    network.Routes = append(network.Routes, Route {
       ID: routeID,
+      Type: routeAttr.Type,
+      Color: routeAttr.Color,
+      DisplayName: displayName(config, routeAttr.Type, routeAttr.ShortName, routeAttr.LongName),
     })
 
+    for directionID := 0; directionID < len(routeAttr.DirectionNames); directionID++ {
+      var destination string
+      if directionID < len(routeAttr.DirectionDestinations) {
+        destination = routeAttr.DirectionDestinations[directionID]
+      }
+      network.RouteDirections = append(network.RouteDirections, RouteDirection {
+        RouteID: routeID,
+        DirectionID: directionID,
+        Name: routeAttr.DirectionNames[directionID],
+        Destination: destination,
+      })
+    }
+
     var tripsRes TripsResponse
     json.Unmarshal(body, &tripsRes)
+
+    typicalTrips := make(map[int][]TripData)
+    for _, trip := range tripsRes.Data {
+      if _, ok := typicalRanks[trip.ID]; ok {
+        directionID := trip.Attributes.DirectionID
+        typicalTrips[directionID] = append(typicalTrips[directionID], trip)
+      }
+    }
+    for directionID, trips := range typicalTrips {
+      sort.Slice(trips, func(i, j int) bool {
+        return typicalRanks[trips[i].ID] < typicalRanks[trips[j].ID]
+      })
+
+      orderedTrips := make([][]string, len(trips))
+      for i, trip := range trips {
+        for _, stop := range trip.Relationships.Stops.Data {
+          orderedTrips[i] = append(orderedTrips[i], stop.ID)
+        }
+      }
+      network.RouteStops = append(
+        network.RouteStops,
+        orderRouteStops(routeID, directionID, orderedTrips)...,
+      )
+    }
+
     for _, entity := range tripsRes.Included {
       switch entity.Type {
       case "shape":
         var shapeAttr ShapeAttributes
         json.Unmarshal(entity.Attributes, &shapeAttr);
-        shapes = append(shapes, Shape {
+        network.Shapes = append(network.Shapes, Shape {
           ID: entity.ID,
           RouteID: routeID,
           Polyline: shapeAttr.Polyline,
@@ -176,17 +307,58 @@ func main() {
       case "stop":
         var stopAttr StopAttributes
         json.Unmarshal(entity.Attributes, &stopAttr)
-        stops = append(stops, Stop {
+        var stopRel StopRelationships
+        json.Unmarshal(entity.Relationships, &stopRel)
+        var parentStation string
+        if stopRel.ParentStation.Data != nil {
+          parentStation = stopRel.ParentStation.Data.ID
+        }
+        network.Stops = append(network.Stops, Stop {
           ID: entity.ID,
           RouteID: routeID,
           Name: stopAttr.Name,
           Latitude: stopAttr.Latitude,
           Longitude: stopAttr.Longitude,
+          ParentStation: parentStation,
+          PlatformCode: stopAttr.PlatformCode,
         })
       }
     }
   }
 
+  sortRouteStops(network.RouteStops)
+  return network
+}
+
+func main() {
+  gtfsPath := flag.String(
+    "gtfs",
+    "",
+    "Path to a GTFS static feed zip to load instead of fetching from the V3 API",
+  )
+  flag.Parse()
+
+  err := godotenv.Load()
+  if err != nil {
+    panic(fmt.Sprintf("Error loading .env file: %v", err))
+  }
+
+  configs, err := loadRouteConfigs()
+  if err != nil {
+    panic(fmt.Sprintf("Error loading route config: %v", err))
+  }
+
+  var network *Network
+  if *gtfsPath != "" {
+    log.Println(fmt.Sprintf("Loading GTFS static feed %s", *gtfsPath))
+    network, err = loadGTFS(*gtfsPath, configs)
+    if err != nil {
+      panic(fmt.Sprintf("Error loading GTFS static feed: %v", err))
+    }
+  } else {
+    network = fetchFromV3(configs)
+  }
+
   source := fmt.Sprintf(
     "host=%s port=%s dbname=%s password=%s user=%s sslmode=disable",
     os.Getenv("POSTGRES_HOST"),
@@ -201,100 +373,218 @@ func main() {
   }
   defer db.Close()
 
+  tx, err := db.Begin()
+  if err != nil {
+    panic(fmt.Sprintf("Error beginning transaction: %v", err))
+  }
+  defer func() {
+    if tx != nil {
+      tx.Rollback()
+    }
+  }()
+
+  // Everything is cleared and reinserted in one transaction, so the API keeps serving the previous
+  // network until the new one is committed
   log.Println("Clearing existing cache")
-  _, err = db.Exec("DELETE FROM route")
+  _, err = tx.Exec("DELETE FROM route")
   if err != nil {
     panic(fmt.Sprintf("Error clearing route table: %v", err))
   }
 
-  _, err = db.Exec("DELETE FROM shape")
+  _, err = tx.Exec("DELETE FROM shape")
   if err != nil {
     panic(fmt.Sprintf("Error clearing shape table: %v", err))
   }
 
-  _, err = db.Exec("DELETE FROM stop")
+  _, err = tx.Exec("DELETE FROM stop")
   if err != nil {
     panic(fmt.Sprintf("Error clearing stop table: %v", err))
   }
 
-  if len(routes) > 0 {
-    log.Println("Inserting routes into cache")
-    statement := "INSERT INTO route (id) VALUES "
-    var values []string
-    for _, route := range routes {
-      values = append(
-        values,
-        fmt.Sprintf("('%s')", route.ID),
-      )
-    }
-    statement += strings.Join(values, ", ")
+  _, err = tx.Exec("DELETE FROM route_stop")
+  if err != nil {
+    panic(fmt.Sprintf("Error clearing route stop table: %v", err))
+  }
 
-    prepared, err := db.Prepare(statement)
-    if err != nil {
-      panic(fmt.Sprintf("Error preparing routes statement: %v", err))
-    }
-    _, err = prepared.Exec()
-    if err != nil {
-      panic(fmt.Sprintf("Error inserting routes: %v", err))
-    }
-  } else {
-    log.Println("No routes to insert")
+  _, err = tx.Exec("DELETE FROM route_direction")
+  if err != nil {
+    panic(fmt.Sprintf("Error clearing route direction table: %v", err))
   }
 
-  if len(shapes) > 0 {
-    log.Println("Inserting shapes into cache")
-    statement := "INSERT INTO shape (id, route_id, polyline) VALUES "
-    var values []string
-    for _, shape := range shapes {
-      values = append(
-        values,
-        fmt.Sprintf("('%s', '%s', '%s')", shape.ID, shape.RouteID, shape.Polyline),
-      )
-    }
-    statement += strings.Join(values, ", ")
+  log.Println(fmt.Sprintf("Inserting %d routes into cache", len(network.Routes)))
+  if err = insertRoutes(tx, network.Routes); err != nil {
+    panic(err.Error())
+  }
 
-    prepared, err := db.Prepare(statement)
-    if err != nil {
-      panic(fmt.Sprintf("Error preparing shapes statement: %v", err))
-    }
-    _, err = prepared.Exec()
-    if err != nil {
-      panic(fmt.Sprintf("Error inserting shapes: %v", err))
-    }
-  } else {
-    log.Println("No shapes to insert")
+  log.Println(fmt.Sprintf("Inserting %d shapes into cache", len(network.Shapes)))
+  if err = insertShapes(tx, network.Shapes); err != nil {
+    panic(err.Error())
   }
 
-  if len(stops) > 0 {
-    log.Println("Inserting stops into cache")
-    statement := "INSERT INTO stop (id, route_id, name, latitude, longitude) VALUES "
-    var values []string
-    for _, stop := range stops {
-      values = append(
-        values,
-        fmt.Sprintf(
-          "('%s', '%s', $$%s$$, %f, %f)",
-          stop.ID,
-          stop.RouteID,
-          stop.Name,
-          stop.Latitude,
-          stop.Longitude,
-        ),
-      )
-    }
-    statement += strings.Join(values, ", ")
+  log.Println(fmt.Sprintf("Inserting %d stops into cache", len(network.Stops)))
+  if err = insertStops(tx, network.Stops); err != nil {
+    panic(err.Error())
+  }
 
-    prepared, err := db.Prepare(statement)
-    if err != nil {
-      panic(fmt.Sprintf("Error preparing stops statement: %v", err))
-    }
-    _, err = prepared.Exec() 
-    if err != nil {
-      panic(fmt.Sprintf("Error inserting stops: %v", err))
-    }
-  } else {
-    log.Println("No stops to insert")
+  log.Println(fmt.Sprintf("Inserting %d route stops into cache", len(network.RouteStops)))
+  if err = insertRouteStops(tx, network.RouteStops); err != nil {
+    panic(err.Error())
+  }
+
+  log.Println(fmt.Sprintf(
+    "Inserting %d route directions into cache",
+    len(network.RouteDirections),
+  ))
+  if err = insertRouteDirections(tx, network.RouteDirections); err != nil {
+    panic(err.Error())
+  }
+
+  if err = tx.Commit(); err != nil {
+    panic(fmt.Sprintf("Error committing transaction: %v", err))
   }
+  tx = nil
 
   log.Println("Done!")
 }
+
+// insertRoutes inserts routes, keeping the order they're provided in as their sort order.
+func insertRoutes(tx *sql.Tx, routes []Route) error {
+  var paramIDs []string = []string{}
+  var paramTypes []int = []int{}
+  var paramColors []string = []string{}
+  var paramDisplayNames []string = []string{}
+  var paramSortOrders []int = []int{}
+  for i, route := range routes {
+    paramIDs = append(paramIDs, route.ID)
+    paramTypes = append(paramTypes, route.Type)
+    paramColors = append(paramColors, route.Color)
+    paramDisplayNames = append(paramDisplayNames, route.DisplayName)
+    paramSortOrders = append(paramSortOrders, i)
+  }
+
+  _, err := tx.Exec(
+    "INSERT INTO route (id, type, color, display_name, sort_order) SELECT unnest($1::text[]), " +
+      "unnest($2::int[]), unnest($3::text[]), unnest($4::text[]), unnest($5::int[])",
+    pq.Array(paramIDs),
+    pq.Array(paramTypes),
+    pq.Array(paramColors),
+    pq.Array(paramDisplayNames),
+    pq.Array(paramSortOrders),
+  )
+  if err != nil {
+    return fmt.Errorf("Error inserting routes: %w", err)
+  }
+  return nil
+}
+
+func insertShapes(tx *sql.Tx, shapes []Shape) error {
+  var paramIDs []string = []string{}
+  var paramRouteIDs []string = []string{}
+  var paramPolylines []string = []string{}
+  for _, shape := range shapes {
+    paramIDs = append(paramIDs, shape.ID)
+    paramRouteIDs = append(paramRouteIDs, shape.RouteID)
+    paramPolylines = append(paramPolylines, shape.Polyline)
+  }
+
+  _, err := tx.Exec(
+    "INSERT INTO shape (id, route_id, polyline) SELECT unnest($1::text[]), unnest($2::text[]), " +
+      "unnest($3::text[])",
+    pq.Array(paramIDs),
+    pq.Array(paramRouteIDs),
+    pq.Array(paramPolylines),
+  )
+  if err != nil {
+    return fmt.Errorf("Error inserting shapes: %w", err)
+  }
+  return nil
+}
+
+func insertStops(tx *sql.Tx, stops []Stop) error {
+  var paramIDs []string = []string{}
+  var paramRouteIDs []string = []string{}
+  var paramNames []string = []string{}
+  var paramLatitudes []float64 = []float64{}
+  var paramLongitudes []float64 = []float64{}
+  var paramParentStations []string = []string{}
+  var paramPlatformCodes []string = []string{}
+  for _, stop := range stops {
+    paramIDs = append(paramIDs, stop.ID)
+    paramRouteIDs = append(paramRouteIDs, stop.RouteID)
+    paramNames = append(paramNames, stop.Name)
+    paramLatitudes = append(paramLatitudes, stop.Latitude)
+    paramLongitudes = append(paramLongitudes, stop.Longitude)
+    paramParentStations = append(paramParentStations, stop.ParentStation)
+    paramPlatformCodes = append(paramPlatformCodes, stop.PlatformCode)
+  }
+
+  _, err := tx.Exec(
+    "INSERT INTO stop (id, route_id, name, latitude, longitude, parent_station, platform_code) " +
+      "SELECT unnest($1::text[]), unnest($2::text[]), unnest($3::text[]), " +
+      "unnest($4::double precision[]), unnest($5::double precision[]), unnest($6::text[]), " +
+      "unnest($7::text[])",
+    pq.Array(paramIDs),
+    pq.Array(paramRouteIDs),
+    pq.Array(paramNames),
+    pq.Array(paramLatitudes),
+    pq.Array(paramLongitudes),
+    pq.Array(paramParentStations),
+    pq.Array(paramPlatformCodes),
+  )
+  if err != nil {
+    return fmt.Errorf("Error inserting stops: %w", err)
+  }
+  return nil
+}
+
+func insertRouteStops(tx *sql.Tx, routeStops []RouteStop) error {
+  var paramRouteIDs []string = []string{}
+  var paramDirections []bool = []bool{}
+  var paramStopIDs []string = []string{}
+  var paramStopSequences []int = []int{}
+  for _, routeStop := range routeStops {
+    paramRouteIDs = append(paramRouteIDs, routeStop.RouteID)
+    paramDirections = append(paramDirections, routeStop.DirectionID == 1)
+    paramStopIDs = append(paramStopIDs, routeStop.StopID)
+    paramStopSequences = append(paramStopSequences, routeStop.StopSequence)
+  }
+
+  _, err := tx.Exec(
+    "INSERT INTO route_stop (route_id, direction, stop_id, stop_sequence) SELECT " +
+      "unnest($1::text[]), unnest($2::boolean[]), unnest($3::text[]), unnest($4::int[])",
+    pq.Array(paramRouteIDs),
+    pq.Array(paramDirections),
+    pq.Array(paramStopIDs),
+    pq.Array(paramStopSequences),
+  )
+  if err != nil {
+    return fmt.Errorf("Error inserting route stops: %w", err)
+  }
+  return nil
+}
+
+func insertRouteDirections(tx *sql.Tx, routeDirections []RouteDirection) error {
+  var paramRouteIDs []string = []string{}
+  var paramDirections []bool = []bool{}
+  var paramNames []string = []string{}
+  var paramDestinations []string = []string{}
+  for _, routeDirection := range routeDirections {
+    paramRouteIDs = append(paramRouteIDs, routeDirection.RouteID)
+    paramDirections = append(paramDirections, routeDirection.DirectionID == 1)
+    paramNames = append(paramNames, routeDirection.Name)
+    paramDestinations = append(paramDestinations, routeDirection.Destination)
+  }
+
+  _, err := tx.Exec(
+    "INSERT INTO route_direction (route_id, direction, name, destination) SELECT " +
+      "unnest($1::text[]), unnest($2::boolean[]), unnest($3::text[]), unnest($4::text[])",
+    pq.Array(paramRouteIDs),
+    pq.Array(paramDirections),
+    pq.Array(paramNames),
+    pq.Array(paramDestinations),
+  )
+  if err != nil {
+    return fmt.Errorf("Error inserting route directions: %w", err)
+  }
+  return nil
+}
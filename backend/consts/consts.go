@@ -1,14 +1,42 @@
 package consts
 
+import "time"
+
 const (
 	ApiPerformance string = "https://performanceapi.mbta.com/developer/api/v2.1"
 	MaxDays        int    = 30
-	Red            string = "Red"
-	Mattapan       string = "Mattapan"
-	Orange         string = "Orange"
-	GreenB         string = "Green-B"
-	GreenC         string = "Green-C"
-	GreenD         string = "Green-D"
-	GreenE         string = "Green-E"
-	Blue           string = "Blue"
+	MaxQueryDays   int    = 90
+	KeepForever    int    = 0
+	FetchWorkers   int    = 8
+)
+
+// Coalesced cache calls are shared by every request waiting on them, so they're only cancelled
+// once every one of those requests is, and are otherwise given up on after this long.
+const CoalescedCallTimeout time.Duration = 10 * time.Minute
+
+const (
+	// A headway is gapped if it's more than this many times as long as its benchmark, and adheres
+	// to it if it's neither gapped nor bunched.
+	HeadwayAdherenceFactor float64 = 1.5
+
+	// A headway is bunched if it's at most this many times as long as its benchmark.
+	HeadwayBunchingFactor float64 = 0.5
+
+	// A travel time exceeds its benchmark if it's more than this percent longer than it.
+	TravelTimeExceedancePct float64 = 20
+
+	// A dwell is an outlier if it's more than this many scaled median absolute deviations from
+	// the median dwell.
+	DwellOutlierMADThreshold float64 = 3
+
+	// A dwell is an outlier if it's more than this many interquartile ranges outside the middle
+	// half of dwells.
+	DwellOutlierIQRThreshold float64 = 1.5
+
+	// Dwells aren't checked for outliers unless their baseline has at least this many dwells.
+	DwellOutlierMinSamples int = 10
+
+	// Service days start and end at this hour in EST, so late night trips count towards the
+	// previous day.
+	ServiceDayStartHour int = 3
 )
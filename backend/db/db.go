@@ -0,0 +1,86 @@
+package db
+
+import (
+  "fmt"
+  "strings"
+)
+
+// A NaturalKey represents the columns that uniquely identify the rows of a cached table.
+//
+// Duplicates keep the row with the latest Latest column if it's set, and otherwise whichever row
+// is stored last.
+type NaturalKey struct {
+  Table   string
+  Columns []string
+  Latest  string
+}
+
+// NaturalKeys are the natural keys of every cached table, in the order that their duplicates are
+// removed.
+//
+// The natural keys migration keeps a copy of the statements for the tables that existed before it,
+// since migrations can't refer to code.
+var NaturalKeys []NaturalKey = []NaturalKey{
+  { Table: "headway", Columns: []string{ "stop_id", "route_id", "direction", "current_dep_dt" } },
+  { Table: "dwell", Columns: []string{ "stop_id", "route_id", "direction", "arr_dt" } },
+  {
+    Table: "travel_time",
+    Columns: []string{ "from_stop_id", "to_stop_id", "route_id", "direction", "dep_dt" },
+  },
+  {
+    Table: "last_headway_cache_datetime",
+    Columns: []string{ "stop_id", "route_id" },
+    Latest: "value",
+  },
+  {
+    Table: "last_dwell_cache_datetime",
+    Columns: []string{ "stop_id", "route_id" },
+    Latest: "value",
+  },
+  {
+    Table: "last_travel_time_cache_datetime",
+    Columns: []string{ "from_stop_id", "to_stop_id", "route_id" },
+    Latest: "value",
+  },
+  {
+    Table: "event",
+    Columns: []string{ "stop_id", "route_id", "trip_id", "event_type", "event_dt" },
+  },
+  {
+    Table: "last_event_cache_datetime",
+    Columns: []string{ "stop_id", "route_id" },
+    Latest: "value",
+  },
+  { Table: "daily_metric", Columns: []string{ "route_id", "service_date", "threshold_id" } },
+  { Table: "last_daily_metric_cache_datetime", Columns: []string{ "route_id" }, Latest: "value" },
+  { Table: "alert_active_period", Columns: []string{ "alert_id", "start_dt" } },
+  { Table: "alert_informed_entity", Columns: []string{ "alert_id", "route_id", "stop_id" } },
+  { Table: "last_alert_cache_datetime", Columns: []string{ "route_id" }, Latest: "value" },
+}
+
+// DedupeStatement returns a statement that deletes every row of the key's table that duplicates
+// another row's natural key, keeping one row for each.
+func (k NaturalKey) DedupeStatement() string {
+  kept := "a.ctid < b.ctid"
+  if k.Latest != "" {
+    kept = fmt.Sprintf(
+      "(a.%s < b.%s OR (a.%s = b.%s AND a.ctid < b.ctid))",
+      k.Latest,
+      k.Latest,
+      k.Latest,
+      k.Latest,
+    )
+  }
+
+  conditions := []string{ kept }
+  for _, column := range k.Columns {
+    conditions = append(conditions, fmt.Sprintf("a.%s = b.%s", column, column))
+  }
+
+  return fmt.Sprintf(
+    "DELETE FROM %s a USING %s b WHERE %s",
+    k.Table,
+    k.Table,
+    strings.Join(conditions, " AND "),
+  )
+}
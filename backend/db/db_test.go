@@ -0,0 +1,44 @@
+package db
+
+import (
+  "os"
+  "strings"
+  "testing"
+)
+
+func TestNaturalKeysMigrationCopiesDedupeStatements(t *testing.T) {
+  migration, err := os.ReadFile("migrations/20231010120000_add_natural_keys.sql")
+  if err != nil {
+    t.Fatalf("Error reading natural keys migration: %v", err)
+  }
+  up := strings.Join(strings.Fields(strings.Split(string(migration), "-- migrate:down")[0]), " ")
+
+  // Only the tables that existed before the migration are deduped by it
+  copied := map[string]bool{
+    "headway": true,
+    "dwell": true,
+    "travel_time": true,
+    "last_headway_cache_datetime": true,
+    "last_dwell_cache_datetime": true,
+    "last_travel_time_cache_datetime": true,
+  }
+  for _, key := range NaturalKeys {
+    if copied[key.Table] && !strings.Contains(up, key.DedupeStatement()+";") {
+      t.Errorf("Expected the migration to copy the dedupe statement of %s", key.Table)
+    }
+  }
+}
+
+func TestNaturalKeysAreUnique(t *testing.T) {
+  seen := make(map[string]bool)
+  for _, key := range NaturalKeys {
+    if seen[key.Table] {
+      t.Errorf("Expected %s to have one natural key, got more", key.Table)
+    }
+    seen[key.Table] = true
+
+    if len(key.Columns) == 0 {
+      t.Errorf("Expected %s's natural key to have columns", key.Table)
+    }
+  }
+}
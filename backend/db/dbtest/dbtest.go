@@ -0,0 +1,224 @@
+package dbtest
+
+import (
+  "context"
+  "database/sql"
+  "database/sql/driver"
+  "errors"
+  "fmt"
+  "io"
+  "regexp"
+  "strconv"
+  "sync"
+  "testing"
+)
+
+// A Query represents a query run against a fake database, along with its arguments.
+type Query struct {
+  SQL  string
+  Args []driver.Value
+}
+
+// A Recorder represents a fake database that records every query run against it, and returns no
+// rows from any of them unless rows were queued with Return.
+//
+// It lets tests check the SQL that code generates without a Postgres to run it against.
+type Recorder struct {
+  mu      sync.Mutex
+  queries []Query
+  results [][][]driver.Value
+}
+
+// Open opens a fake database that records every query run against it.
+func Open() (*sql.DB, *Recorder) {
+  recorder := &Recorder{}
+  return sql.OpenDB(&connector{ recorder: recorder }), recorder
+}
+
+// Begin opens a fake database and begins a transaction on it, closing both once the test is done.
+func Begin(t *testing.T) (*sql.Tx, *Recorder) {
+  t.Helper()
+
+  db, recorder := Open()
+  tx, err := db.Begin()
+  if err != nil {
+    t.Fatalf("Error beginning transaction: %v", err)
+  }
+  t.Cleanup(func() {
+    tx.Rollback()
+    db.Close()
+  })
+  return tx, recorder
+}
+
+// Return queues rows for a query to return. Every query returns the next queued rows, or none once
+// they run out.
+func (r *Recorder) Return(values ...[]driver.Value) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  r.results = append(r.results, values)
+}
+
+// Queries returns every query run so far, in order.
+func (r *Recorder) Queries() []Query {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  return append([]Query{}, r.queries...)
+}
+
+// Only returns the only query run so far, failing the test if there wasn't exactly one.
+func (r *Recorder) Only(t *testing.T) Query {
+  t.Helper()
+
+  queries := r.Queries()
+  if len(queries) != 1 {
+    t.Fatalf("Expected exactly one query, got %d", len(queries))
+  }
+  return queries[0]
+}
+
+var placeholderPattern *regexp.Regexp = regexp.MustCompile(`\$(\d+)`)
+
+// CheckPlaceholders fails the test unless a query uses every one of its arguments' placeholders,
+// and none without an argument.
+func CheckPlaceholders(t *testing.T, query Query) {
+  t.Helper()
+
+  used := make(map[int]bool)
+  for _, match := range placeholderPattern.FindAllStringSubmatch(query.SQL, -1) {
+    n, _ := strconv.Atoi(match[1])
+    used[n] = true
+    if n < 1 || n > len(query.Args) {
+      t.Errorf("Expected placeholders up to $%d, got $%d in %s", len(query.Args), n, query.SQL)
+    }
+  }
+  for n := 1; n <= len(query.Args); n++ {
+    if !used[n] {
+      t.Errorf("Expected argument $%d to be used in %s", n, query.SQL)
+    }
+  }
+}
+
+// Arg returns the argument of a query at a placeholder, like $3, failing the test if it doesn't
+// have one.
+func (q Query) Arg(t *testing.T, placeholder string) driver.Value {
+  t.Helper()
+
+  n, err := strconv.Atoi(placeholder[1:])
+  if err != nil || n < 1 || n > len(q.Args) {
+    t.Fatalf("Expected an argument at %s, got %d arguments", placeholder, len(q.Args))
+  }
+  return q.Args[n-1]
+}
+
+// String returns the query along with its arguments, for test failures.
+func (q Query) String() string {
+  return fmt.Sprintf("%s %v", q.SQL, q.Args)
+}
+
+type connector struct {
+  recorder *Recorder
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+  return &conn{ recorder: c.recorder }, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+  return fakeDriver{}
+}
+
+type fakeDriver struct{}
+
+func (d fakeDriver) Open(name string) (driver.Conn, error) {
+  return nil, errors.New("Fake databases must be opened with a connector")
+}
+
+type conn struct {
+  recorder *Recorder
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+  return &stmt{ recorder: c.recorder, query: query }, nil
+}
+
+func (c *conn) Close() error {
+  return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+  return tx{}, nil
+}
+
+type tx struct{}
+
+func (t tx) Commit() error {
+  return nil
+}
+
+func (t tx) Rollback() error {
+  return nil
+}
+
+type stmt struct {
+  recorder *Recorder
+  query    string
+}
+
+func (s *stmt) Close() error {
+  return nil
+}
+
+func (s *stmt) NumInput() int {
+  return -1
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+  s.record(args)
+  return driver.RowsAffected(0), nil
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+  s.record(args)
+
+  s.recorder.mu.Lock()
+  defer s.recorder.mu.Unlock()
+  if len(s.recorder.results) == 0 {
+    return &rows{}, nil
+  }
+  values := s.recorder.results[0]
+  s.recorder.results = s.recorder.results[1:]
+  return &rows{ values: values }, nil
+}
+
+func (s *stmt) record(args []driver.Value) {
+  s.recorder.mu.Lock()
+  defer s.recorder.mu.Unlock()
+  s.recorder.queries = append(s.recorder.queries, Query{ SQL: s.query, Args: args })
+}
+
+type rows struct {
+  values [][]driver.Value
+}
+
+// Columns returns unnamed columns, as many as the first row has, since rows are only scanned by
+// position.
+func (r *rows) Columns() []string {
+  if len(r.values) == 0 {
+    return nil
+  }
+  return make([]string, len(r.values[0]))
+}
+
+func (r *rows) Close() error {
+  return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+  if len(r.values) == 0 {
+    return io.EOF
+  }
+  copy(dest, r.values[0])
+  r.values = r.values[1:]
+  return nil
+}
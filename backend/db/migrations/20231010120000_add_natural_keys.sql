@@ -0,0 +1,73 @@
+-- migrate:up
+-- These statements are a copy of the dedupe statements of db.NaturalKeys, which the dedupe
+-- command runs.
+DELETE FROM headway a USING headway b
+WHERE a.ctid < b.ctid
+  AND a.stop_id = b.stop_id
+  AND a.route_id = b.route_id
+  AND a.direction = b.direction
+  AND a.current_dep_dt = b.current_dep_dt;
+
+DELETE FROM dwell a USING dwell b
+WHERE a.ctid < b.ctid
+  AND a.stop_id = b.stop_id
+  AND a.route_id = b.route_id
+  AND a.direction = b.direction
+  AND a.arr_dt = b.arr_dt;
+
+DELETE FROM travel_time a USING travel_time b
+WHERE a.ctid < b.ctid
+  AND a.from_stop_id = b.from_stop_id
+  AND a.to_stop_id = b.to_stop_id
+  AND a.route_id = b.route_id
+  AND a.direction = b.direction
+  AND a.dep_dt = b.dep_dt;
+
+DELETE FROM last_headway_cache_datetime a USING last_headway_cache_datetime b
+WHERE (a.value < b.value OR (a.value = b.value AND a.ctid < b.ctid))
+  AND a.stop_id = b.stop_id
+  AND a.route_id = b.route_id;
+
+DELETE FROM last_dwell_cache_datetime a USING last_dwell_cache_datetime b
+WHERE (a.value < b.value OR (a.value = b.value AND a.ctid < b.ctid))
+  AND a.stop_id = b.stop_id
+  AND a.route_id = b.route_id;
+
+DELETE FROM last_travel_time_cache_datetime a USING last_travel_time_cache_datetime b
+WHERE (a.value < b.value OR (a.value = b.value AND a.ctid < b.ctid))
+  AND a.from_stop_id = b.from_stop_id
+  AND a.to_stop_id = b.to_stop_id
+  AND a.route_id = b.route_id;
+
+ALTER TABLE headway
+  ADD CONSTRAINT headway_natural_key UNIQUE (stop_id, route_id, direction, current_dep_dt);
+
+ALTER TABLE dwell
+  ADD CONSTRAINT dwell_natural_key UNIQUE (stop_id, route_id, direction, arr_dt);
+
+ALTER TABLE travel_time
+  ADD CONSTRAINT travel_time_natural_key
+  UNIQUE (from_stop_id, to_stop_id, route_id, direction, dep_dt);
+
+ALTER TABLE last_headway_cache_datetime
+  ADD CONSTRAINT last_headway_cache_datetime_pkey PRIMARY KEY (stop_id, route_id);
+
+ALTER TABLE last_dwell_cache_datetime
+  ADD CONSTRAINT last_dwell_cache_datetime_pkey PRIMARY KEY (stop_id, route_id);
+
+ALTER TABLE last_travel_time_cache_datetime
+  ADD CONSTRAINT last_travel_time_cache_datetime_pkey
+  PRIMARY KEY (from_stop_id, to_stop_id, route_id);
+
+-- migrate:down
+ALTER TABLE last_travel_time_cache_datetime DROP CONSTRAINT last_travel_time_cache_datetime_pkey;
+
+ALTER TABLE last_dwell_cache_datetime DROP CONSTRAINT last_dwell_cache_datetime_pkey;
+
+ALTER TABLE last_headway_cache_datetime DROP CONSTRAINT last_headway_cache_datetime_pkey;
+
+ALTER TABLE travel_time DROP CONSTRAINT travel_time_natural_key;
+
+ALTER TABLE dwell DROP CONSTRAINT dwell_natural_key;
+
+ALTER TABLE headway DROP CONSTRAINT headway_natural_key;
@@ -0,0 +1,11 @@
+-- migrate:up
+CREATE TABLE IF NOT EXISTS backfill_cursor (
+  entity VARCHAR(255) NOT NULL,
+  route_id VARCHAR(255) NOT NULL,
+  key VARCHAR(511) NOT NULL,
+  value TIMESTAMP NOT NULL,
+  PRIMARY KEY (entity, route_id, key)
+);
+
+-- migrate:down
+DROP TABLE backfill_cursor;
@@ -0,0 +1,24 @@
+-- migrate:up
+CREATE TABLE IF NOT EXISTS event (
+  stop_id VARCHAR(255) NOT NULL,
+  route_id VARCHAR(255) NOT NULL,
+  trip_id VARCHAR(255) NOT NULL,
+  vehicle_id VARCHAR(255) NOT NULL,
+  vehicle_label VARCHAR(255) NOT NULL,
+  direction BOOLEAN NOT NULL,
+  stop_sequence INTEGER NOT NULL,
+  event_type VARCHAR(255) NOT NULL,
+  event_dt TIMESTAMP NOT NULL,
+  CONSTRAINT event_natural_key UNIQUE (stop_id, route_id, trip_id, event_type, event_dt)
+);
+
+CREATE TABLE IF NOT EXISTS last_event_cache_datetime (
+  stop_id VARCHAR(255) NOT NULL,
+  route_id VARCHAR(255) NOT NULL,
+  value TIMESTAMP NOT NULL,
+  PRIMARY KEY (stop_id, route_id)
+);
+
+-- migrate:down
+DROP TABLE last_event_cache_datetime;
+DROP TABLE event;
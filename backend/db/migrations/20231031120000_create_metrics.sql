@@ -0,0 +1,21 @@
+-- migrate:up
+CREATE TABLE IF NOT EXISTS daily_metric (
+  route_id VARCHAR(255) NOT NULL,
+  service_date DATE NOT NULL,
+  threshold_id VARCHAR(255) NOT NULL,
+  threshold_name VARCHAR(255) NOT NULL,
+  threshold_type VARCHAR(255) NOT NULL,
+  metric_result DOUBLE PRECISION NOT NULL,
+  metric_result_trip DOUBLE PRECISION NOT NULL,
+  CONSTRAINT daily_metric_natural_key UNIQUE (route_id, service_date, threshold_id)
+);
+
+CREATE TABLE IF NOT EXISTS last_daily_metric_cache_datetime (
+  route_id VARCHAR(255) NOT NULL,
+  value TIMESTAMP NOT NULL,
+  PRIMARY KEY (route_id)
+);
+
+-- migrate:down
+DROP TABLE last_daily_metric_cache_datetime;
+DROP TABLE daily_metric;
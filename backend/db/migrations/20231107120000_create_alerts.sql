@@ -0,0 +1,38 @@
+-- migrate:up
+CREATE TABLE IF NOT EXISTS alert (
+  id VARCHAR(255) PRIMARY KEY,
+  cause VARCHAR(255) NOT NULL,
+  effect VARCHAR(255) NOT NULL,
+  header_text VARCHAR NOT NULL,
+  description_text VARCHAR NOT NULL,
+  severity VARCHAR(255) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS alert_active_period (
+  alert_id VARCHAR(255) NOT NULL REFERENCES alert (id) ON DELETE CASCADE,
+  start_dt TIMESTAMP NOT NULL,
+  end_dt TIMESTAMP,
+  CONSTRAINT alert_active_period_natural_key UNIQUE (alert_id, start_dt)
+);
+
+CREATE TABLE IF NOT EXISTS alert_informed_entity (
+  alert_id VARCHAR(255) NOT NULL REFERENCES alert (id) ON DELETE CASCADE,
+  route_id VARCHAR(255) NOT NULL,
+  stop_id VARCHAR(255) NOT NULL,
+  CONSTRAINT alert_informed_entity_natural_key UNIQUE (alert_id, route_id, stop_id)
+);
+
+CREATE INDEX IF NOT EXISTS alert_informed_entity_route_stop
+  ON alert_informed_entity (route_id, stop_id);
+
+CREATE TABLE IF NOT EXISTS last_alert_cache_datetime (
+  route_id VARCHAR(255) NOT NULL,
+  value TIMESTAMP NOT NULL,
+  PRIMARY KEY (route_id)
+);
+
+-- migrate:down
+DROP TABLE last_alert_cache_datetime;
+DROP TABLE alert_informed_entity;
+DROP TABLE alert_active_period;
+DROP TABLE alert;
@@ -0,0 +1,11 @@
+-- migrate:up
+CREATE TABLE IF NOT EXISTS rejected_record (
+  endpoint VARCHAR(255) NOT NULL,
+  key VARCHAR(511) NOT NULL,
+  payload JSONB NOT NULL,
+  reason VARCHAR NOT NULL,
+  rejected_dt TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- migrate:down
+DROP TABLE rejected_record;
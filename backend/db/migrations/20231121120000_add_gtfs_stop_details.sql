@@ -0,0 +1,19 @@
+-- migrate:up
+ALTER TABLE stop ADD COLUMN IF NOT EXISTS parent_station VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE stop ADD COLUMN IF NOT EXISTS platform_code VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS route_stop (
+  route_id VARCHAR(255) NOT NULL,
+  direction BOOLEAN NOT NULL,
+  stop_id VARCHAR(255) NOT NULL,
+  stop_sequence INTEGER NOT NULL,
+  PRIMARY KEY (route_id, direction, stop_id)
+);
+
+-- migrate:down
+DROP TABLE route_stop;
+
+ALTER TABLE stop DROP COLUMN platform_code;
+
+ALTER TABLE stop DROP COLUMN parent_station;
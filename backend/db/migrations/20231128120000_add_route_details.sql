@@ -0,0 +1,17 @@
+-- migrate:up
+ALTER TABLE route ADD COLUMN IF NOT EXISTS type INTEGER NOT NULL DEFAULT 1;
+
+ALTER TABLE route ADD COLUMN IF NOT EXISTS color VARCHAR(6) NOT NULL DEFAULT '';
+
+ALTER TABLE route ADD COLUMN IF NOT EXISTS display_name VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE route ADD COLUMN IF NOT EXISTS sort_order INTEGER NOT NULL DEFAULT 0;
+
+-- migrate:down
+ALTER TABLE route DROP COLUMN sort_order;
+
+ALTER TABLE route DROP COLUMN display_name;
+
+ALTER TABLE route DROP COLUMN color;
+
+ALTER TABLE route DROP COLUMN type;
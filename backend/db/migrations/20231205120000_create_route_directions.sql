@@ -0,0 +1,11 @@
+-- migrate:up
+CREATE TABLE IF NOT EXISTS route_direction (
+  route_id VARCHAR(255) NOT NULL,
+  direction BOOLEAN NOT NULL,
+  name VARCHAR(255) NOT NULL,
+  destination VARCHAR(255) NOT NULL,
+  PRIMARY KEY (route_id, direction)
+);
+
+-- migrate:down
+DROP TABLE route_direction;
@@ -13,6 +13,69 @@ SET default_tablespace = '';
 
 SET default_table_access_method = heap;
 
+--
+-- Name: alert; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.alert (
+    id character varying(255) NOT NULL,
+    cause character varying(255) NOT NULL,
+    effect character varying(255) NOT NULL,
+    header_text character varying NOT NULL,
+    description_text character varying NOT NULL,
+    severity character varying(255) NOT NULL
+);
+
+
+--
+-- Name: alert_active_period; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.alert_active_period (
+    alert_id character varying(255) NOT NULL,
+    start_dt timestamp without time zone NOT NULL,
+    end_dt timestamp without time zone
+);
+
+
+--
+-- Name: alert_informed_entity; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.alert_informed_entity (
+    alert_id character varying(255) NOT NULL,
+    route_id character varying(255) NOT NULL,
+    stop_id character varying(255) NOT NULL
+);
+
+
+--
+-- Name: backfill_cursor; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.backfill_cursor (
+    entity character varying(255) NOT NULL,
+    route_id character varying(255) NOT NULL,
+    key character varying(511) NOT NULL,
+    value timestamp without time zone NOT NULL
+);
+
+
+--
+-- Name: daily_metric; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.daily_metric (
+    route_id character varying(255) NOT NULL,
+    service_date date NOT NULL,
+    threshold_id character varying(255) NOT NULL,
+    threshold_name character varying(255) NOT NULL,
+    threshold_type character varying(255) NOT NULL,
+    metric_result double precision NOT NULL,
+    metric_result_trip double precision NOT NULL
+);
+
+
 --
 -- Name: dwell; Type: TABLE; Schema: public; Owner: -
 --
@@ -27,6 +90,23 @@ CREATE TABLE public.dwell (
 );
 
 
+--
+-- Name: event; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.event (
+    stop_id character varying(255) NOT NULL,
+    route_id character varying(255) NOT NULL,
+    trip_id character varying(255) NOT NULL,
+    vehicle_id character varying(255) NOT NULL,
+    vehicle_label character varying(255) NOT NULL,
+    direction boolean NOT NULL,
+    stop_sequence integer NOT NULL,
+    event_type character varying(255) NOT NULL,
+    event_dt timestamp without time zone NOT NULL
+);
+
+
 --
 -- Name: headway; Type: TABLE; Schema: public; Owner: -
 --
@@ -43,6 +123,26 @@ CREATE TABLE public.headway (
 );
 
 
+--
+-- Name: last_alert_cache_datetime; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.last_alert_cache_datetime (
+    route_id character varying(255) NOT NULL,
+    value timestamp without time zone NOT NULL
+);
+
+
+--
+-- Name: last_daily_metric_cache_datetime; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.last_daily_metric_cache_datetime (
+    route_id character varying(255) NOT NULL,
+    value timestamp without time zone NOT NULL
+);
+
+
 --
 -- Name: last_dwell_cache_datetime; Type: TABLE; Schema: public; Owner: -
 --
@@ -54,6 +154,17 @@ CREATE TABLE public.last_dwell_cache_datetime (
 );
 
 
+--
+-- Name: last_event_cache_datetime; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.last_event_cache_datetime (
+    stop_id character varying(255) NOT NULL,
+    route_id character varying(255) NOT NULL,
+    value timestamp without time zone NOT NULL
+);
+
+
 --
 -- Name: last_headway_cache_datetime; Type: TABLE; Schema: public; Owner: -
 --
@@ -77,12 +188,53 @@ CREATE TABLE public.last_travel_time_cache_datetime (
 );
 
 
+--
+-- Name: rejected_record; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.rejected_record (
+    endpoint character varying(255) NOT NULL,
+    key character varying(511) NOT NULL,
+    payload jsonb NOT NULL,
+    reason character varying NOT NULL,
+    rejected_dt timestamp without time zone DEFAULT now() NOT NULL
+);
+
+
 --
 -- Name: route; Type: TABLE; Schema: public; Owner: -
 --
 
 CREATE TABLE public.route (
-    id character varying(255) NOT NULL
+    id character varying(255) NOT NULL,
+    type integer DEFAULT 1 NOT NULL,
+    color character varying(6) DEFAULT ''::character varying NOT NULL,
+    display_name character varying(255) DEFAULT ''::character varying NOT NULL,
+    sort_order integer DEFAULT 0 NOT NULL
+);
+
+
+--
+-- Name: route_direction; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.route_direction (
+    route_id character varying(255) NOT NULL,
+    direction boolean NOT NULL,
+    name character varying(255) NOT NULL,
+    destination character varying(255) NOT NULL
+);
+
+
+--
+-- Name: route_stop; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.route_stop (
+    route_id character varying(255) NOT NULL,
+    direction boolean NOT NULL,
+    stop_id character varying(255) NOT NULL,
+    stop_sequence integer NOT NULL
 );
 
 
@@ -115,7 +267,9 @@ CREATE TABLE public.stop (
     route_id character varying(255) NOT NULL,
     name character varying(255) NOT NULL,
     latitude double precision NOT NULL,
-    longitude double precision NOT NULL
+    longitude double precision NOT NULL,
+    parent_station character varying(255) DEFAULT ''::character varying NOT NULL,
+    platform_code character varying(255) DEFAULT ''::character varying NOT NULL
 );
 
 
@@ -135,6 +289,118 @@ CREATE TABLE public.travel_time (
 );
 
 
+--
+-- Name: alert_active_period alert_active_period_natural_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.alert_active_period
+    ADD CONSTRAINT alert_active_period_natural_key UNIQUE (alert_id, start_dt);
+
+
+--
+-- Name: alert_informed_entity alert_informed_entity_natural_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.alert_informed_entity
+    ADD CONSTRAINT alert_informed_entity_natural_key UNIQUE (alert_id, route_id, stop_id);
+
+
+--
+-- Name: alert alert_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.alert
+    ADD CONSTRAINT alert_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: backfill_cursor backfill_cursor_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.backfill_cursor
+    ADD CONSTRAINT backfill_cursor_pkey PRIMARY KEY (entity, route_id, key);
+
+
+--
+-- Name: daily_metric daily_metric_natural_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.daily_metric
+    ADD CONSTRAINT daily_metric_natural_key UNIQUE (route_id, service_date, threshold_id);
+
+
+--
+-- Name: dwell dwell_natural_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.dwell
+    ADD CONSTRAINT dwell_natural_key UNIQUE (stop_id, route_id, direction, arr_dt);
+
+
+--
+-- Name: event event_natural_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.event
+    ADD CONSTRAINT event_natural_key UNIQUE (stop_id, route_id, trip_id, event_type, event_dt);
+
+
+--
+-- Name: headway headway_natural_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.headway
+    ADD CONSTRAINT headway_natural_key UNIQUE (stop_id, route_id, direction, current_dep_dt);
+
+
+--
+-- Name: last_alert_cache_datetime last_alert_cache_datetime_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.last_alert_cache_datetime
+    ADD CONSTRAINT last_alert_cache_datetime_pkey PRIMARY KEY (route_id);
+
+
+--
+-- Name: last_daily_metric_cache_datetime last_daily_metric_cache_datetime_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.last_daily_metric_cache_datetime
+    ADD CONSTRAINT last_daily_metric_cache_datetime_pkey PRIMARY KEY (route_id);
+
+
+--
+-- Name: last_dwell_cache_datetime last_dwell_cache_datetime_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.last_dwell_cache_datetime
+    ADD CONSTRAINT last_dwell_cache_datetime_pkey PRIMARY KEY (stop_id, route_id);
+
+
+--
+-- Name: last_event_cache_datetime last_event_cache_datetime_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.last_event_cache_datetime
+    ADD CONSTRAINT last_event_cache_datetime_pkey PRIMARY KEY (stop_id, route_id);
+
+
+--
+-- Name: last_headway_cache_datetime last_headway_cache_datetime_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.last_headway_cache_datetime
+    ADD CONSTRAINT last_headway_cache_datetime_pkey PRIMARY KEY (stop_id, route_id);
+
+
+--
+-- Name: last_travel_time_cache_datetime last_travel_time_cache_datetime_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.last_travel_time_cache_datetime
+    ADD CONSTRAINT last_travel_time_cache_datetime_pkey PRIMARY KEY (from_stop_id, to_stop_id, route_id);
+
+
 --
 -- Name: route route_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -143,6 +409,22 @@ ALTER TABLE ONLY public.route
     ADD CONSTRAINT route_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: route_direction route_direction_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.route_direction
+    ADD CONSTRAINT route_direction_pkey PRIMARY KEY (route_id, direction);
+
+
+--
+-- Name: route_stop route_stop_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.route_stop
+    ADD CONSTRAINT route_stop_pkey PRIMARY KEY (route_id, direction, stop_id);
+
+
 --
 -- Name: schema_migrations schema_migrations_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -159,6 +441,37 @@ ALTER TABLE ONLY public.shape
     ADD CONSTRAINT shape_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: travel_time travel_time_natural_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.travel_time
+    ADD CONSTRAINT travel_time_natural_key UNIQUE (from_stop_id, to_stop_id, route_id, direction, dep_dt);
+
+
+--
+-- Name: alert_informed_entity_route_stop; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX alert_informed_entity_route_stop ON public.alert_informed_entity USING btree (route_id, stop_id);
+
+
+--
+-- Name: alert_active_period alert_active_period_alert_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.alert_active_period
+    ADD CONSTRAINT alert_active_period_alert_id_fkey FOREIGN KEY (alert_id) REFERENCES public.alert(id) ON DELETE CASCADE;
+
+
+--
+-- Name: alert_informed_entity alert_informed_entity_alert_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.alert_informed_entity
+    ADD CONSTRAINT alert_informed_entity_alert_id_fkey FOREIGN KEY (alert_id) REFERENCES public.alert(id) ON DELETE CASCADE;
+
+
 --
 -- PostgreSQL database dump complete
 --
@@ -169,4 +482,13 @@ ALTER TABLE ONLY public.shape
 --
 
 INSERT INTO public.schema_migrations (version) VALUES
-    ('20230906195458');
+    ('20230906195458'),
+    ('20231010120000'),
+    ('20231017120000'),
+    ('20231024120000'),
+    ('20231031120000'),
+    ('20231107120000'),
+    ('20231114120000'),
+    ('20231121120000'),
+    ('20231128120000'),
+    ('20231205120000');
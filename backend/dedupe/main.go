@@ -0,0 +1,69 @@
+package main
+
+import (
+  "fmt"
+  "log"
+  "os"
+
+  "database/sql"
+
+  "github.com/joho/godotenv"
+  _ "github.com/lib/pq"
+  "github.com/mbta-performance-dashboard/db"
+)
+
+// dedupe deletes the rows of a table that duplicate another row's natural key. Returns the number
+// of rows deleted.
+func dedupe(tx *sql.Tx, key db.NaturalKey) (int64, error) {
+  res, err := tx.Exec(key.DedupeStatement())
+  if err != nil {
+    return 0, fmt.Errorf("Error deduplicating %s: %w", key.Table, err)
+  }
+
+  deleted, err := res.RowsAffected()
+  if err != nil {
+    return 0, fmt.Errorf("Error counting deduplicated %s rows: %w", key.Table, err)
+  }
+  return deleted, nil
+}
+
+func main() {
+  err := godotenv.Load()
+  if err != nil {
+    panic(fmt.Sprintf("Error loading .env file: %v", err))
+  }
+
+  source := fmt.Sprintf(
+    "host=%s port=%s dbname=%s password=%s user=%s sslmode=disable",
+    os.Getenv("POSTGRES_HOST"),
+    os.Getenv("POSTGRES_PORT"),
+    os.Getenv("POSTGRES_DB"),
+    os.Getenv("POSTGRES_PASSWORD"),
+    os.Getenv("POSTGRES_USER"),
+  )
+  conn, err := sql.Open("postgres", source)
+  if err != nil {
+    panic(fmt.Sprintf("Error opening database: %v", err))
+  }
+  defer conn.Close()
+
+  tx, err := conn.Begin()
+  if err != nil {
+    panic(fmt.Sprintf("Error beginning transaction: %v", err))
+  }
+  defer tx.Rollback()
+
+  for _, key := range db.NaturalKeys {
+    deleted, err := dedupe(tx, key)
+    if err != nil {
+      panic(err)
+    }
+    log.Println(fmt.Sprintf("Deleted %d duplicate rows from %s", deleted, key.Table))
+  }
+
+  if err = tx.Commit(); err != nil {
+    panic(fmt.Sprintf("Error committing transaction: %v", err))
+  }
+
+  log.Println("Done!")
+}
@@ -1,35 +1,87 @@
 package dwells
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"strconv"
-	"sync"
+	"time"
 
 	"github.com/lib/pq"
+	"github.com/mbta-performance-dashboard/alerts"
+	"github.com/mbta-performance-dashboard/locks"
+	"github.com/mbta-performance-dashboard/performanceapi"
 	"github.com/mbta-performance-dashboard/types"
 	"github.com/mbta-performance-dashboard/utils"
 )
 
 // An APIResponse represents a response from the MBTA Performance API's dwells endpoint.
 type APIResponse struct {
-	Dwells []*Dwell `json:"dwell_times"`
+	Dwells []*APIDwell `json:"dwell_times"`
 }
 
-func (a *APIResponse) Entities() []*Dwell {
-  return a.Dwells
+func (a *APIResponse) Entities() ([]*Dwell, []*types.RejectedRecord) {
+  if a == nil {
+    return nil, nil
+  }
+  return utils.Validate(a.Dwells, (*APIDwell).Dwell)
 }
 
-
-// A Dwell represents the time a train was stationary at a stop.
-type Dwell struct {
-	types.BaseEntity
+// An APIDwell represents a dwell exactly as the MBTA Performance API returns it, where every field
+// is a string.
+type APIDwell struct {
+	StopID       string `json:"stop_id"`
+	RouteID      string `json:"route_id"`
 	Direction    string `json:"direction"`
 	ArrDt        string `json:"arr_dt"`
 	DepDt        string `json:"dep_dt"`
 	DwellTimeSec string `json:"dwell_time_sec"`
 }
 
+// Dwell converts an upstream dwell into a dwell.
+func (a *APIDwell) Dwell() (*Dwell, error) {
+  direction, err := types.ParseDirection(a.Direction)
+  if err != nil {
+    return nil, err
+  }
+  arrDt, err := utils.ParseUnix(a.ArrDt)
+  if err != nil {
+    return nil, fmt.Errorf("Error converting arrival datetime: %w", err)
+  }
+  depDt, err := utils.ParseUnix(a.DepDt)
+  if err != nil {
+    return nil, fmt.Errorf("Error converting departure datetime: %w", err)
+  }
+  dwellTimeSec, err := strconv.Atoi(a.DwellTimeSec)
+  if err != nil {
+    return nil, fmt.Errorf("Error converting dwell time to integer: %w", err)
+  }
+
+  return &Dwell{
+    BaseEntity: types.BaseEntity{ StopID: a.StopID, RouteID: a.RouteID },
+    Direction: direction,
+    ArrDt: arrDt,
+    DepDt: depDt,
+    DwellTimeSec: dwellTimeSec,
+    AlertIDs: []string{},
+  }, nil
+}
+
+
+// A Dwell represents the time a train was stationary at a stop.
+type Dwell struct {
+	types.BaseEntity
+	Direction     types.Direction `json:"direction"`
+	DirectionName string          `json:"direction_name"`
+	ArrDt         time.Time       `json:"arr_dt"`
+	DepDt         time.Time       `json:"dep_dt"`
+	DwellTimeSec  int             `json:"dwell_time_sec"`
+
+	// AlertIDs are the IDs of the alerts that were active at the stop when the train arrived.
+	AlertIDs []string `json:"alert_ids"`
+}
+
 func (d *Dwell) StopID() string {
   return d.BaseEntity.StopID
 }
@@ -42,34 +94,93 @@ func (d *Dwell) RouteID() string {
   return d.BaseEntity.RouteID
 }
 
+// MarshalJSON marshals a dwell with its datetimes in EST.
+func (d *Dwell) MarshalJSON() ([]byte, error) {
+  type dwell Dwell
+  marshaled := dwell(*d)
+
+  var err error
+  if marshaled.ArrDt, err = utils.InNewYork(d.ArrDt); err != nil {
+    return nil, err
+  }
+  if marshaled.DepDt, err = utils.InNewYork(d.DepDt); err != nil {
+    return nil, err
+  }
+  return json.Marshal(marshaled)
+}
+
+// A LegacyDwell represents a dwell in its original response shape, where every field is a string.
+type LegacyDwell struct {
+	types.BaseEntity
+	Direction     string   `json:"direction"`
+	DirectionName string   `json:"direction_name"`
+	ArrDt         string   `json:"arr_dt"`
+	DepDt         string   `json:"dep_dt"`
+	DwellTimeSec  string   `json:"dwell_time_sec"`
+	AlertIDs      []string `json:"alert_ids"`
+}
+
+func (d *Dwell) Legacy() any {
+  return &LegacyDwell{
+    BaseEntity: d.BaseEntity,
+    Direction: strconv.FormatBool(d.Direction.Bool()),
+    DirectionName: d.DirectionName,
+    ArrDt: d.ArrDt.Format(time.RFC3339Nano),
+    DepDt: d.DepDt.Format(time.RFC3339Nano),
+    DwellTimeSec: strconv.Itoa(d.DwellTimeSec),
+    AlertIDs: d.AlertIDs,
+  }
+}
+
 
 // A DwellService represents a service that will fetch and store dwells.
 type DwellService struct {
   types.BaseService
 }
 
-func NewService(db *sql.DB, mu *sync.Mutex) *DwellService {
-  return &DwellService { BaseService: types.BaseService{ DB: db, Mu: mu } }
+func NewService(
+  db *sql.DB,
+  api performanceapi.Client,
+  lockManager *locks.Manager,
+  retentionDays int,
+) *DwellService {
+  return &DwellService{
+    BaseService: types.BaseService{
+      DB: db,
+      API: api,
+      Locks: lockManager,
+      Entity: "dwell",
+      RetentionDays: retentionDays,
+    },
+  }
 }
 
 func (s *DwellService) BeginTx() (*sql.Tx, error) {
   return s.BaseService.BeginTx()
 }
 
-func (s *DwellService) Lock() {
-  s.BaseService.Lock()
+func (s *DwellService) Lock(stopIDs []string, routeID string) func() {
+  return s.BaseService.Lock(stopIDs, routeID)
 }
 
-func (s *DwellService) Unlock() {
-  s.BaseService.Unlock()
+func (s *DwellService) Coalesce(
+  ctx context.Context,
+  stopIDs []string,
+  routeID string,
+  fn func(ctx context.Context) (any, error),
+) (any, error) {
+  return s.BaseService.Coalesce(ctx, stopIDs, routeID, fn)
 }
 
 func (s *DwellService) FetchFromAPI(
+  ctx context.Context,
   tx *sql.Tx,
   stopIDs []string,
   routeID string,
-) ([]*Dwell, []error) {
+) ([]types.ChunkResult[*Dwell], error) {
   return utils.FetchFromAPI[*Dwell, *APIResponse](
+    ctx,
+    s.API,
     tx,
     stopIDs,
     routeID,
@@ -86,45 +197,31 @@ func (s *DwellService) Insert(tx *sql.Tx, dwells []*Dwell) error {
   var paramStopIDs []string = []string{}
   var paramRouteIDs []string = []string{}
   var paramDirections []bool = []bool{}
-  var paramArrDts []int = []int{}
-  var paramDepDts []int = []int{}
+  var paramArrDts []int64 = []int64{}
+  var paramDepDts []int64 = []int64{}
   var paramDwellTimeSecs []int = []int{}
 
   for i := 0; i < len(dwells); i++ {
-		convertedDirection, err := strconv.Atoi(dwells[i].Direction)
-		if err != nil {
-			panic(fmt.Sprintf("Error converting direction to integer: %v", err))
-		}
-		convertedArrDt, err := strconv.Atoi(dwells[i].ArrDt)
-		if err != nil {
-			panic(fmt.Sprintf("Error converting arrival datetime to integer: %v", err))
-		}
-		convertedDepDt, err := strconv.Atoi(dwells[i].DepDt)
-		if err != nil {
-			panic(fmt.Sprintf("Error converting departure datetime to integer: %v", err))
-		}
-		convertedDwellTimeSec, err := strconv.Atoi(dwells[i].DwellTimeSec)
-		if err != nil {
-			panic(fmt.Sprintf("Error converting dwell time to integer: %v", err))
-		}
-
     paramStopIDs = append(paramStopIDs, dwells[i].StopID())
     paramRouteIDs = append(paramRouteIDs, dwells[i].RouteID())
-    paramDirections = append(paramDirections, convertedDirection == 1)
-    paramArrDts = append(paramArrDts, convertedArrDt)
-    paramDepDts = append(paramDepDts, convertedDepDt)
-    paramDwellTimeSecs = append(paramDwellTimeSecs, convertedDwellTimeSec)
+    paramDirections = append(paramDirections, dwells[i].Direction.Bool())
+    paramArrDts = append(paramArrDts, dwells[i].ArrDt.Unix())
+    paramDepDts = append(paramDepDts, dwells[i].DepDt.Unix())
+    paramDwellTimeSecs = append(paramDwellTimeSecs, dwells[i].DwellTimeSec)
 	}
 
   _, err := tx.Exec(
     "INSERT INTO dwell (stop_id, route_id, direction, arr_dt, dep_dt, dwell_time_sec) " +
-      "SELECT " +
+      "SELECT DISTINCT ON (stop_id, route_id, direction, arr_dt) * FROM (SELECT " +
       "unnest($1::text[]) AS stop_id, " +
       "unnest($2::text[]) AS route_id, " +
       "unnest($3::boolean[]) AS direction, " +
-      "TO_TIMESTAMP(unnest($4::int[])) AS arr_dt, " +
-      "TO_TIMESTAMP(unnest($5::int[])) AS dep_dt, " +
-      "unnest($6::int[]) AS dwell_time_sec",
+      "TO_TIMESTAMP(unnest($4::bigint[])) AS arr_dt, " +
+      "TO_TIMESTAMP(unnest($5::bigint[])) AS dep_dt, " +
+      "unnest($6::int[]) AS dwell_time_sec) AS upserted " +
+      "ON CONFLICT (stop_id, route_id, direction, arr_dt) DO UPDATE SET " +
+      "dep_dt = EXCLUDED.dep_dt, " +
+      "dwell_time_sec = EXCLUDED.dwell_time_sec",
     pq.Array(paramStopIDs),
     pq.Array(paramRouteIDs),
     pq.Array(paramDirections),
@@ -143,16 +240,24 @@ func (s *DwellService) Select(
   tx *sql.Tx,
   stopIDs []string,
   routeID string,
+  filter types.Filter,
 ) ([]*Dwell, error) {
+  filterClause, filterParams := utils.FilterClause(filter, "arr_dt", len(stopIDs)+1)
 	rows, err := tx.Query(
     fmt.Sprintf(
-      "SELECT stop_id, route_id, direction, arr_dt AT TIME ZONE 'America/New_York', dep_dt AT " +
-        "TIME ZONE 'America/New_York', dwell_time_sec FROM dwell WHERE stop_id IN (%s) AND " +
-        "route_id = %s",
+      "SELECT stop_id, route_id, direction, %s, arr_dt AT TIME ZONE 'America/New_York', " +
+        "dep_dt AT TIME ZONE 'America/New_York', dwell_time_sec, %s FROM dwell WHERE stop_id " +
+        "IN (%s) AND route_id = %s%s",
+      utils.DirectionName("dwell.route_id", "dwell.direction"),
+      alerts.ActiveAlertIDs("dwell.route_id", "dwell.stop_id", "dwell.arr_dt"),
       utils.PgPlaceholders(0, len(stopIDs)),
       utils.PgPlaceholders(len(stopIDs), len(stopIDs)+1),
+      filterClause,
     ),
-    utils.SliceToAnySlice[string](append(stopIDs, routeID))...,
+    append(
+      utils.SliceToAnySlice[string](append(stopIDs, routeID)),
+      filterParams...,
+    )...,
   )
 	if err != nil {
     return nil, fmt.Errorf("Error fetching dwells: %w", err)
@@ -161,17 +266,24 @@ func (s *DwellService) Select(
 	var dwells []*Dwell = []*Dwell{}
 	for rows.Next() {
 		var dwell Dwell
+		var direction bool
 		err := rows.Scan(
 			&dwell.BaseEntity.StopID,
 			&dwell.BaseEntity.RouteID,
-			&dwell.Direction,
+			&direction,
+			&dwell.DirectionName,
 			&dwell.ArrDt,
 			&dwell.DepDt,
 			&dwell.DwellTimeSec,
+			pq.Array(&dwell.AlertIDs),
 		)
 		if err != nil {
       return nil, fmt.Errorf("Error scanning dwells: %w", err)
 		}
+		dwell.Direction = types.DirectionFromBool(direction)
+		if dwell.AlertIDs == nil {
+			dwell.AlertIDs = []string{}
+		}
 		dwells = append(dwells, &dwell)
 	}
 	rows.Close()
@@ -179,10 +291,43 @@ func (s *DwellService) Select(
 	return dwells, nil
 }
 
-func (s *DwellService) UpdateCacheDatetimes(tx *sql.Tx, stopIDs []string, routeID string) error {
-  return utils.UpdateCacheDatetimes(tx, stopIDs, routeID, "last_dwell_cache_datetime")
+func (s *DwellService) SelectStats(
+  tx *sql.Tx,
+  stopIDs []string,
+  routeID string,
+  filter types.Filter,
+  bucket time.Duration,
+) ([]*types.Stat, error) {
+  filterClause, filterParams := utils.FilterClause(filter, "arr_dt", len(stopIDs)+1)
+  return utils.SelectStats(
+    tx,
+    "dwell",
+    "arr_dt",
+    "dwell_time_sec",
+    "",
+    fmt.Sprintf(
+      "stop_id IN (%s) AND route_id = %s%s",
+      utils.PgPlaceholders(0, len(stopIDs)),
+      utils.PgPlaceholders(len(stopIDs), len(stopIDs)+1),
+      filterClause,
+    ),
+    append(
+      utils.SliceToAnySlice[string](append(stopIDs, routeID)),
+      filterParams...,
+    ),
+    bucket,
+  )
+}
+
+func (s *DwellService) UpdateCacheDatetime(
+  tx *sql.Tx,
+  stopID string,
+  routeID string,
+  value time.Time,
+) error {
+  return utils.UpdateCacheDatetime(tx, stopID, routeID, value, "last_dwell_cache_datetime")
 }
 
 func (s *DwellService) DeleteOutdated(tx *sql.Tx) error {
-  return utils.DeleteOutdated(tx, "dwell", "arr_dt")
+  return utils.DeleteOutdated(tx, "dwell", "arr_dt", s.RetentionDays)
 }
@@ -0,0 +1,332 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mbta-performance-dashboard/locks"
+	"github.com/mbta-performance-dashboard/performanceapi"
+	"github.com/mbta-performance-dashboard/types"
+	"github.com/mbta-performance-dashboard/utils"
+)
+
+// An APIResponse represents a response from the MBTA Performance API's events endpoint.
+type APIResponse struct {
+	Events []*APIEvent `json:"events"`
+}
+
+func (a *APIResponse) Entities() ([]*Event, []*types.RejectedRecord) {
+  if a == nil {
+    return nil, nil
+  }
+  return utils.Validate(a.Events, (*APIEvent).Event)
+}
+
+// An APIEvent represents an event exactly as the MBTA Performance API returns it, where every field
+// is a string.
+type APIEvent struct {
+	StopID       string `json:"stop_id"`
+	RouteID      string `json:"route_id"`
+	TripID       string `json:"trip_id"`
+	VehicleID    string `json:"vehicle_id"`
+	VehicleLabel string `json:"vehicle_label"`
+	Direction    string `json:"direction_id"`
+	StopSequence string `json:"stop_sequence"`
+	EventType    string `json:"event_type"`
+	EventTime    string `json:"event_time"`
+}
+
+// Event converts an upstream event into an event.
+func (a *APIEvent) Event() (*Event, error) {
+  direction, err := types.ParseDirection(a.Direction)
+  if err != nil {
+    return nil, err
+  }
+  stopSequence, err := strconv.Atoi(a.StopSequence)
+  if err != nil {
+    return nil, fmt.Errorf("Error converting stop sequence to integer: %w", err)
+  }
+  eventTime, err := utils.ParseUnix(a.EventTime)
+  if err != nil {
+    return nil, fmt.Errorf("Error converting event datetime: %w", err)
+  }
+
+  return &Event{
+    BaseEntity: types.BaseEntity{ StopID: a.StopID, RouteID: a.RouteID },
+    TripID: a.TripID,
+    VehicleID: a.VehicleID,
+    VehicleLabel: a.VehicleLabel,
+    Direction: direction,
+    StopSequence: stopSequence,
+    EventType: a.EventType,
+    EventTime: eventTime,
+  }, nil
+}
+
+
+// An Event represents a single arrival or departure of a vehicle at a stop during a trip.
+type Event struct {
+	types.BaseEntity
+	TripID        string          `json:"trip_id"`
+	VehicleID     string          `json:"vehicle_id"`
+	VehicleLabel  string          `json:"vehicle_label"`
+	Direction     types.Direction `json:"direction"`
+	DirectionName string          `json:"direction_name"`
+	StopSequence  int             `json:"stop_sequence"`
+	EventType     string          `json:"event_type"`
+	EventTime     time.Time       `json:"event_time"`
+}
+
+func (e *Event) StopID() string {
+  return e.BaseEntity.StopID
+}
+
+func (e *Event) SetStopID(stopID string) {
+  e.BaseEntity.StopID = stopID
+}
+
+func (e *Event) RouteID() string {
+  return e.BaseEntity.RouteID
+}
+
+// MarshalJSON marshals an event with its datetime in EST.
+func (e *Event) MarshalJSON() ([]byte, error) {
+  type event Event
+  marshaled := event(*e)
+
+  var err error
+  if marshaled.EventTime, err = utils.InNewYork(e.EventTime); err != nil {
+    return nil, err
+  }
+  return json.Marshal(marshaled)
+}
+
+// A LegacyEvent represents an event in its original response shape, where every field is a string.
+type LegacyEvent struct {
+	types.BaseEntity
+	TripID        string `json:"trip_id"`
+	VehicleID     string `json:"vehicle_id"`
+	VehicleLabel  string `json:"vehicle_label"`
+	Direction     string `json:"direction_id"`
+	DirectionName string `json:"direction_name,omitempty"`
+	StopSequence  string `json:"stop_sequence"`
+	EventType     string `json:"event_type"`
+	EventTime     string `json:"event_time"`
+}
+
+func (e *Event) Legacy() any {
+  return &LegacyEvent{
+    BaseEntity: e.BaseEntity,
+    TripID: e.TripID,
+    VehicleID: e.VehicleID,
+    VehicleLabel: e.VehicleLabel,
+    Direction: strconv.FormatBool(e.Direction.Bool()),
+    DirectionName: e.DirectionName,
+    StopSequence: strconv.Itoa(e.StopSequence),
+    EventType: e.EventType,
+    EventTime: e.EventTime.Format(time.RFC3339Nano),
+  }
+}
+
+
+// An EventService represents a service that will fetch and store events.
+type EventService struct {
+  types.BaseService
+}
+
+func NewService(
+  db *sql.DB,
+  api performanceapi.Client,
+  lockManager *locks.Manager,
+  retentionDays int,
+) *EventService {
+  return &EventService{
+    BaseService: types.BaseService{
+      DB: db,
+      API: api,
+      Locks: lockManager,
+      Entity: "event",
+      RetentionDays: retentionDays,
+    },
+  }
+}
+
+func (s *EventService) BeginTx() (*sql.Tx, error) {
+  return s.BaseService.BeginTx()
+}
+
+func (s *EventService) Lock(stopIDs []string, routeID string) func() {
+  return s.BaseService.Lock(stopIDs, routeID)
+}
+
+func (s *EventService) Coalesce(
+  ctx context.Context,
+  stopIDs []string,
+  routeID string,
+  fn func(ctx context.Context) (any, error),
+) (any, error) {
+  return s.BaseService.Coalesce(ctx, stopIDs, routeID, fn)
+}
+
+func (s *EventService) FetchFromAPI(
+  ctx context.Context,
+  tx *sql.Tx,
+  stopIDs []string,
+  routeID string,
+) ([]types.ChunkResult[*Event], error) {
+  return utils.FetchFromAPI[*Event, *APIResponse](
+    ctx,
+    s.API,
+    tx,
+    stopIDs,
+    routeID,
+    "last_event_cache_datetime",
+    "events",
+  )
+}
+
+func (s *EventService) Insert(tx *sql.Tx, events []*Event) error {
+	if len(events) == 0 {
+    return nil
+	}
+
+  var paramStopIDs []string = []string{}
+  var paramRouteIDs []string = []string{}
+  var paramTripIDs []string = []string{}
+  var paramVehicleIDs []string = []string{}
+  var paramVehicleLabels []string = []string{}
+  var paramDirections []bool = []bool{}
+  var paramStopSequences []int = []int{}
+  var paramEventTypes []string = []string{}
+  var paramEventTimes []int64 = []int64{}
+
+  for i := 0; i < len(events); i++ {
+    paramStopIDs = append(paramStopIDs, events[i].StopID())
+    paramRouteIDs = append(paramRouteIDs, events[i].RouteID())
+    paramTripIDs = append(paramTripIDs, events[i].TripID)
+    paramVehicleIDs = append(paramVehicleIDs, events[i].VehicleID)
+    paramVehicleLabels = append(paramVehicleLabels, events[i].VehicleLabel)
+    paramDirections = append(paramDirections, events[i].Direction.Bool())
+    paramStopSequences = append(paramStopSequences, events[i].StopSequence)
+    paramEventTypes = append(paramEventTypes, events[i].EventType)
+    paramEventTimes = append(paramEventTimes, events[i].EventTime.Unix())
+	}
+
+  _, err := tx.Exec(
+    "INSERT INTO event (stop_id, route_id, trip_id, vehicle_id, vehicle_label, direction, " +
+      "stop_sequence, event_type, event_dt) SELECT DISTINCT ON (stop_id, route_id, trip_id, " +
+      "event_type, event_dt) * FROM (SELECT " +
+      "unnest($1::text[]) AS stop_id, " +
+      "unnest($2::text[]) AS route_id, " +
+      "unnest($3::text[]) AS trip_id, " +
+      "unnest($4::text[]) AS vehicle_id, " +
+      "unnest($5::text[]) AS vehicle_label, " +
+      "unnest($6::boolean[]) AS direction, " +
+      "unnest($7::int[]) AS stop_sequence, " +
+      "unnest($8::text[]) AS event_type, " +
+      "TO_TIMESTAMP(unnest($9::bigint[])) AS event_dt) AS upserted " +
+      "ON CONFLICT (stop_id, route_id, trip_id, event_type, event_dt) DO UPDATE SET " +
+      "vehicle_id = EXCLUDED.vehicle_id, " +
+      "vehicle_label = EXCLUDED.vehicle_label, " +
+      "direction = EXCLUDED.direction, " +
+      "stop_sequence = EXCLUDED.stop_sequence",
+    pq.Array(paramStopIDs),
+    pq.Array(paramRouteIDs),
+    pq.Array(paramTripIDs),
+    pq.Array(paramVehicleIDs),
+    pq.Array(paramVehicleLabels),
+    pq.Array(paramDirections),
+    pq.Array(paramStopSequences),
+    pq.Array(paramEventTypes),
+    pq.Array(paramEventTimes),
+  )
+	if err != nil {
+    return fmt.Errorf("Error inserting events: %w", err)
+	}
+
+  return nil
+}
+
+func (s *EventService) Select(
+  tx *sql.Tx,
+  stopIDs []string,
+  routeID string,
+  filter types.Filter,
+) ([]*Event, error) {
+  filterClause, filterParams := utils.FilterClause(filter, "event_dt", len(stopIDs)+1)
+	rows, err := tx.Query(
+    fmt.Sprintf(
+      "SELECT stop_id, route_id, trip_id, vehicle_id, vehicle_label, direction, %s, " +
+        "stop_sequence, event_type, event_dt AT TIME ZONE 'America/New_York' FROM event WHERE " +
+        "stop_id IN (%s) AND route_id = %s%s ORDER BY event_dt, trip_id, stop_sequence",
+      utils.DirectionName("event.route_id", "event.direction"),
+      utils.PgPlaceholders(0, len(stopIDs)),
+      utils.PgPlaceholders(len(stopIDs), len(stopIDs)+1),
+      filterClause,
+    ),
+    append(
+      utils.SliceToAnySlice[string](append(stopIDs, routeID)),
+      filterParams...,
+    )...,
+  )
+	if err != nil {
+    return nil, fmt.Errorf("Error fetching events: %w", err)
+	}
+
+	var events []*Event = []*Event{}
+	for rows.Next() {
+		var event Event
+		var direction bool
+		err := rows.Scan(
+			&event.BaseEntity.StopID,
+			&event.BaseEntity.RouteID,
+			&event.TripID,
+			&event.VehicleID,
+			&event.VehicleLabel,
+			&direction,
+			&event.DirectionName,
+			&event.StopSequence,
+			&event.EventType,
+			&event.EventTime,
+		)
+		if err != nil {
+      return nil, fmt.Errorf("Error scanning events: %w", err)
+		}
+		event.Direction = types.DirectionFromBool(direction)
+		events = append(events, &event)
+	}
+	rows.Close()
+
+	return events, nil
+}
+
+// SelectStats isn't supported, since events are raw arrivals and departures without a duration to
+// aggregate.
+func (s *EventService) SelectStats(
+  tx *sql.Tx,
+  stopIDs []string,
+  routeID string,
+  filter types.Filter,
+  bucket time.Duration,
+) ([]*types.Stat, error) {
+  return nil, errors.New("Events have no stats, please use /stats/headway or /stats/dwell instead")
+}
+
+func (s *EventService) UpdateCacheDatetime(
+  tx *sql.Tx,
+  stopID string,
+  routeID string,
+  value time.Time,
+) error {
+  return utils.UpdateCacheDatetime(tx, stopID, routeID, value, "last_event_cache_datetime")
+}
+
+func (s *EventService) DeleteOutdated(tx *sql.Tx) error {
+  return utils.DeleteOutdated(tx, "event", "event_dt", s.RetentionDays)
+}
@@ -1,29 +1,38 @@
 package headways
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"strconv"
-	"sync"
+	"time"
 
 	"github.com/lib/pq"
+	"github.com/mbta-performance-dashboard/alerts"
+	"github.com/mbta-performance-dashboard/locks"
+	"github.com/mbta-performance-dashboard/performanceapi"
 	"github.com/mbta-performance-dashboard/types"
 	"github.com/mbta-performance-dashboard/utils"
 )
 
 // An APIResponse represents a response from the MBTA Performance API's headways endpoint.
 type APIResponse struct {
-	Headways []*Headway `json:"headways"`
+	Headways []*APIHeadway `json:"headways"`
 }
 
-func (a *APIResponse) Entities() []*Headway {
-  return a.Headways
+func (a *APIResponse) Entities() ([]*Headway, []*types.RejectedRecord) {
+  if a == nil {
+    return nil, nil
+  }
+  return utils.Validate(a.Headways, (*APIHeadway).Headway)
 }
 
-
-// A Headway represents the time between the previous and current trains' departures at a stop.
-type Headway struct {
-	types.BaseEntity
+// An APIHeadway represents a headway exactly as the MBTA Performance API returns it, where every
+// field is a string.
+type APIHeadway struct {
+	StopID                  string `json:"stop_id"`
+	RouteID                 string `json:"route_id"`
 	PrevRouteID             string `json:"prev_route_id"`
 	Direction               string `json:"direction"`
 	CurrentDepDt            string `json:"current_dep_dt"`
@@ -32,6 +41,57 @@ type Headway struct {
 	BenchmarkHeadwayTimeSec string `json:"benchmark_headway_time_sec"`
 }
 
+// Headway converts an upstream headway into a headway.
+func (a *APIHeadway) Headway() (*Headway, error) {
+  direction, err := types.ParseDirection(a.Direction)
+  if err != nil {
+    return nil, err
+  }
+  currentDepDt, err := utils.ParseUnix(a.CurrentDepDt)
+  if err != nil {
+    return nil, fmt.Errorf("Error converting current departure datetime: %w", err)
+  }
+  previousDepDt, err := utils.ParseUnix(a.PreviousDepDt)
+  if err != nil {
+    return nil, fmt.Errorf("Error converting previous departure datetime: %w", err)
+  }
+  headwayTimeSec, err := strconv.Atoi(a.HeadwayTimeSec)
+  if err != nil {
+    return nil, fmt.Errorf("Error converting headway time to integer: %w", err)
+  }
+  benchmarkHeadwayTimeSec, err := strconv.Atoi(a.BenchmarkHeadwayTimeSec)
+  if err != nil {
+    return nil, fmt.Errorf("Error converting benchmark headway time to integer: %w", err)
+  }
+
+  return &Headway{
+    BaseEntity: types.BaseEntity{ StopID: a.StopID, RouteID: a.RouteID },
+    PrevRouteID: a.PrevRouteID,
+    Direction: direction,
+    CurrentDepDt: currentDepDt,
+    PreviousDepDt: previousDepDt,
+    HeadwayTimeSec: headwayTimeSec,
+    BenchmarkHeadwayTimeSec: benchmarkHeadwayTimeSec,
+    AlertIDs: []string{},
+  }, nil
+}
+
+
+// A Headway represents the time between the previous and current trains' departures at a stop.
+type Headway struct {
+	types.BaseEntity
+	PrevRouteID             string          `json:"prev_route_id"`
+	Direction               types.Direction `json:"direction"`
+	DirectionName           string          `json:"direction_name"`
+	CurrentDepDt            time.Time       `json:"current_dep_dt"`
+	PreviousDepDt           time.Time       `json:"previous_dep_dt"`
+	HeadwayTimeSec          int             `json:"headway_time_sec"`
+	BenchmarkHeadwayTimeSec int             `json:"benchmark_headway_time_sec"`
+
+	// AlertIDs are the IDs of the alerts that were active at the stop when the train departed.
+	AlertIDs []string `json:"alert_ids"`
+}
+
 func (h *Headway) StopID() string {
   return h.BaseEntity.StopID
 }
@@ -44,33 +104,97 @@ func (h *Headway) RouteID() string {
   return h.BaseEntity.RouteID
 }
 
+// MarshalJSON marshals a headway with its datetimes in EST.
+func (h *Headway) MarshalJSON() ([]byte, error) {
+  type headway Headway
+  marshaled := headway(*h)
+
+  var err error
+  if marshaled.CurrentDepDt, err = utils.InNewYork(h.CurrentDepDt); err != nil {
+    return nil, err
+  }
+  if marshaled.PreviousDepDt, err = utils.InNewYork(h.PreviousDepDt); err != nil {
+    return nil, err
+  }
+  return json.Marshal(marshaled)
+}
+
+// A LegacyHeadway represents a headway in its original response shape, where every field is a
+// string.
+type LegacyHeadway struct {
+	types.BaseEntity
+	PrevRouteID             string   `json:"prev_route_id"`
+	Direction               string   `json:"direction"`
+	DirectionName           string   `json:"direction_name"`
+	CurrentDepDt            string   `json:"current_dep_dt"`
+	PreviousDepDt           string   `json:"previous_dep_dt"`
+	HeadwayTimeSec          string   `json:"headway_time_sec"`
+	BenchmarkHeadwayTimeSec string   `json:"benchmark_headway_time_sec"`
+	AlertIDs                []string `json:"alert_ids"`
+}
+
+func (h *Headway) Legacy() any {
+  return &LegacyHeadway{
+    BaseEntity: h.BaseEntity,
+    PrevRouteID: h.PrevRouteID,
+    Direction: strconv.FormatBool(h.Direction.Bool()),
+    DirectionName: h.DirectionName,
+    CurrentDepDt: h.CurrentDepDt.Format(time.RFC3339Nano),
+    PreviousDepDt: h.PreviousDepDt.Format(time.RFC3339Nano),
+    HeadwayTimeSec: strconv.Itoa(h.HeadwayTimeSec),
+    BenchmarkHeadwayTimeSec: strconv.Itoa(h.BenchmarkHeadwayTimeSec),
+    AlertIDs: h.AlertIDs,
+  }
+}
+
 // A HeadwayService represents a service that will fetch and store headways.
 type HeadwayService struct {
   types.BaseService
 }
 
-func NewService(db *sql.DB, mu *sync.Mutex) *HeadwayService {
-  return &HeadwayService{ BaseService: types.BaseService{ DB: db, Mu: mu } }
+func NewService(
+  db *sql.DB,
+  api performanceapi.Client,
+  lockManager *locks.Manager,
+  retentionDays int,
+) *HeadwayService {
+  return &HeadwayService{
+    BaseService: types.BaseService{
+      DB: db,
+      API: api,
+      Locks: lockManager,
+      Entity: "headway",
+      RetentionDays: retentionDays,
+    },
+  }
 }
 
 func (s *HeadwayService) BeginTx() (*sql.Tx, error) {
   return s.BaseService.BeginTx()
 }
 
-func (s *HeadwayService) Lock() {
-  s.BaseService.Lock()
+func (s *HeadwayService) Lock(stopIDs []string, routeID string) func() {
+  return s.BaseService.Lock(stopIDs, routeID)
 }
 
-func (s *HeadwayService) Unlock() {
-  s.BaseService.Unlock()
+func (s *HeadwayService) Coalesce(
+  ctx context.Context,
+  stopIDs []string,
+  routeID string,
+  fn func(ctx context.Context) (any, error),
+) (any, error) {
+  return s.BaseService.Coalesce(ctx, stopIDs, routeID, fn)
 }
 
 func (s *HeadwayService) FetchFromAPI(
+  ctx context.Context,
   tx *sql.Tx,
   stopIDs []string,
   routeID string,
-) ([]*Headway, []error) {
+) ([]types.ChunkResult[*Headway], error) {
   return utils.FetchFromAPI[*Headway, *APIResponse](
+    ctx,
+    s.API,
     tx,
     stopIDs,
     routeID,
@@ -88,57 +212,42 @@ func (s *HeadwayService) Insert(tx *sql.Tx, headways []*Headway) error {
   var paramRouteIDs []string = []string{}
   var paramPrevRouteIDs []string = []string{}
   var paramDirections []bool = []bool{}
-  var paramCurrentDepDts []int = []int{}
-  var paramPreviousDepDts []int = []int{}
+  var paramCurrentDepDts []int64 = []int64{}
+  var paramPreviousDepDts []int64 = []int64{}
   var paramHeadwayTimeSecs []int = []int{}
   var paramBenchmarkHeadwayTimeSecs []int = []int{}
 
   for i := 0; i < len(headways); i++ {
-		convertedDirection, err := strconv.Atoi(headways[i].Direction)
-		if err != nil {
-      return fmt.Errorf("Error converting direction to integer: %w", err)
-		}
-		convertedCurrentDepDt, err := strconv.Atoi(headways[i].CurrentDepDt)
-		if err != nil {
-      return fmt.Errorf("Error converting current departure datetime to integer: %w", err)
-		}
-		convertedPreviousDepDt, err := strconv.Atoi(headways[i].PreviousDepDt)
-		if err != nil {
-      return fmt.Errorf("Error converting previous departure datetime to integer: %w", err)
-		}
-		convertedHeadwayTimeSec, err := strconv.Atoi(headways[i].HeadwayTimeSec)
-		if err != nil {
-      return fmt.Errorf("Error converting headway time to integer: %w", err)
-		}
-		convertedBenchmarkHeadwayTimeSec, err := strconv.Atoi(headways[i].BenchmarkHeadwayTimeSec)
-		if err != nil {
-      return fmt.Errorf("Error converting benchmark headway time to integer: %w", err)
-		}
-
     paramStopIDs = append(paramStopIDs, headways[i].StopID())
     paramRouteIDs = append(paramRouteIDs, headways[i].RouteID())
     paramPrevRouteIDs = append(paramPrevRouteIDs, headways[i].PrevRouteID)
-    paramDirections = append(paramDirections, convertedDirection == 1)
-    paramCurrentDepDts = append(paramCurrentDepDts, convertedCurrentDepDt)
-    paramPreviousDepDts = append(paramPreviousDepDts, convertedPreviousDepDt)
-    paramHeadwayTimeSecs = append(paramHeadwayTimeSecs, convertedHeadwayTimeSec)
+    paramDirections = append(paramDirections, headways[i].Direction.Bool())
+    paramCurrentDepDts = append(paramCurrentDepDts, headways[i].CurrentDepDt.Unix())
+    paramPreviousDepDts = append(paramPreviousDepDts, headways[i].PreviousDepDt.Unix())
+    paramHeadwayTimeSecs = append(paramHeadwayTimeSecs, headways[i].HeadwayTimeSec)
     paramBenchmarkHeadwayTimeSecs = append(
       paramBenchmarkHeadwayTimeSecs,
-      convertedBenchmarkHeadwayTimeSec,
+      headways[i].BenchmarkHeadwayTimeSec,
     )
 	}
 
   _, err := tx.Exec(
     "INSERT INTO headway (stop_id, route_id, prev_route_id, direction, " +
       "current_dep_dt, previous_dep_dt, headway_time_sec, benchmark_headway_time_sec) SELECT " +
+      "DISTINCT ON (stop_id, route_id, direction, current_dep_dt) * FROM (SELECT " +
       "unnest($1::text[]) AS stop_id, " +
       "unnest($2::text[]) AS route_id, " +
       "unnest($3::text[]) AS prev_route_id, " +
       "unnest($4::boolean[]) AS direction, " +
-      "TO_TIMESTAMP(unnest($5::int[])) AS current_dep_dt, " +
-      "TO_TIMESTAMP(unnest($6::int[])) AS previous_dep_dt, " +
+      "TO_TIMESTAMP(unnest($5::bigint[])) AS current_dep_dt, " +
+      "TO_TIMESTAMP(unnest($6::bigint[])) AS previous_dep_dt, " +
       "unnest($7::int[]) AS headway_time_sec, " +
-      "unnest($8::int[]) AS benchmark_headway_time_sec",
+      "unnest($8::int[]) AS benchmark_headway_time_sec) AS upserted " +
+      "ON CONFLICT (stop_id, route_id, direction, current_dep_dt) DO UPDATE SET " +
+      "prev_route_id = EXCLUDED.prev_route_id, " +
+      "previous_dep_dt = EXCLUDED.previous_dep_dt, " +
+      "headway_time_sec = EXCLUDED.headway_time_sec, " +
+      "benchmark_headway_time_sec = EXCLUDED.benchmark_headway_time_sec",
     pq.Array(paramStopIDs),
     pq.Array(paramRouteIDs),
     pq.Array(paramPrevRouteIDs),
@@ -159,17 +268,25 @@ func (s *HeadwayService) Select(
   tx *sql.Tx,
   stopIDs []string,
   routeID string,
+  filter types.Filter,
 ) ([]*Headway, error) {
+  filterClause, filterParams := utils.FilterClause(filter, "current_dep_dt", len(stopIDs)+1)
 	rows, err := tx.Query(
     fmt.Sprintf(
-      "SELECT stop_id, route_id, prev_route_id, direction, current_dep_dt AT TIME " +
+      "SELECT stop_id, route_id, prev_route_id, direction, %s, current_dep_dt AT TIME " +
         "ZONE 'America/New_York', previous_dep_dt AT TIME ZONE 'America/New_York', " +
-        "headway_time_sec, benchmark_headway_time_sec FROM headway WHERE stop_id IN (%s) AND " +
-        "route_id = %s",
+        "headway_time_sec, benchmark_headway_time_sec, %s FROM headway WHERE stop_id IN (%s) " +
+        "AND route_id = %s%s",
+      utils.DirectionName("headway.route_id", "headway.direction"),
+      alerts.ActiveAlertIDs("headway.route_id", "headway.stop_id", "headway.current_dep_dt"),
       utils.PgPlaceholders(0, len(stopIDs)),
       utils.PgPlaceholders(len(stopIDs), len(stopIDs)+1),
+      filterClause,
     ),
-    utils.SliceToAnySlice[string](append(stopIDs, routeID))...,
+    append(
+      utils.SliceToAnySlice[string](append(stopIDs, routeID)),
+      filterParams...,
+    )...,
   )
 	if err != nil {
     return nil, fmt.Errorf("Error fetching headways: %w", err)
@@ -178,19 +295,26 @@ func (s *HeadwayService) Select(
 	var headways []*Headway = []*Headway{}
 	for rows.Next() {
 		var headway Headway
+		var direction bool
 		err := rows.Scan(
 			&headway.BaseEntity.StopID,
 			&headway.BaseEntity.RouteID,
 			&headway.PrevRouteID,
-			&headway.Direction,
+			&direction,
+			&headway.DirectionName,
 			&headway.CurrentDepDt,
 			&headway.PreviousDepDt,
 			&headway.HeadwayTimeSec,
 			&headway.BenchmarkHeadwayTimeSec,
+			pq.Array(&headway.AlertIDs),
 		)
 		if err != nil {
       return nil, fmt.Errorf("Error scanning headways: %w", err)
 		}
+		headway.Direction = types.DirectionFromBool(direction)
+		if headway.AlertIDs == nil {
+			headway.AlertIDs = []string{}
+		}
 		headways = append(headways, &headway)
 	}
 	rows.Close()
@@ -198,10 +322,43 @@ func (s *HeadwayService) Select(
 	return headways, nil
 }
 
-func (s *HeadwayService) UpdateCacheDatetimes(tx *sql.Tx, stopIDs []string, routeID string) error {
-  return utils.UpdateCacheDatetimes(tx, stopIDs, routeID, "last_headway_cache_datetime")
+func (s *HeadwayService) SelectStats(
+  tx *sql.Tx,
+  stopIDs []string,
+  routeID string,
+  filter types.Filter,
+  bucket time.Duration,
+) ([]*types.Stat, error) {
+  filterClause, filterParams := utils.FilterClause(filter, "current_dep_dt", len(stopIDs)+1)
+  return utils.SelectStats(
+    tx,
+    "headway",
+    "current_dep_dt",
+    "headway_time_sec",
+    "benchmark_headway_time_sec",
+    fmt.Sprintf(
+      "stop_id IN (%s) AND route_id = %s%s",
+      utils.PgPlaceholders(0, len(stopIDs)),
+      utils.PgPlaceholders(len(stopIDs), len(stopIDs)+1),
+      filterClause,
+    ),
+    append(
+      utils.SliceToAnySlice[string](append(stopIDs, routeID)),
+      filterParams...,
+    ),
+    bucket,
+  )
+}
+
+func (s *HeadwayService) UpdateCacheDatetime(
+  tx *sql.Tx,
+  stopID string,
+  routeID string,
+  value time.Time,
+) error {
+  return utils.UpdateCacheDatetime(tx, stopID, routeID, value, "last_headway_cache_datetime")
 }
 
 func (s *HeadwayService) DeleteOutdated(tx *sql.Tx) error {
-  return utils.DeleteOutdated(tx, "headway", "current_dep_dt")
+  return utils.DeleteOutdated(tx, "headway", "current_dep_dt", s.RetentionDays)
 }
@@ -0,0 +1,150 @@
+package locks
+
+import (
+  "context"
+  "sort"
+  "sync"
+
+  "github.com/mbta-performance-dashboard/consts"
+)
+
+// A Manager hands out locks by key, so that callers working on unrelated keys never block each
+// other, and coalesces duplicate work on the same key into a single call.
+type Manager struct {
+  mu    sync.Mutex
+  locks map[string]*entry
+  calls map[string]*call
+}
+
+// An entry represents a lock for a single key, along with how many callers hold or are waiting on
+// it, so that it can be discarded once nobody needs it.
+type entry struct {
+  mu   sync.Mutex
+  refs int
+}
+
+// A call represents a piece of work in progress whose result is shared by every caller that asked
+// for the same key while it was running.
+//
+// done is closed once value and err are set. waiters is how many callers are still waiting on the
+// call, and cancel cancels the call's context once none are.
+type call struct {
+  done    chan struct{}
+  value   any
+  err     error
+  waiters int
+  cancel  context.CancelFunc
+}
+
+func NewManager() *Manager {
+  return &Manager{
+    locks: make(map[string]*entry),
+    calls: make(map[string]*call),
+  }
+}
+
+// Lock locks every provided key and returns a function that unlocks them.
+//
+// Keys are locked in sorted order so that callers locking overlapping sets of keys can't deadlock.
+func (m *Manager) Lock(keys ...string) func() {
+  sorted := dedupe(keys)
+
+  entries := make([]*entry, len(sorted))
+  m.mu.Lock()
+  for i, key := range sorted {
+    e, ok := m.locks[key]
+    if !ok {
+      e = &entry{}
+      m.locks[key] = e
+    }
+    e.refs++
+    entries[i] = e
+  }
+  m.mu.Unlock()
+
+  for _, e := range entries {
+    e.mu.Lock()
+  }
+
+  return func() {
+    for i := len(entries) - 1; i >= 0; i-- {
+      entries[i].mu.Unlock()
+    }
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    for i, key := range sorted {
+      entries[i].refs--
+      if entries[i].refs == 0 {
+        delete(m.locks, key)
+      }
+    }
+  }
+}
+
+// Do calls fn and returns its result, unless a call for the same key is already in progress, in
+// which case it waits for that call and returns its result instead.
+//
+// fn is shared by every caller, so it runs under a context that's detached from the caller that
+// started it, and times out after consts.CoalescedCallTimeout. Cancelling ctx abandons this
+// caller's wait, and only cancels fn once no other caller is waiting on it.
+func (m *Manager) Do(
+  ctx context.Context,
+  key string,
+  fn func(ctx context.Context) (any, error),
+) (any, error) {
+  m.mu.Lock()
+  c, ok := m.calls[key]
+  if !ok {
+    callCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), consts.CoalescedCallTimeout)
+    c = &call{ done: make(chan struct{}), cancel: cancel }
+    m.calls[key] = c
+
+    go func() {
+      defer cancel()
+      c.value, c.err = fn(callCtx)
+
+      m.mu.Lock()
+      if m.calls[key] == c {
+        delete(m.calls, key)
+      }
+      m.mu.Unlock()
+      close(c.done)
+    }()
+  }
+  c.waiters++
+  m.mu.Unlock()
+
+  select {
+  case <-c.done:
+    return c.value, c.err
+  case <-ctx.Done():
+    m.mu.Lock()
+    c.waiters--
+    if c.waiters == 0 {
+      // Nobody is left to share the result with, so later callers start a call of their own
+      // instead of joining a cancelled one
+      c.cancel()
+      if m.calls[key] == c {
+        delete(m.calls, key)
+      }
+    }
+    m.mu.Unlock()
+    return nil, ctx.Err()
+  }
+}
+
+// dedupe returns the provided keys sorted and without duplicates.
+func dedupe(keys []string) []string {
+  sorted := make([]string, len(keys))
+  copy(sorted, keys)
+  sort.Strings(sorted)
+
+  var unique []string = []string{}
+  for i, key := range sorted {
+    if i == 0 || key != sorted[i-1] {
+      unique = append(unique, key)
+    }
+  }
+  return unique
+}
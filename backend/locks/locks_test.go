@@ -0,0 +1,121 @@
+package locks
+
+import (
+  "context"
+  "errors"
+  "testing"
+  "time"
+)
+
+// waitForWaiters waits until a call for the provided key has the provided number of waiters.
+func waitForWaiters(t *testing.T, m *Manager, key string, waiters int) {
+  t.Helper()
+
+  deadline := time.Now().Add(5 * time.Second)
+  for time.Now().Before(deadline) {
+    m.mu.Lock()
+    c, ok := m.calls[key]
+    joined := ok && c.waiters == waiters
+    m.mu.Unlock()
+    if joined {
+      return
+    }
+    time.Sleep(time.Millisecond)
+  }
+  t.Fatalf("Expected %d callers to wait on %s", waiters, key)
+}
+
+func TestDoCancelsCallOnceSoleWaiterLeaves(t *testing.T) {
+  m := NewManager()
+  started := make(chan struct{})
+  cancelled := make(chan error, 1)
+
+  ctx, cancel := context.WithCancel(context.Background())
+  result := make(chan error, 1)
+  go func() {
+    _, err := m.Do(ctx, "key", func(ctx context.Context) (any, error) {
+      close(started)
+      <-ctx.Done()
+      cancelled <- ctx.Err()
+      return nil, ctx.Err()
+    })
+    result <- err
+  }()
+
+  <-started
+  cancel()
+
+  if err := <-result; !errors.Is(err, context.Canceled) {
+    t.Errorf("Expected the caller to stop waiting with its context's error, got %v", err)
+  }
+
+  select {
+  case err := <-cancelled:
+    if !errors.Is(err, context.Canceled) {
+      t.Errorf("Expected the call to be cancelled, got %v", err)
+    }
+  case <-time.After(5 * time.Second):
+    t.Fatal("Expected the call to be cancelled once its only waiter left")
+  }
+
+  // Later callers start over instead of joining the cancelled call
+  value, err := m.Do(context.Background(), "key", func(ctx context.Context) (any, error) {
+    return "fresh", nil
+  })
+  if err != nil || value != "fresh" {
+    t.Errorf("Expected a fresh call after cancelling, got %v, %v", value, err)
+  }
+}
+
+func TestDoKeepsCallRunningWhileOtherWaitersRemain(t *testing.T) {
+  m := NewManager()
+  started := make(chan struct{})
+  release := make(chan struct{})
+  fn := func(ctx context.Context) (any, error) {
+    close(started)
+    select {
+    case <-release:
+      return "done", nil
+    case <-ctx.Done():
+      return nil, ctx.Err()
+    }
+  }
+
+  leavingCtx, cancel := context.WithCancel(context.Background())
+  leaving := make(chan error, 1)
+  go func() {
+    _, err := m.Do(leavingCtx, "key", fn)
+    leaving <- err
+  }()
+  <-started
+
+  type outcome struct {
+    value any
+    err   error
+  }
+  staying := make(chan outcome, 1)
+  go func() {
+    value, err := m.Do(context.Background(), "key", fn)
+    staying <- outcome{ value: value, err: err }
+  }()
+  waitForWaiters(t, m, "key", 2)
+
+  cancel()
+  if err := <-leaving; !errors.Is(err, context.Canceled) {
+    t.Errorf("Expected the leaving caller to stop waiting with its context's error, got %v", err)
+  }
+
+  close(release)
+  select {
+  case res := <-staying:
+    if res.err != nil || res.value != "done" {
+      t.Errorf(
+        "Expected the remaining caller to get the call's result, got %v, %v",
+        res.value,
+        res.err,
+      )
+    }
+  case <-time.After(5 * time.Second):
+    t.Fatal("Expected the call to finish for the remaining caller")
+  }
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"sync"
 
 	"database/sql"
 	"net/http"
@@ -13,8 +13,17 @@ import (
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 
+	"github.com/mbta-performance-dashboard/alerts"
+	"github.com/mbta-performance-dashboard/analytics"
 	"github.com/mbta-performance-dashboard/dwells"
+	"github.com/mbta-performance-dashboard/events"
 	"github.com/mbta-performance-dashboard/headways"
+	"github.com/mbta-performance-dashboard/locks"
+	"github.com/mbta-performance-dashboard/metrics"
+	"github.com/mbta-performance-dashboard/performanceapi"
+	"github.com/mbta-performance-dashboard/periods"
+	"github.com/mbta-performance-dashboard/routes"
+	"github.com/mbta-performance-dashboard/scheduler"
 	"github.com/mbta-performance-dashboard/traveltimes"
 	"github.com/mbta-performance-dashboard/types"
 	"github.com/mbta-performance-dashboard/utils"
@@ -40,11 +49,73 @@ func main() {
 	}
 	defer db.Close()
 
-	var mutex sync.Mutex
+	performanceAPIConfig, err := performanceapi.ConfigFromEnv()
+	if err != nil {
+		panic(fmt.Sprintf("Error configuring Performance API client: %v", err))
+	}
+	performanceAPILimitConfig, err := performanceapi.LimitConfigFromEnv()
+	if err != nil {
+		panic(fmt.Sprintf("Error configuring Performance API rate limit: %v", err))
+	}
+	performanceAPI := performanceapi.NewLimitedClient(
+		performanceapi.NewHTTPClient(performanceAPIConfig),
+		performanceAPILimitConfig,
+	)
+
+	lockManager := locks.NewManager()
 
 	r := gin.Default()
 	r.Use(cors.Default())
 
+	// route : -> []Route
+	r.GET("/route", func(c *gin.Context) {
+		statement := "SELECT id, type, color, display_name FROM route ORDER BY sort_order, id"
+
+		prepared, err := db.Prepare(statement)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"type": "error",
+				"data": fmt.Sprintf("Error preparing routes statement: %v", err),
+			})
+			return
+		}
+
+		rows, err := prepared.Query()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"type": "error",
+				"data": fmt.Sprintf("Failed to fetch routes: %v", err),
+			})
+			return
+		}
+
+		var routes []types.Route = []types.Route{}
+		for rows.Next() {
+			var route types.Route
+			err := rows.Scan(&route.ID, &route.Type, &route.Color, &route.DisplayName)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"type": "error",
+					"data": fmt.Sprintf("Error scanning routes: %v", err),
+				})
+				return
+			}
+			routes = append(routes, route)
+		}
+		rows.Close()
+
+		c.JSON(http.StatusOK, gin.H{
+			"type": "success",
+			"data": routes,
+		})
+	})
+
+	routeService := routes.NewService(db)
+	// route/:id : -> RouteDetail
+	r.GET("/route/:id", func(c *gin.Context) {
+		routes.SelectRoute(c, routeService)
+	})
+
 	// shape : []Shape
 	r.GET("/shape", func(c *gin.Context) {
 		statement := "SELECT * FROM shape"
@@ -90,7 +161,8 @@ func main() {
 
 	// stop : -> []Stop
 	r.GET("/stop", func(c *gin.Context) {
-		statement := "SELECT * FROM stop"
+		statement := "SELECT id, route_id, name, latitude, longitude, parent_station, platform_code " +
+			"FROM stop"
 
 		prepared, err := db.Prepare(statement)
 		if err != nil {
@@ -113,7 +185,15 @@ func main() {
 		var stops []types.Stop = []types.Stop{}
 		for rows.Next() {
 			var stop types.Stop
-			err := rows.Scan(&stop.ID, &stop.RouteID, &stop.Name, &stop.Latitude, &stop.Longitude)
+			err := rows.Scan(
+				&stop.ID,
+				&stop.RouteID,
+				&stop.Name,
+				&stop.Latitude,
+				&stop.Longitude,
+				&stop.ParentStation,
+				&stop.PlatformCode,
+			)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{
 					"type": "error",
@@ -131,38 +211,273 @@ func main() {
 		})
 	})
 
-	headwayService := headways.NewService(db, &mutex)
-	// /cache/headway : stop_ids []string, route_id string
+	// /performance_api/stats : -> map[string]EndpointStats
+	r.GET("/performance_api/stats", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"data": performanceAPI.Stats(),
+		})
+	})
+
+	headwayRetentionDays, err := utils.RetentionDaysFromEnv("HEADWAY_RETENTION_DAYS")
+	if err != nil {
+		panic(fmt.Sprintf("Error configuring retention: %v", err))
+	}
+	headwayService := headways.NewService(db, performanceAPI, lockManager, headwayRetentionDays)
+	// /cache/headway : stop_ids []string, station_id []string, route_id string, direction string
 	r.GET("/cache/headway", func(c *gin.Context) {
 		utils.Cache[*headways.Headway](c, headwayService)
 	})
 
-	// /headway : stop_ids []string, route_id string, start_datetime int, end_datetime int -> []Headway
+	// /headway : stop_ids []string, station_id []string, route_id string, direction string,
+	// start_datetime int, end_datetime int -> []Headway
 	r.GET("/headway", func(c *gin.Context) {
 		utils.Select[*headways.Headway](c, headwayService)
 	})
 
-	dwellService := dwells.NewService(db, &mutex)
-	// /cache/dwell : stop_ids []string, route_id string
+	// /v2/headway : stop_ids []string, station_id []string, route_id string, direction string,
+	// start_datetime int, end_datetime int -> []Headway
+	r.GET("/v2/headway", func(c *gin.Context) {
+		utils.SelectV2[*headways.Headway](c, headwayService)
+	})
+
+	// /stats/headway : stop_ids []string, station_id []string, route_id string, direction string,
+	// start_datetime int, end_datetime int, bucket int -> []Stat
+	r.GET("/stats/headway", func(c *gin.Context) {
+		utils.Stats[*headways.Headway](c, headwayService)
+	})
+
+	dwellRetentionDays, err := utils.RetentionDaysFromEnv("DWELL_RETENTION_DAYS")
+	if err != nil {
+		panic(fmt.Sprintf("Error configuring retention: %v", err))
+	}
+	dwellService := dwells.NewService(db, performanceAPI, lockManager, dwellRetentionDays)
+	// /cache/dwell : stop_ids []string, station_id []string, route_id string, direction string
 	r.GET("/cache/dwell", func(c *gin.Context) {
 		utils.Cache[*dwells.Dwell](c, dwellService)
 	})
 
-	// /dwell : stop_ids []string, route_id string, start_datetime int, end_datetime int -> []Dwell
+	// /dwell : stop_ids []string, station_id []string, route_id string, direction string,
+	// start_datetime int, end_datetime int -> []Dwell
 	r.GET("/dwell", func(c *gin.Context) {
 		utils.Select[*dwells.Dwell](c, dwellService)
 	})
 
-	travelTimeService := traveltimes.NewService(db, &mutex)
-	// /cache/travel_time : from_stop_ids []string, to_stop_ids []string, route_id string
+	// /v2/dwell : stop_ids []string, station_id []string, route_id string, direction string,
+	// start_datetime int, end_datetime int -> []Dwell
+	r.GET("/v2/dwell", func(c *gin.Context) {
+		utils.SelectV2[*dwells.Dwell](c, dwellService)
+	})
+
+	// /stats/dwell : stop_ids []string, station_id []string, route_id string, direction string,
+	// start_datetime int, end_datetime int, bucket int -> []Stat
+	r.GET("/stats/dwell", func(c *gin.Context) {
+		utils.Stats[*dwells.Dwell](c, dwellService)
+	})
+
+	eventRetentionDays, err := utils.RetentionDaysFromEnv("EVENT_RETENTION_DAYS")
+	if err != nil {
+		panic(fmt.Sprintf("Error configuring retention: %v", err))
+	}
+	eventService := events.NewService(db, performanceAPI, lockManager, eventRetentionDays)
+	// /cache/event : stop_ids []string, station_id []string, route_id string, direction string
+	r.GET("/cache/event", func(c *gin.Context) {
+		utils.Cache[*events.Event](c, eventService)
+	})
+
+	// /event : stop_ids []string, station_id []string, route_id string, direction string,
+	// start_datetime int, end_datetime int -> []Event
+	r.GET("/event", func(c *gin.Context) {
+		utils.Select[*events.Event](c, eventService)
+	})
+
+	// /v2/event : stop_ids []string, station_id []string, route_id string, direction string,
+	// start_datetime int, end_datetime int -> []Event
+	r.GET("/v2/event", func(c *gin.Context) {
+		utils.SelectV2[*events.Event](c, eventService)
+	})
+
+	travelTimeRetentionDays, err := utils.RetentionDaysFromEnv("TRAVEL_TIME_RETENTION_DAYS")
+	if err != nil {
+		panic(fmt.Sprintf("Error configuring retention: %v", err))
+	}
+	travelTimeService := traveltimes.NewService(
+		db,
+		performanceAPI,
+		lockManager,
+		travelTimeRetentionDays,
+	)
+	// /cache/travel_time : from_stop_ids []string, from_station_id []string, to_stop_ids []string,
+	// to_station_id []string, route_id string, direction string
 	r.GET("/cache/travel_time", func(c *gin.Context) {
 		traveltimes.CacheTravelTimes(c, travelTimeService)
 	})
 
-	// /travel_time : from_stop_ids []string, to_stop_ids []string, route_id string -> []TravelTime
+	// /travel_time : from_stop_ids []string, from_station_id []string, to_stop_ids []string,
+	// to_station_id []string, route_id string, direction string, start_datetime int,
+	// end_datetime int -> []TravelTime
 	r.GET("/travel_time", func(c *gin.Context) {
 		traveltimes.SelectTravelTimes(c, travelTimeService)
 	})
 
+	// /v2/travel_time : from_stop_ids []string, from_station_id []string, to_stop_ids []string,
+	// to_station_id []string, route_id string, direction string, start_datetime int,
+	// end_datetime int -> []TravelTime
+	r.GET("/v2/travel_time", func(c *gin.Context) {
+		traveltimes.SelectTravelTimesV2(c, travelTimeService)
+	})
+
+	// /stats/travel_time : from_stop_ids []string, from_station_id []string,
+	// to_stop_ids []string, to_station_id []string, route_id string, direction string,
+	// start_datetime int, end_datetime int, bucket int -> []Stat
+	r.GET("/stats/travel_time", func(c *gin.Context) {
+		traveltimes.StatsTravelTimes(c, travelTimeService)
+	})
+
+	// /analytics/travel_time_reliability : from_stop_ids []string, from_station_id []string,
+	// to_stop_ids []string, to_station_id []string, route_id string, direction string,
+	// start_datetime int, end_datetime int, bucket int, exceedance_pct float -> []Reliability
+	r.GET("/analytics/travel_time_reliability", func(c *gin.Context) {
+		traveltimes.ReliabilityTravelTimes(c, travelTimeService)
+	})
+
+	dailyMetricRetentionDays, err := utils.RetentionDaysFromEnv("DAILY_METRIC_RETENTION_DAYS")
+	if err != nil {
+		panic(fmt.Sprintf("Error configuring retention: %v", err))
+	}
+	metricService := metrics.NewService(db, performanceAPI, lockManager, dailyMetricRetentionDays)
+	// /cache/metrics/daily : route_id string
+	r.GET("/cache/metrics/daily", func(c *gin.Context) {
+		metrics.CacheDailyMetrics(c, metricService)
+	})
+
+	// /metrics/daily : route_id string, start string, end string -> []Day
+	r.GET("/metrics/daily", func(c *gin.Context) {
+		metrics.SelectDailyMetrics(c, metricService)
+	})
+
+	// /metrics/current : route_id string -> []CurrentMetric
+	r.GET("/metrics/current", func(c *gin.Context) {
+		metrics.SelectCurrentMetrics(c, metricService)
+	})
+
+	analyticsService := analytics.NewService(db)
+	// /analytics/headway_adherence : stop_ids []string, station_id []string, route_id string,
+	// direction string, start_datetime int, end_datetime int, bunched_ratio float,
+	// gapped_ratio float, granularity string -> HeadwayAdherence
+	r.GET("/analytics/headway_adherence", func(c *gin.Context) {
+		analytics.SelectHeadwayAdherence(c, analyticsService)
+	})
+
+	// /analytics/dwell_outliers : stop_ids []string, station_id []string, route_id string,
+	// direction string, start_datetime int, end_datetime int, method string,
+	// threshold float -> []DwellOutlier
+	r.GET("/analytics/dwell_outliers", func(c *gin.Context) {
+		analytics.SelectDwellOutliers(c, analyticsService)
+	})
+
+	periodConfig := periods.DefaultConfig()
+	if path, ok := os.LookupEnv("PERIOD_CONFIG"); ok {
+		periodConfig, err = periods.LoadConfig(path)
+		if err != nil {
+			panic(fmt.Sprintf("Error loading period config: %v", err))
+		}
+	}
+	profileService := periods.NewService(db, periodConfig)
+	// /profile : entity string, stop_ids []string, station_id []string, from_stop_ids []string,
+	// from_station_id []string, to_stop_ids []string, to_station_id []string, route_id string,
+	// direction string, start_datetime int, end_datetime int -> []ProfileStat
+	r.GET("/profile", func(c *gin.Context) {
+		periods.SelectProfile(c, profileService)
+	})
+
+	alertRetentionDays, err := utils.RetentionDaysFromEnv("ALERT_RETENTION_DAYS")
+	if err != nil {
+		panic(fmt.Sprintf("Error configuring retention: %v", err))
+	}
+	alertService := alerts.NewService(db, performanceAPI, lockManager, alertRetentionDays)
+	// /cache/alert : route_id string
+	r.GET("/cache/alert", func(c *gin.Context) {
+		alerts.CacheAlerts(c, alertService)
+	})
+
+	// /alert : route_id string, stop_ids []string, start_datetime int, end_datetime int -> []Alert
+	r.GET("/alert", func(c *gin.Context) {
+		alerts.SelectAlerts(c, alertService)
+	})
+
+	if path, ok := os.LookupEnv("SCHEDULER_CONFIG"); ok {
+		config, err := scheduler.LoadConfig(path)
+		if err != nil {
+			panic(fmt.Sprintf("Error loading scheduler config: %v", err))
+		}
+
+		// Jobs for stops or routes that aren't loaded would fail every night, so they're caught here
+		err = func() error {
+			tx, err := db.Begin()
+			if err != nil {
+				return fmt.Errorf("Error beginning transaction: %w", err)
+			}
+			defer tx.Rollback()
+
+			return scheduler.ValidateIDs(tx, config.Jobs)
+		}()
+		if err != nil {
+			panic(fmt.Sprintf("Error validating scheduler config: %v", err))
+		}
+
+		cacheScheduler, err := scheduler.New(config, map[string]scheduler.Refresher{
+			"headway": func(job scheduler.Job) (*types.CacheReport, error) {
+				return utils.CacheEntities[*headways.Headway](
+					context.Background(),
+					headwayService,
+					job.StopIDs,
+					job.RouteID,
+				)
+			},
+			"dwell": func(job scheduler.Job) (*types.CacheReport, error) {
+				return utils.CacheEntities[*dwells.Dwell](
+					context.Background(),
+					dwellService,
+					job.StopIDs,
+					job.RouteID,
+				)
+			},
+			"event": func(job scheduler.Job) (*types.CacheReport, error) {
+				return utils.CacheEntities[*events.Event](
+					context.Background(),
+					eventService,
+					job.StopIDs,
+					job.RouteID,
+				)
+			},
+			"daily_metric": func(job scheduler.Job) (*types.CacheReport, error) {
+				return metrics.CacheEntities(context.Background(), metricService, job.RouteID)
+			},
+			"alert": func(job scheduler.Job) (*types.CacheReport, error) {
+				return alerts.CacheEntities(context.Background(), alertService, job.RouteID)
+			},
+			"travel_time": func(job scheduler.Job) (*types.CacheReport, error) {
+				return traveltimes.CacheEntities(
+					context.Background(),
+					travelTimeService,
+					job.FromStopIDs,
+					job.ToStopIDs,
+					job.RouteID,
+				)
+			},
+		})
+		if err != nil {
+			panic(fmt.Sprintf("Error creating scheduler: %v", err))
+		}
+		cacheScheduler.Start()
+
+		// /scheduler/status : -> []Status
+		r.GET("/scheduler/status", func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{
+				"data": cacheScheduler.Statuses(),
+			})
+		})
+	}
+
 	r.Run()
 }
@@ -0,0 +1,424 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mbta-performance-dashboard/analytics"
+	"github.com/mbta-performance-dashboard/consts"
+	"github.com/mbta-performance-dashboard/locks"
+	"github.com/mbta-performance-dashboard/performanceapi"
+	"github.com/mbta-performance-dashboard/types"
+	"github.com/mbta-performance-dashboard/utils"
+)
+
+// A DailyAPIResponse represents a response from the MBTA Performance API's daily metrics endpoint.
+type DailyAPIResponse struct {
+	DailyMetrics []*DailyMetric `json:"daily_metrics"`
+}
+
+func (a *DailyAPIResponse) Entities() ([]*DailyMetric, []*types.RejectedRecord) {
+  if a == nil {
+    return nil, nil
+  }
+  return utils.Validate(a.DailyMetrics, func(dailyMetric *DailyMetric) (*DailyMetric, error) {
+    return dailyMetric, dailyMetric.Validate()
+  })
+}
+
+// A CurrentAPIResponse represents a response from the MBTA Performance API's current metrics
+// endpoint.
+type CurrentAPIResponse struct {
+	CurrentMetrics []*CurrentMetric `json:"current_metrics"`
+}
+
+
+// A DailyMetric represents the MBTA's official reliability of a route over a single service day,
+// as measured against one of its thresholds.
+type DailyMetric struct {
+	Route            string `json:"route_id"`
+	ServiceDate      string `json:"service_date"`
+	ThresholdID      string `json:"threshold_id"`
+	ThresholdName    string `json:"threshold_name"`
+	ThresholdType    string `json:"threshold_type"`
+	MetricResult     string `json:"metric_result"`
+	MetricResultTrip string `json:"metric_result_trip"`
+}
+
+// Validate checks that the service date and results of a daily metric can be converted before
+// it's inserted.
+func (d *DailyMetric) Validate() error {
+  if _, err := time.Parse(time.DateOnly, d.ServiceDate); err != nil {
+    return fmt.Errorf("Error parsing service date: %w", err)
+  }
+  if _, err := strconv.ParseFloat(d.MetricResult, 64); err != nil {
+    return fmt.Errorf("Error converting metric result to float: %w", err)
+  }
+  if _, err := strconv.ParseFloat(d.MetricResultTrip, 64); err != nil {
+    return fmt.Errorf("Error converting trip metric result to float: %w", err)
+  }
+  return nil
+}
+
+// StopID is always empty, since daily metrics are per route.
+func (m *DailyMetric) StopID() string {
+  return ""
+}
+
+func (m *DailyMetric) SetStopID(stopID string) {}
+
+func (m *DailyMetric) RouteID() string {
+  return m.Route
+}
+
+// A CurrentMetric represents the MBTA's official reliability of a route so far today, as measured
+// against one of its thresholds.
+type CurrentMetric struct {
+	Route                      string `json:"route_id"`
+	ThresholdID                string `json:"threshold_id"`
+	ThresholdName              string `json:"threshold_name"`
+	ThresholdType              string `json:"threshold_type"`
+	TimePeriodType             string `json:"time_period_type"`
+	MetricResultLastHour       string `json:"metric_result_last_hour"`
+	MetricResultCurrentDay     string `json:"metric_result_current_day"`
+	MetricResultTripLastHour   string `json:"metric_result_trip_last_hour"`
+	MetricResultTripCurrentDay string `json:"metric_result_trip_current_day"`
+}
+
+// A Day represents a route's official daily metrics for a single service day, alongside our own
+// headway adherence for that day.
+type Day struct {
+	ServiceDate string         `json:"service_date"`
+	Metrics     []*DailyMetric `json:"metrics"`
+
+	// HeadwayAdherence is the share of cached headways that were on time, neither bunched at half
+	// their benchmark or less nor gapped past 1.5 times it, or nil if no headways were cached for
+	// the day.
+	HeadwayAdherence *float64 `json:"headway_adherence"`
+	HeadwayCount     int      `json:"headway_count"`
+}
+
+
+// A MetricService represents a service that will fetch and store metrics.
+//
+// Metrics are per route rather than per stop, so unlike other services, everything is keyed by
+// route ID alone.
+type MetricService struct {
+  types.BaseService
+}
+
+func NewService(
+  db *sql.DB,
+  api performanceapi.Client,
+  lockManager *locks.Manager,
+  retentionDays int,
+) *MetricService {
+  return &MetricService{
+    BaseService: types.BaseService{
+      DB: db,
+      API: api,
+      Locks: lockManager,
+      Entity: "daily_metric",
+      RetentionDays: retentionDays,
+    },
+  }
+}
+
+func (s *MetricService) BeginTx() (*sql.Tx, error) {
+  return s.BaseService.BeginTx()
+}
+
+// Lock locks a route's daily metrics and returns a function that unlocks them.
+func (s *MetricService) Lock(routeID string) func() {
+  return s.Locks.Lock(fmt.Sprintf("%s:%s", s.Entity, routeID))
+}
+
+// Coalesce calls fn, unless a call for the same route is already in progress, in which case it
+// shares that call's result instead.
+//
+// fn is given a context that isn't cancelled along with ctx, and cancelling ctx only stops this
+// caller from waiting.
+func (s *MetricService) Coalesce(
+  ctx context.Context,
+  routeID string,
+  fn func(ctx context.Context) (any, error),
+) (any, error) {
+  return s.Locks.Do(ctx, fmt.Sprintf("%s:%s", s.Entity, routeID), fn)
+}
+
+// FetchDailyFromAPI fetches a route's daily metrics from the MBTA Performance API, in week-long
+// chunks from its last cache datetime (or 30 days ago) up to the end of yesterday.
+func (s *MetricService) FetchDailyFromAPI(
+  ctx context.Context,
+  tx *sql.Tx,
+  routeID string,
+) ([]types.ChunkResult[*DailyMetric], error) {
+  var datetime time.Time
+  cached := true
+  err := tx.QueryRow(
+    "SELECT value AT TIME ZONE 'America/New_York' FROM last_daily_metric_cache_datetime WHERE " +
+      "route_id = $1",
+    routeID,
+  ).Scan(&datetime)
+  if err == sql.ErrNoRows {
+    cached = false
+  } else if err != nil {
+    return nil, fmt.Errorf("Error querying datetimes: %w", err)
+  }
+
+  startOfToday, err := utils.StartOfToday()
+  if err != nil {
+    return nil, err
+  }
+
+  var chunks []types.Chunk = []types.Chunk{}
+  for _, window := range utils.CacheWindows(datetime, cached, startOfToday) {
+    chunks = append(chunks, types.Chunk{
+      Key: routeID,
+      Window: window,
+      Params: map[string]string{
+        "route": routeID,
+        "from_service_date": window.Start.Format(time.DateOnly),
+        "to_service_date": window.End.Format(time.DateOnly),
+      },
+    })
+  }
+
+  results := utils.FetchChunks[*DailyMetric, *DailyAPIResponse](ctx, s.API, "dailymetrics", chunks)
+  for _, result := range results {
+    for j := 0; j < len(result.Entities); j++ {
+      result.Entities[j].Route = routeID
+    }
+  }
+
+  return results, nil
+}
+
+// FetchCurrentFromAPI fetches a route's current metrics straight from the MBTA Performance API.
+//
+// Current metrics change throughout the day, so they're never cached.
+func (s *MetricService) FetchCurrentFromAPI(
+  ctx context.Context,
+  routeID string,
+) ([]*CurrentMetric, error) {
+  var apiRes CurrentAPIResponse
+  err := s.API.Get(ctx, "currentmetrics", map[string]string{ "route": routeID }, &apiRes)
+  if err != nil {
+    return nil, err
+  }
+
+  var currentMetrics []*CurrentMetric = []*CurrentMetric{}
+  for _, currentMetric := range apiRes.CurrentMetrics {
+    currentMetric.Route = routeID
+    currentMetrics = append(currentMetrics, currentMetric)
+  }
+  return currentMetrics, nil
+}
+
+func (s *MetricService) InsertDaily(tx *sql.Tx, dailyMetrics []*DailyMetric) error {
+	if len(dailyMetrics) == 0 {
+    return nil
+	}
+
+  var paramRouteIDs []string = []string{}
+  var paramServiceDates []string = []string{}
+  var paramThresholdIDs []string = []string{}
+  var paramThresholdNames []string = []string{}
+  var paramThresholdTypes []string = []string{}
+  var paramMetricResults []float64 = []float64{}
+  var paramMetricResultTrips []float64 = []float64{}
+
+  for i := 0; i < len(dailyMetrics); i++ {
+		if _, err := time.Parse(time.DateOnly, dailyMetrics[i].ServiceDate); err != nil {
+      return fmt.Errorf("Error parsing service date: %w", err)
+		}
+		convertedMetricResult, err := strconv.ParseFloat(dailyMetrics[i].MetricResult, 64)
+		if err != nil {
+      return fmt.Errorf("Error converting metric result to float: %w", err)
+		}
+		convertedMetricResultTrip, err := strconv.ParseFloat(dailyMetrics[i].MetricResultTrip, 64)
+		if err != nil {
+      return fmt.Errorf("Error converting trip metric result to float: %w", err)
+		}
+
+    paramRouteIDs = append(paramRouteIDs, dailyMetrics[i].RouteID())
+    paramServiceDates = append(paramServiceDates, dailyMetrics[i].ServiceDate)
+    paramThresholdIDs = append(paramThresholdIDs, dailyMetrics[i].ThresholdID)
+    paramThresholdNames = append(paramThresholdNames, dailyMetrics[i].ThresholdName)
+    paramThresholdTypes = append(paramThresholdTypes, dailyMetrics[i].ThresholdType)
+    paramMetricResults = append(paramMetricResults, convertedMetricResult)
+    paramMetricResultTrips = append(paramMetricResultTrips, convertedMetricResultTrip)
+	}
+
+  _, err := tx.Exec(
+    "INSERT INTO daily_metric (route_id, service_date, threshold_id, threshold_name, " +
+      "threshold_type, metric_result, metric_result_trip) SELECT DISTINCT ON (route_id, " +
+      "service_date, threshold_id) * FROM (SELECT " +
+      "unnest($1::text[]) AS route_id, " +
+      "unnest($2::date[]) AS service_date, " +
+      "unnest($3::text[]) AS threshold_id, " +
+      "unnest($4::text[]) AS threshold_name, " +
+      "unnest($5::text[]) AS threshold_type, " +
+      "unnest($6::double precision[]) AS metric_result, " +
+      "unnest($7::double precision[]) AS metric_result_trip) AS upserted " +
+      "ON CONFLICT (route_id, service_date, threshold_id) DO UPDATE SET " +
+      "threshold_name = EXCLUDED.threshold_name, " +
+      "threshold_type = EXCLUDED.threshold_type, " +
+      "metric_result = EXCLUDED.metric_result, " +
+      "metric_result_trip = EXCLUDED.metric_result_trip",
+    pq.Array(paramRouteIDs),
+    pq.Array(paramServiceDates),
+    pq.Array(paramThresholdIDs),
+    pq.Array(paramThresholdNames),
+    pq.Array(paramThresholdTypes),
+    pq.Array(paramMetricResults),
+    pq.Array(paramMetricResultTrips),
+  )
+	if err != nil {
+    return fmt.Errorf("Error inserting daily metrics: %w", err)
+	}
+
+  return nil
+}
+
+// SelectDaily selects a route's daily metrics between two service dates, inclusive, joined with
+// our own headway adherence for the same days.
+//
+// Only days with either metrics or headways are returned, in order.
+func (s *MetricService) SelectDaily(
+  tx *sql.Tx,
+  routeID string,
+  start time.Time,
+  end time.Time,
+) ([]*Day, error) {
+  days := make(map[string]*Day)
+  day := func(serviceDate time.Time) *Day {
+    key := serviceDate.Format(time.DateOnly)
+    if _, ok := days[key]; !ok {
+      days[key] = &Day{ ServiceDate: key, Metrics: []*DailyMetric{} }
+    }
+    return days[key]
+  }
+
+  // Each query's rows are closed before the next query, since a transaction can only read one
+  // query's rows at a time
+  err := func() error {
+    rows, err := tx.Query(
+      "SELECT route_id, service_date, threshold_id, threshold_name, threshold_type, " +
+        "metric_result, metric_result_trip FROM daily_metric WHERE route_id = $1 AND " +
+        "service_date BETWEEN $2 AND $3 ORDER BY service_date, threshold_id",
+      routeID,
+      start.Format(time.DateOnly),
+      end.Format(time.DateOnly),
+    )
+    if err != nil {
+      return fmt.Errorf("Error fetching daily metrics: %w", err)
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+      var dailyMetric DailyMetric
+      var serviceDate time.Time
+      err := rows.Scan(
+        &dailyMetric.Route,
+        &serviceDate,
+        &dailyMetric.ThresholdID,
+        &dailyMetric.ThresholdName,
+        &dailyMetric.ThresholdType,
+        &dailyMetric.MetricResult,
+        &dailyMetric.MetricResultTrip,
+      )
+      if err != nil {
+        return fmt.Errorf("Error scanning daily metrics: %w", err)
+      }
+      dailyMetric.ServiceDate = serviceDate.Format(time.DateOnly)
+
+      d := day(serviceDate)
+      d.Metrics = append(d.Metrics, &dailyMetric)
+    }
+
+    return nil
+  }()
+  if err != nil {
+    return nil, err
+  }
+
+  err = func() error {
+    rows, err := tx.Query(
+      fmt.Sprintf(
+        "SELECT service_date, COUNT(*), AVG(CASE WHEN classification = '%s' THEN 1.0 ELSE 0.0 " +
+          "END) FROM (SELECT %s AS service_date, %s AS classification FROM headway WHERE " +
+          "route_id = $1 AND benchmark_headway_time_sec > 0) AS headways WHERE service_date " +
+          "BETWEEN $2 AND $3 GROUP BY service_date",
+        analytics.HeadwayOnTime,
+        utils.ServiceDate("current_dep_dt"),
+        analytics.HeadwayClassification("$4", "$5"),
+      ),
+      routeID,
+      start.Format(time.DateOnly),
+      end.Format(time.DateOnly),
+      consts.HeadwayBunchingFactor,
+      consts.HeadwayAdherenceFactor,
+    )
+    if err != nil {
+      return fmt.Errorf("Error computing headway adherence: %w", err)
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+      var serviceDate time.Time
+      var count int
+      var adherence float64
+      if err := rows.Scan(&serviceDate, &count, &adherence); err != nil {
+        return fmt.Errorf("Error scanning headway adherence: %w", err)
+      }
+
+      d := day(serviceDate)
+      d.HeadwayCount = count
+      d.HeadwayAdherence = &adherence
+    }
+
+    return nil
+  }()
+  if err != nil {
+    return nil, err
+  }
+
+	var selected []*Day = []*Day{}
+	for date := start; !date.After(end); date = date.AddDate(0, 0, 1) {
+		if d, ok := days[date.Format(time.DateOnly)]; ok {
+			selected = append(selected, d)
+		}
+	}
+
+	return selected, nil
+}
+
+// UpdateDailyCacheDatetime advances the last cache datetime of a route's daily metrics to the
+// provided value.
+func (s *MetricService) UpdateDailyCacheDatetime(
+  tx *sql.Tx,
+  routeID string,
+  value time.Time,
+) error {
+  _, err := tx.Exec(
+    "INSERT INTO last_daily_metric_cache_datetime (route_id, value) VALUES ($1, $2) ON CONFLICT " +
+      "(route_id) DO UPDATE SET value = EXCLUDED.value WHERE " +
+      "last_daily_metric_cache_datetime.value < EXCLUDED.value",
+    routeID,
+    value,
+  )
+  if err != nil {
+    return fmt.Errorf("Error updating last cache datetime: %w", err)
+  }
+
+  return nil
+}
+
+func (s *MetricService) DeleteOutdated(tx *sql.Tx) error {
+  return utils.DeleteOutdated(tx, "daily_metric", "service_date", s.RetentionDays)
+}
@@ -0,0 +1,207 @@
+package metrics
+
+import (
+  "context"
+  "database/sql"
+  "errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+  "github.com/mbta-performance-dashboard/consts"
+  "github.com/mbta-performance-dashboard/types"
+  "github.com/mbta-performance-dashboard/utils"
+)
+
+func CacheDailyMetrics(c *gin.Context, service *MetricService) {
+	routeID := c.DefaultQuery("route_id", "")
+
+  report, err := CacheEntities(c.Request.Context(), service, routeID)
+  if err != nil {
+    utils.PropagateToResponse(c, err)
+    return
+  }
+
+  utils.RespondWithReport(c, report)
+}
+
+// CacheEntities caches a route's daily metrics up to the end of yesterday, without being tied to
+// a request.
+//
+// The route is keyed by its ID in the returned report.
+func CacheEntities(
+  ctx context.Context,
+  service *MetricService,
+  routeID string,
+) (*types.CacheReport, error) {
+  report, err := service.Coalesce(ctx, routeID, func(ctx context.Context) (any, error) {
+    unlock := service.Lock(routeID)
+    defer unlock()
+
+    return cacheEntities(ctx, service, routeID)
+  })
+  if err != nil {
+    return nil, err
+  }
+  return report.(*types.CacheReport), nil
+}
+
+// cacheEntities caches daily metrics, assuming that the caller has already locked the route.
+func cacheEntities(
+  ctx context.Context,
+  service *MetricService,
+  routeID string,
+) (*types.CacheReport, error) {
+  results, err := func() ([]types.ChunkResult[*DailyMetric], error) {
+    tx, err := service.BeginTx()
+    if err != nil {
+      return nil, err
+    }
+    defer tx.Rollback()
+
+    if err := utils.ValidateRouteID(tx, routeID); err != nil {
+      return nil, err
+    }
+
+    return service.FetchDailyFromAPI(ctx, tx, routeID)
+  }()
+  if err != nil {
+    return nil, err
+  }
+
+  report := utils.CommitChunks[*DailyMetric](
+    service.BeginTx,
+    []string{ routeID },
+    results,
+    func(tx *sql.Tx, result types.ChunkResult[*DailyMetric]) error {
+      return service.InsertDaily(tx, result.Entities)
+    },
+    func(tx *sql.Tx, result types.ChunkResult[*DailyMetric]) error {
+      return service.UpdateDailyCacheDatetime(
+        tx,
+        routeID,
+        result.Chunk.Window.End.Add(time.Second),
+      )
+    },
+  )
+
+  if err := utils.DeleteOutdatedInTx(service.BeginTx, service.DeleteOutdated); err != nil {
+    return nil, err
+  }
+
+  return report, nil
+}
+
+// parseServiceDates parses a range of service dates from a request's start and end query
+// parameters, as YYYY-MM-DD.
+//
+// Defaults to the last 30 days up to and including yesterday, and ranges may be at most 90 days
+// long.
+func parseServiceDates(c *gin.Context) (time.Time, time.Time, error) {
+  startOfToday, err := utils.StartOfToday()
+  if err != nil {
+    return time.Time{}, time.Time{}, err
+  }
+  yesterday := startOfToday.AddDate(0, 0, -1)
+
+  end, err := time.Parse(time.DateOnly, c.DefaultQuery("end", yesterday.Format(time.DateOnly)))
+  if err != nil {
+    return time.Time{}, time.Time{}, errors.New("Invalid end date, expected YYYY-MM-DD")
+  }
+
+  start, err := time.Parse(
+    time.DateOnly,
+    c.DefaultQuery("start", end.AddDate(0, 0, -consts.MaxDays+1).Format(time.DateOnly)),
+  )
+  if err != nil {
+    return time.Time{}, time.Time{}, errors.New("Invalid start date, expected YYYY-MM-DD")
+  }
+
+  if end.Before(start) {
+    return time.Time{}, time.Time{}, errors.New("End date must not be before start date")
+  }
+
+  if end.Sub(start).Hours()/24 >= float64(consts.MaxQueryDays) {
+    return time.Time{}, time.Time{}, fmt.Errorf(
+      "Date range must be at most %d days long",
+      consts.MaxQueryDays,
+    )
+  }
+
+  return start, end, nil
+}
+
+func SelectDailyMetrics(c *gin.Context, service *MetricService) {
+	routeID := c.DefaultQuery("route_id", "")
+
+  var days []*Day
+  err := func() error {
+    start, end, err := parseServiceDates(c)
+    if err != nil {
+      return err
+    }
+
+    tx, err := service.BeginTx()
+    if err != nil {
+      return err
+    }
+    defer func() {
+      if tx != nil {
+        tx.Rollback()
+      }
+    }()
+
+    if err := utils.ValidateRouteID(tx, routeID); err != nil {
+      return err
+    }
+
+    days, err = service.SelectDaily(tx, routeID, start, end)
+    if err != nil {
+      return err
+    }
+
+    if err = tx.Commit(); err != nil {
+      return fmt.Errorf("Error committing transaction: %w", err)
+    }
+    tx = nil
+
+    return nil
+  }()
+  if err != nil {
+    utils.PropagateToResponse(c, err)
+    return
+  }
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": days,
+	})
+}
+
+func SelectCurrentMetrics(c *gin.Context, service *MetricService) {
+	routeID := c.DefaultQuery("route_id", "")
+
+  var currentMetrics []*CurrentMetric
+  err := func() error {
+    tx, err := service.BeginTx()
+    if err != nil {
+      return err
+    }
+    err = utils.ValidateRouteID(tx, routeID)
+    tx.Rollback()
+    if err != nil {
+      return err
+    }
+
+    currentMetrics, err = service.FetchCurrentFromAPI(c.Request.Context(), routeID)
+    return err
+  }()
+  if err != nil {
+    utils.PropagateToResponse(c, err)
+    return
+  }
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": currentMetrics,
+	})
+}
@@ -0,0 +1,36 @@
+package metrics
+
+import (
+  "net/http/httptest"
+  "testing"
+
+  "github.com/gin-gonic/gin"
+)
+
+func TestParseServiceDatesCapsRange(t *testing.T) {
+  cases := []struct {
+    name  string
+    query string
+    valid bool
+  }{
+    { name: "90 days", query: "start=2024-01-01&end=2024-03-30", valid: true },
+    { name: "91 days", query: "start=2024-01-01&end=2024-03-31", valid: false },
+    { name: "unbounded start", query: "start=1900-01-01&end=2024-03-31", valid: false },
+    { name: "end before start", query: "start=2024-01-02&end=2024-01-01", valid: false },
+  }
+
+  for _, tc := range cases {
+    t.Run(tc.name, func(t *testing.T) {
+      c, _ := gin.CreateTestContext(httptest.NewRecorder())
+      c.Request = httptest.NewRequest("GET", "/metrics/daily?" + tc.query, nil)
+
+      _, _, err := parseServiceDates(c)
+      if tc.valid && err != nil {
+        t.Errorf("Expected %s to be valid, got %v", tc.query, err)
+      }
+      if !tc.valid && err == nil {
+        t.Errorf("Expected %s to be rejected", tc.query)
+      }
+    })
+  }
+}
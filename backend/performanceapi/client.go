@@ -0,0 +1,219 @@
+package performanceapi
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "net/http"
+  "net/url"
+  "os"
+  "strconv"
+  "time"
+
+  "github.com/mbta-performance-dashboard/consts"
+)
+
+// A Client represents a client for the MBTA Performance API.
+//
+// Services depend on this interface rather than on HTTP directly, so that a fake can be swapped in
+// wherever the real API shouldn't be hit.
+type Client interface {
+  // Get fetches from the provided endpoint with the provided query params, and decodes the JSON
+  // response into out.
+  //
+  // Returns a *StatusError, *DecodeError or *TimeoutError if the request didn't succeed.
+  Get(ctx context.Context, endpoint string, params map[string]string, out any) error
+}
+
+// A Config represents how to reach the MBTA Performance API.
+type Config struct {
+  BaseURL string
+  APIKey  string
+  Timeout time.Duration
+}
+
+// ConfigFromEnv creates a config from environment variables.
+//
+// PERFORMANCE_API_KEY is required, while PERFORMANCE_API_URL and PERFORMANCE_API_TIMEOUT_SEC
+// default to the public API and 30 seconds respectively.
+func ConfigFromEnv() (Config, error) {
+  config := Config{
+    BaseURL: consts.ApiPerformance,
+    APIKey:  os.Getenv("PERFORMANCE_API_KEY"),
+    Timeout: 30 * time.Second,
+  }
+
+  if baseURL, ok := os.LookupEnv("PERFORMANCE_API_URL"); ok {
+    config.BaseURL = baseURL
+  }
+
+  if value, ok := os.LookupEnv("PERFORMANCE_API_TIMEOUT_SEC"); ok {
+    seconds, err := strconv.Atoi(value)
+    if err != nil || seconds <= 0 {
+      return Config{}, fmt.Errorf("Invalid Performance API timeout %s", value)
+    }
+    config.Timeout = time.Duration(seconds) * time.Second
+  }
+
+  return config, nil
+}
+
+// A StatusError represents a response from the Performance API with a non-2xx status code.
+//
+// RetryAfter is set if the response asked to be retried after some time, like most 429s do.
+type StatusError struct {
+  Endpoint   string
+  StatusCode int
+  Body       string
+  RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+  return fmt.Sprintf(
+    "Performance API endpoint %s responded with status %d: %s",
+    e.Endpoint,
+    e.StatusCode,
+    e.Body,
+  )
+}
+
+// A DecodeError represents a response from the Performance API that couldn't be decoded, like an
+// HTML error page.
+type DecodeError struct {
+  Endpoint string
+  Err      error
+}
+
+func (e *DecodeError) Error() string {
+  return fmt.Sprintf("Error decoding response from Performance API endpoint %s: %v", e.Endpoint, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+  return e.Err
+}
+
+// A TimeoutError represents a request to the Performance API that didn't finish in time.
+type TimeoutError struct {
+  Endpoint string
+  Err      error
+}
+
+func (e *TimeoutError) Error() string {
+  return fmt.Sprintf("Request to Performance API endpoint %s timed out: %v", e.Endpoint, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+  return e.Err
+}
+
+// maxErrorBodyLength is the most of an error response's body that is kept in a StatusError.
+const maxErrorBodyLength int = 512
+
+// An HTTPClient represents a Client that fetches from the Performance API over HTTP.
+type HTTPClient struct {
+  config Config
+  client *http.Client
+}
+
+func NewHTTPClient(config Config) *HTTPClient {
+  return &HTTPClient{
+    config: config,
+    client: &http.Client{ Timeout: config.Timeout },
+  }
+}
+
+func (c *HTTPClient) Get(
+  ctx context.Context,
+  endpoint string,
+  params map[string]string,
+  out any,
+) error {
+  req, err := http.NewRequestWithContext(
+    ctx,
+    "GET",
+    fmt.Sprintf("%s/%s", c.config.BaseURL, endpoint),
+    nil,
+  )
+  if err != nil {
+    return fmt.Errorf("Error creating HTTP request to endpoint %s: %w", endpoint, err)
+  }
+
+  query := req.URL.Query()
+  query.Add("api_key", c.config.APIKey)
+  query.Add("format", "json")
+  for k, v := range params {
+    query.Add(k, v)
+  }
+  req.URL.RawQuery = query.Encode()
+
+  res, err := c.client.Do(req)
+  if err != nil {
+    err = redactAPIKey(req, err)
+    if isTimeout(err) {
+      return &TimeoutError{ Endpoint: endpoint, Err: err }
+    }
+    return fmt.Errorf("Error fetching from endpoint %s: %w", endpoint, err)
+  }
+  defer res.Body.Close()
+
+  body, err := io.ReadAll(res.Body)
+  if err != nil {
+    if isTimeout(err) {
+      return &TimeoutError{ Endpoint: endpoint, Err: err }
+    }
+    return fmt.Errorf("Error reading response body from endpoint %s: %w", endpoint, err)
+  }
+
+  if res.StatusCode < 200 || res.StatusCode > 299 {
+    if len(body) > maxErrorBodyLength {
+      body = body[:maxErrorBodyLength]
+    }
+    statusErr := &StatusError{
+      Endpoint:   endpoint,
+      StatusCode: res.StatusCode,
+      Body:       string(body),
+    }
+    if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && seconds > 0 {
+      statusErr.RetryAfter = time.Duration(seconds) * time.Second
+    }
+    return statusErr
+  }
+
+  if err := json.Unmarshal(body, out); err != nil {
+    return &DecodeError{ Endpoint: endpoint, Err: err }
+  }
+
+  return nil
+}
+
+// redactAPIKey redacts the API key from the URL that an error from sending a request names, so
+// that the key never reaches anyone the error is reported to.
+func redactAPIKey(req *http.Request, err error) error {
+  var urlErr *url.Error
+  if !errors.As(err, &urlErr) {
+    return err
+  }
+
+  redacted := *req.URL
+  query := redacted.Query()
+  if query.Has("api_key") {
+    query.Set("api_key", "REDACTED")
+  }
+  redacted.RawQuery = query.Encode()
+  urlErr.URL = redacted.String()
+
+  return err
+}
+
+// isTimeout determines whether an error was caused by a request timing out.
+func isTimeout(err error) bool {
+  if errors.Is(err, context.DeadlineExceeded) {
+    return true
+  }
+
+  var netErr net.Error
+  return errors.As(err, &netErr) && netErr.Timeout()
+}
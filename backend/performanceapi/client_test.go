@@ -0,0 +1,61 @@
+package performanceapi
+
+import (
+  "context"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+)
+
+const testAPIKey string = "secret-test-key"
+
+func TestGetRedactsAPIKeyFromErrors(t *testing.T) {
+  slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    <-r.Context().Done()
+  }))
+  defer slow.Close()
+
+  closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  closedURL := closed.URL
+  closed.Close()
+
+  cases := []struct {
+    name    string
+    baseURL string
+    timeout time.Duration
+  }{
+    { name: "timeout", baseURL: slow.URL, timeout: 50 * time.Millisecond },
+    { name: "connection refused", baseURL: closedURL, timeout: 5 * time.Second },
+  }
+
+  for _, tc := range cases {
+    t.Run(tc.name, func(t *testing.T) {
+      client := NewHTTPClient(Config{
+        BaseURL: tc.baseURL,
+        APIKey:  testAPIKey,
+        Timeout: tc.timeout,
+      })
+
+      var out any
+      params := map[string]string{ "stop": "70061" }
+      err := client.Get(context.Background(), "headways", params, &out)
+      if err == nil {
+        t.Fatal("Expected the request to fail")
+      }
+      if strings.Contains(err.Error(), testAPIKey) {
+        t.Errorf("Expected the error not to contain the API key, got %v", err)
+      }
+      if !strings.Contains(err.Error(), "stop=70061") {
+        t.Errorf("Expected the error to still name the rest of the URL, got %v", err)
+      }
+
+      var timeoutErr *TimeoutError
+      if tc.name == "timeout" && !errors.As(err, &timeoutErr) {
+        t.Errorf("Expected a *TimeoutError, got %T", err)
+      }
+    })
+  }
+}
@@ -0,0 +1,320 @@
+package performanceapi
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "math/rand"
+  "net/http"
+  "os"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// A LimitConfig represents how fast and how persistently requests are made to the Performance API.
+type LimitConfig struct {
+  // RequestsPerSec is the rate at which tokens are added to the shared token bucket.
+  RequestsPerSec float64
+
+  // Burst is the most tokens the bucket can hold, and so the most requests that can start at once
+  // after a quiet period.
+  Burst int
+
+  // MaxInFlight is the most requests that can be waiting on the Performance API at once.
+  MaxInFlight int
+
+  // MaxRetries is how many times a request is retried after a 429, 5xx or timeout.
+  MaxRetries int
+
+  // BaseBackoff is how long to wait before the first retry, doubling for every retry after.
+  BaseBackoff time.Duration
+
+  // MaxBackoff caps how long to wait before any single retry.
+  MaxBackoff time.Duration
+}
+
+// LimitConfigFromEnv creates a limit config from environment variables, defaulting to a
+// conservative 2 requests per second and 4 requests in flight.
+func LimitConfigFromEnv() (LimitConfig, error) {
+  config := LimitConfig{
+    RequestsPerSec: 2,
+    Burst:          4,
+    MaxInFlight:    4,
+    MaxRetries:     4,
+    BaseBackoff:    time.Second,
+    MaxBackoff:     30 * time.Second,
+  }
+
+  if value, ok := os.LookupEnv("PERFORMANCE_API_REQUESTS_PER_SEC"); ok {
+    requestsPerSec, err := strconv.ParseFloat(value, 64)
+    if err != nil || requestsPerSec <= 0 {
+      return LimitConfig{}, fmt.Errorf("Invalid Performance API requests per second %s", value)
+    }
+    config.RequestsPerSec = requestsPerSec
+  }
+
+  if value, ok := os.LookupEnv("PERFORMANCE_API_BURST"); ok {
+    burst, err := strconv.Atoi(value)
+    if err != nil || burst < 1 {
+      return LimitConfig{}, fmt.Errorf("Invalid Performance API burst %s", value)
+    }
+    config.Burst = burst
+  }
+
+  if value, ok := os.LookupEnv("PERFORMANCE_API_MAX_IN_FLIGHT"); ok {
+    maxInFlight, err := strconv.Atoi(value)
+    if err != nil || maxInFlight < 1 {
+      return LimitConfig{}, fmt.Errorf("Invalid Performance API max in flight %s", value)
+    }
+    config.MaxInFlight = maxInFlight
+  }
+
+  if value, ok := os.LookupEnv("PERFORMANCE_API_MAX_RETRIES"); ok {
+    maxRetries, err := strconv.Atoi(value)
+    if err != nil || maxRetries < 0 {
+      return LimitConfig{}, fmt.Errorf("Invalid Performance API max retries %s", value)
+    }
+    config.MaxRetries = maxRetries
+  }
+
+  return config, nil
+}
+
+// An EndpointStats represents counters for the requests made to a single Performance API endpoint.
+type EndpointStats struct {
+  Requests     int64         `json:"requests"`
+  Successes    int64         `json:"successes"`
+  Failures     int64         `json:"failures"`
+  Retries      int64         `json:"retries"`
+  RateLimited  int64         `json:"rate_limited"`
+  ServerErrors int64         `json:"server_errors"`
+  Timeouts     int64         `json:"timeouts"`
+  InFlight     int           `json:"in_flight"`
+  PeakInFlight int           `json:"peak_in_flight"`
+  TotalWait    time.Duration `json:"total_wait_ns"`
+}
+
+// A clock represents a source of the current time and of timers, so that waiting can be faked.
+type clock interface {
+  Now() time.Time
+
+  // NewTimer returns a channel that receives once the duration has passed, along with a function
+  // that stops it.
+  NewTimer(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+// A realClock represents the system clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+  return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+  timer := time.NewTimer(d)
+  return timer.C, timer.Stop
+}
+
+// A LimitedClient represents a Client that shares a rate limit and an in-flight limit across every
+// request it makes, retrying throttled and failed requests with exponential backoff.
+type LimitedClient struct {
+  inner    Client
+  config   LimitConfig
+  clock    clock
+  bucket   *tokenBucket
+  inFlight chan struct{}
+
+  mu    sync.Mutex
+  stats map[string]*EndpointStats
+}
+
+func NewLimitedClient(inner Client, config LimitConfig) *LimitedClient {
+  return newLimitedClient(inner, config, realClock{})
+}
+
+func newLimitedClient(inner Client, config LimitConfig, clock clock) *LimitedClient {
+  return &LimitedClient{
+    inner:    inner,
+    config:   config,
+    clock:    clock,
+    bucket:   newTokenBucket(config.RequestsPerSec, config.Burst, clock),
+    inFlight: make(chan struct{}, config.MaxInFlight),
+    stats:    make(map[string]*EndpointStats),
+  }
+}
+
+func (c *LimitedClient) Get(
+  ctx context.Context,
+  endpoint string,
+  params map[string]string,
+  out any,
+) error {
+  var err error
+  for attempt := 0; ; attempt++ {
+    err = c.attempt(ctx, endpoint, params, out)
+    if err == nil {
+      c.record(endpoint, func(stats *EndpointStats) { stats.Successes++ })
+      return nil
+    }
+
+    if !retryable(err) || attempt >= c.config.MaxRetries {
+      break
+    }
+
+    c.record(endpoint, func(stats *EndpointStats) { stats.Retries++ })
+    timer, stop := c.clock.NewTimer(c.backoff(attempt, err))
+    select {
+    case <-ctx.Done():
+      stop()
+      c.record(endpoint, func(stats *EndpointStats) { stats.Failures++ })
+      return ctx.Err()
+    case <-timer:
+    }
+  }
+
+  c.record(endpoint, func(stats *EndpointStats) { stats.Failures++ })
+  return err
+}
+
+// Stats returns a snapshot of the counters for every endpoint requested so far.
+func (c *LimitedClient) Stats() map[string]EndpointStats {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  stats := make(map[string]EndpointStats, len(c.stats))
+  for endpoint, endpointStats := range c.stats {
+    stats[endpoint] = *endpointStats
+  }
+  return stats
+}
+
+// attempt makes a single request once both a token and an in-flight slot are available.
+func (c *LimitedClient) attempt(
+  ctx context.Context,
+  endpoint string,
+  params map[string]string,
+  out any,
+) error {
+  start := c.clock.Now()
+  if err := c.bucket.Wait(ctx); err != nil {
+    return err
+  }
+
+  select {
+  case c.inFlight <- struct{}{}:
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+  defer func() { <-c.inFlight }()
+
+  c.record(endpoint, func(stats *EndpointStats) {
+    stats.Requests++
+    stats.TotalWait += c.clock.Now().Sub(start)
+    stats.InFlight++
+    stats.PeakInFlight = max(stats.PeakInFlight, stats.InFlight)
+  })
+  err := c.inner.Get(ctx, endpoint, params, out)
+  c.record(endpoint, func(stats *EndpointStats) {
+    stats.InFlight--
+
+    var statusErr *StatusError
+    var timeoutErr *TimeoutError
+    if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests {
+      stats.RateLimited++
+    } else if errors.As(err, &statusErr) && statusErr.StatusCode >= 500 {
+      stats.ServerErrors++
+    } else if errors.As(err, &timeoutErr) {
+      stats.Timeouts++
+    }
+  })
+
+  return err
+}
+
+// backoff returns how long to wait before retrying after the provided attempt, preferring the
+// Performance API's Retry-After if it gave one.
+func (c *LimitedClient) backoff(attempt int, err error) time.Duration {
+  var statusErr *StatusError
+  if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+    return min(statusErr.RetryAfter, c.config.MaxBackoff)
+  }
+
+  backoff := c.config.BaseBackoff << attempt
+  if backoff <= 0 || backoff > c.config.MaxBackoff {
+    backoff = c.config.MaxBackoff
+  }
+
+  // Full jitter keeps retries from many goroutines from lining up with each other
+  return time.Duration(rand.Int63n(int64(backoff)) + 1)
+}
+
+// record updates the counters for an endpoint.
+func (c *LimitedClient) record(endpoint string, update func(stats *EndpointStats)) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  stats, ok := c.stats[endpoint]
+  if !ok {
+    stats = &EndpointStats{}
+    c.stats[endpoint] = stats
+  }
+  update(stats)
+}
+
+// retryable determines whether a failed request is worth retrying.
+func retryable(err error) bool {
+  var statusErr *StatusError
+  if errors.As(err, &statusErr) {
+    return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+  }
+
+  var timeoutErr *TimeoutError
+  return errors.As(err, &timeoutErr)
+}
+
+// A tokenBucket represents a rate limiter that allows bursts of up to its capacity.
+type tokenBucket struct {
+  mu       sync.Mutex
+  clock    clock
+  rate     float64
+  capacity float64
+  tokens   float64
+  last     time.Time
+}
+
+func newTokenBucket(rate float64, capacity int, clock clock) *tokenBucket {
+  return &tokenBucket{
+    clock:    clock,
+    rate:     rate,
+    capacity: float64(capacity),
+    tokens:   float64(capacity),
+    last:     clock.Now(),
+  }
+}
+
+// Wait blocks until a token is available and takes it, or until the context is done.
+func (b *tokenBucket) Wait(ctx context.Context) error {
+  for {
+    b.mu.Lock()
+    now := b.clock.Now()
+    b.tokens = min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+    b.last = now
+
+    if b.tokens >= 1 {
+      b.tokens--
+      b.mu.Unlock()
+      return nil
+    }
+    wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+    b.mu.Unlock()
+
+    timer, stop := b.clock.NewTimer(wait)
+    select {
+    case <-ctx.Done():
+      stop()
+      return ctx.Err()
+    case <-timer:
+    }
+  }
+}
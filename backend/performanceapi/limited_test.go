@@ -0,0 +1,317 @@
+package performanceapi
+
+import (
+  "context"
+  "errors"
+  "net/http"
+  "sync"
+  "testing"
+  "time"
+)
+
+// A fakeClock represents a clock where every timer fires immediately, moving the clock forward by
+// its duration.
+type fakeClock struct {
+  mu    sync.Mutex
+  now   time.Time
+  waits []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  c.now = c.now.Add(d)
+  c.waits = append(c.waits, d)
+  fired := make(chan time.Time, 1)
+  fired <- c.now
+  return fired, func() bool { return false }
+}
+
+// Waits returns how long every timer so far waited for, in order.
+func (c *fakeClock) Waits() []time.Duration {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return append([]time.Duration{}, c.waits...)
+}
+
+// A fakeClient represents a Client that fails each endpoint's requests with the errors scripted for
+// it, in order, and succeeds once they run out.
+//
+// If release is set, every request signals started and then blocks until release is closed.
+type fakeClient struct {
+  mu       sync.Mutex
+  errs     map[string][]error
+  calls    map[string]int
+  inFlight int
+  peak     int
+  started  chan struct{}
+  release  chan struct{}
+}
+
+func newFakeClient(errs map[string][]error) *fakeClient {
+  return &fakeClient{ errs: errs, calls: make(map[string]int) }
+}
+
+func (c *fakeClient) Get(
+  ctx context.Context,
+  endpoint string,
+  params map[string]string,
+  out any,
+) error {
+  c.mu.Lock()
+  var err error
+  if call := c.calls[endpoint]; call < len(c.errs[endpoint]) {
+    err = c.errs[endpoint][call]
+  }
+  c.calls[endpoint]++
+  c.inFlight++
+  c.peak = max(c.peak, c.inFlight)
+  c.mu.Unlock()
+
+  if c.release != nil {
+    c.started <- struct{}{}
+    <-c.release
+  }
+
+  c.mu.Lock()
+  c.inFlight--
+  c.mu.Unlock()
+  return err
+}
+
+// Calls returns how many requests were made to an endpoint.
+func (c *fakeClient) Calls(endpoint string) int {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.calls[endpoint]
+}
+
+// testLimitConfig returns a config that's only limited by its retries.
+func testLimitConfig() LimitConfig {
+  return LimitConfig{
+    RequestsPerSec: 1000,
+    Burst:          100,
+    MaxInFlight:    4,
+    MaxRetries:     4,
+    BaseBackoff:    time.Second,
+    MaxBackoff:     30 * time.Second,
+  }
+}
+
+func TestLimitedClientWaitsForTokens(t *testing.T) {
+  config := testLimitConfig()
+  config.RequestsPerSec = 2
+  config.Burst = 2
+  clock := &fakeClock{}
+  client := newLimitedClient(newFakeClient(nil), config, clock)
+
+  for i := 0; i < 6; i++ {
+    if err := client.Get(context.Background(), "headways", nil, nil); err != nil {
+      t.Fatalf("Expected request %d to succeed, got %v", i, err)
+    }
+  }
+
+  // The burst is spent right away, and every request after it waits for the next token
+  waits := clock.Waits()
+  if len(waits) != 4 {
+    t.Fatalf("Expected 4 waits for tokens, got %v", waits)
+  }
+  for _, wait := range waits {
+    if wait != 500 * time.Millisecond {
+      t.Errorf("Expected every wait to be 500ms at 2 requests per second, got %v", waits)
+      break
+    }
+  }
+
+  stats := client.Stats()["headways"]
+  if stats.Requests != 6 || stats.TotalWait != 2 * time.Second {
+    t.Errorf("Expected 6 requests waiting 2s in total, got %+v", stats)
+  }
+}
+
+func TestLimitedClientCapsRequestsInFlight(t *testing.T) {
+  const requests = 10
+  config := testLimitConfig()
+  config.MaxInFlight = 3
+  inner := newFakeClient(nil)
+  inner.started = make(chan struct{}, requests)
+  inner.release = make(chan struct{})
+  client := newLimitedClient(inner, config, &fakeClock{})
+
+  var wg sync.WaitGroup
+  for i := 0; i < requests; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      client.Get(context.Background(), "headways", nil, nil)
+    }()
+  }
+
+  for i := 0; i < config.MaxInFlight; i++ {
+    <-inner.started
+  }
+  select {
+  case <-inner.started:
+    t.Errorf("Expected at most %d requests in flight", config.MaxInFlight)
+  case <-time.After(50 * time.Millisecond):
+  }
+
+  close(inner.release)
+  wg.Wait()
+
+  if inner.peak != config.MaxInFlight {
+    t.Errorf("Expected %d requests in flight at most, got %d", config.MaxInFlight, inner.peak)
+  }
+  stats := client.Stats()["headways"]
+  if stats.Requests != requests || stats.PeakInFlight != config.MaxInFlight || stats.InFlight != 0 {
+    t.Errorf(
+      "Expected %d requests peaking at %d in flight, got %+v",
+      requests,
+      config.MaxInFlight,
+      stats,
+    )
+  }
+}
+
+func TestLimitedClientRetriesOnlyRetryableErrors(t *testing.T) {
+  cases := []struct {
+    name      string
+    err       error
+    retryable bool
+  }{
+    { name: "429", err: &StatusError{ StatusCode: 429 }, retryable: true },
+    { name: "500", err: &StatusError{ StatusCode: 500 }, retryable: true },
+    { name: "503", err: &StatusError{ StatusCode: 503 }, retryable: true },
+    { name: "timeout", err: &TimeoutError{ Err: context.DeadlineExceeded }, retryable: true },
+    { name: "400", err: &StatusError{ StatusCode: 400 }, retryable: false },
+    { name: "404", err: &StatusError{ StatusCode: 404 }, retryable: false },
+  }
+
+  for _, tc := range cases {
+    t.Run(tc.name, func(t *testing.T) {
+      inner := newFakeClient(map[string][]error{ "headways": { tc.err } })
+      clock := &fakeClock{}
+      client := newLimitedClient(inner, testLimitConfig(), clock)
+
+      err := client.Get(context.Background(), "headways", nil, nil)
+      calls := inner.Calls("headways")
+      if tc.retryable {
+        if err != nil || calls != 2 {
+          t.Errorf("Expected one retry to succeed, got %d requests and %v", calls, err)
+        }
+        if waits := clock.Waits(); len(waits) != 1 || waits[0] <= 0 || waits[0] > time.Second {
+          t.Errorf("Expected a single backoff of at most the base backoff, got %v", waits)
+        }
+      } else {
+        if !errors.Is(err, tc.err) || calls != 1 {
+          t.Errorf("Expected no retries, got %d requests and %v", calls, err)
+        }
+      }
+    })
+  }
+}
+
+func TestLimitedClientHonorsRetryAfter(t *testing.T) {
+  cases := []struct {
+    name       string
+    retryAfter time.Duration
+    expected   time.Duration
+  }{
+    { name: "within max backoff", retryAfter: 7 * time.Second, expected: 7 * time.Second },
+    { name: "beyond max backoff", retryAfter: time.Minute, expected: 30 * time.Second },
+  }
+
+  for _, tc := range cases {
+    t.Run(tc.name, func(t *testing.T) {
+      statusErr := &StatusError{
+        StatusCode: http.StatusTooManyRequests,
+        RetryAfter: tc.retryAfter,
+      }
+      inner := newFakeClient(map[string][]error{ "headways": { statusErr } })
+      clock := &fakeClock{}
+      client := newLimitedClient(inner, testLimitConfig(), clock)
+
+      if err := client.Get(context.Background(), "headways", nil, nil); err != nil {
+        t.Fatalf("Expected the retry to succeed, got %v", err)
+      }
+      if waits := clock.Waits(); len(waits) != 1 || waits[0] != tc.expected {
+        t.Errorf("Expected to wait %v before retrying, got %v", tc.expected, waits)
+      }
+    })
+  }
+}
+
+func TestLimitedClientStopsAfterMaxRetries(t *testing.T) {
+  serverErr := &StatusError{ StatusCode: http.StatusBadGateway }
+  inner := newFakeClient(map[string][]error{
+    "headways": { serverErr, serverErr, serverErr, serverErr, serverErr },
+  })
+  config := testLimitConfig()
+  config.MaxRetries = 2
+  clock := &fakeClock{}
+  client := newLimitedClient(inner, config, clock)
+
+  err := client.Get(context.Background(), "headways", nil, nil)
+  if !errors.Is(err, serverErr) {
+    t.Errorf("Expected the last error once retries ran out, got %v", err)
+  }
+  if inner.Calls("headways") != 3 {
+    t.Errorf("Expected 3 requests with 2 retries, got %d", inner.Calls("headways"))
+  }
+
+  // Backoff doubles with every retry, before jitter
+  waits := clock.Waits()
+  if len(waits) != 2 || waits[0] > time.Second || waits[1] > 2 * time.Second {
+    t.Errorf("Expected backoffs of at most 1s and 2s, got %v", waits)
+  }
+}
+
+func TestLimitedClientCountsStatsPerEndpoint(t *testing.T) {
+  inner := newFakeClient(map[string][]error{
+    "headways": { &StatusError{ StatusCode: http.StatusTooManyRequests } },
+    "dwells": {
+      &StatusError{ StatusCode: http.StatusServiceUnavailable },
+      &TimeoutError{ Err: context.DeadlineExceeded },
+      &StatusError{ StatusCode: http.StatusNotFound },
+    },
+  })
+  client := newLimitedClient(inner, testLimitConfig(), &fakeClock{})
+
+  client.Get(context.Background(), "headways", nil, nil)
+  client.Get(context.Background(), "headways", nil, nil)
+  client.Get(context.Background(), "dwells", nil, nil)
+
+  expected := map[string]EndpointStats{
+    "headways": {
+      Requests:     3,
+      Successes:    2,
+      Retries:      1,
+      RateLimited:  1,
+      PeakInFlight: 1,
+    },
+    "dwells": {
+      Requests:     3,
+      Failures:     1,
+      Retries:      2,
+      ServerErrors: 1,
+      Timeouts:     1,
+      PeakInFlight: 1,
+    },
+  }
+  stats := client.Stats()
+  if len(stats) != len(expected) {
+    t.Errorf("Expected stats for %d endpoints, got %v", len(expected), stats)
+  }
+  for endpoint, expectedStats := range expected {
+    if stats[endpoint] != expectedStats {
+      t.Errorf("Expected %s stats %+v, got %+v", endpoint, expectedStats, stats[endpoint])
+    }
+  }
+}
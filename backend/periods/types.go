@@ -0,0 +1,339 @@
+package periods
+
+import (
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "os"
+  "sort"
+  "time"
+
+  "github.com/lib/pq"
+  "github.com/mbta-performance-dashboard/types"
+  "github.com/mbta-performance-dashboard/utils"
+)
+
+// The types of day that service is profiled by.
+const (
+  DayTypeWeekday  string = "weekday"
+  DayTypeSaturday string = "saturday"
+  DayTypeSunday   string = "sunday"
+  DayTypeHoliday  string = "holiday"
+)
+
+// DayTypes are the types of day in the order they're listed.
+var DayTypes []string = []string{ DayTypeWeekday, DayTypeSaturday, DayTypeSunday, DayTypeHoliday }
+
+// A Period represents a named part of the service day, like "am_peak".
+//
+// Start and End are times of day in EST as HH:MM, where Start is inclusive and End is exclusive.
+// Periods whose end is before their start wrap past midnight, like a late night period from 22:00
+// to 03:00.
+type Period struct {
+  Name  string `json:"name"`
+  Start string `json:"start"`
+  End   string `json:"end"`
+}
+
+// A Config represents the periods that service days are split into, and the service dates that
+// run a holiday schedule.
+//
+// Entities are placed in the first period they fall within, and left out if they don't fall within
+// any.
+type Config struct {
+  Periods  []Period `json:"periods"`
+  Holidays []string `json:"holidays"`
+}
+
+// DefaultConfig returns periods that cover the whole service day, along with the holidays that
+// the MBTA runs Sunday service on from ten years ago through next year.
+func DefaultConfig() Config {
+  var holidays []string = []string{}
+  year := time.Now().Year()
+  for y := year - 10; y <= year + 1; y++ {
+    for _, holiday := range Holidays(y) {
+      holidays = append(holidays, holiday.Format(time.DateOnly))
+    }
+  }
+
+  return Config{
+    Periods: []Period{
+      { Name: "early_morning", Start: "03:00", End: "06:30" },
+      { Name: "am_peak", Start: "06:30", End: "09:30" },
+      { Name: "midday", Start: "09:30", End: "15:30" },
+      { Name: "pm_peak", Start: "15:30", End: "18:30" },
+      { Name: "evening", Start: "18:30", End: "22:00" },
+      { Name: "late_night", Start: "22:00", End: "03:00" },
+    },
+    Holidays: holidays,
+  }
+}
+
+// LoadConfig loads a period config from a JSON file, filling in defaults for anything omitted.
+func LoadConfig(path string) (Config, error) {
+  body, err := os.ReadFile(path)
+  if err != nil {
+    return Config{}, fmt.Errorf("Error reading period config: %w", err)
+  }
+
+  // Decoding straight into the defaults would reuse their periods, so that a period missing a
+  // field would silently take it from the default in the same position
+  var loaded Config
+  if err := json.Unmarshal(body, &loaded); err != nil {
+    return Config{}, fmt.Errorf("Error decoding period config: %w", err)
+  }
+  config := DefaultConfig()
+  if loaded.Periods != nil {
+    config.Periods = loaded.Periods
+  }
+  if loaded.Holidays != nil {
+    config.Holidays = loaded.Holidays
+  }
+
+  if len(config.Periods) == 0 {
+    return Config{}, errors.New("Period config must list at least one period")
+  }
+  seen := make(map[string]bool)
+  for i, period := range config.Periods {
+    if period.Name == "" {
+      return Config{}, errors.New("Every period in the period config needs a name")
+    }
+    if seen[period.Name] {
+      return Config{}, fmt.Errorf(
+        "Period %s is listed more than once in the period config",
+        period.Name,
+      )
+    }
+    seen[period.Name] = true
+
+    start, err := time.Parse("15:04", period.Start)
+    if err != nil {
+      return Config{}, fmt.Errorf(
+        "Invalid start %s of period %s, expected HH:MM",
+        period.Start,
+        period.Name,
+      )
+    }
+    end, err := time.Parse("15:04", period.End)
+    if err != nil {
+      return Config{}, fmt.Errorf(
+        "Invalid end %s of period %s, expected HH:MM",
+        period.End,
+        period.Name,
+      )
+    }
+    if start.Equal(end) {
+      return Config{}, fmt.Errorf("Period %s must not start and end at the same time", period.Name)
+    }
+
+    // Times are zero padded, so that they can be compared as is
+    config.Periods[i].Start = start.Format("15:04")
+    config.Periods[i].End = end.Format("15:04")
+  }
+
+  for _, holiday := range config.Holidays {
+    if _, err := time.Parse(time.DateOnly, holiday); err != nil {
+      return Config{}, fmt.Errorf("Invalid holiday %s, expected YYYY-MM-DD", holiday)
+    }
+  }
+
+  return config, nil
+}
+
+// Holidays returns the holidays in a year that the MBTA runs Sunday service on: New Year's Day,
+// Memorial Day, Independence Day, Labor Day, Thanksgiving and Christmas.
+func Holidays(year int) []time.Time {
+  return []time.Time{
+    time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC),
+    lastWeekday(year, time.May, time.Monday),
+    time.Date(year, time.July, 4, 0, 0, 0, 0, time.UTC),
+    nthWeekday(year, time.September, time.Monday, 1),
+    nthWeekday(year, time.November, time.Thursday, 4),
+    time.Date(year, time.December, 25, 0, 0, 0, 0, time.UTC),
+  }
+}
+
+// nthWeekday returns the nth occurrence of a weekday in a month, like the fourth Thursday.
+func nthWeekday(year int, month time.Month, weekday time.Weekday, n int) time.Time {
+  first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+  offset := (int(weekday) - int(first.Weekday()) + 7) % 7
+  return first.AddDate(0, 0, offset + (n - 1) * 7)
+}
+
+// lastWeekday returns the last occurrence of a weekday in a month, like the last Monday.
+func lastWeekday(year int, month time.Month, weekday time.Weekday) time.Time {
+  last := time.Date(year, month + 1, 0, 0, 0, 0, 0, time.UTC)
+  offset := (int(last.Weekday()) - int(weekday) + 7) % 7
+  return last.AddDate(0, 0, -offset)
+}
+
+// A ProfileStat represents statistics for the entities that fell within a single period on a
+// single type of day.
+type ProfileStat struct {
+  DayType       string   `json:"day_type"`
+  Period        string   `json:"period"`
+  Count         int      `json:"count"`
+  Mean          float64  `json:"mean"`
+  Min           int      `json:"min"`
+  Max           int      `json:"max"`
+  P50           float64  `json:"p50"`
+  P90           float64  `json:"p90"`
+  P95           float64  `json:"p95"`
+  BenchmarkMean *float64 `json:"benchmark_mean"`
+}
+
+
+// A ProfileService represents a service that aggregates cached entities by service period.
+type ProfileService struct {
+  types.BaseService
+  Config Config
+}
+
+func NewService(db *sql.DB, config Config) *ProfileService {
+  return &ProfileService{
+    BaseService: types.BaseService{
+      DB: db,
+      Entity: "profile",
+    },
+    Config: config,
+  }
+}
+
+func (s *ProfileService) BeginTx() (*sql.Tx, error) {
+  return s.BaseService.BeginTx()
+}
+
+// periodClause returns an SQL expression for the name of the first configured period that a
+// table's datetime column falls within, or NULL if it doesn't fall within any, along with its
+// params. Placeholders are numbered starting after the provided offset.
+func (s *ProfileService) periodClause(dateColumn string, offset int) (string, []any) {
+  timeOfDay := fmt.Sprintf("(%s::timestamptz AT TIME ZONE 'America/New_York')::time", dateColumn)
+
+  clause := "CASE"
+  var params []any = []any{}
+  for _, period := range s.Config.Periods {
+    params = append(params, period.Start, period.End, period.Name)
+    start := utils.PgPlaceholders(offset+len(params)-3, offset+len(params)-2)
+    end := utils.PgPlaceholders(offset+len(params)-2, offset+len(params)-1)
+    name := utils.PgPlaceholders(offset+len(params)-1, offset+len(params))
+
+    // Periods that wrap past midnight include everything after their start or before their end
+    operator := "AND"
+    if period.End < period.Start {
+      operator = "OR"
+    }
+    clause += fmt.Sprintf(
+      " WHEN %s >= %s::time %s %s < %s::time THEN %s::text",
+      timeOfDay,
+      start,
+      operator,
+      timeOfDay,
+      end,
+      name,
+    )
+  }
+  clause += " END"
+
+  return clause, params
+}
+
+// dayTypeClause returns an SQL expression for the type of day of a table's datetime column's
+// service date, given the placeholder of the holidays.
+func dayTypeClause(dateColumn string, holidaysPlaceholder string) string {
+  serviceDate := utils.ServiceDate(dateColumn)
+  return fmt.Sprintf(
+    "CASE WHEN %s = ANY(%s::date[]) THEN '%s' WHEN EXTRACT(ISODOW FROM %s) = 6 THEN '%s' WHEN " +
+      "EXTRACT(ISODOW FROM %s) = 7 THEN '%s' ELSE '%s' END",
+    serviceDate,
+    holidaysPlaceholder,
+    DayTypeHoliday,
+    serviceDate,
+    DayTypeSaturday,
+    serviceDate,
+    DayTypeSunday,
+    DayTypeWeekday,
+  )
+}
+
+// SelectProfile aggregates a table's values by type of day and period, in order.
+//
+// The provided conditions make up the WHERE clause and must only use placeholders for the provided
+// params. An empty benchmark column leaves every stat's benchmark mean as nil.
+func (s *ProfileService) SelectProfile(
+  tx *sql.Tx,
+  table string,
+  dateColumn string,
+  valueColumn string,
+  benchmarkColumn string,
+  conditions string,
+  params []any,
+) ([]*ProfileStat, error) {
+  benchmark := "NULL::integer"
+  if benchmarkColumn != "" {
+    benchmark = benchmarkColumn
+  }
+
+  offset := len(params)
+  holidaysPlaceholder := utils.PgPlaceholders(offset, offset+1)
+  periodClause, periodParams := s.periodClause(dateColumn, offset+1)
+  rows, err := tx.Query(
+    fmt.Sprintf(
+      "SELECT day_type, period, COUNT(*), AVG(value), MIN(value), MAX(value), " +
+        "PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY value), PERCENTILE_CONT(0.9) WITHIN GROUP " +
+        "(ORDER BY value), PERCENTILE_CONT(0.95) WITHIN GROUP (ORDER BY value), AVG(benchmark) " +
+        "FROM (SELECT %s AS day_type, %s AS period, %s AS value, %s AS benchmark FROM %s WHERE " +
+        "%s) AS profiled WHERE period IS NOT NULL GROUP BY day_type, period",
+      dayTypeClause(dateColumn, holidaysPlaceholder),
+      periodClause,
+      valueColumn,
+      benchmark,
+      table,
+      conditions,
+    ),
+    append(append(params, pq.Array(s.Config.Holidays)), periodParams...)...,
+  )
+  if err != nil {
+    return nil, fmt.Errorf("Error aggregating %s profile: %w", table, err)
+  }
+  defer rows.Close()
+
+  var stats []*ProfileStat = []*ProfileStat{}
+  for rows.Next() {
+    var stat ProfileStat
+    err := rows.Scan(
+      &stat.DayType,
+      &stat.Period,
+      &stat.Count,
+      &stat.Mean,
+      &stat.Min,
+      &stat.Max,
+      &stat.P50,
+      &stat.P90,
+      &stat.P95,
+      &stat.BenchmarkMean,
+    )
+    if err != nil {
+      return nil, fmt.Errorf("Error scanning %s profile: %w", table, err)
+    }
+    stats = append(stats, &stat)
+  }
+
+  // Stats are listed by type of day and then by period, in the order they're configured in
+  dayTypeOrder := make(map[string]int)
+  for i, dayType := range DayTypes {
+    dayTypeOrder[dayType] = i
+  }
+  periodOrder := make(map[string]int)
+  for i, period := range s.Config.Periods {
+    periodOrder[period.Name] = i
+  }
+  sort.Slice(stats, func(i, j int) bool {
+    if stats[i].DayType != stats[j].DayType {
+      return dayTypeOrder[stats[i].DayType] < dayTypeOrder[stats[j].DayType]
+    }
+    return periodOrder[stats[i].Period] < periodOrder[stats[j].Period]
+  })
+
+  return stats, nil
+}
@@ -0,0 +1,278 @@
+package periods
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/mbta-performance-dashboard/db/dbtest"
+  "github.com/mbta-performance-dashboard/utils"
+)
+
+// dates formats dates as YYYY-MM-DD, for comparing them in test failures.
+func dates(values ...time.Time) string {
+  var formatted []string
+  for _, value := range values {
+    formatted = append(formatted, value.Format(time.DateOnly))
+  }
+  return strings.Join(formatted, ", ")
+}
+
+func TestHolidays(t *testing.T) {
+  cases := []struct {
+    year     int
+    expected string
+  }{
+    // Thanksgiving on its earliest date, since November starts on a Thursday
+    {
+      year:     2018,
+      expected: "2018-01-01, 2018-05-28, 2018-07-04, 2018-09-03, 2018-11-22, 2018-12-25",
+    },
+    // Memorial Day on the last day of May
+    {
+      year:     2021,
+      expected: "2021-01-01, 2021-05-31, 2021-07-04, 2021-09-06, 2021-11-25, 2021-12-25",
+    },
+    // Thanksgiving on its latest date, in a leap year
+    {
+      year:     2024,
+      expected: "2024-01-01, 2024-05-27, 2024-07-04, 2024-09-02, 2024-11-28, 2024-12-25",
+    },
+    // Labor Day on the first day of September
+    {
+      year:     2025,
+      expected: "2025-01-01, 2025-05-26, 2025-07-04, 2025-09-01, 2025-11-27, 2025-12-25",
+    },
+  }
+
+  for _, tc := range cases {
+    if actual := dates(Holidays(tc.year)...); actual != tc.expected {
+      t.Errorf("Expected %d holidays %s, got %s", tc.year, tc.expected, actual)
+    }
+  }
+}
+
+func TestNthWeekday(t *testing.T) {
+  cases := []struct {
+    year     int
+    month    time.Month
+    weekday  time.Weekday
+    n        int
+    expected string
+  }{
+    { year: 2025, month: time.September, weekday: time.Monday, n: 1, expected: "2025-09-01" },
+    { year: 2024, month: time.September, weekday: time.Monday, n: 1, expected: "2024-09-02" },
+    { year: 2024, month: time.September, weekday: time.Sunday, n: 1, expected: "2024-09-01" },
+    { year: 2024, month: time.November, weekday: time.Thursday, n: 4, expected: "2024-11-28" },
+    { year: 2024, month: time.November, weekday: time.Friday, n: 5, expected: "2024-11-29" },
+  }
+
+  for _, tc := range cases {
+    if actual := dates(nthWeekday(tc.year, tc.month, tc.weekday, tc.n)); actual != tc.expected {
+      t.Errorf(
+        "Expected %s %d of %s %d to be %s, got %s",
+        tc.weekday,
+        tc.n,
+        tc.month,
+        tc.year,
+        tc.expected,
+        actual,
+      )
+    }
+  }
+}
+
+func TestLastWeekday(t *testing.T) {
+  cases := []struct {
+    year     int
+    month    time.Month
+    weekday  time.Weekday
+    expected string
+  }{
+    { year: 2021, month: time.May, weekday: time.Monday, expected: "2021-05-31" },
+    { year: 2024, month: time.May, weekday: time.Monday, expected: "2024-05-27" },
+    { year: 2024, month: time.May, weekday: time.Friday, expected: "2024-05-31" },
+    { year: 2024, month: time.February, weekday: time.Thursday, expected: "2024-02-29" },
+    { year: 2024, month: time.December, weekday: time.Tuesday, expected: "2024-12-31" },
+  }
+
+  for _, tc := range cases {
+    if actual := dates(lastWeekday(tc.year, tc.month, tc.weekday)); actual != tc.expected {
+      t.Errorf(
+        "Expected the last %s of %s %d to be %s, got %s",
+        tc.weekday,
+        tc.month,
+        tc.year,
+        tc.expected,
+        actual,
+      )
+    }
+  }
+}
+
+// writeConfig writes a period config to a file, and returns its path.
+func writeConfig(t *testing.T, body string) string {
+  t.Helper()
+
+  path := filepath.Join(t.TempDir(), "periods.json")
+  if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+    t.Fatalf("Error writing period config: %v", err)
+  }
+  return path
+}
+
+func TestLoadConfig(t *testing.T) {
+  config, err := LoadConfig(writeConfig(
+    t,
+    `{ "periods": [{ "name": "am_peak", "start": "6:30", "end": "9:30" }], ` +
+      `"holidays": ["2024-01-01"] }`,
+  ))
+  if err != nil {
+    t.Fatalf("Expected the config to load, got %v", err)
+  }
+
+  // Times are zero padded, so that periods wrapping past midnight can be found by comparing them
+  expected := fmt.Sprint([]Period{ { Name: "am_peak", Start: "06:30", End: "09:30" } })
+  if actual := fmt.Sprint(config.Periods); actual != expected {
+    t.Errorf("Expected periods %s, got %s", expected, actual)
+  }
+  if len(config.Holidays) != 1 || config.Holidays[0] != "2024-01-01" {
+    t.Errorf("Expected the configured holidays to replace the defaults, got %v", config.Holidays)
+  }
+
+  config, err = LoadConfig(writeConfig(t, `{ "holidays": [] }`))
+  if err != nil {
+    t.Fatalf("Expected a config without periods to load, got %v", err)
+  }
+  if len(config.Periods) != len(DefaultConfig().Periods) {
+    t.Errorf("Expected omitted periods to default, got %v", config.Periods)
+  }
+}
+
+func TestLoadConfigRejectsInvalidConfigs(t *testing.T) {
+  cases := []struct {
+    name string
+    body string
+  }{
+    { name: "malformed", body: `{ "periods": ` },
+    { name: "no periods", body: `{ "periods": [] }` },
+    { name: "unnamed period", body: `{ "periods": [{ "start": "06:30", "end": "09:30" }] }` },
+    {
+      name: "duplicate period",
+      body: `{ "periods": [{ "name": "a", "start": "06:30", "end": "09:30" }, ` +
+        `{ "name": "a", "start": "09:30", "end": "15:30" }] }`,
+    },
+    {
+      name: "invalid start",
+      body: `{ "periods": [{ "name": "a", "start": "6am", "end": "09:30" }] }`,
+    },
+    {
+      name: "invalid end",
+      body: `{ "periods": [{ "name": "a", "start": "06:30", "end": "24:00" }] }`,
+    },
+    {
+      name: "empty period",
+      body: `{ "periods": [{ "name": "a", "start": "06:30", "end": "6:30" }] }`,
+    },
+    { name: "missing end", body: `{ "periods": [{ "name": "a", "start": "06:30" }] }` },
+    { name: "invalid holiday", body: `{ "holidays": ["12/25/2024"] }` },
+  }
+
+  for _, tc := range cases {
+    t.Run(tc.name, func(t *testing.T) {
+      if _, err := LoadConfig(writeConfig(t, tc.body)); err == nil {
+        t.Errorf("Expected %s to be rejected", tc.body)
+      }
+    })
+  }
+
+  if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+    t.Error("Expected a missing config to be rejected")
+  }
+}
+
+func TestPeriodClause(t *testing.T) {
+  service := &ProfileService{
+    Config: Config{
+      Periods: []Period{
+        { Name: "am_peak", Start: "06:30", End: "09:30" },
+        { Name: "late_night", Start: "22:00", End: "03:00" },
+      },
+    },
+  }
+
+  clause, params := service.periodClause("arr_dt", 3)
+
+  timeOfDay := "(arr_dt::timestamptz AT TIME ZONE 'America/New_York')::time"
+  expected := "CASE" +
+    fmt.Sprintf(" WHEN %s >= $4::time AND %s < $5::time THEN $6::text", timeOfDay, timeOfDay) +
+    fmt.Sprintf(" WHEN %s >= $7::time OR %s < $8::time THEN $9::text", timeOfDay, timeOfDay) +
+    " END"
+  if clause != expected {
+    t.Errorf("Expected clause %s, got %s", expected, clause)
+  }
+
+  expectedParams := fmt.Sprint([]any{ "06:30", "09:30", "am_peak", "22:00", "03:00", "late_night" })
+  if actual := fmt.Sprint(params); actual != expectedParams {
+    t.Errorf("Expected params %s, got %s", expectedParams, actual)
+  }
+}
+
+func TestDayTypeClause(t *testing.T) {
+  clause := dayTypeClause("arr_dt", "$3")
+
+  // Days are typed by their service date, so that a train just after midnight counts towards the
+  // day before
+  serviceDate := utils.ServiceDate("arr_dt")
+  expected := fmt.Sprintf(
+    "CASE WHEN %s = ANY($3::date[]) THEN 'holiday' WHEN EXTRACT(ISODOW FROM %s) = 6 THEN " +
+      "'saturday' WHEN EXTRACT(ISODOW FROM %s) = 7 THEN 'sunday' ELSE 'weekday' END",
+    serviceDate,
+    serviceDate,
+    serviceDate,
+  )
+  if clause != expected {
+    t.Errorf("Expected holidays to take precedence over weekends in %s, got %s", expected, clause)
+  }
+}
+
+func TestSelectProfilePlaceholders(t *testing.T) {
+  tx, recorder := dbtest.Begin(t)
+  service := &ProfileService{
+    Config: Config{
+      Periods: []Period{
+        { Name: "am_peak", Start: "06:30", End: "09:30" },
+        { Name: "late_night", Start: "22:00", End: "03:00" },
+      },
+      Holidays: []string{ "2024-01-01", "2024-05-27" },
+    },
+  }
+
+  _, err := service.SelectProfile(
+    tx,
+    "dwell",
+    "arr_dt",
+    "dwell_time_sec",
+    "",
+    "stop_id IN ($1, $2) AND route_id = $3",
+    []any{ "70061", "70063", "Red" },
+  )
+  if err != nil {
+    t.Fatalf("Expected the query to run, got %v", err)
+  }
+
+  query := recorder.Only(t)
+  dbtest.CheckPlaceholders(t, query)
+  if !strings.Contains(query.SQL, dayTypeClause("arr_dt", "$4")) {
+    t.Errorf("Expected the holidays at $4, got %s", query.SQL)
+  }
+  if clause, _ := service.periodClause("arr_dt", 4); !strings.Contains(query.SQL, clause) {
+    t.Errorf("Expected the periods to start at $5, got %s", query.SQL)
+  }
+  if query.Arg(t, "$4") != `{"2024-01-01","2024-05-27"}` || query.Arg(t, "$5") != "06:30" {
+    t.Errorf("Expected the holidays at $4 and the periods after them, got %v", query)
+  }
+}
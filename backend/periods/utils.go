@@ -0,0 +1,166 @@
+package periods
+
+import (
+  "fmt"
+  "net/http"
+
+  "github.com/gin-gonic/gin"
+  "github.com/mbta-performance-dashboard/types"
+  "github.com/mbta-performance-dashboard/utils"
+)
+
+// selectProfile aggregates a request's headways, dwells or travel times by type of day and
+// period, depending on its entity query parameter.
+func selectProfile(
+  c *gin.Context,
+  service *ProfileService,
+  routeID string,
+) ([]*ProfileStat, *types.ResolvedDirection, error) {
+  entity := c.DefaultQuery("entity", "")
+
+  var stopIDs []string
+  var toStopIDs []string
+  var err error
+  switch entity {
+  case "headway", "dwell":
+    stopIDs, err = utils.ResolveStopIDs(c, service.BeginTx, "stop_ids", "station_id", routeID)
+  case "travel_time":
+    stopIDs, err = utils.ResolveStopIDs(
+      c,
+      service.BeginTx,
+      "from_stop_ids",
+      "from_station_id",
+      routeID,
+    )
+    if err == nil {
+      toStopIDs, err = utils.ResolveStopIDs(
+        c,
+        service.BeginTx,
+        "to_stop_ids",
+        "to_station_id",
+        routeID,
+      )
+    }
+  default:
+    return nil, nil, fmt.Errorf(
+      "Invalid entity %s, expected headway, dwell or travel_time",
+      entity,
+    )
+  }
+  if err != nil {
+    return nil, nil, err
+  }
+
+  filter, err := utils.ParseFilter(c)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  tx, err := service.BeginTx()
+  if err != nil {
+    return nil, nil, fmt.Errorf("Error beginning transaction: %w", err)
+  }
+  defer func() {
+    if tx != nil {
+      tx.Rollback()
+    }
+  }()
+
+  if err := utils.ValidateIDs(tx, append(stopIDs, toStopIDs...), routeID); err != nil {
+    return nil, nil, err
+  }
+
+  direction, err := utils.ResolveDirection(c, tx, routeID)
+  if err != nil {
+    return nil, nil, err
+  }
+  if direction != nil {
+    filter.Direction = &direction.Direction
+  }
+
+  var stats []*ProfileStat
+  switch entity {
+  case "headway":
+    filterClause, filterParams := utils.FilterClause(filter, "current_dep_dt", len(stopIDs)+1)
+    stats, err = service.SelectProfile(
+      tx,
+      "headway",
+      "current_dep_dt",
+      "headway_time_sec",
+      "benchmark_headway_time_sec",
+      fmt.Sprintf(
+        "stop_id IN (%s) AND route_id = %s%s",
+        utils.PgPlaceholders(0, len(stopIDs)),
+        utils.PgPlaceholders(len(stopIDs), len(stopIDs)+1),
+        filterClause,
+      ),
+      append(utils.SliceToAnySlice[string](append(stopIDs, routeID)), filterParams...),
+    )
+  case "dwell":
+    filterClause, filterParams := utils.FilterClause(filter, "arr_dt", len(stopIDs)+1)
+    stats, err = service.SelectProfile(
+      tx,
+      "dwell",
+      "arr_dt",
+      "dwell_time_sec",
+      "",
+      fmt.Sprintf(
+        "stop_id IN (%s) AND route_id = %s%s",
+        utils.PgPlaceholders(0, len(stopIDs)),
+        utils.PgPlaceholders(len(stopIDs), len(stopIDs)+1),
+        filterClause,
+      ),
+      append(utils.SliceToAnySlice[string](append(stopIDs, routeID)), filterParams...),
+    )
+  case "travel_time":
+    filterClause, filterParams := utils.FilterClause(
+      filter,
+      "dep_dt",
+      len(stopIDs)+len(toStopIDs)+1,
+    )
+    stats, err = service.SelectProfile(
+      tx,
+      "travel_time",
+      "dep_dt",
+      "travel_time_sec",
+      "benchmark_travel_time_sec",
+      fmt.Sprintf(
+        "from_stop_id IN (%s) AND to_stop_id IN (%s) AND route_id = %s%s",
+        utils.PgPlaceholders(0, len(stopIDs)),
+        utils.PgPlaceholders(len(stopIDs), len(stopIDs)+len(toStopIDs)),
+        utils.PgPlaceholders(len(stopIDs)+len(toStopIDs), len(stopIDs)+len(toStopIDs)+1),
+        filterClause,
+      ),
+      append(
+        utils.SliceToAnySlice[string](append(stopIDs, append(toStopIDs, routeID)...)),
+        filterParams...,
+      ),
+    )
+  }
+  if err != nil {
+    return nil, nil, err
+  }
+
+  if err = tx.Commit(); err != nil {
+    return nil, nil, fmt.Errorf("Error committing transaction: %w", err)
+  }
+  tx = nil
+
+  return stats, direction, nil
+}
+
+func SelectProfile(c *gin.Context, service *ProfileService) {
+	routeID := c.DefaultQuery("route_id", "")
+
+  stats, direction, err := selectProfile(c, service, routeID)
+  if err != nil {
+    utils.PropagateToResponse(c, err)
+    return
+  }
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": stats,
+		"direction": direction,
+		"periods": service.Config.Periods,
+	})
+}
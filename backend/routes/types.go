@@ -0,0 +1,167 @@
+package routes
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/mbta-performance-dashboard/types"
+)
+
+// A RouteDetail represents a route along with the stations it serves in each direction.
+type RouteDetail struct {
+	types.Route
+	Directions []*RouteDirection `json:"directions"`
+}
+
+// A RouteDirection represents one direction of a route, like "South" towards "Ashmont/Braintree".
+//
+// Stations are in the order they're served in this direction.
+type RouteDirection struct {
+	Direction   types.Direction `json:"direction"`
+	Name        string          `json:"name"`
+	Destination string          `json:"destination"`
+	Stations    []*Station      `json:"stations"`
+}
+
+// A Station represents a parent station and the platforms of it that a route serves in a single
+// direction, or a single stop that isn't part of a station.
+//
+// StopSequence is the sequence of the station's first platform.
+type Station struct {
+	ID           string       `json:"id"`
+	Name         string       `json:"name"`
+	Latitude     float64      `json:"latitude"`
+	Longitude    float64      `json:"longitude"`
+	StopSequence int          `json:"stop_sequence"`
+	Stops        []*RouteStop `json:"stops"`
+}
+
+// A RouteStop represents a stop along with where it falls along a route in one direction.
+type RouteStop struct {
+	types.Stop
+	StopSequence int `json:"stop_sequence"`
+}
+
+
+// A RouteService represents a service that reads the static network loaded by the cache command.
+type RouteService struct {
+  types.BaseService
+}
+
+func NewService(db *sql.DB) *RouteService {
+  return &RouteService{
+    BaseService: types.BaseService{
+      DB: db,
+      Entity: "route",
+    },
+  }
+}
+
+func (s *RouteService) BeginTx() (*sql.Tx, error) {
+  return s.BaseService.BeginTx()
+}
+
+// Select selects a route along with both of its directions, grouping its stops by parent station.
+func (s *RouteService) Select(tx *sql.Tx, routeID string) (*RouteDetail, error) {
+  var route RouteDetail
+  err := tx.QueryRow(
+    "SELECT id, type, color, display_name FROM route WHERE id = $1",
+    routeID,
+  ).Scan(&route.ID, &route.Type, &route.Color, &route.DisplayName)
+  if err == sql.ErrNoRows {
+    return nil, fmt.Errorf("Invalid route ID %s", routeID)
+  }
+  if err != nil {
+    return nil, fmt.Errorf("Error querying route: %w", err)
+  }
+
+  // Both directions are always returned, even if the loader didn't know their names
+  route.Directions = []*RouteDirection{
+    { Direction: types.DirectionZero, Stations: []*Station{} },
+    { Direction: types.DirectionOne, Stations: []*Station{} },
+  }
+
+  rows, err := tx.Query(
+    "SELECT direction, name, destination FROM route_direction WHERE route_id = $1",
+    routeID,
+  )
+  if err != nil {
+    return nil, fmt.Errorf("Error querying route directions: %w", err)
+  }
+  for rows.Next() {
+    var direction bool
+    var name string
+    var destination string
+    if err := rows.Scan(&direction, &name, &destination); err != nil {
+      rows.Close()
+      return nil, fmt.Errorf("Error scanning route directions: %w", err)
+    }
+
+    routeDirection := route.Directions[types.DirectionFromBool(direction)]
+    routeDirection.Name = name
+    routeDirection.Destination = destination
+  }
+  rows.Close()
+
+  rows, err = tx.Query(
+    "SELECT route_stop.direction, route_stop.stop_sequence, stop.id, stop.route_id, stop.name, " +
+      "stop.latitude, stop.longitude, stop.parent_station, stop.platform_code FROM route_stop " +
+      "JOIN stop ON stop.id = route_stop.stop_id AND stop.route_id = route_stop.route_id " +
+      "WHERE route_stop.route_id = $1 ORDER BY route_stop.direction, route_stop.stop_sequence, " +
+      "stop.id",
+    routeID,
+  )
+  if err != nil {
+    return nil, fmt.Errorf("Error querying route stops: %w", err)
+  }
+  defer rows.Close()
+
+  stations := make(map[types.Direction]map[string]*Station)
+  for rows.Next() {
+    var direction bool
+    var routeStop RouteStop
+    err := rows.Scan(
+      &direction,
+      &routeStop.StopSequence,
+      &routeStop.ID,
+      &routeStop.RouteID,
+      &routeStop.Name,
+      &routeStop.Latitude,
+      &routeStop.Longitude,
+      &routeStop.ParentStation,
+      &routeStop.PlatformCode,
+    )
+    if err != nil {
+      return nil, fmt.Errorf("Error scanning route stops: %w", err)
+    }
+
+    routeDirection := route.Directions[types.DirectionFromBool(direction)]
+    if stations[routeDirection.Direction] == nil {
+      stations[routeDirection.Direction] = make(map[string]*Station)
+    }
+
+    // Stops that aren't part of a station are their own station
+    stationID := routeStop.ParentStation
+    if stationID == "" {
+      stationID = routeStop.ID
+    }
+
+    // Stops are ordered by sequence, so a station is placed where its first platform is served
+    station, ok := stations[routeDirection.Direction][stationID]
+    if !ok {
+      station = &Station{
+        ID: stationID,
+        Name: routeStop.Name,
+        Latitude: routeStop.Latitude,
+        Longitude: routeStop.Longitude,
+        StopSequence: routeStop.StopSequence,
+        Stops: []*RouteStop{},
+      }
+      stations[routeDirection.Direction][stationID] = station
+      routeDirection.Stations = append(routeDirection.Stations, station)
+    }
+    station.Stops = append(station.Stops, &routeStop)
+  }
+
+  return &route, nil
+}
@@ -0,0 +1,46 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+  "github.com/mbta-performance-dashboard/utils"
+)
+
+func SelectRoute(c *gin.Context, service *RouteService) {
+  routeID := c.Param("id")
+
+  var route *RouteDetail
+  err := func() error {
+    tx, err := service.BeginTx()
+    if err != nil {
+      return err
+    }
+    defer func() {
+      if tx != nil {
+        tx.Rollback()
+      }
+    }()
+
+    route, err = service.Select(tx, routeID)
+    if err != nil {
+      return err
+    }
+
+    if err = tx.Commit(); err != nil {
+      return fmt.Errorf("Error committing transaction: %w", err)
+    }
+    tx = nil
+
+    return nil
+  }()
+  if err != nil {
+    utils.PropagateToResponse(c, err)
+    return
+  }
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": route,
+	})
+}
@@ -0,0 +1,313 @@
+package scheduler
+
+import (
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "math/rand"
+  "os"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/mbta-performance-dashboard/types"
+  "github.com/mbta-performance-dashboard/utils"
+)
+
+// MaxStatuses is the number of most recent job statuses the scheduler keeps in its status log.
+const MaxStatuses int = 500
+
+// A Job represents a single combination of stops and a route whose entities should be refreshed.
+//
+// Headway, dwell and event jobs use StopIDs, travel time jobs use FromStopIDs and ToStopIDs, and
+// daily metric and alert jobs only use RouteID.
+type Job struct {
+  Entity      string   `json:"entity"`
+  RouteID     string   `json:"route_id"`
+  StopIDs     []string `json:"stop_ids,omitempty"`
+  FromStopIDs []string `json:"from_stop_ids,omitempty"`
+  ToStopIDs   []string `json:"to_stop_ids,omitempty"`
+}
+
+func (j Job) String() string {
+  if j.Entity == "travel_time" {
+    return fmt.Sprintf(
+      "%s %s %s -> %s",
+      j.Entity,
+      j.RouteID,
+      strings.Join(j.FromStopIDs, ","),
+      strings.Join(j.ToStopIDs, ","),
+    )
+  }
+  return fmt.Sprintf("%s %s %s", j.Entity, j.RouteID, strings.Join(j.StopIDs, ","))
+}
+
+// Validate checks that a job has a known entity, along with the route and stops that its entity
+// uses and none that it doesn't.
+func (j Job) Validate() error {
+  if j.RouteID == "" {
+    return errors.New("Route ID required")
+  }
+
+  var used map[string]bool
+  switch j.Entity {
+  case "headway", "dwell", "event":
+    used = map[string]bool{ "stop_ids": true }
+  case "travel_time":
+    used = map[string]bool{ "from_stop_ids": true, "to_stop_ids": true }
+  case "daily_metric", "alert":
+    used = map[string]bool{}
+  default:
+    return fmt.Errorf("Unknown entity %s", j.Entity)
+  }
+
+  fields := []struct {
+    name    string
+    stopIDs []string
+  }{
+    { name: "stop_ids", stopIDs: j.StopIDs },
+    { name: "from_stop_ids", stopIDs: j.FromStopIDs },
+    { name: "to_stop_ids", stopIDs: j.ToStopIDs },
+  }
+  for _, field := range fields {
+    if !used[field.name] {
+      if len(field.stopIDs) > 0 {
+        return fmt.Errorf("Unexpected %s for %s job", field.name, j.Entity)
+      }
+      continue
+    }
+
+    if len(field.stopIDs) == 0 {
+      return fmt.Errorf("At least one stop ID required in %s", field.name)
+    }
+    for _, stopID := range field.stopIDs {
+      if stopID == "" {
+        return fmt.Errorf("Stop IDs in %s must not be empty", field.name)
+      }
+    }
+  }
+
+  return nil
+}
+
+// ValidateIDs checks that the route and stops of every job are part of the loaded static network.
+func ValidateIDs(tx *sql.Tx, jobs []Job) error {
+  for _, job := range jobs {
+    var err error
+    switch job.Entity {
+    case "travel_time":
+      stopIDs := append(append([]string{}, job.FromStopIDs...), job.ToStopIDs...)
+      err = utils.ValidateIDs(tx, stopIDs, job.RouteID)
+    case "daily_metric", "alert":
+      err = utils.ValidateRouteID(tx, job.RouteID)
+    default:
+      err = utils.ValidateIDs(tx, job.StopIDs, job.RouteID)
+    }
+    if err != nil {
+      return fmt.Errorf("Invalid scheduled job %s: %w", job, err)
+    }
+  }
+
+  return nil
+}
+
+// A Config represents when and how the scheduler refreshes its jobs.
+type Config struct {
+  // Hour is the hour of the day, in EST, at which jobs are refreshed.
+  Hour int `json:"hour"`
+
+  // Concurrency is the maximum number of jobs that are refreshed at once.
+  Concurrency int `json:"concurrency"`
+
+  // JitterSec is the maximum number of seconds a job is randomly delayed by, so that jobs don't
+  // all hit the Performance API at the same moment.
+  JitterSec int `json:"jitter_sec"`
+
+  // RunOnStart determines whether jobs are also refreshed as soon as the scheduler starts.
+  RunOnStart bool `json:"run_on_start"`
+
+  Jobs []Job `json:"jobs"`
+}
+
+// LoadConfig loads a scheduler config from a JSON file, filling in defaults for anything omitted.
+//
+// Every job is validated against its entity, but not against the static network. See ValidateIDs.
+func LoadConfig(path string) (Config, error) {
+  body, err := os.ReadFile(path)
+  if err != nil {
+    return Config{}, fmt.Errorf("Error reading scheduler config: %w", err)
+  }
+
+  config := Config{
+    Hour:        3,
+    Concurrency: 2,
+    JitterSec:   60,
+  }
+  if err := json.Unmarshal(body, &config); err != nil {
+    return Config{}, fmt.Errorf("Error decoding scheduler config: %w", err)
+  }
+
+  if config.Hour < 0 || config.Hour > 23 {
+    return Config{}, fmt.Errorf("Invalid scheduler hour %d", config.Hour)
+  }
+  if config.Concurrency < 1 {
+    return Config{}, errors.New("Scheduler concurrency must be at least 1")
+  }
+  if config.JitterSec < 0 {
+    return Config{}, errors.New("Scheduler jitter must not be negative")
+  }
+
+  for i, job := range config.Jobs {
+    if err := job.Validate(); err != nil {
+      return Config{}, fmt.Errorf("Invalid scheduled job %d (%s): %w", i + 1, job, err)
+    }
+  }
+
+  return config, nil
+}
+
+// A Refresher refreshes the cached entities for a job, reporting which of its keys were cached.
+type Refresher func(job Job) (*types.CacheReport, error)
+
+// A Status represents the outcome of a single job refresh.
+//
+// Report is nil if the job failed before any of its keys could be cached.
+type Status struct {
+  Job        string             `json:"job"`
+  StartedAt  time.Time          `json:"started_at"`
+  FinishedAt time.Time          `json:"finished_at"`
+  Report     *types.CacheReport `json:"report,omitempty"`
+  Error      string             `json:"error,omitempty"`
+}
+
+// A Scheduler periodically refreshes a configured set of jobs in the background, so that requests
+// only ever have to read from the cache.
+type Scheduler struct {
+  config     Config
+  refreshers map[string]Refresher
+
+  mu       sync.Mutex
+  statuses []Status
+}
+
+// New creates a scheduler that refreshes jobs using the refresher registered for their entity.
+func New(config Config, refreshers map[string]Refresher) (*Scheduler, error) {
+  for _, job := range config.Jobs {
+    if _, ok := refreshers[job.Entity]; !ok {
+      return nil, fmt.Errorf("Unknown entity %s for scheduled job", job.Entity)
+    }
+  }
+
+  return &Scheduler{
+    config:     config,
+    refreshers: refreshers,
+    statuses:   []Status{},
+  }, nil
+}
+
+// Start starts refreshing jobs in the background, once a day at the configured hour.
+func (s *Scheduler) Start() {
+  go func() {
+    if s.config.RunOnStart {
+      s.RunOnce()
+    }
+
+    for {
+      next, err := s.nextRun()
+      if err != nil {
+        log.Printf("Scheduler stopped: %v", err)
+        return
+      }
+
+      log.Printf("Next scheduled cache refresh at %s", next.Format(time.RFC3339))
+      time.Sleep(time.Until(next))
+      s.RunOnce()
+    }
+  }()
+}
+
+// RunOnce refreshes every job, respecting the configured concurrency and jitter.
+func (s *Scheduler) RunOnce() {
+  log.Printf("Refreshing %d scheduled cache jobs", len(s.config.Jobs))
+
+  var wg sync.WaitGroup
+  semaphore := make(chan struct{}, s.config.Concurrency)
+
+  for i := 0; i < len(s.config.Jobs); i++ {
+    wg.Add(1)
+
+    go func(job Job) {
+      defer wg.Done()
+
+      if s.config.JitterSec > 0 {
+        time.Sleep(time.Duration(rand.Int63n(int64(s.config.JitterSec) * int64(time.Second))))
+      }
+
+      semaphore <- struct{}{}
+      defer func() { <-semaphore }()
+
+      s.refresh(job)
+    }(s.config.Jobs[i])
+  }
+
+  wg.Wait()
+  log.Println("Finished refreshing scheduled cache jobs")
+}
+
+// Statuses returns the scheduler's status log, from oldest to newest.
+func (s *Scheduler) Statuses() []Status {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  statuses := make([]Status, len(s.statuses))
+  copy(statuses, s.statuses)
+  return statuses
+}
+
+// refresh refreshes a single job and records its outcome in the status log.
+func (s *Scheduler) refresh(job Job) {
+  status := Status{
+    Job:       job.String(),
+    StartedAt: time.Now(),
+  }
+
+  report, err := s.refreshers[job.Entity](job)
+  status.FinishedAt = time.Now()
+  status.Report = report
+  if err == nil && report != nil {
+    err = report.Err()
+  }
+  if err != nil {
+    status.Error = err.Error()
+    log.Printf("Failed to refresh %s: %v", status.Job, err)
+  } else {
+    log.Printf("Refreshed %s", status.Job)
+  }
+
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.statuses = append(s.statuses, status)
+  if len(s.statuses) > MaxStatuses {
+    s.statuses = s.statuses[len(s.statuses)-MaxStatuses:]
+  }
+}
+
+// nextRun returns the next time at which jobs should be refreshed.
+func (s *Scheduler) nextRun() (time.Time, error) {
+  newYork, err := time.LoadLocation("America/New_York")
+  if err != nil {
+    return time.Time{}, fmt.Errorf("Error loading New York timezone: %w", err)
+  }
+
+  now := time.Now().In(newYork)
+  year, month, day := now.Date()
+  next := time.Date(year, month, day, s.config.Hour, 0, 0, 0, newYork)
+  if !next.After(now) {
+    next = next.AddDate(0, 0, 1)
+  }
+
+  return next, nil
+}
@@ -0,0 +1,96 @@
+package scheduler
+
+import (
+  "database/sql/driver"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+
+  "github.com/mbta-performance-dashboard/db/dbtest"
+)
+
+// writeConfig writes a scheduler config with the provided jobs to a file, and returns its path.
+func writeConfig(t *testing.T, jobs string) string {
+  t.Helper()
+
+  path := filepath.Join(t.TempDir(), "scheduler.json")
+  if err := os.WriteFile(path, []byte(`{ "jobs": [` + jobs + `] }`), 0644); err != nil {
+    t.Fatalf("Error writing scheduler config: %v", err)
+  }
+  return path
+}
+
+func TestLoadConfigAcceptsExample(t *testing.T) {
+  config, err := LoadConfig(filepath.Join("..", "scheduler.example.json"))
+  if err != nil {
+    t.Fatalf("Expected the example config to load, got %v", err)
+  }
+  if len(config.Jobs) == 0 {
+    t.Error("Expected the example config to have jobs")
+  }
+}
+
+func TestLoadConfigRejectsInvalidJobs(t *testing.T) {
+  cases := []struct {
+    name string
+    job  string
+  }{
+    { name: "unknown entity", job: `{ "entity": "ridership", "route_id": "Red" }` },
+    { name: "missing route", job: `{ "entity": "headway", "stop_ids": ["70061"] }` },
+    { name: "missing stops", job: `{ "entity": "dwell", "route_id": "Red" }` },
+    { name: "empty stop", job: `{ "entity": "event", "route_id": "Red", "stop_ids": [""] }` },
+    {
+      name: "travel time with stops",
+      job:  `{ "entity": "travel_time", "route_id": "Red", "stop_ids": ["70061"] }`,
+    },
+    {
+      name: "travel time without destination",
+      job:  `{ "entity": "travel_time", "route_id": "Red", "from_stop_ids": ["70061"] }`,
+    },
+    {
+      name: "headway with origins",
+      job: `{ "entity": "headway", "route_id": "Red", "stop_ids": ["70061"], ` +
+        `"from_stop_ids": ["70061"] }`,
+    },
+    {
+      name: "alert with stops",
+      job:  `{ "entity": "alert", "route_id": "Red", "stop_ids": ["70061"] }`,
+    },
+  }
+
+  for _, tc := range cases {
+    t.Run(tc.name, func(t *testing.T) {
+      if _, err := LoadConfig(writeConfig(t, tc.job)); err == nil {
+        t.Errorf("Expected %s to be rejected", tc.job)
+      }
+    })
+  }
+}
+
+func TestValidateIDs(t *testing.T) {
+  stop := []driver.Value{ "70061", "Red", "Alewife", 42.39, -71.14, "place-alfcl", "" }
+  route := []driver.Value{ "Red" }
+  jobs := []Job{
+    { Entity: "headway", RouteID: "Red", StopIDs: []string{ "70061" } },
+    { Entity: "daily_metric", RouteID: "Red" },
+  }
+
+  tx, recorder := dbtest.Begin(t)
+  recorder.Return(stop)
+  recorder.Return(route)
+  recorder.Return(route)
+  if err := ValidateIDs(tx, jobs); err != nil {
+    t.Errorf("Expected the jobs to be valid, got %v", err)
+  }
+
+  // The headway job's stop isn't loaded
+  tx, recorder = dbtest.Begin(t)
+  err := ValidateIDs(tx, jobs)
+  if err == nil || !strings.Contains(err.Error(), jobs[0].String()) {
+    t.Errorf("Expected the invalid job to be named, got %v", err)
+  }
+  if len(recorder.Queries()) != 1 {
+    t.Errorf("Expected validation to stop at the first invalid job, got %v", recorder.Queries())
+  }
+}
@@ -1,35 +1,39 @@
 package traveltimes
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
   "errors"
 	"fmt"
-  "net/http"
 	"strconv"
-	"sync"
   "time"
 
 	"github.com/lib/pq"
-	"github.com/mbta-performance-dashboard/consts"
+	"github.com/mbta-performance-dashboard/locks"
+	"github.com/mbta-performance-dashboard/performanceapi"
 	"github.com/mbta-performance-dashboard/types"
 	"github.com/mbta-performance-dashboard/utils"
 )
 
 // An APIResponse represents a response from the MBTA Performance API's travel times endpoint.
 type APIResponse struct {
-	TravelTimes []*TravelTime `json:"travel_times"`
+	TravelTimes []*APITravelTime `json:"travel_times"`
 }
 
-func (a *APIResponse) Entities() []*TravelTime {
-  return a.TravelTimes
+func (a *APIResponse) Entities() ([]*TravelTime, []*types.RejectedRecord) {
+  if a == nil {
+    return nil, nil
+  }
+  return utils.Validate(a.TravelTimes, (*APITravelTime).TravelTime)
 }
 
-
-// A TravelTime represents the travel time of a train from an origin to a destination.
-type TravelTime struct {
-  types.BaseEntity
-	FromStopID             string `json:"from_stop_id"`
-	ToStopID               string `json:"to_stop_id"`
+// An APITravelTime represents a travel time exactly as the MBTA Performance API returns it, where
+// every field is a string.
+//
+// The API doesn't include the origin and destination, which are filled in from the request.
+type APITravelTime struct {
+	RouteID                string `json:"route_id"`
 	Direction              string `json:"direction"`
 	DepDt                  string `json:"dep_dt"`
 	ArrDt                  string `json:"arr_dt"`
@@ -37,6 +41,53 @@ type TravelTime struct {
 	BenchmarkTravelTimeSec string `json:"benchmark_travel_time_sec"`
 }
 
+// TravelTime converts an upstream travel time into a travel time.
+func (a *APITravelTime) TravelTime() (*TravelTime, error) {
+  direction, err := types.ParseDirection(a.Direction)
+  if err != nil {
+    return nil, err
+  }
+  depDt, err := utils.ParseUnix(a.DepDt)
+  if err != nil {
+    return nil, fmt.Errorf("Error converting departure datetime: %w", err)
+  }
+  arrDt, err := utils.ParseUnix(a.ArrDt)
+  if err != nil {
+    return nil, fmt.Errorf("Error converting arrival datetime: %w", err)
+  }
+  travelTimeSec, err := strconv.Atoi(a.TravelTimeSec)
+  if err != nil {
+    return nil, fmt.Errorf("Error converting travel time to integer: %w", err)
+  }
+  benchmarkTravelTimeSec, err := strconv.Atoi(a.BenchmarkTravelTimeSec)
+  if err != nil {
+    return nil, fmt.Errorf("Error converting benchmark travel time to integer: %w", err)
+  }
+
+  return &TravelTime{
+    BaseEntity: types.BaseEntity{ RouteID: a.RouteID },
+    Direction: direction,
+    DepDt: depDt,
+    ArrDt: arrDt,
+    TravelTimeSec: travelTimeSec,
+    BenchmarkTravelTimeSec: benchmarkTravelTimeSec,
+  }, nil
+}
+
+
+// A TravelTime represents the travel time of a train from an origin to a destination.
+type TravelTime struct {
+  types.BaseEntity
+	FromStopID             string          `json:"from_stop_id"`
+	ToStopID               string          `json:"to_stop_id"`
+	Direction              types.Direction `json:"direction"`
+	DirectionName          string          `json:"direction_name"`
+	DepDt                  time.Time       `json:"dep_dt"`
+	ArrDt                  time.Time       `json:"arr_dt"`
+	TravelTimeSec          int             `json:"travel_time_sec"`
+	BenchmarkTravelTimeSec int             `json:"benchmark_travel_time_sec"`
+}
+
 // These don't actually matter
 func (t *TravelTime) StopID() string {
   return t.BaseEntity.StopID
@@ -51,6 +102,49 @@ func (t *TravelTime) RouteID() string {
   return t.BaseEntity.RouteID
 }
 
+// MarshalJSON marshals a travel time with its datetimes in EST.
+func (t *TravelTime) MarshalJSON() ([]byte, error) {
+  type travelTime TravelTime
+  marshaled := travelTime(*t)
+
+  var err error
+  if marshaled.DepDt, err = utils.InNewYork(t.DepDt); err != nil {
+    return nil, err
+  }
+  if marshaled.ArrDt, err = utils.InNewYork(t.ArrDt); err != nil {
+    return nil, err
+  }
+  return json.Marshal(marshaled)
+}
+
+// A LegacyTravelTime represents a travel time in its original response shape, where every field is
+// a string.
+type LegacyTravelTime struct {
+  types.BaseEntity
+	FromStopID             string `json:"from_stop_id"`
+	ToStopID               string `json:"to_stop_id"`
+	Direction              string `json:"direction"`
+	DirectionName          string `json:"direction_name"`
+	DepDt                  string `json:"dep_dt"`
+	ArrDt                  string `json:"arr_dt"`
+	TravelTimeSec          string `json:"travel_time_sec"`
+	BenchmarkTravelTimeSec string `json:"benchmark_travel_time_sec"`
+}
+
+func (t *TravelTime) Legacy() any {
+  return &LegacyTravelTime{
+    BaseEntity: t.BaseEntity,
+    FromStopID: t.FromStopID,
+    ToStopID: t.ToStopID,
+    Direction: strconv.FormatBool(t.Direction.Bool()),
+    DirectionName: t.DirectionName,
+    DepDt: t.DepDt.Format(time.RFC3339Nano),
+    ArrDt: t.ArrDt.Format(time.RFC3339Nano),
+    TravelTimeSec: strconv.Itoa(t.TravelTimeSec),
+    BenchmarkTravelTimeSec: strconv.Itoa(t.BenchmarkTravelTimeSec),
+  }
+}
+
 
 // A LastCacheDatetime represents the last time data was cached for this origin-destination-route ID
 // combination.
@@ -65,41 +159,87 @@ type LastCacheDatetime struct {
 }
 
 
+// A Reliability represents how reliable travel times between an origin and a destination were
+// within a single bucket of time.
+//
+// BufferTimeSec is the extra time on top of a typical trip needed to arrive on time 9 times out of
+// 10, and PlanningTimeIndex is the 95th percentile travel time as a multiple of the benchmark.
+// ExcessJourneyTimeSec is the average time trips took beyond their benchmark, where trips that
+// beat their benchmark count as no excess. Benchmark metrics are nil if no trips had a benchmark,
+// and only cover the trips that did, so PlanningTimeIndex isn't always P95 over BenchmarkMean.
+type Reliability struct {
+  FromStopID           string    `json:"from_stop_id"`
+  ToStopID             string    `json:"to_stop_id"`
+  BucketStart          time.Time `json:"bucket_start"`
+  Count                int       `json:"count"`
+  P50                  float64   `json:"p50"`
+  P90                  float64   `json:"p90"`
+  P95                  float64   `json:"p95"`
+  BufferTimeSec        float64   `json:"buffer_time_sec"`
+  BenchmarkMean        *float64  `json:"benchmark_mean"`
+  ExcessJourneyTimeSec *float64  `json:"excess_journey_time_sec"`
+  PlanningTimeIndex    *float64  `json:"planning_time_index"`
+  ExceedingPct         *float64  `json:"exceeding_pct"`
+}
+
 // A TravelTimeService represents a service that will fetch and store travel times.
 type TravelTimeService struct {
   types.BaseService
 }
 
-func NewService(db *sql.DB, mu *sync.Mutex) *TravelTimeService {
-  return &TravelTimeService { BaseService: types.BaseService{ DB: db, Mu: mu } }
+func NewService(
+  db *sql.DB,
+  api performanceapi.Client,
+  lockManager *locks.Manager,
+  retentionDays int,
+) *TravelTimeService {
+  return &TravelTimeService{
+    BaseService: types.BaseService{
+      DB: db,
+      API: api,
+      Locks: lockManager,
+      Entity: "travel_time",
+      RetentionDays: retentionDays,
+    },
+  }
 }
 
 func (s *TravelTimeService) BeginTx() (*sql.Tx, error) {
   return s.BaseService.BeginTx()
 }
 
-func (s *TravelTimeService) Lock() {
-  s.BaseService.Lock()
+func (s *TravelTimeService) Lock(stopIDs []string, routeID string) func() {
+  return s.BaseService.Lock(stopIDs, routeID)
 }
 
-func (s *TravelTimeService) Unlock() {
-  s.BaseService.Unlock()
+func (s *TravelTimeService) Coalesce(
+  ctx context.Context,
+  stopIDs []string,
+  routeID string,
+  fn func(ctx context.Context) (any, error),
+) (any, error) {
+  return s.BaseService.Coalesce(ctx, stopIDs, routeID, fn)
 }
 
 func (s *TravelTimeService) FetchFromAPI(
+  ctx context.Context,
   tx *sql.Tx,
   stopIDs []string,
   routeID string,
-) ([]*TravelTime, []error) {
-  return nil, []error{ errors.New("Please use FetchTravelTimesFromAPI instead") }
+) ([]types.ChunkResult[*TravelTime], error) {
+  return nil, errors.New("Please use FetchTravelTimesFromAPI instead")
 }
 
+// FetchTravelTimesFromAPI fetches travel times in chunks, keyed by origin-destination pair.
+//
+// Each chunk's params hold its pair's "from_stop" and "to_stop".
 func (s *TravelTimeService) FetchTravelTimesFromAPI(
+  ctx context.Context,
   tx *sql.Tx,
   fromStopIDs []string,
   toStopIDs []string,
   routeID string,
-) ([]*TravelTime, []error) {
+) ([]types.ChunkResult[*TravelTime], error) {
   datetimes, err := s.lastCacheDatetimes(
     tx,
     fromStopIDs,
@@ -107,95 +247,43 @@ func (s *TravelTimeService) FetchTravelTimesFromAPI(
     routeID,
   )
   if err != nil {
-    return nil, []error{ err }
+    return nil, err
   }
 
   startOfToday, err := utils.StartOfToday()
   if err != nil {
-    return nil, []error{ err }
+    return nil, err
   }
-	endOfYesterday := startOfToday.Add(-1 * time.Second)
-
-  var wg sync.WaitGroup
-	results := make(chan []*TravelTime)
-  errs := []error{}
 
+  var chunks []types.Chunk = []types.Chunk{}
 	for i := 0; i < len(fromStopIDs); i++ {
     for j := 0; j < len(toStopIDs); j++ {
-      wg.Add(1)
-
-      go func(fromStopID string, toStopID string) {
-        defer wg.Done()
-
-        datetime, datetimeOk := datetimes[fromStopID][toStopID]
-        if datetimeOk &&
-          (datetime.After(startOfToday) ||
-            datetime.Equal(startOfToday)) {
-          return
-        }
-
-        var startOfRange time.Time
-        var endOfRange time.Time
-
-        if !datetimeOk ||
-          startOfToday.Sub(datetime).Hours()/24 >= float64(consts.MaxDays) {
-          startOfRange = startOfToday.AddDate(0, 0, -consts.MaxDays)
-        } else {
-          startOfRange = datetime
-        }
-
-        if startOfRange.AddDate(0, 0, 7).Before(startOfToday) {
-          endOfRange = startOfRange.AddDate(0, 0, 7).Add(-1 * time.Second)
-        } else {
-          endOfRange = endOfYesterday
-        }
-
-        client := http.Client{}
-
-        for true {
-          var travelTimes []*TravelTime
-          travelTimes, errs = utils.FetchFromRequest[*TravelTime, *APIResponse](
-            client,
-            "traveltimes",
-            errs,
-            map[string]string{
-              "from_stop": fromStopID,
-              "to_stop": toStopID,
-              "route": routeID,
-              "from_datetime": strconv.FormatInt(startOfRange.Unix(), 10),
-              "to_datetime": strconv.FormatInt(endOfRange.Unix(), 10),
-            },
-          )
-          for k := 0; k < len(travelTimes); k++ {
-            travelTimes[k].FromStopID = fromStopID
-            travelTimes[k].ToStopID = toStopID
-          }
-          results <- travelTimes
-
-          startOfRange = startOfRange.AddDate(0, 0, 7)
-          if endOfRange.Equal(endOfYesterday) {
-            break
-          } else if endOfRange.AddDate(0, 0, 7).Before(startOfToday) {
-            endOfRange = endOfRange.AddDate(0, 0, 7)
-          } else {
-            endOfRange = endOfYesterday
-          }
-        }
-      }(fromStopIDs[i], toStopIDs[j])
+      datetime, datetimeOk := datetimes[fromStopIDs[i]][toStopIDs[j]]
+      for _, window := range utils.CacheWindows(datetime, datetimeOk, startOfToday) {
+        chunks = append(chunks, types.Chunk{
+          Key: PairKey(fromStopIDs[i], toStopIDs[j]),
+          Window: window,
+          Params: map[string]string{
+            "from_stop": fromStopIDs[i],
+            "to_stop": toStopIDs[j],
+            "route": routeID,
+            "from_datetime": strconv.FormatInt(window.Start.Unix(), 10),
+            "to_datetime": strconv.FormatInt(window.End.Unix(), 10),
+          },
+        })
+      }
     }
 	}
 
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
-
-	var travelTimes []*TravelTime = []*TravelTime{}
-	for result := range results {
-		travelTimes = append(travelTimes, result...)
-	}
+  results := utils.FetchChunks[*TravelTime, *APIResponse](ctx, s.API, "traveltimes", chunks)
+  for _, result := range results {
+    for k := 0; k < len(result.Entities); k++ {
+      result.Entities[k].FromStopID = result.Chunk.Params["from_stop"]
+      result.Entities[k].ToStopID = result.Chunk.Params["to_stop"]
+    }
+  }
 
-  return travelTimes, errs
+  return results, nil
 }
 
 func (s *TravelTimeService) lastCacheDatetimes(
@@ -250,57 +338,41 @@ func (s *TravelTimeService) Insert(tx *sql.Tx, travelTimes []*TravelTime) error
   var paramToStopIDs []string = []string{}
   var paramRouteIDs []string = []string{}
   var paramDirections []bool = []bool{}
-  var paramDepDts []int = []int{}
-  var paramArrDts []int = []int{}
+  var paramDepDts []int64 = []int64{}
+  var paramArrDts []int64 = []int64{}
   var paramTravelTimeSecs []int = []int{}
   var paramBenchmarkTravelTimeSecs []int = []int{}
 
   for i := 0; i < len(travelTimes); i++ {
-		convertedDirection, err := strconv.Atoi(travelTimes[i].Direction)
-		if err != nil {
-			panic(fmt.Sprintf("Error converting direction to integer: %v", err))
-		}
-		convertedDepDt, err := strconv.Atoi(travelTimes[i].DepDt)
-		if err != nil {
-			panic(fmt.Sprintf("Error converting departure datetime to integer: %v", err))
-		}
-		convertedArrDt, err := strconv.Atoi(travelTimes[i].ArrDt)
-		if err != nil {
-			panic(fmt.Sprintf("Error converting arrival datetime to integer: %v", err))
-		}
-		convertedTravelTimeSec, err := strconv.Atoi(travelTimes[i].TravelTimeSec)
-		if err != nil {
-			panic(fmt.Sprintf("Error converting travel time to integer: %v", err))
-		}
-		convertedBenchmarkTravelTimeSec, err := strconv.Atoi(travelTimes[i].BenchmarkTravelTimeSec)
-		if err != nil {
-			panic(fmt.Sprintf("Error converting benchmark travel time to integer: %v", err))
-		}
-
     paramFromStopIDs = append(paramFromStopIDs, travelTimes[i].FromStopID)
     paramToStopIDs = append(paramToStopIDs, travelTimes[i].ToStopID)
     paramRouteIDs = append(paramRouteIDs, travelTimes[i].RouteID())
-    paramDirections = append(paramDirections, convertedDirection == 1)
-    paramDepDts = append(paramDepDts, convertedDepDt)
-    paramArrDts = append(paramArrDts, convertedArrDt)
-    paramTravelTimeSecs = append(paramTravelTimeSecs, convertedTravelTimeSec)
+    paramDirections = append(paramDirections, travelTimes[i].Direction.Bool())
+    paramDepDts = append(paramDepDts, travelTimes[i].DepDt.Unix())
+    paramArrDts = append(paramArrDts, travelTimes[i].ArrDt.Unix())
+    paramTravelTimeSecs = append(paramTravelTimeSecs, travelTimes[i].TravelTimeSec)
     paramBenchmarkTravelTimeSecs = append(
       paramBenchmarkTravelTimeSecs,
-      convertedBenchmarkTravelTimeSec,
+      travelTimes[i].BenchmarkTravelTimeSec,
     )
 	}
 
   _, err := tx.Exec(
     "INSERT INTO travel_time (from_stop_id, to_stop_id, route_id, direction, dep_dt, "+
       "arr_dt, travel_time_sec, benchmark_travel_time_sec) SELECT " +
+      "DISTINCT ON (from_stop_id, to_stop_id, route_id, direction, dep_dt) * FROM (SELECT " +
       "unnest($1::text[]) AS from_stop_id, " +
       "unnest($2::text[]) AS to_stop_id, " +
       "unnest($3::text[]) AS route_id, " +
       "unnest($4::boolean[]) AS direction, " +
-      "TO_TIMESTAMP(unnest($5::int[])) AS dep_dt, " +
-      "TO_TIMESTAMP(unnest($6::int[])) AS arr_dt, " +
+      "TO_TIMESTAMP(unnest($5::bigint[])) AS dep_dt, " +
+      "TO_TIMESTAMP(unnest($6::bigint[])) AS arr_dt, " +
       "unnest($7::int[]) AS travel_time_sec, " +
-      "unnest($8::int[]) AS benchmark_travel_time_sec",
+      "unnest($8::int[]) AS benchmark_travel_time_sec) AS upserted " +
+      "ON CONFLICT (from_stop_id, to_stop_id, route_id, direction, dep_dt) DO UPDATE SET " +
+      "arr_dt = EXCLUDED.arr_dt, " +
+      "travel_time_sec = EXCLUDED.travel_time_sec, " +
+      "benchmark_travel_time_sec = EXCLUDED.benchmark_travel_time_sec",
     pq.Array(paramFromStopIDs),
     pq.Array(paramToStopIDs),
     pq.Array(paramRouteIDs),
@@ -321,6 +393,7 @@ func (s *TravelTimeService) Select(
   tx *sql.Tx,
   stopIDs []string,
   routeID string,
+  filter types.Filter,
 ) ([]*TravelTime, error) {
   return nil, errors.New("Please use SelectTravelTimes instead")
 }
@@ -330,18 +403,29 @@ func (s *TravelTimeService) SelectTravelTimes(
   fromStopIDs []string,
   toStopIDs []string,
   routeID string,
+  filter types.Filter,
 ) ([]*TravelTime, error) {
+  filterClause, filterParams := utils.FilterClause(
+    filter,
+    "dep_dt",
+    len(fromStopIDs)+len(toStopIDs)+1,
+  )
  	rows, err := tx.Query(
     fmt.Sprintf(
-      "SELECT from_stop_id, to_stop_id, route_id, direction, dep_dt AT TIME ZONE " +
+      "SELECT from_stop_id, to_stop_id, route_id, direction, %s, dep_dt AT TIME ZONE " +
         "'America/New_York', arr_dt AT TIME ZONE 'America/New_York', travel_time_sec, " +
         "benchmark_travel_time_sec FROM travel_time WHERE from_stop_id IN (%s) AND to_stop_id IN " +
-        "(%s) AND route_id = %s",
+        "(%s) AND route_id = %s%s",
+      utils.DirectionName("travel_time.route_id", "travel_time.direction"),
       utils.PgPlaceholders(0, len(fromStopIDs)),
       utils.PgPlaceholders(len(fromStopIDs), len(fromStopIDs)+len(toStopIDs)),
       utils.PgPlaceholders(len(fromStopIDs)+len(toStopIDs), len(fromStopIDs)+len(toStopIDs)+1),
+      filterClause,
     ),
-    utils.SliceToAnySlice[string](append(fromStopIDs, append(toStopIDs, routeID)...))...,
+    append(
+      utils.SliceToAnySlice[string](append(fromStopIDs, append(toStopIDs, routeID)...)),
+      filterParams...,
+    )...,
   )
 	if err != nil {
     return nil, fmt.Errorf("Error fetching travel times: %w", err)
@@ -350,11 +434,13 @@ func (s *TravelTimeService) SelectTravelTimes(
 	var travelTimes []*TravelTime = []*TravelTime{}
 	for rows.Next() {
 		var travelTime TravelTime
+		var direction bool
 		err := rows.Scan(
 			&travelTime.FromStopID,
       &travelTime.ToStopID,
 			&travelTime.BaseEntity.RouteID,
-			&travelTime.Direction,
+			&direction,
+			&travelTime.DirectionName,
 			&travelTime.DepDt,
 			&travelTime.ArrDt,
 			&travelTime.TravelTimeSec,
@@ -363,6 +449,7 @@ func (s *TravelTimeService) SelectTravelTimes(
 		if err != nil {
       return nil, fmt.Errorf("Error scanning travel times: %w", err)
 		}
+		travelTime.Direction = types.DirectionFromBool(direction)
 		travelTimes = append(travelTimes, &travelTime)
 	}
 	rows.Close()
@@ -370,68 +457,172 @@ func (s *TravelTimeService) SelectTravelTimes(
 	return travelTimes, nil 
 }
 
-func (s *TravelTimeService) UpdateCacheDatetimes(tx *sql.Tx, stopIDs []string, routeID string) error {
-  return errors.New("Please use UpdateTravelTimeCacheDatetimes instead")
+func (s *TravelTimeService) SelectStats(
+  tx *sql.Tx,
+  stopIDs []string,
+  routeID string,
+  filter types.Filter,
+  bucket time.Duration,
+) ([]*types.Stat, error) {
+  return nil, errors.New("Please use SelectTravelTimeStats instead")
 }
 
-func (s *TravelTimeService) UpdateTravelTimeCacheDatetimes(
-  tx *sql.Tx, 
+func (s *TravelTimeService) SelectTravelTimeStats(
+  tx *sql.Tx,
   fromStopIDs []string,
   toStopIDs []string,
   routeID string,
-) error {
-  datetimes, err := s.lastCacheDatetimes(
+  filter types.Filter,
+  bucket time.Duration,
+) ([]*types.Stat, error) {
+  filterClause, filterParams := utils.FilterClause(
+    filter,
+    "dep_dt",
+    len(fromStopIDs)+len(toStopIDs)+1,
+  )
+  return utils.SelectStats(
     tx,
-    fromStopIDs,
-    toStopIDs,
-    routeID,
+    "travel_time",
+    "dep_dt",
+    "travel_time_sec",
+    "benchmark_travel_time_sec",
+    fmt.Sprintf(
+      "from_stop_id IN (%s) AND to_stop_id IN (%s) AND route_id = %s%s",
+      utils.PgPlaceholders(0, len(fromStopIDs)),
+      utils.PgPlaceholders(len(fromStopIDs), len(fromStopIDs)+len(toStopIDs)),
+      utils.PgPlaceholders(len(fromStopIDs)+len(toStopIDs), len(fromStopIDs)+len(toStopIDs)+1),
+      filterClause,
+    ),
+    append(
+      utils.SliceToAnySlice[string](append(fromStopIDs, append(toStopIDs, routeID)...)),
+      filterParams...,
+    ),
+    bucket,
+  )
+}
+
+// SelectReliability computes reliability metrics per origin-destination pair and bucket of time.
+//
+// Buckets are aligned the same way as stats. Trips count as exceeding their benchmark if they took
+// more than exceedancePct percent longer than it.
+func (s *TravelTimeService) SelectReliability(
+  tx *sql.Tx,
+  fromStopIDs []string,
+  toStopIDs []string,
+  routeID string,
+  filter types.Filter,
+  bucket time.Duration,
+  exceedancePct float64,
+) ([]*Reliability, error) {
+  offset := len(fromStopIDs) + len(toStopIDs) + 1
+  filterClause, filterParams := utils.FilterClause(filter, "dep_dt", offset)
+  offset += len(filterParams)
+
+  bucketPlaceholder := utils.PgPlaceholders(offset, offset+1)
+  rows, err := tx.Query(
+    fmt.Sprintf(
+      "SELECT from_stop_id, to_stop_id, (TO_TIMESTAMP(FLOOR(EXTRACT(EPOCH FROM " +
+        "dep_dt::timestamptz AT TIME ZONE 'America/New_York') / %s) * %s) AT TIME ZONE 'UTC') " +
+        "AT TIME ZONE 'America/New_York' AS bucket_start, COUNT(*), PERCENTILE_CONT(0.5) WITHIN " +
+        "GROUP (ORDER BY travel_time_sec), PERCENTILE_CONT(0.9) WITHIN GROUP (ORDER BY " +
+        "travel_time_sec), PERCENTILE_CONT(0.95) WITHIN GROUP (ORDER BY travel_time_sec), " +
+        "PERCENTILE_CONT(0.95) WITHIN GROUP (ORDER BY travel_time_sec) FILTER (WHERE " +
+        "benchmark_travel_time_sec > 0), AVG(benchmark_travel_time_sec) FILTER (WHERE " +
+        "benchmark_travel_time_sec > 0), " +
+        "AVG(GREATEST(travel_time_sec - benchmark_travel_time_sec, 0)) FILTER (WHERE " +
+        "benchmark_travel_time_sec > 0), AVG(CASE WHEN travel_time_sec > " +
+        "benchmark_travel_time_sec * (1 + %s::float / 100) THEN 100.0 ELSE 0.0 END) FILTER " +
+        "(WHERE benchmark_travel_time_sec > 0) FROM travel_time WHERE from_stop_id IN (%s) AND " +
+        "to_stop_id IN (%s) AND route_id = %s%s GROUP BY from_stop_id, to_stop_id, " +
+        "bucket_start ORDER BY bucket_start, from_stop_id, to_stop_id",
+      bucketPlaceholder,
+      bucketPlaceholder,
+      utils.PgPlaceholders(offset+1, offset+2),
+      utils.PgPlaceholders(0, len(fromStopIDs)),
+      utils.PgPlaceholders(len(fromStopIDs), len(fromStopIDs)+len(toStopIDs)),
+      utils.PgPlaceholders(len(fromStopIDs)+len(toStopIDs), len(fromStopIDs)+len(toStopIDs)+1),
+      filterClause,
+    ),
+    append(
+      append(
+        utils.SliceToAnySlice[string](append(fromStopIDs, append(toStopIDs, routeID)...)),
+        filterParams...,
+      ),
+      int64(bucket.Seconds()),
+      exceedancePct,
+    )...,
   )
   if err != nil {
-    return err
+    return nil, fmt.Errorf("Error computing travel time reliability: %w", err)
   }
+  defer rows.Close()
+
+  var reliabilities []*Reliability = []*Reliability{}
+  for rows.Next() {
+    var reliability Reliability
+    var benchmarkedP95 sql.NullFloat64
+    err := rows.Scan(
+      &reliability.FromStopID,
+      &reliability.ToStopID,
+      &reliability.BucketStart,
+      &reliability.Count,
+      &reliability.P50,
+      &reliability.P90,
+      &reliability.P95,
+      &benchmarkedP95,
+      &reliability.BenchmarkMean,
+      &reliability.ExcessJourneyTimeSec,
+      &reliability.ExceedingPct,
+    )
+    if err != nil {
+      return nil, fmt.Errorf("Error scanning travel time reliability: %w", err)
+    }
 
-  startOfToday, err := utils.StartOfToday()
-  if err != nil {
-    return err
+    // The planning time index compares the trips that had a benchmark to their own benchmarks,
+    // rather than every trip to the benchmarks of some of them
+    reliability.BufferTimeSec = reliability.P90 - reliability.P50
+    if benchmarkedP95.Valid && reliability.BenchmarkMean != nil && *reliability.BenchmarkMean > 0 {
+      planningTimeIndex := benchmarkedP95.Float64 / *reliability.BenchmarkMean
+      reliability.PlanningTimeIndex = &planningTimeIndex
+    }
+    reliabilities = append(reliabilities, &reliability)
   }
 
-  for i := 0; i < len(fromStopIDs); i++ {
-    for j := 0; j < len(toStopIDs); j++ {
-      datetime, datetimeOk := datetimes[fromStopIDs[i]][toStopIDs[j]]
-      if datetimeOk &&
-      (datetime.After(startOfToday) ||
-      datetime.Equal(startOfToday)) {
-        continue
-      }
+  return reliabilities, nil
+}
 
-      if !datetimeOk {
-        _, err = tx.Exec(
-          "INSERT INTO last_travel_time_cache_datetime (from_stop_id, to_stop_id, route_id, " +
-            "value) VALUES ($1, $2, $3, $4)", 
-          fromStopIDs[i],
-          toStopIDs[j],
-          routeID, 
-          startOfToday,
-        )
-      } else {
-        _, err = tx.Exec(
-          "UPDATE last_travel_time_cache_datetime SET value = $1 WHERE from_stop_id = $2 AND " +
-            "to_stop_id = $3 AND route_id = $4",
-          startOfToday, 
-          fromStopIDs[i], 
-          toStopIDs[j],
-          routeID,
-        )
-      }
-      if err != nil {
-        return fmt.Errorf("Error updating last cache datetime: %w", err)
-      }
-    }
+func (s *TravelTimeService) UpdateCacheDatetime(
+  tx *sql.Tx,
+  stopID string,
+  routeID string,
+  value time.Time,
+) error {
+  return errors.New("Please use UpdateTravelTimeCacheDatetime instead")
+}
+
+func (s *TravelTimeService) UpdateTravelTimeCacheDatetime(
+  tx *sql.Tx, 
+  fromStopID string,
+  toStopID string,
+  routeID string,
+  value time.Time,
+) error {
+  _, err := tx.Exec(
+    "INSERT INTO last_travel_time_cache_datetime (from_stop_id, to_stop_id, route_id, value) " +
+      "VALUES ($1, $2, $3, $4) ON CONFLICT (from_stop_id, to_stop_id, route_id) DO UPDATE SET " +
+      "value = EXCLUDED.value WHERE last_travel_time_cache_datetime.value < EXCLUDED.value",
+    fromStopID,
+    toStopID,
+    routeID,
+    value,
+  )
+  if err != nil {
+    return fmt.Errorf("Error updating last cache datetime: %w", err)
   }
 
   return nil
 }
 
 func (s *TravelTimeService) DeleteOutdated(tx *sql.Tx) error {
-  return utils.DeleteOutdated(tx, "travel_time", "dep_dt")
+  return utils.DeleteOutdated(tx, "travel_time", "dep_dt", s.RetentionDays)
 }
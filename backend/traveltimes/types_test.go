@@ -0,0 +1,65 @@
+package traveltimes
+
+import (
+  "database/sql/driver"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/mbta-performance-dashboard/db/dbtest"
+  "github.com/mbta-performance-dashboard/types"
+)
+
+func TestSelectReliabilityComparesBenchmarkedTripsToTheirBenchmarks(t *testing.T) {
+  tx, recorder := dbtest.Begin(t)
+  bucketStart := time.Date(2024, time.March, 1, 6, 0, 0, 0, time.UTC)
+
+  // The slowest trips had no benchmark, so every trip's P95 is well above the benchmarked trips'
+  recorder.Return(
+    []driver.Value{
+      "70061", "70075", bucketStart, int64(20), 400.0, 800.0, 900.0, 600.0, 500.0, 50.0, 25.0,
+    },
+    []driver.Value{
+      "70061", "70077", bucketStart, int64(5), 400.0, 800.0, 900.0, nil, nil, nil, nil,
+    },
+  )
+
+  service := &TravelTimeService{}
+  reliabilities, err := service.SelectReliability(
+    tx,
+    []string{ "70061" },
+    []string{ "70075", "70077" },
+    "Red",
+    types.Filter{ StartDatetime: bucketStart },
+    time.Hour,
+    20,
+  )
+  if err != nil {
+    t.Fatalf("Expected the query to run, got %v", err)
+  }
+
+  query := recorder.Only(t)
+  dbtest.CheckPlaceholders(t, query)
+  expected := "PERCENTILE_CONT(0.95) WITHIN GROUP (ORDER BY travel_time_sec) FILTER (WHERE " +
+    "benchmark_travel_time_sec > 0)"
+  if !strings.Contains(query.SQL, expected) {
+    t.Errorf("Expected query to contain %q, got %s", expected, query.SQL)
+  }
+
+  if len(reliabilities) != 2 {
+    t.Fatalf("Expected 2 reliabilities, got %d", len(reliabilities))
+  }
+
+  benchmarked := reliabilities[0]
+  if benchmarked.P95 != 900 || benchmarked.BufferTimeSec != 400 {
+    t.Errorf("Expected stats over every trip, got %+v", benchmarked)
+  }
+  if benchmarked.PlanningTimeIndex == nil || *benchmarked.PlanningTimeIndex != 1.2 {
+    t.Errorf("Expected a planning time index of 600 / 500, got %v", benchmarked.PlanningTimeIndex)
+  }
+
+  unbenchmarked := reliabilities[1]
+  if unbenchmarked.PlanningTimeIndex != nil || unbenchmarked.BenchmarkMean != nil {
+    t.Errorf("Expected no benchmark metrics without benchmarks, got %+v", unbenchmarked)
+  }
+}
@@ -1,24 +1,198 @@
 package traveltimes
 
 import (
-  "errors"
+  "context"
+  "database/sql"
 	"fmt"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+  "github.com/mbta-performance-dashboard/consts"
+  "github.com/mbta-performance-dashboard/types"
   "github.com/mbta-performance-dashboard/utils"
 )
 
 func CacheTravelTimes(c *gin.Context, service *TravelTimeService) {
-	fromStopIDs := strings.Split(c.DefaultQuery("from_stop_ids", ""), ",")
-	toStopIDs := strings.Split(c.DefaultQuery("to_stop_ids", ""), ",")
 	routeID := c.DefaultQuery("route_id", "")
 
+  fromStopIDs, toStopIDs, err := resolveStopIDs(c, service, routeID)
+  if err != nil {
+    utils.PropagateToResponse(c, err)
+    return
+  }
+
+  report, err := CacheEntities(c.Request.Context(), service, fromStopIDs, toStopIDs, routeID)
+  if err != nil {
+    utils.PropagateToResponse(c, err)
+    return
+  }
+
+  utils.RespondWithReport(c, report)
+}
+
+// CacheEntities caches travel times for every origin-destination combination of the provided stop
+// IDs, without being tied to a request.
+//
+// Each combination is cached independently, and is keyed by PairKey in the returned report.
+func CacheEntities(
+  ctx context.Context,
+  service *TravelTimeService,
+  fromStopIDs []string,
+  toStopIDs []string,
+  routeID string,
+) (*types.CacheReport, error) {
+  pairs := pairKeys(fromStopIDs, toStopIDs)
+  report, err := service.Coalesce(ctx, pairs, routeID, func(ctx context.Context) (any, error) {
+    unlock := service.Lock(pairs, routeID)
+    defer unlock()
+
+    return cacheEntities(ctx, service, fromStopIDs, toStopIDs, routeID)
+  })
+  if err != nil {
+    return nil, err
+  }
+  return report.(*types.CacheReport), nil
+}
+
+// cacheEntities caches travel times, assuming that the caller has already locked every
+// origin-destination combination of the provided stop IDs.
+func cacheEntities(
+  ctx context.Context,
+  service *TravelTimeService,
+  fromStopIDs []string,
+  toStopIDs []string,
+  routeID string,
+) (*types.CacheReport, error) {
+  results, err := func() ([]types.ChunkResult[*TravelTime], error) {
+    tx, err := service.BeginTx()
+    if err != nil {
+      return nil, err
+    }
+    defer tx.Rollback()
+
+    if err := utils.ValidateIDs(tx, append(fromStopIDs, toStopIDs...), routeID); err != nil {
+      return nil, err
+    }
+
+    return service.FetchTravelTimesFromAPI(ctx, tx, fromStopIDs, toStopIDs, routeID)
+  }()
+  if err != nil {
+    return nil, err
+  }
+
+  report := utils.CommitChunks[*TravelTime](
+    service.BeginTx,
+    pairKeys(fromStopIDs, toStopIDs),
+    results,
+    func(tx *sql.Tx, result types.ChunkResult[*TravelTime]) error {
+      return service.Insert(tx, result.Entities)
+    },
+    func(tx *sql.Tx, result types.ChunkResult[*TravelTime]) error {
+      return service.UpdateTravelTimeCacheDatetime(
+        tx,
+        result.Chunk.Params["from_stop"],
+        result.Chunk.Params["to_stop"],
+        routeID,
+        result.Chunk.Window.End.Add(time.Second),
+      )
+    },
+  )
+
+  if err := utils.DeleteOutdatedInTx(service.BeginTx, service.DeleteOutdated); err != nil {
+    return nil, err
+  }
+
+  return report, nil
+}
+
+// PairKey returns the key of an origin-destination pair, as used for locking and reporting.
+func PairKey(fromStopID string, toStopID string) string {
+  return fmt.Sprintf("%s>%s", fromStopID, toStopID)
+}
+
+// pairKeys returns a key for every origin-destination combination of the provided stop IDs, for
+// locking travel times the same way other entities lock their stops.
+func pairKeys(fromStopIDs []string, toStopIDs []string) []string {
+  var keys []string = []string{}
+  for i := 0; i < len(fromStopIDs); i++ {
+    for j := 0; j < len(toStopIDs); j++ {
+      keys = append(keys, PairKey(fromStopIDs[i], toStopIDs[j]))
+    }
+  }
+  return keys
+}
+
+// resolveStopIDs gets the origin and destination stop IDs of a request, expanding any origin and
+// destination station IDs to their platforms.
+func resolveStopIDs(
+  c *gin.Context,
+  service *TravelTimeService,
+  routeID string,
+) ([]string, []string, error) {
+  fromStopIDs, err := utils.ResolveStopIDs(
+    c,
+    service.BeginTx,
+    "from_stop_ids",
+    "from_station_id",
+    routeID,
+  )
+  if err != nil {
+    return nil, nil, err
+  }
+
+  toStopIDs, err := utils.ResolveStopIDs(c, service.BeginTx, "to_stop_ids", "to_station_id", routeID)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  return fromStopIDs, toStopIDs, nil
+}
+
+func SelectTravelTimes(c *gin.Context, service *TravelTimeService) {
+  travelTimes, err := selectTravelTimes(c, service)
+  if err != nil {
+    utils.PropagateToResponse(c, err)
+    return
+  }
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": utils.Legacy[*TravelTime](travelTimes),
+	})
+}
+
+// SelectTravelTimesV2 selects travel times, responding with their typed shape.
+func SelectTravelTimesV2(c *gin.Context, service *TravelTimeService) {
+  travelTimes, err := selectTravelTimes(c, service)
+  if err != nil {
+    utils.PropagateToResponse(c, err)
+    return
+  }
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": travelTimes,
+	})
+}
+
+func selectTravelTimes(c *gin.Context, service *TravelTimeService) ([]*TravelTime, error) {
+	routeID := c.DefaultQuery("route_id", "")
+
+  var travelTimes []*TravelTime
   err := func() error {
+    fromStopIDs, toStopIDs, err := resolveStopIDs(c, service, routeID)
+    if err != nil {
+      return err
+    }
+
+    filter, err := utils.ParseFilter(c)
+    if err != nil {
+      return err
+    }
+
     tx, err := service.BeginTx()
     if err != nil {
-      return err 
+      return fmt.Errorf("Error beginning transaction: %w", err)
     }
     defer func() {
       if tx != nil {
@@ -26,27 +200,82 @@ func CacheTravelTimes(c *gin.Context, service *TravelTimeService) {
       }
     }()
 
-    service.Lock()
-    defer service.Unlock()
-
     if err := utils.ValidateIDs(tx, append(fromStopIDs, toStopIDs...), routeID); err != nil {
       return err
     }
 
-    entities, errs := service.FetchTravelTimesFromAPI(tx, fromStopIDs, toStopIDs, routeID)
-    if len(errs) > 0 {
-      return errors.Join(errs...)
+    direction, err := utils.ResolveDirection(c, tx, routeID)
+    if err != nil {
+      return err
+    }
+    if direction != nil {
+      filter.Direction = &direction.Direction
+    }
+
+    travelTimes, err = service.SelectTravelTimes(tx, fromStopIDs, toStopIDs, routeID, filter)
+    if err != nil {
+      return err
     }
 
-    if err = service.Insert(tx, entities); err != nil {
+    if err = tx.Commit(); err != nil {
+      return fmt.Errorf("Error committing transaction: %w", err)
+    }
+    tx = nil;
+
+    return nil
+  }()
+  if err != nil {
+    return nil, err
+  }
+
+  return travelTimes, nil
+}
+
+func StatsTravelTimes(c *gin.Context, service *TravelTimeService) {
+	routeID := c.DefaultQuery("route_id", "")
+
+  var stats []*types.Stat
+  var direction *types.ResolvedDirection
+  err := func() error {
+    fromStopIDs, toStopIDs, err := resolveStopIDs(c, service, routeID)
+    if err != nil {
+      return err
+    }
+
+    filter, err := utils.ParseFilter(c)
+    if err != nil {
+      return err
+    }
+
+    bucket, err := utils.ParseBucket(c.DefaultQuery("bucket", ""))
+    if err != nil {
+      return err
+    }
+
+    tx, err := service.BeginTx()
+    if err != nil {
+      return fmt.Errorf("Error beginning transaction: %w", err)
+    }
+    defer func() {
+      if tx != nil {
+        tx.Rollback()
+      }
+    }()
+
+    if err := utils.ValidateIDs(tx, append(fromStopIDs, toStopIDs...), routeID); err != nil {
       return err
     }
 
-    if err = service.UpdateTravelTimeCacheDatetimes(tx, fromStopIDs, toStopIDs, routeID); err != nil {
+    direction, err = utils.ResolveDirection(c, tx, routeID)
+    if err != nil {
       return err
     }
+    if direction != nil {
+      filter.Direction = &direction.Direction
+    }
 
-    if err = service.DeleteOutdated(tx); err != nil {
+    stats, err = service.SelectTravelTimeStats(tx, fromStopIDs, toStopIDs, routeID, filter, bucket)
+    if err != nil {
       return err
     }
 
@@ -63,27 +292,86 @@ func CacheTravelTimes(c *gin.Context, service *TravelTimeService) {
   }
 
 	c.JSON(http.StatusOK, gin.H{
-		"data": "Successfully cached new entities",
+		"data": stats,
+		"direction": direction,
 	})
 }
 
-func SelectTravelTimes(c *gin.Context, service *TravelTimeService) {
-	fromStopIDs := strings.Split(c.DefaultQuery("from_stop_ids", ""), ",")
-	toStopIDs := strings.Split(c.DefaultQuery("to_stop_ids", ""), ",")
+// parseExceedancePct parses how much longer than its benchmark a trip can take before it exceeds
+// it from a request's exceedance_pct query parameter, as a percent.
+//
+// Defaults to 20 percent.
+func parseExceedancePct(c *gin.Context) (float64, error) {
+  value := c.DefaultQuery("exceedance_pct", "")
+  if value == "" {
+    return consts.TravelTimeExceedancePct, nil
+  }
+
+  exceedancePct, err := strconv.ParseFloat(value, 64)
+  if err != nil || exceedancePct < 0 {
+    return 0, fmt.Errorf("Invalid exceedance_pct %s, expected a non-negative percent", value)
+  }
+  return exceedancePct, nil
+}
+
+func ReliabilityTravelTimes(c *gin.Context, service *TravelTimeService) {
 	routeID := c.DefaultQuery("route_id", "")
 
-  var travelTimes []*TravelTime
+  var reliabilities []*Reliability
+  var direction *types.ResolvedDirection
+  var exceedancePct float64
   err := func() error {
+    fromStopIDs, toStopIDs, err := resolveStopIDs(c, service, routeID)
+    if err != nil {
+      return err
+    }
+
+    filter, err := utils.ParseFilter(c)
+    if err != nil {
+      return err
+    }
+
+    bucket, err := utils.ParseBucket(c.DefaultQuery("bucket", ""))
+    if err != nil {
+      return err
+    }
+
+    exceedancePct, err = parseExceedancePct(c)
+    if err != nil {
+      return err
+    }
+
     tx, err := service.BeginTx()
     if err != nil {
       return fmt.Errorf("Error beginning transaction: %w", err)
     }
+    defer func() {
+      if tx != nil {
+        tx.Rollback()
+      }
+    }()
 
     if err := utils.ValidateIDs(tx, append(fromStopIDs, toStopIDs...), routeID); err != nil {
       return err
     }
 
-    travelTimes, err = service.SelectTravelTimes(tx, fromStopIDs, toStopIDs, routeID)
+    direction, err = utils.ResolveDirection(c, tx, routeID)
+    if err != nil {
+      return err
+    }
+    if direction != nil {
+      filter.Direction = &direction.Direction
+    }
+
+    reliabilities, err = service.SelectReliability(
+      tx,
+      fromStopIDs,
+      toStopIDs,
+      routeID,
+      filter,
+      bucket,
+      exceedancePct,
+    )
     if err != nil {
       return err
     }
@@ -91,7 +379,7 @@ func SelectTravelTimes(c *gin.Context, service *TravelTimeService) {
     if err = tx.Commit(); err != nil {
       return fmt.Errorf("Error committing transaction: %w", err)
     }
-    tx = nil;
+    tx = nil
 
     return nil
   }()
@@ -101,6 +389,8 @@ func SelectTravelTimes(c *gin.Context, service *TravelTimeService) {
   }
 
 	c.JSON(http.StatusOK, gin.H{
-		"data": travelTimes,
+		"data": reliabilities,
+		"direction": direction,
+		"exceedance_pct": exceedancePct,
 	})
 }
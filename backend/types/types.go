@@ -1,15 +1,27 @@
 package types
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
   "fmt"
-	"sync"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/mbta-performance-dashboard/locks"
+	"github.com/mbta-performance-dashboard/performanceapi"
 )
 
 // A Route represents a route on the MBTA, like train lines and buses.
+//
+// Type is the route's GTFS route type, like 1 for subway or 3 for bus, and Color is a hex color
+// without the leading #.
 type Route struct {
-	ID string `json:"id"`
+	ID          string `json:"id"`
+	Type        int    `json:"type"`
+	Color       string `json:"color"`
+	DisplayName string `json:"display_name"`
 }
 
 // A Shape represents a path for a route, represented by its polyline.
@@ -20,12 +32,17 @@ type Shape struct {
 }
 
 // A Stop represents a stop on a route.
+//
+// ParentStation is the ID of the station a platform belongs to, and is empty for stops that aren't
+// part of a station. PlatformCode is empty for stops without a platform code.
 type Stop struct {
-	ID        string  `json:"id"`
-	RouteID   string  `json:"route_id"`
-	Name      string  `json:"name"`
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
+	ID            string  `json:"id"`
+	RouteID       string  `json:"route_id"`
+	Name          string  `json:"name"`
+	Latitude      float64 `json:"latitude"`
+	Longitude     float64 `json:"longitude"`
+	ParentStation string  `json:"parent_station"`
+	PlatformCode  string  `json:"platform_code"`
 }
 
 // A LastCacheDatetime represents the last time data was cached for this stop ID-route ID
@@ -36,10 +53,133 @@ type LastCacheDatetime struct {
 	Value   time.Time `json:"value"`
 }
 
+// A Window represents a range of time to fetch entities for, including both its start and end.
+type Window struct {
+  Start time.Time `json:"start"`
+  End   time.Time `json:"end"`
+}
+
+// A ChunkError represents a failure to fetch entities for a single key over a single window, where
+// the key is a stop ID or an origin-destination pair.
+type ChunkError struct {
+  Key    string
+  Window Window
+  Err    error
+}
+
+func (e *ChunkError) Error() string {
+  return fmt.Sprintf(
+    "Error fetching %s from %s to %s: %v",
+    e.Key,
+    e.Window.Start.Format(time.RFC3339),
+    e.Window.End.Format(time.RFC3339),
+    e.Err,
+  )
+}
+
+func (e *ChunkError) Unwrap() error {
+  return e.Err
+}
+
+func (e *ChunkError) MarshalJSON() ([]byte, error) {
+  return json.Marshal(struct {
+    Key   string    `json:"key"`
+    Start time.Time `json:"start"`
+    End   time.Time `json:"end"`
+    Error string    `json:"error"`
+  }{
+    Key:   e.Key,
+    Start: e.Window.Start,
+    End:   e.Window.End,
+    Error: e.Err.Error(),
+  })
+}
+
+// A Chunk represents a single request to the MBTA Performance API for one key over one window.
+type Chunk struct {
+  Key    string
+  Window Window
+  Params map[string]string
+}
+
+// A ChunkResult represents the outcome of fetching a single chunk.
+//
+// Exactly one of Entities and Err is meaningful, depending on whether Err is nil. Rejected lists the
+// records that were left out of Entities because they were malformed.
+type ChunkResult[T Entity] struct {
+  Chunk    Chunk
+  Entities []T
+  Rejected []*RejectedRecord
+  Err      *ChunkError
+}
+
+// A KeyReport represents the outcome of caching every chunk for a single key.
+//
+// CachedThrough is the key's last cache datetime after caching, and is nil if nothing new needed
+// to be cached for the key.
+type KeyReport struct {
+  Key           string        `json:"key"`
+  CachedThrough *time.Time    `json:"cached_through,omitempty"`
+  Inserted      int           `json:"inserted"`
+  Rejected      int           `json:"rejected"`
+  Errors        []*ChunkError `json:"errors,omitempty"`
+}
+
+// A CacheReport represents which keys were cached successfully during a cache run, and which
+// weren't and why.
+//
+// Rejected is the total number of malformed records that were quarantined across every key.
+type CacheReport struct {
+  Succeeded []*KeyReport `json:"succeeded"`
+  Failed    []*KeyReport `json:"failed"`
+  Rejected  int          `json:"rejected"`
+}
+
+// Err returns a *FetchError listing every chunk that failed, or nil if every key succeeded.
+func (r *CacheReport) Err() error {
+  var chunkErrs []*ChunkError
+  for _, keyReport := range r.Failed {
+    chunkErrs = append(chunkErrs, keyReport.Errors...)
+  }
+
+  if len(chunkErrs) == 0 {
+    return nil
+  }
+  return &FetchError{ Chunks: chunkErrs }
+}
+
+// A FetchError represents a fetch from the MBTA Performance API in which at least one chunk failed.
+type FetchError struct {
+  Chunks []*ChunkError
+}
+
+func (e *FetchError) Error() string {
+  messages := make([]string, len(e.Chunks))
+  for i := 0; i < len(e.Chunks); i++ {
+    messages[i] = e.Chunks[i].Error()
+  }
+  return strings.Join(messages, "\n")
+}
+
 // An APIResponse represents a response from the MBTA Performance API that contains a list of
 // generic entities.
+//
+// Entities converts the upstream records into entities, rejecting any of them that are malformed
+// instead of failing the whole response.
 type APIResponse[T Entity] interface {
-  Entities() []T
+  Entities() ([]T, []*RejectedRecord)
+}
+
+// A RejectedRecord represents a record from the MBTA Performance API that failed validation, and
+// is quarantined instead of being cached.
+//
+// Payload is the record as it was received, and Endpoint and Key are filled in once the record's
+// chunk is known.
+type RejectedRecord struct {
+  Endpoint string
+  Key      string
+  Payload  any
+  Reason   string
 }
 
 // An EntityService represents a service that fetches generic entities from the MBTA Performance API
@@ -48,37 +188,77 @@ type EntityService[T Entity] interface {
   // BeginTx begins a database transaction.
   BeginTx() (*sql.Tx, error)
 
-  // Lock locks the service's mutex.
+  // Lock locks this service's entities for each of the provided stop IDs on a route, and returns a
+  // function that unlocks them.
   //
   // Best used to ensure that there are no data races when caching new entities.
-  Lock()
+  Lock(stopIDs []string, routeID string) func()
 
-  // Unlock unlocks the service's mutex.
-  Unlock()
+  // Coalesce calls fn, unless a call for the same stop and route IDs is already in progress, in
+  // which case it waits for and shares that call's result instead.
+  //
+  // Best used to ensure that duplicate cache requests only fetch from the API once.
+  //
+  // fn is given a context that isn't cancelled along with ctx, since other callers may be waiting
+  // on it. Cancelling ctx stops this caller from waiting, and only cancels fn once every caller
+  // waiting on it has stopped.
+  Coalesce(
+    ctx context.Context,
+    stopIDs []string,
+    routeID string,
+    fn func(ctx context.Context) (any, error),
+  ) (any, error)
 
-  // FetchFromAPI fetches this service's entities from the MBTA Performance API.
-  FetchFromAPI(tx *sql.Tx, stopIDs []string, routeID string) ([]T, []error)
+  // FetchFromAPI fetches this service's entities from the MBTA Performance API in chunks, keyed by
+  // stop ID.
+  //
+  // Every chunk has a result, whether it succeeded or not, so that the chunks that did succeed can
+  // still be cached. Stops fetching if the context is done.
+  FetchFromAPI(
+    ctx context.Context,
+    tx *sql.Tx,
+    stopIDs []string,
+    routeID string,
+  ) ([]ChunkResult[T], error)
 
   // Insert inserts provided entities into the database.
   Insert(tx *sql.Tx, entities []T) error
 
   // Select selects entities from the database whose stop ID matches one of the provided stop IDs,
-  // and whose route ID matches as well.
-  Select(tx *sql.Tx, stopIDs []string, routeID string) ([]T, error)
+  // whose route ID matches as well, and which satisfy the provided filter.
+  Select(tx *sql.Tx, stopIDs []string, routeID string, filter Filter) ([]T, error)
+
+  // SelectStats aggregates the same entities that Select would select into statistics per bucket
+  // of the provided size.
+  SelectStats(
+    tx *sql.Tx,
+    stopIDs []string,
+    routeID string,
+    filter Filter,
+    bucket time.Duration,
+  ) ([]*Stat, error)
 
-  // UpdateCacheDatetimes updates this service's entities' last cache datetimes to the start of
-  // today.
-  UpdateCacheDatetimes(tx *sql.Tx, stopIDs []string, routeID string) error
+  // UpdateCacheDatetime advances this service's last cache datetime for a stop ID-route ID
+  // combination to the provided value, if it isn't already past it.
+  UpdateCacheDatetime(tx *sql.Tx, stopID string, routeID string, value time.Time) error
 
-  // DeleteOutdated deletes this service's entities whose dates are set to before 30 days ago.
+  // DeleteOutdated deletes this service's entities whose dates are set to before its retention
+  // window, unless it keeps them forever.
   DeleteOutdated(tx *sql.Tx) error
 }
 
 // A BaseService represents a basic EntityService, which must have a way to interact with the
-// database and a mutex to prevent data races.
+// database, a way to fetch from the MBTA Performance API, and a lock manager to prevent data races.
+//
+// Entity names the type of entity the service handles, so that services sharing a lock manager
+// never contend over each other's keys. RetentionDays is how many days of entities are kept, or
+// consts.KeepForever.
 type BaseService struct {
-  DB *sql.DB
-  Mu *sync.Mutex
+  DB            *sql.DB
+  API           performanceapi.Client
+  Locks         *locks.Manager
+  Entity        string
+  RetentionDays int
 }
 
 func (s *BaseService) BeginTx() (*sql.Tx, error) {
@@ -89,12 +269,61 @@ func (s *BaseService) BeginTx() (*sql.Tx, error) {
   return tx, nil
 }
 
-func (s *BaseService) Lock() {
-  s.Mu.Lock()
+func (s *BaseService) Lock(stopIDs []string, routeID string) func() {
+  keys := make([]string, len(stopIDs))
+  for i := 0; i < len(stopIDs); i++ {
+    keys[i] = fmt.Sprintf("%s:%s:%s", s.Entity, routeID, stopIDs[i])
+  }
+  return s.Locks.Lock(keys...)
+}
+
+func (s *BaseService) Coalesce(
+  ctx context.Context,
+  stopIDs []string,
+  routeID string,
+  fn func(ctx context.Context) (any, error),
+) (any, error) {
+  sorted := make([]string, len(stopIDs))
+  copy(sorted, stopIDs)
+  sort.Strings(sorted)
+  return s.Locks.Do(
+    ctx,
+    fmt.Sprintf("%s:%s:%s", s.Entity, routeID, strings.Join(sorted, ",")),
+    fn,
+  )
 }
 
-func (s *BaseService) Unlock() {
-  s.Mu.Unlock()
+// A Filter represents optional constraints on the entities returned by a selection.
+//
+// A zero StartDatetime or EndDatetime leaves that end of the time range unbounded, and a nil
+// Direction includes both directions.
+type Filter struct {
+  StartDatetime time.Time
+  EndDatetime   time.Time
+  Direction     *Direction
+}
+
+// A ResolvedDirection represents a direction of a route along with its name, like "North".
+//
+// Name is empty if the route's directions weren't loaded.
+type ResolvedDirection struct {
+  Direction Direction `json:"direction"`
+  Name      string    `json:"name"`
+}
+
+// A Stat represents statistics for the entities that fall within a single bucket of time.
+//
+// BenchmarkMean is nil for entities that don't have a benchmark, like dwells.
+type Stat struct {
+  BucketStart   time.Time `json:"bucket_start"`
+  Count         int       `json:"count"`
+  Mean          float64   `json:"mean"`
+  Min           int       `json:"min"`
+  Max           int       `json:"max"`
+  P50           float64   `json:"p50"`
+  P90           float64   `json:"p90"`
+  P95           float64   `json:"p95"`
+  BenchmarkMean *float64  `json:"benchmark_mean"`
 }
 
 // An Entity represents a generic entity from the MBTA Performance API.
@@ -104,6 +333,44 @@ type Entity interface {
   RouteID() string
 }
 
+// A LegacyEntity represents an entity that also has its original response shape, where every field
+// is a string, which v1 endpoints keep returning so that existing clients don't break.
+type LegacyEntity interface {
+  Legacy() any
+}
+
+// A Direction represents which way a train travelled along its route, as a GTFS direction ID.
+type Direction int
+
+const (
+  DirectionZero Direction = 0
+  DirectionOne  Direction = 1
+)
+
+// ParseDirection parses a direction from a GTFS direction ID, like "0" or "1".
+func ParseDirection(value string) (Direction, error) {
+  switch value {
+  case "0":
+    return DirectionZero, nil
+  case "1":
+    return DirectionOne, nil
+  }
+  return DirectionZero, fmt.Errorf("Invalid direction %s, expected 0 or 1", value)
+}
+
+// DirectionFromBool converts a direction from how it's stored in the database, where true is 1.
+func DirectionFromBool(value bool) Direction {
+  if value {
+    return DirectionOne
+  }
+  return DirectionZero
+}
+
+// Bool converts a direction to how it's stored in the database, where true is 1.
+func (d Direction) Bool() bool {
+  return d == DirectionOne
+}
+
 // A BaseEntity represents an generic entity corresponding to a stop and route ID combination.
 //
 // Not all entities will have just a single stop ID, but all entities will have a route ID.
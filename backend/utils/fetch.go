@@ -0,0 +1,216 @@
+package utils
+
+import (
+  "context"
+  "database/sql"
+  "fmt"
+  "sync"
+  "time"
+
+  "github.com/mbta-performance-dashboard/consts"
+  "github.com/mbta-performance-dashboard/performanceapi"
+  "github.com/mbta-performance-dashboard/types"
+)
+
+// FetchChunks fetches every chunk from a provided MBTA Performance API endpoint using a fixed pool
+// of workers.
+//
+// Results are returned in the same order as the chunks. Chunks that haven't started by the time
+// the context is done fail with the context's error instead of being fetched.
+func FetchChunks[T types.Entity, U types.APIResponse[T]](
+  ctx context.Context,
+  client performanceapi.Client,
+  endpoint string,
+  chunks []types.Chunk,
+) []types.ChunkResult[T] {
+  results := make([]types.ChunkResult[T], len(chunks))
+  indices := make(chan int)
+
+  var wg sync.WaitGroup
+  for i := 0; i < min(consts.FetchWorkers, len(chunks)); i++ {
+    wg.Add(1)
+
+    go func() {
+      defer wg.Done()
+
+      // Every worker only writes to the results of the indices it receives, so the results never
+      // need to be locked
+      for index := range indices {
+        results[index] = fetchChunk[T, U](ctx, client, endpoint, chunks[index])
+      }
+    }()
+  }
+
+  for i := 0; i < len(chunks); i++ {
+    indices <- i
+  }
+  close(indices)
+  wg.Wait()
+
+  return results
+}
+
+// fetchChunk fetches a single chunk.
+func fetchChunk[T types.Entity, U types.APIResponse[T]](
+  ctx context.Context,
+  client performanceapi.Client,
+  endpoint string,
+  chunk types.Chunk,
+) types.ChunkResult[T] {
+  result := types.ChunkResult[T]{ Chunk: chunk }
+
+  if err := ctx.Err(); err != nil {
+    result.Err = &types.ChunkError{ Key: chunk.Key, Window: chunk.Window, Err: err }
+    return result
+  }
+
+  var apiRes U
+  if err := client.Get(ctx, endpoint, chunk.Params, &apiRes); err != nil {
+    result.Err = &types.ChunkError{ Key: chunk.Key, Window: chunk.Window, Err: err }
+    return result
+  }
+
+  entities, rejected := apiRes.Entities()
+  for _, record := range rejected {
+    record.Endpoint = endpoint
+    record.Key = chunk.Key
+  }
+
+  result.Entities = entities
+  result.Rejected = rejected
+  return result
+}
+
+// CacheWindows splits the time between a key's last cache datetime and the end of yesterday into
+// week-long windows, which is the longest the MBTA Performance API allows a query to span.
+//
+// Keys that have never been cached, or were last cached more than 30 days ago, start from 30 days
+// ago. Keys that were already cached today don't need any windows.
+func CacheWindows(datetime time.Time, cached bool, startOfToday time.Time) []types.Window {
+  var windows []types.Window = []types.Window{}
+  if cached && !datetime.Before(startOfToday) {
+    return windows
+  }
+
+  start := datetime
+  if !cached || startOfToday.Sub(datetime).Hours()/24 >= float64(consts.MaxDays) {
+    start = startOfToday.AddDate(0, 0, -consts.MaxDays)
+  }
+
+  for start.Before(startOfToday) {
+    end := start.AddDate(0, 0, 7)
+    if end.After(startOfToday) {
+      end = startOfToday
+    }
+
+    windows = append(windows, types.Window{ Start: start, End: end.Add(-1 * time.Second) })
+    start = end
+  }
+
+  return windows
+}
+
+// CommitChunks caches the entities of every successful chunk in a transaction of its own, so that
+// one failing chunk can't undo the others, and reports the outcome for every key.
+//
+// The results for each key must be in the order of their windows. A key's last cache datetime is
+// only advanced through its chunks up to the first failure, so that the failed window is fetched
+// again next time. Chunks after a failure are still inserted, since inserting them again later
+// won't duplicate them.
+func CommitChunks[T types.Entity](
+  beginTx func() (*sql.Tx, error),
+  keys []string,
+  results []types.ChunkResult[T],
+  insert func(tx *sql.Tx, result types.ChunkResult[T]) error,
+  advance func(tx *sql.Tx, result types.ChunkResult[T]) error,
+) *types.CacheReport {
+  resultsByKey := make(map[string][]types.ChunkResult[T])
+  for _, result := range results {
+    resultsByKey[result.Chunk.Key] = append(resultsByKey[result.Chunk.Key], result)
+  }
+
+  report := &types.CacheReport{
+    Succeeded: []*types.KeyReport{},
+    Failed:    []*types.KeyReport{},
+  }
+  for _, key := range keys {
+    keyReport := &types.KeyReport{ Key: key }
+    contiguous := true
+
+    for _, result := range resultsByKey[key] {
+      if result.Err != nil {
+        keyReport.Errors = append(keyReport.Errors, result.Err)
+        contiguous = false
+        continue
+      }
+
+      err := commitChunk(beginTx, result, contiguous, insert, advance)
+      if err != nil {
+        keyReport.Errors = append(keyReport.Errors, &types.ChunkError{
+          Key:    key,
+          Window: result.Chunk.Window,
+          Err:    err,
+        })
+        contiguous = false
+        continue
+      }
+
+      keyReport.Inserted += len(result.Entities)
+      keyReport.Rejected += len(result.Rejected)
+      report.Rejected += len(result.Rejected)
+      if contiguous {
+        cachedThrough := result.Chunk.Window.End.Add(time.Second)
+        keyReport.CachedThrough = &cachedThrough
+      }
+    }
+
+    if len(keyReport.Errors) > 0 {
+      report.Failed = append(report.Failed, keyReport)
+    } else {
+      report.Succeeded = append(report.Succeeded, keyReport)
+    }
+  }
+
+  return report
+}
+
+// commitChunk inserts a single chunk's entities, quarantines its rejected records and, if
+// requested, advances its key's last cache datetime, all in one transaction.
+func commitChunk[T types.Entity](
+  beginTx func() (*sql.Tx, error),
+  result types.ChunkResult[T],
+  shouldAdvance bool,
+  insert func(tx *sql.Tx, result types.ChunkResult[T]) error,
+  advance func(tx *sql.Tx, result types.ChunkResult[T]) error,
+) error {
+  tx, err := beginTx()
+  if err != nil {
+    return err
+  }
+  defer func() {
+    if tx != nil {
+      tx.Rollback()
+    }
+  }()
+
+  if err = insert(tx, result); err != nil {
+    return err
+  }
+
+  if err = InsertRejectedRecords(tx, result.Rejected); err != nil {
+    return err
+  }
+
+  if shouldAdvance {
+    if err = advance(tx, result); err != nil {
+      return err
+    }
+  }
+
+  if err = tx.Commit(); err != nil {
+    return fmt.Errorf("Error committing transaction: %w", err)
+  }
+  tx = nil
+
+  return nil
+}
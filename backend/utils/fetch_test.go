@@ -0,0 +1,618 @@
+package utils
+
+import (
+  "context"
+  "database/sql"
+  "database/sql/driver"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/mbta-performance-dashboard/consts"
+  "github.com/mbta-performance-dashboard/performanceapi"
+  "github.com/mbta-performance-dashboard/types"
+)
+
+// A testEntity represents a minimal entity, which is rejected if its value is empty.
+type testEntity struct {
+  types.BaseEntity
+  Value string `json:"value"`
+}
+
+func (e *testEntity) StopID() string {
+  return e.BaseEntity.StopID
+}
+
+func (e *testEntity) SetStopID(stopID string) {
+  e.BaseEntity.StopID = stopID
+}
+
+func (e *testEntity) RouteID() string {
+  return e.BaseEntity.RouteID
+}
+
+type testResponse struct {
+  Records []*testEntity `json:"records"`
+}
+
+func (r *testResponse) Entities() ([]*testEntity, []*types.RejectedRecord) {
+  if r == nil {
+    return nil, nil
+  }
+  return Validate(r.Records, func(record *testEntity) (*testEntity, error) {
+    if record.Value == "" {
+      return nil, errors.New("Missing value")
+    }
+    return record, nil
+  })
+}
+
+// A fakeResponse represents how a fakeClient responds to a single chunk, after waiting for delay.
+//
+// A nil err responds with records, which are returned as JSON just like the real API returns them.
+type fakeResponse struct {
+  records []*testEntity
+  err     error
+  delay   time.Duration
+}
+
+// A fakeClient represents a performanceapi.Client that responds to each chunk as configured, keyed
+// by the chunk's "chunk" param, and keeps track of how many requests it's handling at once.
+//
+// If started is set, every call sends its chunk to it once it's in flight, and if release is set,
+// every call holds until it's closed.
+type fakeClient struct {
+  responses map[string]fakeResponse
+  started   chan string
+  release   chan struct{}
+
+  mu          sync.Mutex
+  calls       []string
+  inFlight    int
+  maxInFlight int
+}
+
+var _ performanceapi.Client = (*fakeClient)(nil)
+
+func (c *fakeClient) Get(
+  ctx context.Context,
+  endpoint string,
+  params map[string]string,
+  out any,
+) error {
+  key := params["chunk"]
+
+  c.mu.Lock()
+  c.calls = append(c.calls, key)
+  c.inFlight++
+  c.maxInFlight = max(c.maxInFlight, c.inFlight)
+  c.mu.Unlock()
+  defer func() {
+    c.mu.Lock()
+    c.inFlight--
+    c.mu.Unlock()
+  }()
+
+  if c.started != nil {
+    c.started <- key
+  }
+  if c.release != nil {
+    select {
+    case <-c.release:
+    case <-ctx.Done():
+      return ctx.Err()
+    }
+  }
+
+  res, ok := c.responses[key]
+  if !ok {
+    return fmt.Errorf("Unexpected chunk %s", key)
+  }
+
+  select {
+  case <-time.After(res.delay):
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+
+  if res.err != nil {
+    return res.err
+  }
+
+  body, err := json.Marshal(testResponse{ Records: res.records })
+  if err != nil {
+    return err
+  }
+  return json.Unmarshal(body, out)
+}
+
+// testWindow returns the nth week-long window of a fixed month.
+func testWindow(n int) types.Window {
+  start := time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, 7*n)
+  return types.Window{ Start: start, End: start.AddDate(0, 0, 7).Add(-1 * time.Second) }
+}
+
+// testChunk returns the nth window's chunk for a key, along with the name its response is keyed by.
+func testChunk(key string, n int) (types.Chunk, string) {
+  name := fmt.Sprintf("%s-%d", key, n)
+  return types.Chunk{
+    Key: key,
+    Window: testWindow(n),
+    Params: map[string]string{ "chunk": name },
+  }, name
+}
+
+func TestFetchChunksFansOutAcrossWorkers(t *testing.T) {
+  chunkCount := consts.FetchWorkers * 3
+  client := &fakeClient{
+    responses: make(map[string]fakeResponse),
+    started: make(chan string, chunkCount),
+    release: make(chan struct{}),
+  }
+  var chunks []types.Chunk
+  for i := 0; i < chunkCount; i++ {
+    chunk, name := testChunk(fmt.Sprintf("stop%d", i), 0)
+    chunks = append(chunks, chunk)
+    client.responses[name] = fakeResponse{ records: []*testEntity{ { Value: name } } }
+  }
+
+  done := make(chan []types.ChunkResult[*testEntity])
+  go func() {
+    done <- FetchChunks[*testEntity, *testResponse](
+      context.Background(),
+      client,
+      "test",
+      chunks,
+    )
+  }()
+
+  // Every worker has to be busy with a chunk at once before any of them are let through
+  for i := 0; i < consts.FetchWorkers; i++ {
+    <-client.started
+  }
+  close(client.release)
+
+  var results []types.ChunkResult[*testEntity]
+  select {
+  case results = <-done:
+  case <-time.After(5 * time.Second):
+    t.Fatal("Expected every chunk to be fetched once released")
+  }
+
+  if len(client.calls) != len(chunks) {
+    t.Fatalf("Expected %d calls, got %d", len(chunks), len(client.calls))
+  }
+  if client.maxInFlight != consts.FetchWorkers {
+    t.Errorf(
+      "Expected %d chunks to be fetched at once, got %d",
+      consts.FetchWorkers,
+      client.maxInFlight,
+    )
+  }
+
+  if len(results) != len(chunks) {
+    t.Fatalf("Expected %d results, got %d", len(chunks), len(results))
+  }
+  for i, result := range results {
+    if result.Err != nil {
+      t.Fatalf("Expected chunk %d to succeed, got %v", i, result.Err)
+    }
+    if result.Chunk.Key != chunks[i].Key {
+      t.Errorf("Expected result %d to be for %s, got %s", i, chunks[i].Key, result.Chunk.Key)
+    }
+    if len(result.Entities) != 1 || result.Entities[0].Value != chunks[i].Params["chunk"] {
+      t.Errorf("Expected result %d to have the entity of its own chunk, got %v", i, result.Entities)
+    }
+  }
+}
+
+func TestFetchChunksReportsChunkErrors(t *testing.T) {
+  errUpstream := &performanceapi.StatusError{ Endpoint: "test", StatusCode: 503, Body: "down" }
+  client := &fakeClient{ responses: make(map[string]fakeResponse) }
+
+  var chunks []types.Chunk
+  for _, key := range []string{ "a", "b" } {
+    for n := 0; n < 3; n++ {
+      chunk, name := testChunk(key, n)
+      chunks = append(chunks, chunk)
+      client.responses[name] = fakeResponse{
+        records: []*testEntity{ { Value: name } },
+        delay: time.Duration(n) * 5 * time.Millisecond,
+      }
+    }
+  }
+  failed := client.responses["b-1"]
+  failed.err = errUpstream
+  client.responses["b-1"] = failed
+
+  results := FetchChunks[*testEntity, *testResponse](
+    context.Background(),
+    client,
+    "test",
+    chunks,
+  )
+
+  for i, result := range results {
+    if result.Chunk.Params["chunk"] == "b-1" {
+      if result.Err == nil {
+        t.Fatalf("Expected chunk b-1 to fail")
+      }
+      if result.Err.Key != "b" || result.Err.Window != testWindow(1) {
+        t.Errorf(
+          "Expected the error to name chunk b-1, got %s %v",
+          result.Err.Key,
+          result.Err.Window,
+        )
+      }
+      if !errors.Is(result.Err, errUpstream) {
+        t.Errorf("Expected the error to wrap the upstream error, got %v", result.Err.Err)
+      }
+      continue
+    }
+
+    if result.Err != nil {
+      t.Fatalf("Expected chunk %d to succeed, got %v", i, result.Err)
+    }
+    if len(result.Entities) != 1 || result.Entities[0].Value != result.Chunk.Params["chunk"] {
+      t.Errorf("Expected chunk %d to have its own entity, got %v", i, result.Entities)
+    }
+  }
+}
+
+func TestFetchChunksStopsPendingChunksOnCancel(t *testing.T) {
+  client := &fakeClient{
+    responses: make(map[string]fakeResponse),
+    started: make(chan string),
+  }
+  var chunks []types.Chunk
+  for i := 0; i < consts.FetchWorkers*2; i++ {
+    chunk, name := testChunk(fmt.Sprintf("stop%d", i), 0)
+    chunks = append(chunks, chunk)
+    client.responses[name] = fakeResponse{ delay: time.Hour }
+  }
+
+  ctx, cancel := context.WithCancel(context.Background())
+  done := make(chan []types.ChunkResult[*testEntity])
+  go func() {
+    done <- FetchChunks[*testEntity, *testResponse](ctx, client, "test", chunks)
+  }()
+
+  // Every worker is blocked on a chunk before cancelling, so the rest are still pending
+  for i := 0; i < consts.FetchWorkers; i++ {
+    <-client.started
+  }
+  cancel()
+
+  var results []types.ChunkResult[*testEntity]
+  select {
+  case results = <-done:
+  case <-time.After(5 * time.Second):
+    t.Fatal("Expected fetching to stop once cancelled")
+  }
+
+  if len(client.calls) != consts.FetchWorkers {
+    t.Errorf(
+      "Expected only the %d started chunks to be fetched, got %d",
+      consts.FetchWorkers,
+      len(client.calls),
+    )
+  }
+  for i, result := range results {
+    if result.Err == nil || !errors.Is(result.Err, context.Canceled) {
+      t.Errorf("Expected chunk %d to fail with the context's error, got %v", i, result.Err)
+    }
+  }
+}
+
+func TestFetchChunksTagsRejectedRecords(t *testing.T) {
+  client := &fakeClient{ responses: make(map[string]fakeResponse) }
+  chunk, name := testChunk("a", 0)
+  client.responses[name] = fakeResponse{
+    records: []*testEntity{ { Value: "first" }, { Value: "" }, { Value: "second" } },
+  }
+
+  results := FetchChunks[*testEntity, *testResponse](
+    context.Background(),
+    client,
+    "test",
+    []types.Chunk{ chunk },
+  )
+
+  result := results[0]
+  if result.Err != nil {
+    t.Fatalf("Expected a malformed record not to fail its chunk, got %v", result.Err)
+  }
+  if len(result.Entities) != 2 ||
+    result.Entities[0].Value != "first" ||
+    result.Entities[1].Value != "second" {
+    t.Errorf("Expected the well-formed records to be kept in order, got %v", result.Entities)
+  }
+  if len(result.Rejected) != 1 {
+    t.Fatalf("Expected 1 rejected record, got %d", len(result.Rejected))
+  }
+  rejected := result.Rejected[0]
+  if rejected.Endpoint != "test" || rejected.Key != "a" || rejected.Reason != "Missing value" {
+    t.Errorf(
+      "Expected the rejected record to be tagged with its chunk and reason, got %s %s %s",
+      rejected.Endpoint,
+      rejected.Key,
+      rejected.Reason,
+    )
+  }
+}
+
+func TestCommitChunksCommitsPartiallyAndAdvancesContiguously(t *testing.T) {
+  errInsert := errors.New("insert failed")
+
+  var results []types.ChunkResult[*testEntity]
+  for _, key := range []string{ "a", "b", "c" } {
+    for n := 0; n < 3; n++ {
+      chunk, name := testChunk(key, n)
+      results = append(results, types.ChunkResult[*testEntity]{
+        Chunk: chunk,
+        Entities: []*testEntity{ { Value: name } },
+      })
+    }
+  }
+  // b fails to fetch its middle window, and c fails to insert its first window
+  results[4].Entities = nil
+  results[4].Err = &types.ChunkError{
+    Key: "b",
+    Window: testWindow(1),
+    Err: errors.New("fetch failed"),
+  }
+
+  db, state := openFakeDB()
+  defer db.Close()
+
+  var inserted []string
+  advanced := make(map[string][]time.Time)
+  report := CommitChunks[*testEntity](
+    db.Begin,
+    []string{ "a", "b", "c" },
+    results,
+    func(tx *sql.Tx, result types.ChunkResult[*testEntity]) error {
+      if result.Chunk.Params["chunk"] == "c-0" {
+        return errInsert
+      }
+      inserted = append(inserted, result.Chunk.Params["chunk"])
+      return nil
+    },
+    func(tx *sql.Tx, result types.ChunkResult[*testEntity]) error {
+      advanced[result.Chunk.Key] = append(advanced[result.Chunk.Key], result.Chunk.Window.End)
+      return nil
+    },
+  )
+
+  // Every chunk commits in a transaction of its own, so failures don't undo other chunks
+  expectedInserted := []string{ "a-0", "a-1", "a-2", "b-0", "b-2", "c-1", "c-2" }
+  if fmt.Sprint(inserted) != fmt.Sprint(expectedInserted) {
+    t.Errorf("Expected %v to be inserted, got %v", expectedInserted, inserted)
+  }
+  if commits := state.commits.Load(); commits != int64(len(expectedInserted)) {
+    t.Errorf("Expected %d commits, got %d", len(expectedInserted), commits)
+  }
+  if rollbacks := state.rollbacks.Load(); rollbacks != 1 {
+    t.Errorf("Expected 1 rollback, got %d", rollbacks)
+  }
+
+  // Only chunks before a key's first failure advance its last cache datetime
+  if len(advanced["a"]) != 3 || len(advanced["b"]) != 1 || len(advanced["c"]) != 0 {
+    t.Errorf("Expected a, b and c to advance 3, 1 and 0 times, got %v", advanced)
+  }
+
+  if len(report.Succeeded) != 1 || len(report.Failed) != 2 {
+    t.Fatalf(
+      "Expected 1 key to succeed and 2 to fail, got %v and %v",
+      report.Succeeded,
+      report.Failed,
+    )
+  }
+  reports := make(map[string]*types.KeyReport)
+  for _, keyReport := range append(report.Succeeded, report.Failed...) {
+    reports[keyReport.Key] = keyReport
+  }
+  if report.Succeeded[0].Key != "a" {
+    t.Errorf("Expected a to succeed, got %s", report.Succeeded[0].Key)
+  }
+
+  expectedCachedThrough := map[string]*time.Time{
+    "a": timePtr(testWindow(2).End.Add(time.Second)),
+    "b": timePtr(testWindow(0).End.Add(time.Second)),
+    "c": nil,
+  }
+  for key, expected := range expectedCachedThrough {
+    actual := reports[key].CachedThrough
+    if (expected == nil) != (actual == nil) || (expected != nil && !expected.Equal(*actual)) {
+      t.Errorf("Expected %s to be cached through %v, got %v", key, expected, actual)
+    }
+  }
+
+  if reports["b"].Inserted != 2 || reports["c"].Inserted != 2 {
+    t.Errorf(
+      "Expected b and c to still insert their other chunks, got %d and %d",
+      reports["b"].Inserted,
+      reports["c"].Inserted,
+    )
+  }
+
+  // Both fetch and insert failures are reported against the window they happened in
+  if len(reports["b"].Errors) != 1 || reports["b"].Errors[0].Window != testWindow(1) {
+    t.Errorf("Expected b to report its failed fetch, got %v", reports["b"].Errors)
+  }
+  if len(reports["c"].Errors) != 1 || !errors.Is(reports["c"].Errors[0], errInsert) ||
+    reports["c"].Errors[0].Window != testWindow(0) {
+    t.Errorf("Expected c to report its failed insert, got %v", reports["c"].Errors)
+  }
+
+  var fetchErr *types.FetchError
+  if !errors.As(report.Err(), &fetchErr) || len(fetchErr.Chunks) != 2 {
+    t.Errorf("Expected the report to list both failed chunks, got %v", report.Err())
+  }
+}
+
+func TestCommitChunksSucceedsWithoutErrors(t *testing.T) {
+  db, _ := openFakeDB()
+  defer db.Close()
+
+  chunk, name := testChunk("a", 0)
+  report := CommitChunks[*testEntity](
+    db.Begin,
+    []string{ "a", "b" },
+    []types.ChunkResult[*testEntity]{
+      { Chunk: chunk, Entities: []*testEntity{ { Value: name } } },
+    },
+    func(tx *sql.Tx, result types.ChunkResult[*testEntity]) error { return nil },
+    func(tx *sql.Tx, result types.ChunkResult[*testEntity]) error { return nil },
+  )
+
+  if len(report.Succeeded) != 2 || len(report.Failed) != 0 || report.Err() != nil {
+    t.Fatalf("Expected every key to succeed, got %v and %v", report.Succeeded, report.Failed)
+  }
+  // Keys without any chunks were already cached, so their last cache datetime isn't reported
+  if report.Succeeded[1].Key != "b" || report.Succeeded[1].CachedThrough != nil {
+    t.Errorf("Expected b to have nothing new cached, got %v", report.Succeeded[1])
+  }
+}
+
+func TestCommitChunksQuarantinesRejectedRecords(t *testing.T) {
+  var results []types.ChunkResult[*testEntity]
+  for _, key := range []string{ "a", "b" } {
+    chunk, name := testChunk(key, 0)
+    results = append(results, types.ChunkResult[*testEntity]{
+      Chunk: chunk,
+      Entities: []*testEntity{ { Value: name } },
+      Rejected: []*types.RejectedRecord{
+        { Endpoint: "test", Key: key, Payload: &testEntity{}, Reason: "Missing value" },
+        { Endpoint: "test", Key: key, Payload: &testEntity{}, Reason: "Missing value" },
+      },
+    })
+  }
+
+  db, state := openFakeDB()
+  defer db.Close()
+
+  // b fails to insert, so its rejected records are rolled back along with its entities
+  report := CommitChunks[*testEntity](
+    db.Begin,
+    []string{ "a", "b" },
+    results,
+    func(tx *sql.Tx, result types.ChunkResult[*testEntity]) error {
+      if result.Chunk.Key == "b" {
+        return errors.New("insert failed")
+      }
+      return nil
+    },
+    func(tx *sql.Tx, result types.ChunkResult[*testEntity]) error { return nil },
+  )
+
+  if len(state.execs) != 1 {
+    t.Fatalf("Expected rejected records to be quarantined once, got %d", len(state.execs))
+  }
+  if keys, ok := state.execs[0][1].(string); !ok || keys != `{"a","a"}` {
+    t.Errorf("Expected a's rejected records to be quarantined, got %v", state.execs[0][1])
+  }
+  if report.Rejected != 2 || report.Succeeded[0].Rejected != 2 || report.Failed[0].Rejected != 0 {
+    t.Errorf(
+      "Expected only a's 2 rejected records to be counted, got %d, %d and %d",
+      report.Rejected,
+      report.Succeeded[0].Rejected,
+      report.Failed[0].Rejected,
+    )
+  }
+}
+
+func timePtr(value time.Time) *time.Time {
+  return &value
+}
+
+// A fakeDBState represents what has happened to a fake database's transactions and statements.
+type fakeDBState struct {
+  commits   atomic.Int64
+  rollbacks atomic.Int64
+
+  mu    sync.Mutex
+  execs [][]driver.Value
+}
+
+// openFakeDB opens a database whose transactions and statements do nothing but record themselves,
+// which is enough to hand *sql.Tx values to code that doesn't read anything back.
+func openFakeDB() (*sql.DB, *fakeDBState) {
+  state := &fakeDBState{}
+  return sql.OpenDB(&fakeConnector{ state: state }), state
+}
+
+type fakeConnector struct {
+  state *fakeDBState
+}
+
+func (c *fakeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+  return &fakeConn{ state: c.state }, nil
+}
+
+func (c *fakeConnector) Driver() driver.Driver {
+  return fakeDriver{}
+}
+
+type fakeDriver struct{}
+
+func (d fakeDriver) Open(name string) (driver.Conn, error) {
+  return nil, errors.New("Fake databases must be opened with a connector")
+}
+
+type fakeConn struct {
+  state *fakeDBState
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+  return &fakeStmt{ state: c.state }, nil
+}
+
+func (c *fakeConn) Close() error {
+  return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+  return &fakeTx{ state: c.state }, nil
+}
+
+type fakeTx struct {
+  state *fakeDBState
+}
+
+func (t *fakeTx) Commit() error {
+  t.state.commits.Add(1)
+  return nil
+}
+
+func (t *fakeTx) Rollback() error {
+  t.state.rollbacks.Add(1)
+  return nil
+}
+
+type fakeStmt struct {
+  state *fakeDBState
+}
+
+func (s *fakeStmt) Close() error {
+  return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+  return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+  s.state.mu.Lock()
+  defer s.state.mu.Unlock()
+  s.state.execs = append(s.state.execs, args)
+  return driver.RowsAffected(len(args)), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+  return nil, errors.New("Fake databases can't be queried")
+}
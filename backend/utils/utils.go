@@ -1,19 +1,18 @@
 package utils
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
   "strconv"
 	"strings"
-  "sync"
 	"time"
 	"github.com/gin-gonic/gin"
 	"github.com/mbta-performance-dashboard/consts"
+	"github.com/mbta-performance-dashboard/performanceapi"
 	"github.com/mbta-performance-dashboard/types"
 )
 
@@ -41,6 +40,20 @@ func SliceToAnySlice[T any](slice []T) []any {
   return anySlice
 }
 
+// Dedupe returns a new slice of the provided values without duplicates, keeping the first of each
+// in order.
+func Dedupe[T comparable](values []T) []T {
+  seen := make(map[T]bool)
+  var unique []T = []T{}
+  for _, value := range values {
+    if !seen[value] {
+      seen[value] = true
+      unique = append(unique, value)
+    }
+  }
+  return unique
+}
+
 // StartOfToday returns the start of today (where the start is 00:00:00) in EST.
 func StartOfToday() (time.Time, error) {
 	newYork, err := time.LoadLocation("America/New_York")
@@ -55,8 +68,230 @@ func StartOfToday() (time.Time, error) {
   return startOfToday, nil
 }
 
+// InNewYork returns the provided datetime in EST.
+func InNewYork(datetime time.Time) (time.Time, error) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+    return time.Time{}, fmt.Errorf("Error loading New York timezone: %w", err)
+	}
+  return datetime.In(newYork), nil
+}
+
+// ParseUnix parses a datetime provided as Unix seconds, like the MBTA Performance API's.
+func ParseUnix(value string) (time.Time, error) {
+  seconds, err := strconv.ParseInt(value, 10, 64)
+  if err != nil {
+    return time.Time{}, fmt.Errorf("Invalid datetime %s, expected Unix seconds", value)
+  }
+  return time.Unix(seconds, 0), nil
+}
+
+// ParseDatetime parses a datetime provided either as Unix seconds or as an RFC 3339 string.
+func ParseDatetime(value string) (time.Time, error) {
+  if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+    return time.Unix(seconds, 0), nil
+  }
+
+  datetime, err := time.Parse(time.RFC3339, value)
+  if err != nil {
+    return time.Time{}, fmt.Errorf("Invalid datetime %s, expected Unix seconds or RFC 3339", value)
+  }
+  return datetime, nil
+}
+
+// ParseFilter parses a filter from a request's start_datetime and end_datetime query parameters.
+//
+// Either parameter may be omitted, leaving that end of the time range unbounded.
+func ParseFilter(c *gin.Context) (types.Filter, error) {
+  var filter types.Filter
+
+  if value := c.DefaultQuery("start_datetime", ""); value != "" {
+    datetime, err := ParseDatetime(value)
+    if err != nil {
+      return types.Filter{}, err
+    }
+    filter.StartDatetime = datetime
+  }
+
+  if value := c.DefaultQuery("end_datetime", ""); value != "" {
+    datetime, err := ParseDatetime(value)
+    if err != nil {
+      return types.Filter{}, err
+    }
+    filter.EndDatetime = datetime
+  }
+
+  if !filter.StartDatetime.IsZero() &&
+    !filter.EndDatetime.IsZero() &&
+    filter.EndDatetime.Before(filter.StartDatetime) {
+    return types.Filter{}, errors.New("End datetime must not be before start datetime")
+  }
+
+  return filter, nil
+}
+
+// FilterClause builds the SQL conditions that apply a filter to a table's datetime column.
+//
+// The conditions are returned with a leading " AND " so they can be appended to an existing WHERE
+// clause, along with their params. Placeholders are numbered starting after the provided offset.
+func FilterClause(filter types.Filter, dateColumn string, offset int) (string, []any) {
+  var clause string
+  var params []any = []any{}
+
+  if !filter.StartDatetime.IsZero() {
+    params = append(params, filter.StartDatetime.Unix())
+    clause += fmt.Sprintf(
+      " AND %s >= TO_TIMESTAMP(%s)",
+      dateColumn,
+      PgPlaceholders(offset+len(params)-1, offset+len(params)),
+    )
+  }
+
+  if !filter.EndDatetime.IsZero() {
+    params = append(params, filter.EndDatetime.Unix())
+    clause += fmt.Sprintf(
+      " AND %s <= TO_TIMESTAMP(%s)",
+      dateColumn,
+      PgPlaceholders(offset+len(params)-1, offset+len(params)),
+    )
+  }
+
+  if filter.Direction != nil {
+    params = append(params, filter.Direction.Bool())
+    clause += fmt.Sprintf(
+      " AND direction = %s",
+      PgPlaceholders(offset+len(params)-1, offset+len(params)),
+    )
+  }
+
+  return clause, params
+}
+
+// ResolveDirection resolves a request's direction query parameter on a route, or returns nil if
+// the request doesn't have one.
+//
+// Directions can be given as 0 or 1, or as the name or destination of one of the route's
+// directions, like "North", "northbound" or "Alewife", ignoring case.
+func ResolveDirection(
+  c *gin.Context,
+  tx *sql.Tx,
+  routeID string,
+) (*types.ResolvedDirection, error) {
+  value := c.DefaultQuery("direction", "")
+  if value == "" {
+    return nil, nil
+  }
+
+  if direction, err := types.ParseDirection(value); err == nil {
+    name, err := SelectDirectionName(tx, routeID, direction)
+    if err != nil {
+      return nil, err
+    }
+    return &types.ResolvedDirection{ Direction: direction, Name: name }, nil
+  }
+
+  rows, err := tx.Query(
+    "SELECT direction, name FROM route_direction WHERE route_id = $1 AND (LOWER(name) = " +
+      "LOWER($2) OR LOWER(name) || 'bound' = LOWER($2) OR LOWER(destination) = LOWER($2))",
+    routeID,
+    value,
+  )
+  if err != nil {
+    return nil, fmt.Errorf("Error querying route directions: %w", err)
+  }
+  defer rows.Close()
+
+  var resolved []*types.ResolvedDirection
+  for rows.Next() {
+    var direction bool
+    var name string
+    if err := rows.Scan(&direction, &name); err != nil {
+      return nil, fmt.Errorf("Error scanning route directions: %w", err)
+    }
+    resolved = append(resolved, &types.ResolvedDirection{
+      Direction: types.DirectionFromBool(direction),
+      Name: name,
+    })
+  }
+
+  if len(resolved) != 1 {
+    return nil, fmt.Errorf(
+      "Invalid direction %s for route %s, expected 0, 1 or one of its direction names",
+      value,
+      routeID,
+    )
+  }
+  return resolved[0], nil
+}
+
+// SelectDirectionName gets the name of a route's direction, or an empty string if the route's
+// directions weren't loaded.
+func SelectDirectionName(tx *sql.Tx, routeID string, direction types.Direction) (string, error) {
+  var name string
+  err := tx.QueryRow(
+    "SELECT name FROM route_direction WHERE route_id = $1 AND direction = $2",
+    routeID,
+    direction.Bool(),
+  ).Scan(&name)
+  if err == sql.ErrNoRows {
+    return "", nil
+  }
+  if err != nil {
+    return "", fmt.Errorf("Error querying direction name: %w", err)
+  }
+  return name, nil
+}
+
+// DirectionName returns an SQL expression for the name of a route's direction, given the columns
+// that hold them, which is empty if the route's directions weren't loaded.
+func DirectionName(routeColumn string, directionColumn string) string {
+  return fmt.Sprintf(
+    "COALESCE((SELECT route_direction.name FROM route_direction WHERE route_direction.route_id " +
+      "= %s AND route_direction.direction = %s), '')",
+    routeColumn,
+    directionColumn,
+  )
+}
+
+// ParseBucket parses a bucket size provided either as seconds or as a Go duration string, like
+// "1h" or "15m".
+//
+// Defaults to a day if the provided value is empty.
+func ParseBucket(value string) (time.Duration, error) {
+  if value == "" {
+    return 24 * time.Hour, nil
+  }
+
+  var bucket time.Duration
+  if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+    bucket = time.Duration(seconds) * time.Second
+  } else {
+    bucket, err = time.ParseDuration(value)
+    if err != nil {
+      return 0, fmt.Errorf("Invalid bucket %s, expected seconds or a duration", value)
+    }
+  }
+
+  if bucket < time.Minute {
+    return 0, errors.New("Bucket must be at least a minute long")
+  }
+  return bucket, nil
+}
+
 // PropagateToResponse makes a JSON response that propagates a provided error as is.
+//
+// If the error came from chunks failing to fetch, every failed chunk is also listed under
+// "errors".
 func PropagateToResponse(c *gin.Context, err error) {
+  var fetchErr *types.FetchError
+  if errors.As(err, &fetchErr) {
+    c.JSON(http.StatusInternalServerError, gin.H{
+      "data": fmt.Sprintf("%v", err),
+      "errors": fetchErr.Chunks,
+    })
+    return
+  }
+
   c.JSON(http.StatusInternalServerError, gin.H{
     "data": fmt.Sprintf("%v", err),
   })
@@ -73,7 +308,11 @@ func ValidateIDs(tx *sql.Tx, stopIDs []string, routeID string) error {
 	}
 
 	rows, err := tx.Query(
-    fmt.Sprintf("SELECT * FROM stop WHERE id IN (%s)", PgPlaceholders(0, len(stopIDs))),
+    fmt.Sprintf(
+      "SELECT id, route_id, name, latitude, longitude, parent_station, platform_code FROM stop " +
+        "WHERE id IN (%s)",
+      PgPlaceholders(0, len(stopIDs)),
+    ),
     SliceToAnySlice[string](stopIDs)...
   )
 	if err != nil {
@@ -89,6 +328,8 @@ func ValidateIDs(tx *sql.Tx, stopIDs []string, routeID string) error {
 			&stop.Name,
 			&stop.Latitude,
 			&stop.Longitude,
+			&stop.ParentStation,
+			&stop.PlatformCode,
 		)
 		if err != nil {
       return fmt.Errorf("Error scanning stops: %w", err)
@@ -101,16 +342,118 @@ func ValidateIDs(tx *sql.Tx, stopIDs []string, routeID string) error {
 		return errors.New("Not all stop IDs are valid")
 	}
 
+  return ValidateRouteID(tx, routeID)
+}
+
+// ResolveStopIDs gets the stop IDs of a request from a query parameter of stop IDs, a query
+// parameter of station IDs, or both.
+//
+// Station IDs are expanded to the IDs of their platforms on the provided route. If the request has
+// a direction, only the platforms served in that direction are included. Every stop ID is only
+// returned once, even if it's listed more than once or along with its station.
+func ResolveStopIDs(
+  c *gin.Context,
+  beginTx func() (*sql.Tx, error),
+  stopParam string,
+  stationParam string,
+  routeID string,
+) ([]string, error) {
+  stationIDs := c.DefaultQuery(stationParam, "")
+  if stationIDs == "" {
+    return Dedupe(strings.Split(c.DefaultQuery(stopParam, ""), ",")), nil
+  }
+
+  tx, err := beginTx()
+  if err != nil {
+    return nil, err
+  }
+  defer tx.Rollback()
+
+  var direction *types.Direction
+  resolved, err := ResolveDirection(c, tx, routeID)
+  if err != nil {
+    return nil, err
+  }
+  if resolved != nil {
+    direction = &resolved.Direction
+  }
+
+  var stopIDs []string = []string{}
+  if value := c.DefaultQuery(stopParam, ""); value != "" {
+    stopIDs = strings.Split(value, ",")
+  }
+  for _, stationID := range strings.Split(stationIDs, ",") {
+    platformIDs, err := ExpandStationID(tx, stationID, routeID, direction)
+    if err != nil {
+      return nil, err
+    }
+    stopIDs = append(stopIDs, platformIDs...)
+  }
+
+  // A platform can be listed along with its station, so it's only kept once
+  return Dedupe(stopIDs), nil
+}
+
+// ExpandStationID gets the IDs of a station's platforms on a route, optionally only those served in
+// a single direction.
+//
+// A stop that isn't part of a station expands to itself. Returns an error if the station has no
+// platforms on the route.
+func ExpandStationID(
+  tx *sql.Tx,
+  stationID string,
+  routeID string,
+  direction *types.Direction,
+) ([]string, error) {
+  if routeID == "" {
+    return nil, errors.New("Route ID required")
+  }
+
+  statement := "SELECT id FROM stop WHERE route_id = $1 AND (parent_station = $2 OR (id = $2 " +
+    "AND parent_station = ''))"
+  params := []any{ routeID, stationID }
+  if direction != nil {
+    statement += " AND id IN (SELECT stop_id FROM route_stop WHERE route_id = $1 AND " +
+      "direction = $3)"
+    params = append(params, direction.Bool())
+  }
+
+  rows, err := tx.Query(statement + " ORDER BY id", params...)
+  if err != nil {
+    return nil, fmt.Errorf("Error querying station platforms: %w", err)
+  }
+  defer rows.Close()
+
+  var stopIDs []string = []string{}
+  for rows.Next() {
+    var stopID string
+    if err := rows.Scan(&stopID); err != nil {
+      return nil, fmt.Errorf("Error scanning station platforms: %w", err)
+    }
+    stopIDs = append(stopIDs, stopID)
+  }
+
+  if len(stopIDs) == 0 {
+    return nil, fmt.Errorf("Invalid station ID %s for route %s", stationID, routeID)
+  }
+  return stopIDs, nil
+}
+
+// ValidateRouteID validates a route ID on its own, for entities that aren't tied to any stops.
+func ValidateRouteID(tx *sql.Tx, routeID string) error {
+	if routeID == "" {
+		return errors.New("Route ID required")
+	}
 
-  rows, err = tx.Query("SELECT * from route WHERE id = $1", routeID)
+  rows, err := tx.Query("SELECT * from route WHERE id = $1", routeID)
 	if err != nil {
     return fmt.Errorf("Error querying routes: %w", err)
 	}
+	defer rows.Close()
 
 	if !rows.Next() {
     return fmt.Errorf("Invalid route ID %s", routeID)
 	}
-	rows.Close()
 
   return nil
 }
@@ -118,14 +461,17 @@ func ValidateIDs(tx *sql.Tx, stopIDs []string, routeID string) error {
 // FetchFromAPI fetches generic entities from the MBTA Performance API.
 //
 // Fetches data from the API in week-long chunks starting from 30 days ago. If a chunk ends after
-// the start of today, then it will be cut short to accommodate for it.
+// the start of today, then it will be cut short to accommodate for it. Every chunk has a result,
+// in the order of its window for each stop ID.
 func FetchFromAPI[T types.Entity, U types.APIResponse[T]](
+  ctx context.Context,
+  client performanceapi.Client,
   tx *sql.Tx,
   stopIDs []string,
   routeID string,
   lastCacheDatetimeTable string,
   endpoint string,
-) ([]T, []error) {
+) ([]types.ChunkResult[T], error) {
   datetimes, err := lastCacheDatetimes(
     tx,
     stopIDs,
@@ -133,91 +479,39 @@ func FetchFromAPI[T types.Entity, U types.APIResponse[T]](
     lastCacheDatetimeTable,
   )
   if err != nil {
-    return nil, []error{ err }
+    return nil, err
   }
 
   startOfToday, err := StartOfToday()
   if err != nil {
-    return nil, []error{ err }
-  }
-	endOfYesterday := startOfToday.Add(-1 * time.Second)
-
-  var wg sync.WaitGroup
-	results := make(chan []T)
-  errs := []error{}
-
-	for i := 0; i < len(stopIDs); i++ {
-		wg.Add(1)
-
-		go func(stopID string) {
-			defer wg.Done()
-
-			datetime, datetimeOk := datetimes[stopID]
-			if datetimeOk &&
-				(datetime.After(startOfToday) ||
-					datetime.Equal(startOfToday)) {
-				return
-			}
-
-			var startOfRange time.Time
-			var endOfRange time.Time
-
-			if !datetimeOk ||
-				startOfToday.Sub(datetime).Hours()/24 >= float64(consts.MaxDays) {
-				startOfRange = startOfToday.AddDate(0, 0, -consts.MaxDays)
-			} else {
-				startOfRange = datetime
-			}
-
-			if startOfRange.AddDate(0, 0, 7).Before(startOfToday) {
-				endOfRange = startOfRange.AddDate(0, 0, 7).Add(-1 * time.Second)
-			} else {
-				endOfRange = endOfYesterday
-			}
-
-			client := http.Client{}
-
-			for true {
-        var entities []T
-        entities, errs = FetchFromRequest[T, U](
-          client,
-          endpoint,
-          errs,
-          map[string]string{
-            "stop": stopID,
-            "route": routeID,
-            "from_datetime": strconv.FormatInt(startOfRange.Unix(), 10),
-            "to_datetime": strconv.FormatInt(endOfRange.Unix(), 10),
-          },
-        )
-        for j := 0; j < len(entities); j++ {
-          entities[j].SetStopID(stopID)
-        }
-				results <- entities
-
-				startOfRange = startOfRange.AddDate(0, 0, 7)
-				if endOfRange.Equal(endOfYesterday) {
-					break
-				} else if endOfRange.AddDate(0, 0, 7).Before(startOfToday) {
-					endOfRange = endOfRange.AddDate(0, 0, 7)
-				} else {
-					endOfRange = endOfYesterday
-				}
-			}
-		}(stopIDs[i])
-	}
+    return nil, err
+  }
 
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
+  var chunks []types.Chunk = []types.Chunk{}
+  for i := 0; i < len(stopIDs); i++ {
+    datetime, datetimeOk := datetimes[stopIDs[i]]
+    for _, window := range CacheWindows(datetime, datetimeOk, startOfToday) {
+      chunks = append(chunks, types.Chunk{
+        Key: stopIDs[i],
+        Window: window,
+        Params: map[string]string{
+          "stop": stopIDs[i],
+          "route": routeID,
+          "from_datetime": strconv.FormatInt(window.Start.Unix(), 10),
+          "to_datetime": strconv.FormatInt(window.End.Unix(), 10),
+        },
+      })
+    }
+  }
 
-	var entities []T = []T{}
-	for result := range results {
-		entities = append(entities, result...)
-	}
+  results := FetchChunks[T, U](ctx, client, endpoint, chunks)
+  for _, result := range results {
+    for j := 0; j < len(result.Entities); j++ {
+      result.Entities[j].SetStopID(result.Chunk.Key)
+    }
+  }
 
-  return entities, errs
+  return results, nil
 }
 
 // lastCacheDatetimes gets the last cache datetimes from a provided table.
@@ -259,60 +553,206 @@ func lastCacheDatetimes(
   return datetimes, nil
 }
 
-// FetchFromRequest fetches a generic entity from a provided MBTA Performance API endpoint.
-func FetchFromRequest[T types.Entity, U types.APIResponse[T]](
-  client http.Client,
-  endpoint string,
-  errs []error,
-  params map[string]string,
-) ([]T, []error) {
-  req, err := http.NewRequest(
-    "GET",
-    fmt.Sprintf("%s/%s", consts.ApiPerformance, endpoint),
-    nil,
-  )
+// Cache caches generic entities from the MBTA Performance API up to the last 30 days.
+//
+// The provided service must specifically define caching behavior. Responds with a report of which
+// stop IDs were cached and which weren't, with a 207 if only some of them were.
+func Cache[T types.Entity](c *gin.Context, service types.EntityService[T]) {
+	routeID := c.DefaultQuery("route_id", "")
+
+  stopIDs, err := ResolveStopIDs(c, service.BeginTx, "stop_ids", "station_id", routeID)
+  if err != nil {
+    PropagateToResponse(c, err)
+    return
+  }
+
+  report, err := CacheEntities[T](c.Request.Context(), service, stopIDs, routeID)
+  if err != nil {
+    PropagateToResponse(c, err)
+    return
+  }
+
+  RespondWithReport(c, report)
+}
+
+// RespondWithReport makes a JSON response out of a cache report, with a 207 if only some keys
+// were cached.
+func RespondWithReport(c *gin.Context, report *types.CacheReport) {
+  status := http.StatusOK
+  if len(report.Failed) > 0 {
+    status = http.StatusMultiStatus
+  }
+
+	c.JSON(status, gin.H{
+		"data": report,
+	})
+}
+
+// CacheEntities caches generic entities for the provided stop and route IDs from the MBTA
+// Performance API up to the last 30 days.
+//
+// Unlike Cache, this isn't tied to a request, so it can also be used by background jobs. Fetching
+// stops early if the context is done, like when a client disconnects. Only one caller can cache a
+// given stop at a time, and duplicate calls for the same stops share a single fetch from the API.
+//
+// Each stop ID is cached independently, so the returned report may list some as failed even
+// though the returned error is nil.
+func CacheEntities[T types.Entity](
+  ctx context.Context,
+  service types.EntityService[T],
+  stopIDs []string,
+  routeID string,
+) (*types.CacheReport, error) {
+  report, err := service.Coalesce(ctx, stopIDs, routeID, func(ctx context.Context) (any, error) {
+    unlock := service.Lock(stopIDs, routeID)
+    defer unlock()
+
+    return cacheEntities[T](ctx, service, stopIDs, routeID)
+  })
+  if err != nil {
+    return nil, err
+  }
+  return report.(*types.CacheReport), nil
+}
+
+// cacheEntities caches generic entities, assuming that the caller has already locked the provided
+// stop IDs.
+func cacheEntities[T types.Entity](
+  ctx context.Context,
+  service types.EntityService[T],
+  stopIDs []string,
+  routeID string,
+) (*types.CacheReport, error) {
+  results, err := func() ([]types.ChunkResult[T], error) {
+    tx, err := service.BeginTx()
+    if err != nil {
+      return nil, err
+    }
+    defer tx.Rollback()
+
+    if err := ValidateIDs(tx, stopIDs, routeID); err != nil {
+      return nil, err
+    }
+
+    return service.FetchFromAPI(ctx, tx, stopIDs, routeID)
+  }()
   if err != nil {
-    errs = append(errs, fmt.Errorf("Error creating HTTP request to endpoint: %w", err))
-    return nil, errs
+    return nil, err
   }
 
-  query := req.URL.Query()
-  query.Add("api_key", os.Getenv("PERFORMANCE_API_KEY"))
-  query.Add("format", "json")
-  for k, v := range params {
-    query.Add(k, v)
+  report := CommitChunks[T](
+    service.BeginTx,
+    stopIDs,
+    results,
+    func(tx *sql.Tx, result types.ChunkResult[T]) error {
+      return service.Insert(tx, result.Entities)
+    },
+    func(tx *sql.Tx, result types.ChunkResult[T]) error {
+      return service.UpdateCacheDatetime(
+        tx,
+        result.Chunk.Key,
+        routeID,
+        result.Chunk.Window.End.Add(time.Second),
+      )
+    },
+  )
+
+  if err := DeleteOutdatedInTx(service.BeginTx, service.DeleteOutdated); err != nil {
+    return nil, err
   }
-  req.URL.RawQuery = query.Encode()
 
-  res, err := client.Do(req)
+  return report, nil
+}
+
+// DeleteOutdatedInTx deletes outdated entities in a transaction of its own.
+func DeleteOutdatedInTx(
+  beginTx func() (*sql.Tx, error),
+  deleteOutdated func(tx *sql.Tx) error,
+) error {
+  tx, err := beginTx()
   if err != nil {
-    errs = append(errs, fmt.Errorf("Error fetching entities: %w", err))
-    return nil, errs
+    return err
   }
+  defer func() {
+    if tx != nil {
+      tx.Rollback()
+    }
+  }()
+
+  if err = deleteOutdated(tx); err != nil {
+    return err
+  }
+
+  if err = tx.Commit(); err != nil {
+    return fmt.Errorf("Error committing transaction: %w", err)
+  }
+  tx = nil
 
-  body, err := io.ReadAll(res.Body)
+  return nil
+}
+
+// Select selects a generic entity, responding with its legacy shape if it has one.
+//
+// The provided service must specifically define selection behavior.
+func Select[T types.Entity](c *gin.Context, service types.EntityService[T]) {
+  entities, err := selectEntities[T](c, service)
   if err != nil {
-    errs = append(errs, fmt.Errorf("Errors reading response body: %w", err))
-    return nil, errs
+    PropagateToResponse(c, err)
+    return
   }
-  res.Body.Close()
 
-  var apiRes U
-  json.Unmarshal(body, &apiRes)
-  return apiRes.Entities(), errs
+	c.JSON(http.StatusOK, gin.H{
+		"data": Legacy[T](entities),
+	})
 }
 
-// Cache caches generic entities from the MBTA Performance API up to the last 30 days.
+// SelectV2 selects a generic entity, responding with its typed shape.
 //
-// The provided service must specifically define caching behavior.
-func Cache[T types.Entity](c *gin.Context, service types.EntityService[T]) {
-	stopIDs := strings.Split(c.DefaultQuery("stop_ids", ""), ",")
+// The provided service must specifically define selection behavior.
+func SelectV2[T types.Entity](c *gin.Context, service types.EntityService[T]) {
+  entities, err := selectEntities[T](c, service)
+  if err != nil {
+    PropagateToResponse(c, err)
+    return
+  }
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": entities,
+	})
+}
+
+// Legacy converts entities into their legacy shape, leaving entities that don't have one as is.
+func Legacy[T types.Entity](entities []T) []any {
+  var legacyEntities []any = []any{}
+  for i := 0; i < len(entities); i++ {
+    if legacyEntity, ok := any(entities[i]).(types.LegacyEntity); ok {
+      legacyEntities = append(legacyEntities, legacyEntity.Legacy())
+    } else {
+      legacyEntities = append(legacyEntities, entities[i])
+    }
+  }
+  return legacyEntities
+}
+
+// selectEntities selects generic entities using a request's stop IDs, route ID and filter.
+func selectEntities[T types.Entity](c *gin.Context, service types.EntityService[T]) ([]T, error) {
 	routeID := c.DefaultQuery("route_id", "")
 
+  var entities []T
   err := func() error {
+    stopIDs, err := ResolveStopIDs(c, service.BeginTx, "stop_ids", "station_id", routeID)
+    if err != nil {
+      return err
+    }
+
+    filter, err := ParseFilter(c)
+    if err != nil {
+      return err
+    }
+
     tx, err := service.BeginTx()
     if err != nil {
-      return err 
+      return fmt.Errorf("Error beginning transaction: %w", err)
     }
     defer func() {
       if tx != nil {
@@ -320,66 +760,81 @@ func Cache[T types.Entity](c *gin.Context, service types.EntityService[T]) {
       }
     }()
 
-    service.Lock()
-    defer service.Unlock()
-
     if err := ValidateIDs(tx, stopIDs, routeID); err != nil {
       return err
     }
 
-    entities, errs := service.FetchFromAPI(tx, stopIDs, routeID)
-    if len(errs) > 0 {
-      return errors.Join(errs...)
-    }
-
-    if err = service.Insert(tx, entities); err != nil {
+    direction, err := ResolveDirection(c, tx, routeID)
+    if err != nil {
       return err
     }
-
-    if err = service.UpdateCacheDatetimes(tx, stopIDs, routeID); err != nil {
-      return err
+    if direction != nil {
+      filter.Direction = &direction.Direction
     }
 
-    if err = service.DeleteOutdated(tx); err != nil {
+    entities, err = service.Select(tx, stopIDs, routeID, filter)
+    if err != nil {
       return err
     }
 
     if err = tx.Commit(); err != nil {
       return fmt.Errorf("Error committing transaction: %w", err)
     }
-    tx = nil
+    tx = nil;
 
     return nil
   }()
-  if err != nil {
-    PropagateToResponse(c, err)
-    return
-  }
 
-	c.JSON(http.StatusOK, gin.H{
-		"data": "Successfully cached new entities",
-	})
+  return entities, err
 }
 
-// Select selects a generic entity.
+// Stats aggregates generic entities into statistics per bucket of time.
 //
-// The provided service must specifically define selection behavior.
-func Select[T types.Entity](c *gin.Context, service types.EntityService[T]) {
-	stopIDs := strings.Split(c.DefaultQuery("stop_ids", ""), ",")
+// The provided service must specifically define aggregation behavior.
+func Stats[T types.Entity](c *gin.Context, service types.EntityService[T]) {
 	routeID := c.DefaultQuery("route_id", "")
 
-  var entities []T
+  var stats []*types.Stat
+  var direction *types.ResolvedDirection
   err := func() error {
+    stopIDs, err := ResolveStopIDs(c, service.BeginTx, "stop_ids", "station_id", routeID)
+    if err != nil {
+      return err
+    }
+
+    filter, err := ParseFilter(c)
+    if err != nil {
+      return err
+    }
+
+    bucket, err := ParseBucket(c.DefaultQuery("bucket", ""))
+    if err != nil {
+      return err
+    }
+
     tx, err := service.BeginTx()
     if err != nil {
       return fmt.Errorf("Error beginning transaction: %w", err)
     }
+    defer func() {
+      if tx != nil {
+        tx.Rollback()
+      }
+    }()
 
     if err := ValidateIDs(tx, stopIDs, routeID); err != nil {
       return err
     }
 
-    entities, err = service.Select(tx, stopIDs, routeID)
+    direction, err = ResolveDirection(c, tx, routeID)
+    if err != nil {
+      return err
+    }
+    if direction != nil {
+      filter.Direction = &direction.Direction
+    }
+
+    stats, err = service.SelectStats(tx, stopIDs, routeID, filter, bucket)
     if err != nil {
       return err
     }
@@ -387,7 +842,7 @@ func Select[T types.Entity](c *gin.Context, service types.EntityService[T]) {
     if err = tx.Commit(); err != nil {
       return fmt.Errorf("Error committing transaction: %w", err)
     }
-    tx = nil;
+    tx = nil
 
     return nil
   }()
@@ -397,77 +852,128 @@ func Select[T types.Entity](c *gin.Context, service types.EntityService[T]) {
   }
 
 	c.JSON(http.StatusOK, gin.H{
-		"data": entities,
+		"data": stats,
+		"direction": direction,
 	})
 }
 
-// UpdateCacheDatetimes updates the last cache datetimes to the start of today.
-func UpdateCacheDatetimes(
-  tx *sql.Tx, 
-  stopIDs []string, 
-  routeID string, 
-  lastCacheDatetimeTable string,
-) error {
-  datetimes, err := lastCacheDatetimes(
-    tx,
-    stopIDs,
-    routeID,
-    lastCacheDatetimeTable,
-  )
-  if err != nil {
-    return err
+// SelectStats aggregates a table's value column into statistics per bucket of time, computed
+// in Postgres.
+//
+// Buckets are aligned to midnight in EST, so day-long buckets line up with service days. The
+// provided conditions make up the WHERE clause and must only use placeholders for the provided
+// params. An empty benchmark column leaves every stat's benchmark mean as nil.
+func SelectStats(
+  tx *sql.Tx,
+  table string,
+  dateColumn string,
+  valueColumn string,
+  benchmarkColumn string,
+  conditions string,
+  params []any,
+  bucket time.Duration,
+) ([]*types.Stat, error) {
+  benchmarkMean := "NULL"
+  if benchmarkColumn != "" {
+    benchmarkMean = fmt.Sprintf("AVG(%s)", benchmarkColumn)
   }
 
-  startOfToday, err := StartOfToday()
+  bucketPlaceholder := PgPlaceholders(len(params), len(params)+1)
+  rows, err := tx.Query(
+    fmt.Sprintf(
+      "SELECT (TO_TIMESTAMP(FLOOR(EXTRACT(EPOCH FROM %s::timestamptz AT TIME ZONE " +
+        "'America/New_York') / %s) * %s) AT TIME ZONE 'UTC') AT TIME ZONE 'America/New_York' " +
+        "AS bucket_start, COUNT(*), AVG(%s), MIN(%s), MAX(%s), PERCENTILE_CONT(0.5) WITHIN " +
+        "GROUP (ORDER BY %s), PERCENTILE_CONT(0.9) WITHIN GROUP (ORDER BY %s), " +
+        "PERCENTILE_CONT(0.95) WITHIN GROUP (ORDER BY %s), %s FROM %s WHERE %s GROUP BY " +
+        "bucket_start ORDER BY bucket_start",
+      dateColumn,
+      bucketPlaceholder,
+      bucketPlaceholder,
+      valueColumn,
+      valueColumn,
+      valueColumn,
+      valueColumn,
+      valueColumn,
+      valueColumn,
+      benchmarkMean,
+      table,
+      conditions,
+    ),
+    append(params, int64(bucket.Seconds()))...,
+  )
   if err != nil {
-    return err
+    return nil, fmt.Errorf("Error aggregating %s stats: %w", table, err)
   }
 
-  for i := 0; i < len(stopIDs); i++ {
-    datetime, datetimeOk := datetimes[stopIDs[i]]
-    if datetimeOk &&
-    (datetime.After(startOfToday) ||
-    datetime.Equal(startOfToday)) {
-      continue
-    }
-
-    if !datetimeOk {
-      _, err = tx.Exec(
-        fmt.Sprintf(
-          "INSERT INTO %s (stop_id, route_id, value) VALUES ($1, $2, $3)", 
-          lastCacheDatetimeTable,
-        ), 
-        stopIDs[i], 
-        routeID, 
-        startOfToday,
-      )
-    } else {
-      _, err = tx.Exec(
-        fmt.Sprintf(
-          "UPDATE %s SET value = $1 WHERE stop_id = $2 AND route_id = $3",
-          lastCacheDatetimeTable,
-        ),
-        startOfToday, 
-        stopIDs[i], 
-        routeID,
-      )
-    }
+  var stats []*types.Stat = []*types.Stat{}
+  for rows.Next() {
+    var stat types.Stat
+    err := rows.Scan(
+      &stat.BucketStart,
+      &stat.Count,
+      &stat.Mean,
+      &stat.Min,
+      &stat.Max,
+      &stat.P50,
+      &stat.P90,
+      &stat.P95,
+      &stat.BenchmarkMean,
+    )
     if err != nil {
-      return fmt.Errorf("Error updating last cache datetime: %w", err)
+      return nil, fmt.Errorf("Error scanning %s stats: %w", table, err)
     }
+    stats = append(stats, &stat)
+  }
+  rows.Close()
+
+  return stats, nil
+}
+
+// UpdateCacheDatetime advances the last cache datetime of a stop ID-route ID combination to the
+// provided value.
+//
+// Datetimes that are already at or after the provided value are left as is.
+func UpdateCacheDatetime(
+  tx *sql.Tx, 
+  stopID string, 
+  routeID string, 
+  value time.Time,
+  lastCacheDatetimeTable string,
+) error {
+  _, err := tx.Exec(
+    fmt.Sprintf(
+      "INSERT INTO %s (stop_id, route_id, value) VALUES ($1, $2, $3) ON CONFLICT (stop_id, " +
+        "route_id) DO UPDATE SET value = EXCLUDED.value WHERE %s.value < EXCLUDED.value",
+      lastCacheDatetimeTable,
+      lastCacheDatetimeTable,
+    ),
+    stopID,
+    routeID,
+    value,
+  )
+  if err != nil {
+    return fmt.Errorf("Error updating last cache datetime: %w", err)
   }
 
   return nil
 }
 
-// DeleteOutdated deletes rows from the provided table whose dates are set to before 30 days ago.
-func DeleteOutdated(tx *sql.Tx, table string, dateColumn string) error {
+// DeleteOutdated deletes rows from the provided table whose dates are set to before the provided
+// number of days ago.
+//
+// Nothing is deleted if the rows are kept forever.
+func DeleteOutdated(tx *sql.Tx, table string, dateColumn string, retentionDays int) error {
+  if retentionDays == consts.KeepForever {
+    return nil
+  }
+
   _, err := tx.Exec(fmt.Sprintf(
     "DELETE FROM %s WHERE %s < DATE_TRUNC('day', NOW() AT TIME ZONE 'America/New_York' - " +
       "INTERVAL '%d days')",
     table,
     dateColumn,
-    consts.MaxDays,
+    retentionDays,
   ))
 
   if err != nil {
@@ -476,3 +982,36 @@ func DeleteOutdated(tx *sql.Tx, table string, dateColumn string) error {
 
   return nil
 }
+
+// RetentionDaysFromEnv reads how many days of an entity to keep from an environment variable,
+// which can also be "forever".
+//
+// Defaults to 30 days if the variable isn't set.
+func RetentionDaysFromEnv(name string) (int, error) {
+  value, ok := os.LookupEnv(name)
+  if !ok {
+    return consts.MaxDays, nil
+  }
+
+  if value == "forever" {
+    return consts.KeepForever, nil
+  }
+
+  days, err := strconv.Atoi(value)
+  if err != nil || days < 1 {
+    return 0, fmt.Errorf("Invalid %s %s, expected a positive number of days or forever", name, value)
+  }
+  return days, nil
+}
+
+// ServiceDate returns an SQL expression for the service date of a table's datetime column, in EST.
+//
+// Service days start at 3 AM rather than midnight, so late night trips count towards the day they
+// started on.
+func ServiceDate(dateColumn string) string {
+  return fmt.Sprintf(
+    "(%s::timestamptz AT TIME ZONE 'America/New_York' - INTERVAL '%d hours')::date",
+    dateColumn,
+    consts.ServiceDayStartHour,
+  )
+}
@@ -0,0 +1,43 @@
+package utils
+
+import (
+  "fmt"
+  "net/http/httptest"
+  "testing"
+
+  "github.com/gin-gonic/gin"
+)
+
+func TestDedupe(t *testing.T) {
+  cases := []struct {
+    values   []string
+    expected []string
+  }{
+    { values: []string{}, expected: []string{} },
+    { values: []string{ "70061" }, expected: []string{ "70061" } },
+    {
+      values: []string{ "70061", "70063", "70061", "70064", "70063" },
+      expected: []string{ "70061", "70063", "70064" },
+    },
+  }
+
+  for _, tc := range cases {
+    actual := Dedupe(tc.values)
+    if fmt.Sprint(actual) != fmt.Sprint(tc.expected) {
+      t.Errorf("Expected %v to dedupe to %v, got %v", tc.values, tc.expected, actual)
+    }
+  }
+}
+
+func TestResolveStopIDsDedupesStopIDs(t *testing.T) {
+  c, _ := gin.CreateTestContext(httptest.NewRecorder())
+  c.Request = httptest.NewRequest("GET", "/headway?stop_ids=70061,70063,70061&route_id=Red", nil)
+
+  stopIDs, err := ResolveStopIDs(c, nil, "stop_ids", "station_id", "Red")
+  if err != nil {
+    t.Fatalf("Expected stop IDs to resolve, got %v", err)
+  }
+  if fmt.Sprint(stopIDs) != fmt.Sprint([]string{ "70061", "70063" }) {
+    t.Errorf("Expected every stop ID to be listed once, got %v", stopIDs)
+  }
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+  "database/sql"
+  "encoding/json"
+  "fmt"
+
+  "github.com/lib/pq"
+  "github.com/mbta-performance-dashboard/types"
+)
+
+// Validate converts every record from the MBTA Performance API, rejecting the records that fail to
+// convert instead of failing all of them.
+//
+// Records that convert successfully keep their order.
+func Validate[U any, T any](
+  records []U,
+  convert func(record U) (T, error),
+) ([]T, []*types.RejectedRecord) {
+  var entities []T = []T{}
+  var rejected []*types.RejectedRecord = []*types.RejectedRecord{}
+
+  for i := 0; i < len(records); i++ {
+    entity, err := convert(records[i])
+    if err != nil {
+      rejected = append(rejected, &types.RejectedRecord{ Payload: records[i], Reason: err.Error() })
+      continue
+    }
+    entities = append(entities, entity)
+  }
+
+  return entities, rejected
+}
+
+// InsertRejectedRecords quarantines rejected records, so that they can be inspected later without
+// holding up the rest of their chunk.
+func InsertRejectedRecords(tx *sql.Tx, records []*types.RejectedRecord) error {
+  if len(records) == 0 {
+    return nil
+  }
+
+  var paramEndpoints []string = []string{}
+  var paramKeys []string = []string{}
+  var paramPayloads []string = []string{}
+  var paramReasons []string = []string{}
+
+  for i := 0; i < len(records); i++ {
+    payload, err := json.Marshal(records[i].Payload)
+    if err != nil {
+      return fmt.Errorf("Error marshaling rejected record: %w", err)
+    }
+
+    paramEndpoints = append(paramEndpoints, records[i].Endpoint)
+    paramKeys = append(paramKeys, records[i].Key)
+    paramPayloads = append(paramPayloads, string(payload))
+    paramReasons = append(paramReasons, records[i].Reason)
+  }
+
+  _, err := tx.Exec(
+    "INSERT INTO rejected_record (endpoint, key, payload, reason) SELECT " +
+      "unnest($1::text[]), unnest($2::text[]), unnest($3::jsonb[]), unnest($4::text[])",
+    pq.Array(paramEndpoints),
+    pq.Array(paramKeys),
+    pq.Array(paramPayloads),
+    pq.Array(paramReasons),
+  )
+  if err != nil {
+    return fmt.Errorf("Error inserting rejected records: %w", err)
+  }
+
+  return nil
+}